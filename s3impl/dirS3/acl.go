@@ -0,0 +1,108 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The ACL of a bucket is its "acl" configuration (see bucketConfig), the ACL
+// of an object is stored as JSON in a sidecar file next to the object, named
+// as aclPrefix + the base64 encoded object name.
+const aclPrefix = ".acl-"
+
+// aclFile returns the name of the object's ACL file
+func (root hier) aclFile(owner s3intf.Owner, bucket, object string) string {
+	return filepath.Join(root.dir, owner.ID(), bucket, aclPrefix+b64.EncodeToString([]byte(object)))
+}
+
+// BucketOwner returns the ID of the owner of the bucket
+func (root hier) BucketOwner(bucket string) (string, error) {
+	names, err := readDirNames(root.dir)
+	if err != nil {
+		return "", err
+	}
+	for _, nm := range names {
+		if strings.HasPrefix(nm, ".") {
+			continue
+		}
+		if root.CheckBucket(s3intf.OwnerOf(nm), bucket) {
+			return nm, nil
+		}
+	}
+	return "", s3intf.NoSuchBucket
+}
+
+// GetACL returns the ACL of the bucket or the object
+func (root hier) GetACL(owner s3intf.Owner, bucket, object string) (s3intf.ACL, error) {
+	acl := s3intf.PrivateACL(owner.ID())
+	var b []byte
+	if object == "" {
+		if !root.CheckBucket(owner, bucket) {
+			return acl, s3intf.NoSuchBucket
+		}
+		val, err := root.bucketConfig(owner, bucket, "acl")
+		if err != nil || val == "" {
+			return acl, err
+		}
+		b = []byte(val)
+	} else {
+		fn, err := root.findFile(owner, bucket, object)
+		if err != nil {
+			return acl, err
+		}
+		if fn == "" {
+			return acl, s3intf.NotFound
+		}
+		if b, err = ioutil.ReadFile(root.aclFile(owner, bucket, object)); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return acl, err
+		}
+	}
+	err := json.Unmarshal(b, &acl)
+	return acl, err
+}
+
+// SetACL sets the ACL of the bucket or the object
+func (root hier) SetACL(owner s3intf.Owner, bucket, object string, acl s3intf.ACL) error {
+	b, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	if object == "" {
+		if !root.CheckBucket(owner, bucket) {
+			return s3intf.NoSuchBucket
+		}
+		return root.setBucketConfig(owner, bucket, "acl", string(b))
+	}
+	fn, err := root.findFile(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	if fn == "" {
+		return s3intf.NotFound
+	}
+	return replaceFile(root.aclFile(owner, bucket, object), b)
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// Copy copies the object as a hard link of the source file (so the copy shares
+// the source's modification time), or by copying the content if the
+// file system does not support hard links.
+func (root hier) Copy(owner s3intf.Owner, srcBucket, srcObject, srcVersionID, dstBucket, dstObject,
+	filename, media string, meta s3intf.Metadata) (s3intf.Object, error) {
+
+	src, obj, err := root.statVersion(owner, srcBucket, srcObject, srcVersionID)
+	if err != nil {
+		return obj, err
+	}
+	if !root.CheckBucket(owner, dstBucket) {
+		return obj, s3intf.NotFound
+	}
+	if filename == "" {
+		filename = obj.Filename
+	}
+	if media == "" {
+		media = obj.ContentType
+	}
+	if meta == nil {
+		meta = obj.Metadata
+	}
+	md5hash := etagHash(obj.ETag)
+	dir := filepath.Join(root.dir, owner.ID(), dstBucket)
+	fn := filepath.Join(dir, encodeFilename(dstObject, filename, media, string(md5hash)))
+	obj.Key, obj.Filename, obj.ContentType, obj.Metadata = dstObject, filename, media, meta
+	if fn == src { // only the metadata may change
+		return obj, writeMeta(root.metaFile(owner, dstBucket, dstObject), meta)
+	}
+	tmp := filepath.Join(dir, tempPrefix+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err = os.Link(src, tmp); err != nil {
+		if tmp, err = copyFile(dir, src); err != nil {
+			return obj, err
+		}
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return obj, err
+	}
+	obj.LastModified = fi.ModTime()
+	obj.VersionID, err = root.replace(owner, dstBucket, dstObject, tmp, fn, meta)
+	return obj, err
+}
+
+// copyFile copies the file into a new temporary file in dir, and returns its name
+func copyFile(dir, src string) (string, error) {
+	sfh, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer sfh.Close()
+	fh, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(fh, sfh)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", err
+	}
+	return fh.Name(), nil
+}
@@ -20,35 +20,43 @@ limitations under the License.
 package dirS3
 
 import (
-	"crypto/hmac"
 	"crypto/md5"
-	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"github.com/tgulacsi/s3weed/s3intf"
-	"hash"
 	"io"
+	"io/ioutil"
 	//"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 )
 
-type hier string
+type hier struct {
+	dir   string
+	creds s3intf.CredentialProvider
+}
 
 // NewDirS3 stores everything under a common root.
 // The first level of subdirs are the owners,
 // the second are the buckets, and each object is a file under the bucket dir.
-func NewDirS3(root string) s3intf.Storage {
+// The owners are looked up in creds.
+func NewDirS3(root string, creds s3intf.CredentialProvider) s3intf.Storage {
 	os.MkdirAll(root, 0750)
-	return hier(root)
+	return hier{dir: root, creds: creds}
+}
+
+// String returns the root dir
+func (root hier) String() string {
+	return root.dir
 }
 
 // ListBuckets list all buckets owned by the given owner
 func (root hier) ListBuckets(owner s3intf.Owner) ([]s3intf.Bucket, error) {
-	dn := filepath.Join(string(root), owner.ID())
+	dn := filepath.Join(root.dir, owner.ID())
 	dh, err := os.Open(dn)
 	if err != nil {
 		if _, ok := err.(*os.PathError); ok {
@@ -74,12 +82,15 @@ func (root hier) ListBuckets(owner s3intf.Owner) ([]s3intf.Bucket, error) {
 
 // CreateBucket creates a new bucket
 func (root hier) CreateBucket(owner s3intf.Owner, bucket string) error {
-	return os.MkdirAll(filepath.Join(string(root), owner.ID(), bucket), 0750)
+	if root.CheckBucket(owner, bucket) {
+		return s3intf.BucketAlreadyOwnedByYou
+	}
+	return os.MkdirAll(filepath.Join(root.dir, owner.ID(), bucket), 0750)
 }
 
 // CheckBucket returns whether the owner has a bucket named as given
 func (root hier) CheckBucket(owner s3intf.Owner, bucket string) bool {
-	dh, err := os.Open(filepath.Join(string(root), owner.ID(), bucket))
+	dh, err := os.Open(filepath.Join(root.dir, owner.ID(), bucket))
 	if err != nil {
 		return false
 	}
@@ -89,8 +100,14 @@ func (root hier) CheckBucket(owner s3intf.Owner, bucket string) bool {
 
 // DelBucket deletes a bucket
 func (root hier) DelBucket(owner s3intf.Owner, bucket string) error {
-	dh, err := os.Open(filepath.Join(string(root), owner.ID(), bucket))
+	if err := root.checkNoVersions(owner, bucket); err != nil {
+		return err
+	}
+	dh, err := os.Open(filepath.Join(root.dir, owner.ID(), bucket))
 	if err != nil {
+		if os.IsNotExist(err) {
+			err = s3intf.NoSuchBucket
+		}
 		return err
 	}
 	infos, err := dh.Readdir(1)
@@ -100,11 +117,14 @@ func (root hier) DelBucket(owner s3intf.Owner, bucket string) error {
 	}
 	if len(infos) > 0 {
 		dh.Close()
-		return errors.New("cannot delete non-empty bucket")
+		return s3intf.BucketNotEmpty
 	}
 	nm := dh.Name()
 	dh.Close()
-	return os.Remove(nm)
+	if err = os.Remove(nm); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(root.dir, configDir, owner.ID(), bucket))
 }
 
 // List lists a bucket, all objects Key starts with prefix, delimiter segments
@@ -114,52 +134,58 @@ func (root hier) List(owner s3intf.Owner, bucket, prefix, delimiter, marker stri
 	limit, skip int) (
 	objects []s3intf.Object, commonprefixes []string,
 	truncated bool, err error) {
-	dh, e := os.Open(filepath.Join(string(root), owner.ID(), bucket))
+	dh, e := os.Open(filepath.Join(root.dir, owner.ID(), bucket))
+	if e != nil {
+		if err = e; os.IsNotExist(e) {
+			err = s3intf.NoSuchBucket
+		}
+		return
+	}
+	infos, e := dh.Readdir(-1)
+	dh.Close()
 	if e != nil {
 		err = e
 		return
 	}
-	defer dh.Close()
+	// the file names are not ordered by the keys
+	type entry struct {
+		key     string
+		md5hash []byte
+		fi      os.FileInfo
+	}
+	entries := make([]entry, 0, len(infos))
+	for _, fi := range infos {
+		if strings.HasPrefix(fi.Name(), ".") { // temporary file
+			continue
+		}
+		var e entry
+		if e.key, _, _, e.md5hash, err = decodeFilename(fi.Name()); err != nil {
+			return
+		}
+		e.fi = fi
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
 	var (
-		infos     []os.FileInfo
-		key, etag string
-		md5hash   []byte
-		ok        bool
+		etag string
+		ok   bool
 	)
-
 	objects = make([]s3intf.Object, 0, 64)
 	f := s3intf.NewListFilter(prefix, delimiter, marker, limit, skip)
-OUTER:
-	for {
-		infos, e = dh.Readdir(limit)
-		if e != nil {
-			if e == io.EOF {
+	for _, e := range entries {
+		if ok, err = f.Check(e.key); err != nil {
+			if err == io.EOF {
+				err = nil
 				break
 			}
-			err = e
+			err = fmt.Errorf("error checking %s: %s", e.key, err)
 			return
-		}
-
-		for _, fi := range infos {
-			if key, _, _, md5hash, err = decodeFilename(fi.Name()); err != nil {
-				return
-			}
-			if ok, e = f.Check(key); e != nil {
-				if e == io.EOF {
-					break OUTER
-				}
-				err = fmt.Errorf("error checking %s: %s", key, e)
-				return
-			} else if ok {
-				if md5hash != nil && len(md5hash) == 16 {
-					etag = hex.EncodeToString(md5hash)
-				} else {
-					etag = ""
-				}
-				objects = append(objects,
-					s3intf.Object{Key: string(key), Owner: owner,
-						ETag: etag, LastModified: fi.ModTime(), Size: fi.Size()})
-			}
+		} else if ok {
+			etag = hashETag(e.md5hash)
+			objects = append(objects,
+				s3intf.Object{Key: e.key, Owner: owner,
+					ETag: etag, LastModified: e.fi.ModTime(), Size: e.fi.Size()})
 		}
 	}
 	commonprefixes, truncated = f.Result()
@@ -168,16 +194,61 @@ OUTER:
 
 // Put puts a file as a new object into the bucket
 func (root hier) Put(owner s3intf.Owner, bucket, object, filename, media string,
-	body io.Reader, size int64, md5hash []byte) error {
+	body io.Reader, size int64, md5hash []byte, meta s3intf.Metadata) (string, error) {
 
-	fh, err := os.Create(filepath.Join(string(root), owner.ID(), bucket,
-		encodeFilename(object, filename, media, string(md5hash))))
+	dir := filepath.Join(root.dir, owner.ID(), bucket)
+	fh, err := ioutil.TempFile(dir, tempPrefix)
 	if err != nil {
-		return err
+		return "", err
 	}
 	_, err = io.Copy(fh, body)
-	fh.Close()
-	return err
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return "", err
+	}
+	return root.replace(owner, bucket, object, fh.Name(),
+		filepath.Join(dir, encodeFilename(object, filename, media, string(md5hash))), meta)
+}
+
+// tempPrefix is the prefix of the temporary files in the bucket directories
+const tempPrefix = ".tmp-"
+
+// replace renames the temporary file to fn, and removes the previous version
+// of the object. As copies may be hard links, files are never overwritten in place.
+// In a versioned bucket, the file is linked as a new version, too, and its ID is returned.
+func (root hier) replace(owner s3intf.Owner, bucket, object, tmp, fn string, meta s3intf.Metadata) (
+	string, error) {
+	old, err := root.findFile(owner, bucket, object)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	versionID, err := root.newVersionID(owner, bucket)
+	if err == nil && versionID != "" {
+		_, filename, media, md5hash, _ := decodeFilename(filepath.Base(fn))
+		err = root.addVersion(owner, bucket, object, tmp, time.Now(), versionID, filename, media, md5hash, meta)
+	}
+	if err == nil {
+		err = writeMeta(root.metaFile(owner, bucket, object), meta)
+	}
+	if err == nil {
+		err = removeFile(root.aclFile(owner, bucket, object))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err = os.Rename(tmp, fn); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if old != "" && old != fn {
+		return versionID, os.Remove(old)
+	}
+	return versionID, nil
 }
 
 var b64 = base64.URLEncoding
@@ -189,6 +260,23 @@ func encodeFilename(parts ...string) string {
 	return strings.Join(parts, "#")
 }
 
+// hashETag returns the ETag of the hash stored in the file name:
+// the hex MD5 hash, or the multipart ETag as is
+func hashETag(hash []byte) string {
+	if len(hash) == md5.Size {
+		return hex.EncodeToString(hash)
+	}
+	return string(hash)
+}
+
+// etagHash is the reverse of hashETag
+func etagHash(etag string) []byte {
+	if b, err := hex.DecodeString(etag); err == nil && len(b) == md5.Size {
+		return b
+	}
+	return []byte(etag)
+}
+
 func decodeFilename(fn string) (object, filename, media string, md5hash []byte, err error) {
 	strs := strings.SplitN(fn, "#", 4)
 	var b []byte
@@ -211,8 +299,11 @@ func decodeFilename(fn string) (object, filename, media string, md5hash []byte,
 }
 
 func (root hier) findFile(owner s3intf.Owner, bucket, object string) (string, error) {
-	dh, err := os.Open(filepath.Join(string(root), owner.ID(), bucket))
+	dh, err := os.Open(filepath.Join(root.dir, owner.ID(), bucket))
 	if err != nil {
+		if os.IsNotExist(err) {
+			err = s3intf.NoSuchBucket
+		}
 		return "", err
 	}
 	defer dh.Close()
@@ -231,75 +322,116 @@ func (root hier) findFile(owner s3intf.Owner, bucket, object string) (string, er
 	return "", nil
 }
 
-// Get retrieves an object from the bucket
-func (root hier) Get(owner s3intf.Owner, bucket, object string) (
-	filename, media string, body io.ReadCloser, size int64, md5hash []byte, err error) {
-	fn, e := root.findFile(owner, bucket, object)
-	if e != nil {
-		err = e
+// stat returns the object's file name and data
+func (root hier) stat(owner s3intf.Owner, bucket, object string) (fn string, obj s3intf.Object, err error) {
+	if fn, err = root.findFile(owner, bucket, object); err != nil {
 		return
 	}
 	if fn == "" {
-		err = fmt.Errorf("no such file as %s: %s", fn, e)
+		err = s3intf.NotFound
 		return
 	}
-	fh, e := os.Open(fn)
-	if e != nil {
-		err = e
+	fi, err := os.Stat(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = s3intf.NotFound
+		}
 		return
 	}
-	body = fh
-	fi, e := fh.Stat()
-	if e != nil {
-		err = e
+	obj = s3intf.Object{Key: object, Owner: owner, Size: fi.Size(), LastModified: fi.ModTime()}
+	var md5hash []byte
+	if _, obj.Filename, obj.ContentType, md5hash, err = decodeFilename(filepath.Base(fn)); err != nil {
 		return
 	}
-	size = fi.Size()
-	_, filename, media, md5hash, err = decodeFilename(filepath.Base(fn))
-	if md5hash == nil {
+	if len(md5hash) == 0 { // old files may miss the hash
+		var fh *os.File
+		if fh, err = os.Open(fn); err != nil {
+			return
+		}
 		hsh := md5.New()
-		if _, e = io.Copy(hsh, fh); e != nil {
-			err = e
+		_, err = io.Copy(hsh, fh)
+		fh.Close()
+		if err != nil {
 			return
 		}
 		md5hash = hsh.Sum(nil)
-		fh.Seek(0, 0)
 	}
-	return
-}
-
-// Del deletes the object from the bucket
-func (root hier) Del(owner s3intf.Owner, bucket, object string) error {
-	fn, err := root.findFile(owner, bucket, object)
-	if err != nil {
-		return err
+	obj.ETag = hashETag(md5hash)
+	if obj.Metadata, err = readMeta(root.metaFile(owner, bucket, object)); err != nil {
+		return
+	}
+	var vs []versionFile
+	if vs, err = root.objectVersions(owner, bucket, object); err == nil && len(vs) > 0 {
+		obj.VersionID = vs[0].versionID
 	}
-	return os.Remove(fn)
+	return
 }
 
-type user string
-
-// ID returns the ID of this owner
-func (u user) ID() string {
-	return string(u)
+// Stat returns the object's data from its (encoded) file name
+func (root hier) Stat(owner s3intf.Owner, bucket, object string) (s3intf.Object, error) {
+	_, obj, err := root.stat(owner, bucket, object)
+	return obj, err
 }
 
-// Name returns then name of this owner
-func (u user) Name() string {
-	return string(u)
+// Get retrieves an object from the bucket
+func (root hier) Get(owner s3intf.Owner, bucket, object string, offset, length int64) (
+	obj s3intf.Object, body io.ReadCloser, err error) {
+	fn, obj, err := root.stat(owner, bucket, object)
+	if err != nil {
+		return
+	}
+	start, n, err := s3intf.ResolveRange(offset, length, obj.Size)
+	if err != nil {
+		return
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return
+	}
+	if _, err = fh.Seek(start, 0); err != nil {
+		fh.Close()
+		return
+	}
+	return obj, limitedReadCloser{Reader: io.LimitReader(fh, n), Closer: fh}, nil
 }
 
-// GetHMAC returns a HMAC initialized with the secret key
-func (u user) GetHMAC(h func() hash.Hash) hash.Hash {
-	return hmac.New(h, nil)
+// limitedReadCloser reads from the Reader and closes the Closer
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
 }
 
-// Check checks the validity of the authorization
-func (u user) CalcHash(bytesToSign []byte) []byte {
-	return s3intf.CalcHash(hmac.New(sha1.New, nil), bytesToSign)
+// Del deletes the object from the bucket - in a versioned bucket,
+// adds a delete marker as the new version
+func (root hier) Del(owner s3intf.Owner, bucket, object string) error {
+	fn, err := root.findFile(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	versionID, err := root.newVersionID(owner, bucket)
+	if err != nil {
+		return err
+	}
+	if versionID != "" {
+		if err = root.addVersion(owner, bucket, object, "", time.Now(), versionID, "", "", nil, nil); err != nil {
+			return err
+		}
+	} else if fn == "" {
+		return s3intf.NotFound
+	}
+	if fn == "" {
+		return nil
+	}
+	if err = os.Remove(fn); err != nil {
+		return err
+	}
+	if err = removeFile(root.aclFile(owner, bucket, object)); err != nil {
+		return err
+	}
+	return writeMeta(root.metaFile(owner, bucket, object), nil)
 }
 
 // GetOwner returns the Owner for the accessKey - or an error
 func (root hier) GetOwner(accessKey string) (s3intf.Owner, error) {
-	return user(accessKey), nil
+	return s3intf.GetCredentialOwner(root.creds, accessKey)
 }
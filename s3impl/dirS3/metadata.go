@@ -0,0 +1,98 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The metadata of an object is stored as JSON in a sidecar file in the
+// bucket's directory, named as metaPrefix + the base64 encoded object name
+// (so List skips it). The metadata of a version is in the version's directory,
+// named as metaPrefix + the base64 encoded version ID.
+const metaPrefix = ".meta-"
+
+// metaFile returns the name of the object's metadata file
+func (root hier) metaFile(owner s3intf.Owner, bucket, object string) string {
+	return filepath.Join(root.dir, owner.ID(), bucket, metaPrefix+b64.EncodeToString([]byte(object)))
+}
+
+// versionMetaFile returns the name of the version's metadata file
+func (root hier) versionMetaFile(owner s3intf.Owner, bucket, object, versionID string) string {
+	return filepath.Join(root.versionDir(owner, bucket, object),
+		metaPrefix+b64.EncodeToString([]byte(versionID)))
+}
+
+// readMeta reads the metadata file - a missing file means no metadata
+func readMeta(fn string) (s3intf.Metadata, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var meta s3intf.Metadata
+	if err = json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeMeta replaces the metadata file, or removes it if meta is empty
+func writeMeta(fn string, meta s3intf.Metadata) error {
+	if len(meta) == 0 {
+		return removeFile(fn)
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return replaceFile(fn, b)
+}
+
+// replaceFile replaces the content of fn with b, through a temporary file
+func replaceFile(fn string, b []byte) error {
+	fh, err := ioutil.TempFile(filepath.Dir(fn), tempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(b)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), fn)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+	}
+	return err
+}
+
+// removeFile removes the file, if it exists
+func removeFile(fn string) error {
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// uploadsDir is the directory (under root) where the parts are staged,
+// in a subdirectory for each upload
+const uploadsDir = ".uploads"
+
+// uploadInfo is stored in the upload's directory
+type uploadInfo struct {
+	Owner         string          `json:"owner"`
+	Bucket        string          `json:"bucket"`
+	Object        string          `json:"object"`
+	Filename      string          `json:"filename"`
+	Media         string          `json:"media"`
+	Initiated     time.Time       `json:"initiated"`
+	Initiator     string          `json:"initiator,omitempty"`
+	InitiatorName string          `json:"initiatorName,omitempty"`
+	Meta          s3intf.Metadata `json:"meta,omitempty"`
+	ACL           *s3intf.ACL     `json:"acl,omitempty"`
+}
+
+const uploadInfoName = "upload.json"
+
+// uploadDir returns the upload's directory,
+// checking that the upload exists and belongs to the object
+func (root hier) uploadDir(owner s3intf.Owner, bucket, object, uploadID string) (string, uploadInfo, error) {
+	var info uploadInfo
+	if uploadID == "" || strings.ContainsAny(uploadID, `/\.`) {
+		return "", info, s3intf.NoSuchUpload
+	}
+	dir := filepath.Join(root.dir, uploadsDir, uploadID)
+	b, err := ioutil.ReadFile(filepath.Join(dir, uploadInfoName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = s3intf.NoSuchUpload
+		}
+		return "", info, err
+	}
+	if err = json.Unmarshal(b, &info); err != nil {
+		return "", info, fmt.Errorf("error decoding %s: %s", dir, err)
+	}
+	if info.Owner != owner.ID() || info.Bucket != bucket || info.Object != object {
+		return "", info, s3intf.NoSuchUpload
+	}
+	return dir, info, nil
+}
+
+// InitMultipart initiates a multipart upload, and returns its ID
+func (root hier) InitMultipart(owner, initiator s3intf.Owner, bucket, object, filename, media string,
+	meta s3intf.Metadata, acl *s3intf.ACL) (string, error) {
+	if !root.CheckBucket(owner, bucket) {
+		return "", s3intf.NotFound
+	}
+	uploadID, err := s3intf.NewUploadID()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root.dir, uploadsDir, uploadID)
+	if err = os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(uploadInfo{Owner: owner.ID(), Bucket: bucket, Object: object,
+		Filename: filename, Media: media, Meta: meta, ACL: acl, Initiated: time.Now(),
+		Initiator: initiator.ID(), InitiatorName: initiator.Name()})
+	if err != nil {
+		return "", err
+	}
+	return uploadID, ioutil.WriteFile(filepath.Join(dir, uploadInfoName), b, 0640)
+}
+
+// PutPart stores the part as "number.md5" in the upload's directory
+func (root hier) PutPart(owner s3intf.Owner, bucket, object, uploadID string, partNumber int,
+	body io.Reader, size int64, md5hash []byte) error {
+	dir, _, err := root.uploadDir(owner, bucket, object, uploadID)
+	if err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	hsh := md5.New()
+	_, err = io.Copy(io.MultiWriter(fh, hsh), body)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	prefix := fmt.Sprintf("%05d.", partNumber)
+	fn := prefix + hex.EncodeToString(hsh.Sum(nil))
+	if err = os.Rename(fh.Name(), filepath.Join(dir, fn)); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	// remove the previously uploaded part with the same number
+	names, err := readDirNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, nm := range names {
+		if strings.HasPrefix(nm, prefix) && nm != fn {
+			os.Remove(filepath.Join(dir, nm))
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the names in the dir
+func readDirNames(dir string) ([]string, error) {
+	dh, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer dh.Close()
+	return dh.Readdirnames(-1)
+}
+
+// listParts returns the parts of the upload dir, ordered by number
+func listParts(dir string) ([]s3intf.Part, error) {
+	dh, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := dh.Readdir(-1)
+	dh.Close()
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]s3intf.Part, 0, len(infos))
+	for _, fi := range infos {
+		nm := fi.Name()
+		i := strings.IndexByte(nm, '.')
+		if i < 0 {
+			continue
+		}
+		number, err := strconv.Atoi(nm[:i])
+		if err != nil {
+			continue
+		}
+		parts = append(parts, s3intf.Part{Number: number, ETag: nm[i+1:],
+			Size: fi.Size(), LastModified: fi.ModTime()})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+	return parts, nil
+}
+
+// partName returns the file name of the part
+func partName(p s3intf.Part) string {
+	return fmt.Sprintf("%05d.%s", p.Number, p.ETag)
+}
+
+// CompleteMultipart concatenates the parts into the object
+func (root hier) CompleteMultipart(owner s3intf.Owner, bucket, object, uploadID string,
+	parts []s3intf.Part) (string, string, error) {
+	dir, info, err := root.uploadDir(owner, bucket, object, uploadID)
+	if err != nil {
+		return "", "", err
+	}
+	uploaded, err := listParts(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if parts, err = s3intf.CompleteParts(uploaded, parts); err != nil {
+		return "", "", err
+	}
+	fh, err := ioutil.TempFile(dir, "tmp-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(fh.Name())
+	for _, p := range parts {
+		var pfh *os.File
+		if pfh, err = os.Open(filepath.Join(dir, partName(p))); err != nil {
+			break
+		}
+		_, err = io.Copy(fh, pfh)
+		pfh.Close()
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", "", err
+	}
+	etag := s3intf.MultipartETag(parts)
+	versionID, err := root.replace(owner, bucket, object, fh.Name(), filepath.Join(root.dir, owner.ID(), bucket,
+		encodeFilename(object, info.Filename, info.Media, etag)), info.Meta)
+	if err != nil {
+		return "", "", err
+	}
+	return etag, versionID, os.RemoveAll(dir)
+}
+
+// AbortMultipart deletes the upload's directory
+func (root hier) AbortMultipart(owner s3intf.Owner, bucket, object, uploadID string) error {
+	dir, _, err := root.uploadDir(owner, bucket, object, uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListParts returns the uploaded parts, ordered by number
+func (root hier) ListParts(owner s3intf.Owner, bucket, object, uploadID string) ([]s3intf.Part, error) {
+	dir, _, err := root.uploadDir(owner, bucket, object, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return listParts(dir)
+}
+
+// ListMultipartUploads returns the uploads in progress, ordered by key and initiation time
+func (root hier) ListMultipartUploads(owner s3intf.Owner, bucket, prefix string) ([]s3intf.Upload, error) {
+	if !root.CheckBucket(owner, bucket) {
+		return nil, s3intf.NotFound
+	}
+	names, err := readDirNames(filepath.Join(root.dir, uploadsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var (
+		uploads []s3intf.Upload
+		b       []byte
+	)
+	for _, nm := range names {
+		var info uploadInfo
+		if b, err = ioutil.ReadFile(filepath.Join(root.dir, uploadsDir, nm, uploadInfoName)); err != nil {
+			continue
+		}
+		if err = json.Unmarshal(b, &info); err != nil {
+			continue
+		}
+		if info.Owner != owner.ID() || info.Bucket != bucket || !strings.HasPrefix(info.Object, prefix) {
+			continue
+		}
+		uploads = append(uploads, s3intf.Upload{Key: info.Object, UploadID: nm,
+			Initiated: info.Initiated, Initiator: info.Initiator, InitiatorName: info.InitiatorName,
+			ACL: info.ACL})
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
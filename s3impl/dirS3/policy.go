@@ -0,0 +1,49 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"path/filepath"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// GetPolicy returns the policy of the bucket: its "policy" configuration
+func (root hier) GetPolicy(owner s3intf.Owner, bucket string) ([]byte, error) {
+	if !root.CheckBucket(owner, bucket) {
+		return nil, s3intf.NoSuchBucket
+	}
+	val, err := root.bucketConfig(owner, bucket, "policy")
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, s3intf.NoSuchBucketPolicy
+	}
+	return []byte(val), nil
+}
+
+// SetPolicy sets (or deletes, if empty) the policy of the bucket
+func (root hier) SetPolicy(owner s3intf.Owner, bucket string, policy []byte) error {
+	if !root.CheckBucket(owner, bucket) {
+		return s3intf.NoSuchBucket
+	}
+	if len(policy) == 0 {
+		return removeFile(filepath.Join(root.dir, configDir, owner.ID(), bucket, "policy"))
+	}
+	return root.setBucketConfig(owner, bucket, "policy", string(policy))
+}
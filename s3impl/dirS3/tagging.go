@@ -0,0 +1,92 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The tags of a bucket are its "tagging" configuration, as JSON, the tags of
+// an object are in its metadata file (and in its latest version's one).
+
+// GetTags returns the tags of the bucket or the object
+func (root hier) GetTags(owner s3intf.Owner, bucket, object string) (s3intf.Tags, error) {
+	if !root.CheckBucket(owner, bucket) {
+		return nil, s3intf.NoSuchBucket
+	}
+	if object != "" {
+		obj, err := root.Stat(owner, bucket, object)
+		if err != nil {
+			return nil, err
+		}
+		return obj.Metadata.Tags(), nil
+	}
+	val, err := root.bucketConfig(owner, bucket, "tagging")
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, s3intf.NoSuchTagSet
+	}
+	var tags s3intf.Tags
+	err = json.Unmarshal([]byte(val), &tags)
+	return tags, err
+}
+
+// SetTags sets (or deletes, if empty) the tags of the bucket or the object
+func (root hier) SetTags(owner s3intf.Owner, bucket, object string, tags s3intf.Tags) error {
+	if !root.CheckBucket(owner, bucket) {
+		return s3intf.NoSuchBucket
+	}
+	if object == "" {
+		if len(tags) == 0 {
+			return removeFile(filepath.Join(root.dir, configDir, owner.ID(), bucket, "tagging"))
+		}
+		b, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		return root.setBucketConfig(owner, bucket, "tagging", string(b))
+	}
+	fn, err := root.findFile(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	if fn == "" {
+		return s3intf.NotFound
+	}
+	metaFn := root.metaFile(owner, bucket, object)
+	meta, err := readMeta(metaFn)
+	if err != nil {
+		return err
+	}
+	if err = writeMeta(metaFn, meta.SetTags(tags)); err != nil {
+		return err
+	}
+	vs, err := root.objectVersions(owner, bucket, object)
+	if err != nil || len(vs) == 0 || vs[0].deleteMarker {
+		return err
+	}
+	metaFn = root.versionMetaFile(owner, bucket, object, vs[0].versionID)
+	if meta, err = readMeta(metaFn); err != nil {
+		return err
+	}
+	return writeMeta(metaFn, meta.SetTags(tags))
+}
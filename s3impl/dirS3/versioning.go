@@ -0,0 +1,452 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// Every version of the objects of a versioned bucket is a file under
+// root/.versions/owner/bucket/object (with the object name base64 encoded),
+// named as order#versionID#filename#media#md5 (base64 encoded, except
+// order, which is s3intf.VersionOrder of the creation; md5 is "~" for the
+// delete markers), so the newest is the first.
+// The current version (if it is not a delete marker) is a hard link of its
+// version file in the bucket's directory.
+//
+// The metadata of the versions are in the object's versions directory (see metaFile).
+//
+// The configuration of the buckets is under root/.config/owner/bucket/,
+// each in its own file.
+const (
+	versionsDir = ".versions"
+	configDir   = ".config"
+	// deleteMarker is the md5 part of the delete markers' name
+	deleteMarker = "~"
+)
+
+// bucketConfig returns the bucket's named configuration ("" if not set)
+func (root hier) bucketConfig(owner s3intf.Owner, bucket, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(root.dir, configDir, owner.ID(), bucket, name))
+	if err != nil && os.IsNotExist(err) {
+		err = nil
+	}
+	return string(b), err
+}
+
+// setBucketConfig sets the bucket's named configuration
+func (root hier) setBucketConfig(owner s3intf.Owner, bucket, name, value string) error {
+	dir := filepath.Join(root.dir, configDir, owner.ID(), bucket)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), []byte(value), 0640)
+}
+
+// versionFile is a version of an object
+type versionFile struct {
+	name, versionID, filename, media string
+	md5hash                          []byte
+	deleteMarker                     bool
+	fi                               os.FileInfo
+}
+
+// object returns the Object of the version
+func (v versionFile) object(owner s3intf.Owner, object string) s3intf.Object {
+	obj := s3intf.Object{Key: object, Owner: owner, Size: v.fi.Size(), LastModified: v.fi.ModTime(),
+		Filename: v.filename, ContentType: v.media, VersionID: v.versionID}
+	if !v.deleteMarker {
+		obj.ETag = hashETag(v.md5hash)
+	}
+	return obj
+}
+
+// versionDir returns the directory of the object's versions
+func (root hier) versionDir(owner s3intf.Owner, bucket, object string) string {
+	return filepath.Join(root.dir, versionsDir, owner.ID(), bucket, b64.EncodeToString([]byte(object)))
+}
+
+// objectVersions returns the versions of the object, the newest first
+func (root hier) objectVersions(owner s3intf.Owner, bucket, object string) ([]versionFile, error) {
+	dh, err := os.Open(root.versionDir(owner, bucket, object))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	infos, err := dh.Readdir(-1)
+	dh.Close()
+	if err != nil {
+		return nil, err
+	}
+	vs := make([]versionFile, 0, len(infos))
+	for _, fi := range infos {
+		parts := strings.Split(fi.Name(), "#")
+		if len(parts) != 5 {
+			continue
+		}
+		v := versionFile{name: fi.Name(), fi: fi}
+		if v.versionID, v.filename, v.media, _, err = decodeFilename(
+			strings.Join(parts[1:4], "#") + "#"); err != nil {
+			return nil, err
+		}
+		if parts[4] == deleteMarker {
+			v.deleteMarker = true
+		} else if v.md5hash, err = b64.DecodeString(parts[4]); err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].name < vs[j].name })
+	return vs, nil
+}
+
+// findVersion returns the index of the version in vs (0 if versionID is empty), or -1
+func findVersion(vs []versionFile, versionID string) int {
+	if versionID == "" && len(vs) > 0 {
+		return 0
+	}
+	for i, v := range vs {
+		if v.versionID == versionID {
+			return i
+		}
+	}
+	return -1
+}
+
+// Versioning returns the versioning state of the bucket
+func (root hier) Versioning(owner s3intf.Owner, bucket string) (string, error) {
+	if !root.CheckBucket(owner, bucket) {
+		return "", s3intf.NotFound
+	}
+	return root.bucketConfig(owner, bucket, "versioning")
+}
+
+// newVersionID returns the ID of a new version of an object in the bucket:
+// "" if the bucket is not versioned
+func (root hier) newVersionID(owner s3intf.Owner, bucket string) (string, error) {
+	state, err := root.bucketConfig(owner, bucket, "versioning")
+	if err != nil || state == "" {
+		return "", err
+	}
+	if state == s3intf.VersioningSuspended {
+		return s3intf.NullVersionID, nil
+	}
+	return s3intf.NewUploadID()
+}
+
+// SetVersioning sets the versioning state of the bucket.
+// When versioning is enabled first, the existing objects become null versions.
+func (root hier) SetVersioning(owner s3intf.Owner, bucket, state string) error {
+	if err := s3intf.CheckVersioning(state); err != nil {
+		return err
+	}
+	old, err := root.Versioning(owner, bucket)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		dir := filepath.Join(root.dir, owner.ID(), bucket)
+		names, err := readDirNames(dir)
+		if err != nil {
+			return err
+		}
+		for _, nm := range names {
+			if strings.HasPrefix(nm, ".") { // temporary file
+				continue
+			}
+			object, filename, media, md5hash, err := decodeFilename(nm)
+			if err != nil {
+				return err
+			}
+			fn := filepath.Join(dir, nm)
+			fi, err := os.Stat(fn)
+			if err != nil {
+				return err
+			}
+			meta, err := readMeta(root.metaFile(owner, bucket, object))
+			if err != nil {
+				return err
+			}
+			if err = root.addVersion(owner, bucket, object, fn, fi.ModTime(),
+				s3intf.NullVersionID, filename, media, md5hash, meta); err != nil {
+				return err
+			}
+		}
+	}
+	return root.setBucketConfig(owner, bucket, "versioning", state)
+}
+
+// addVersion links the file (or creates an empty one for a delete marker, if fn is empty)
+// as a version of the object - replacing the null version if versionID is null
+func (root hier) addVersion(owner s3intf.Owner, bucket, object, fn string, created time.Time,
+	versionID, filename, media string, md5hash []byte, meta s3intf.Metadata) error {
+
+	dir := root.versionDir(owner, bucket, object)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	if versionID == s3intf.NullVersionID {
+		vs, err := root.objectVersions(owner, bucket, object)
+		if err != nil {
+			return err
+		}
+		for _, v := range vs {
+			if v.versionID == s3intf.NullVersionID {
+				if err = os.Remove(filepath.Join(dir, v.name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := writeMeta(root.versionMetaFile(owner, bucket, object, versionID), meta); err != nil {
+		return err
+	}
+	md5part := deleteMarker
+	if fn != "" {
+		md5part = b64.EncodeToString(md5hash)
+	}
+	name := filepath.Join(dir, s3intf.VersionOrder(created)+"#"+
+		strings.TrimSuffix(encodeFilename(versionID, filename, media, ""), "#")+"#"+md5part)
+	if fn == "" {
+		fh, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		return fh.Close()
+	}
+	if err := os.Link(fn, name); err != nil {
+		tmp, err := copyFile(dir, fn)
+		if err != nil {
+			return err
+		}
+		return os.Rename(tmp, name)
+	}
+	return nil
+}
+
+// StatVersion returns the version of the object
+func (root hier) StatVersion(owner s3intf.Owner, bucket, object, versionID string) (s3intf.Version, error) {
+	vs, err := root.objectVersions(owner, bucket, object)
+	if err != nil {
+		return s3intf.Version{}, err
+	}
+	if len(vs) == 0 { // not versioned
+		if versionID != "" && versionID != s3intf.NullVersionID {
+			return s3intf.Version{}, s3intf.NoSuchVersion
+		}
+		obj, err := root.Stat(owner, bucket, object)
+		return s3intf.Version{Object: obj, IsLatest: true}, err
+	}
+	i := findVersion(vs, versionID)
+	if i < 0 {
+		return s3intf.Version{}, s3intf.NoSuchVersion
+	}
+	v := s3intf.Version{Object: vs[i].object(owner, object), IsLatest: i == 0,
+		DeleteMarker: vs[i].deleteMarker}
+	v.Metadata, err = readMeta(root.versionMetaFile(owner, bucket, object, vs[i].versionID))
+	return v, err
+}
+
+// statVersion returns the file and the version of the object,
+// as stat does for the latest one (if versionID is empty)
+func (root hier) statVersion(owner s3intf.Owner, bucket, object, versionID string) (string, s3intf.Object, error) {
+	if versionID == "" {
+		return root.stat(owner, bucket, object)
+	}
+	vs, err := root.objectVersions(owner, bucket, object)
+	if err != nil {
+		return "", s3intf.Object{}, err
+	}
+	if len(vs) == 0 { // not versioned
+		if versionID != s3intf.NullVersionID {
+			return "", s3intf.Object{}, s3intf.NoSuchVersion
+		}
+		return root.stat(owner, bucket, object)
+	}
+	i := findVersion(vs, versionID)
+	if i < 0 {
+		return "", s3intf.Object{}, s3intf.NoSuchVersion
+	}
+	if vs[i].deleteMarker {
+		return "", s3intf.Object{}, s3intf.NotFound
+	}
+	obj := vs[i].object(owner, object)
+	obj.Metadata, err = readMeta(root.versionMetaFile(owner, bucket, object, vs[i].versionID))
+	return filepath.Join(root.versionDir(owner, bucket, object), vs[i].name), obj, err
+}
+
+// GetVersion retrieves the version of the object
+func (root hier) GetVersion(owner s3intf.Owner, bucket, object, versionID string, offset, length int64) (
+	s3intf.Object, io.ReadCloser, error) {
+
+	vs, err := root.objectVersions(owner, bucket, object)
+	if err != nil {
+		return s3intf.Object{}, nil, err
+	}
+	if len(vs) == 0 { // not versioned
+		if versionID != "" && versionID != s3intf.NullVersionID {
+			return s3intf.Object{}, nil, s3intf.NoSuchVersion
+		}
+		return root.Get(owner, bucket, object, offset, length)
+	}
+	i := findVersion(vs, versionID)
+	if i < 0 {
+		return s3intf.Object{}, nil, s3intf.NoSuchVersion
+	}
+	if vs[i].deleteMarker {
+		return s3intf.Object{}, nil, s3intf.NotFound
+	}
+	obj := vs[i].object(owner, object)
+	if obj.Metadata, err = readMeta(root.versionMetaFile(owner, bucket, object, vs[i].versionID)); err != nil {
+		return obj, nil, err
+	}
+	start, n, err := s3intf.ResolveRange(offset, length, obj.Size)
+	if err != nil {
+		return obj, nil, err
+	}
+	fh, err := os.Open(filepath.Join(root.versionDir(owner, bucket, object), vs[i].name))
+	if err != nil {
+		return obj, nil, err
+	}
+	if _, err = fh.Seek(start, 0); err != nil {
+		fh.Close()
+		return obj, nil, err
+	}
+	return obj, limitedReadCloser{Reader: io.LimitReader(fh, n), Closer: fh}, nil
+}
+
+// DelVersion deletes the version permanently
+func (root hier) DelVersion(owner s3intf.Owner, bucket, object, versionID string) error {
+	vs, err := root.objectVersions(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	if len(vs) == 0 {
+		if versionID == s3intf.NullVersionID { // not versioned
+			return root.Del(owner, bucket, object)
+		}
+		return s3intf.NoSuchVersion
+	}
+	i := findVersion(vs, versionID)
+	if i < 0 {
+		return s3intf.NoSuchVersion
+	}
+	dir := root.versionDir(owner, bucket, object)
+	if err = os.Remove(filepath.Join(dir, vs[i].name)); err != nil {
+		return err
+	}
+	if err = writeMeta(root.versionMetaFile(owner, bucket, object, vs[i].versionID), nil); err != nil {
+		return err
+	}
+	if len(vs) == 1 {
+		os.Remove(dir)
+	}
+	if i > 0 {
+		return nil
+	}
+	// the previous version becomes the current
+	fn, err := root.findFile(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	if fn != "" {
+		if err = os.Remove(fn); err != nil {
+			return err
+		}
+	}
+	var meta s3intf.Metadata
+	if len(vs) > 1 && !vs[1].deleteMarker {
+		if meta, err = readMeta(root.versionMetaFile(owner, bucket, object, vs[1].versionID)); err != nil {
+			return err
+		}
+	}
+	if err = writeMeta(root.metaFile(owner, bucket, object), meta); err != nil {
+		return err
+	}
+	if len(vs) == 1 || vs[1].deleteMarker {
+		return nil
+	}
+	return os.Link(filepath.Join(dir, vs[1].name), filepath.Join(root.dir, owner.ID(), bucket,
+		encodeFilename(object, vs[1].filename, vs[1].media, string(vs[1].md5hash))))
+}
+
+// ListVersions lists the versions of the bucket
+func (root hier) ListVersions(owner s3intf.Owner, bucket, prefix, delimiter, keyMarker, versionIDMarker string,
+	limit int) (versions []s3intf.Version, commonprefixes []string, truncated bool, err error) {
+
+	if !root.CheckBucket(owner, bucket) {
+		err = s3intf.NotFound
+		return
+	}
+	names, err := readDirNames(filepath.Join(root.dir, versionsDir, owner.ID(), bucket))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	objects := make([]string, 0, len(names))
+	for _, nm := range names {
+		b, err := b64.DecodeString(nm)
+		if err != nil {
+			continue
+		}
+		if object := string(b); strings.HasPrefix(object, prefix) {
+			objects = append(objects, object)
+		}
+	}
+	sort.Strings(objects)
+	var all []s3intf.Version
+	for _, object := range objects {
+		var vs []versionFile
+		if vs, err = root.objectVersions(owner, bucket, object); err != nil {
+			return
+		}
+		for i, v := range vs {
+			all = append(all, s3intf.Version{Object: v.object(owner, object),
+				IsLatest: i == 0, DeleteMarker: v.deleteMarker})
+		}
+	}
+	versions, commonprefixes, truncated = s3intf.FilterVersions(all, prefix, delimiter,
+		keyMarker, versionIDMarker, limit)
+	return
+}
+
+// checkNoVersions returns an error if the bucket has object versions
+func (root hier) checkNoVersions(owner s3intf.Owner, bucket string) error {
+	names, err := readDirNames(filepath.Join(root.dir, versionsDir, owner.ID(), bucket))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(names) > 0 {
+		return s3intf.BucketNotEmpty
+	}
+	return nil
+}
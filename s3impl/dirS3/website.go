@@ -0,0 +1,57 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dirS3
+
+import (
+	"encoding/json"
+	"path/filepath"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// GetWebsite returns the website configuration of the bucket: its "website"
+// configuration, as JSON
+func (root hier) GetWebsite(owner s3intf.Owner, bucket string) (*s3intf.WebsiteConfig, error) {
+	if !root.CheckBucket(owner, bucket) {
+		return nil, s3intf.NoSuchBucket
+	}
+	val, err := root.bucketConfig(owner, bucket, "website")
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, s3intf.NoSuchWebsiteConfiguration
+	}
+	config := new(s3intf.WebsiteConfig)
+	err = json.Unmarshal([]byte(val), config)
+	return config, err
+}
+
+// SetWebsite sets (or deletes, if nil) the website configuration of the bucket
+func (root hier) SetWebsite(owner s3intf.Owner, bucket string, config *s3intf.WebsiteConfig) error {
+	if !root.CheckBucket(owner, bucket) {
+		return s3intf.NoSuchBucket
+	}
+	if config == nil {
+		return removeFile(filepath.Join(root.dir, configDir, owner.ID(), bucket, "website"))
+	}
+	b, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return root.setBucketConfig(owner, bucket, "website", string(b))
+}
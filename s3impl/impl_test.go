@@ -18,21 +18,30 @@ package main
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"github.com/tgulacsi/s3weed/s3impl/dirS3"
 	"github.com/tgulacsi/s3weed/s3intf"
+	"github.com/tgulacsi/s3weed/s3lifecycle"
 	"github.com/tgulacsi/s3weed/s3srv"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 var b64 = base64.StdEncoding
@@ -40,8 +49,15 @@ var b64 = base64.StdEncoding
 var backers = make([]s3intf.Storage, 0, 1)
 var handlers = make([]http.Handler, 0, 1)
 var serviceHost = "s3.test.org"
+var websiteHost = "s3-website.test.org"
 var Debug = false
 
+// testAccessKey is the access key of the "test" owner
+const testAccessKey = "AKTEST"
+
+// otherAccessKey is the access key of the "other" owner, for the ACL tests
+const otherAccessKey = "AKOTHER"
+
 func Test01ListBuckets(t *testing.T) {
 	doReq(t, "GET", "/", nil, status200)
 }
@@ -125,86 +141,1778 @@ func Test03PutObject(t *testing.T) {
 		})
 }
 
-func Test99Delete(t *testing.T) {
-	keyID := regexp.MustCompile("<Key>[^<]+</Key>")
-	doReq(t, "GET", "/test/", nil, func(r *httptest.ResponseRecorder) error {
+func Test04Presigned(t *testing.T) {
+	var o s3intf.Owner
+	var err error
+	for i, b := range backers {
+		if o, err = b.GetOwner(testAccessKey); err != nil {
+			t.Errorf("cannot get owner for test: %s", err)
+			continue
+		}
+		date := time.Now().UTC()
+		for _, step := range []struct {
+			method string
+			date   time.Time
+			body   io.Reader
+			code   int
+		}{
+			{"PUT", date, strings.NewReader("presigned"), 200},
+			{"GET", date, nil, 200},
+			{"GET", date.Add(-2 * time.Hour), nil, 403},
+		} {
+			req, err := http.NewRequest(step.method, "/test/presigned.txt", step.body)
+			if err != nil {
+				t.Fatalf("cannot create request: " + err.Error())
+			}
+			req.Host = serviceHost
+			presignV4(req, testAccessKey, o, step.date, 3600)
+			rw := httptest.NewRecorder()
+			handlers[i].ServeHTTP(rw, req)
+			if rw.Code != step.code {
+				t.Errorf("presigned %s %s: got %d, awaited %d (body:%q)",
+					step.method, req.URL, rw.Code, step.code, rw.Body.Bytes())
+			} else if step.method == "GET" && rw.Code == 200 && rw.Body.String() != "presigned" {
+				t.Errorf("presigned GET: got %q", rw.Body.Bytes())
+			}
+		}
+	}
+}
+
+func Test05Multipart(t *testing.T) {
+	s3intf.MinPartSize = 4
+	var uploadID string
+	initiate := func(r *httptest.ResponseRecorder) error {
 		if err := status200(r); err != nil {
 			return err
 		}
-		for _, key := range keyID.FindAll(r.Body.Bytes(), -1) {
-			key = key[5 : len(key)-6]
-			t.Logf("deleting %s", key)
+		var res struct{ UploadID string `xml:"UploadId"` }
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		if uploadID = res.UploadID; uploadID == "" {
+			return errors.New("no UploadId")
+		}
+		return nil
+	}
+	doReq(t, "POST", "/test/multi.txt?uploads", nil, initiate)
+	parts := []string{"hello ", "multipart ", "world"}
+	etags := make([]string, len(parts))
+	for i := len(parts) - 1; i >= 0; i-- {
+		doReq(t, "PUT", fmt.Sprintf("/test/multi.txt?partNumber=%d&uploadId=%s", i+1, uploadID),
+			strings.NewReader(parts[i]), func(r *httptest.ResponseRecorder) error {
+				etags[i] = r.Header().Get("ETag")
+				return status200(r)
+			})
+	}
+	doReq(t, "GET", "/test/multi.txt?uploadId="+uploadID, nil,
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if n := strings.Count(r.Body.String(), "<Part>"); n != len(parts) {
+				return fmt.Errorf("got %d parts, awaited %d", n, len(parts))
+			}
+			return nil
+		})
+	doReq(t, "GET", "/test/?uploads", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if !strings.Contains(r.Body.String(), "<UploadId>"+uploadID+"</UploadId>") {
+			return errors.New("upload " + uploadID + " is missing from the list")
+		}
+		return nil
+	})
+
+	complete := func(uploadID string, numbers ...int) string {
+		var buf bytes.Buffer
+		buf.WriteString("<CompleteMultipartUpload>")
+		for _, i := range numbers {
+			fmt.Fprintf(&buf, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>",
+				i, etags[i-1])
+		}
+		buf.WriteString("</CompleteMultipartUpload>")
+		return buf.String()
+	}
+	// the parts must be in ascending order
+	doReq(t, "POST", "/test/multi.txt?uploadId="+uploadID,
+		strings.NewReader(complete(uploadID, 2, 1)), statusCode(400))
+	// skip the second part
+	// the ETag is the MD5 hash of the parts' MD5 hashes, and the number of parts
+	hsh := md5.New()
+	for _, p := range []string{parts[0], parts[2]} {
+		sum := md5.Sum([]byte(p))
+		hsh.Write(sum[:])
+	}
+	multiETag := `"` + hex.EncodeToString(hsh.Sum(nil)) + `-2"`
+	doReq(t, "POST", "/test/multi.txt?uploadId="+uploadID,
+		strings.NewReader(complete(uploadID, 1, 3)), func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			var res struct{ ETag string }
+			if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+				return err
+			}
+			if res.ETag != multiETag {
+				return fmt.Errorf("got ETag %s, awaited %s", res.ETag, multiETag)
+			}
+			return nil
+		})
+	doReq(t, "GET", "/test/multi.txt", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if got, want := r.Body.String(), parts[0]+parts[2]; got != want {
+			return fmt.Errorf("got %q, awaited %q", got, want)
+		}
+		if got := r.Header().Get("ETag"); got != multiETag {
+			return fmt.Errorf("got ETag %s, awaited %s", got, multiETag)
 		}
 		return nil
 	})
+	doReq(t, "GET", "/test/multi.txt?uploadId="+uploadID, nil, statusCode(404))
+
+	// abort
+	doReq(t, "POST", "/test/aborted.txt?uploads", nil, initiate)
+	doReq(t, "PUT", "/test/aborted.txt?partNumber=1&uploadId="+uploadID,
+		strings.NewReader("aborted"), status200)
+	doReq(t, "DELETE", "/test/aborted.txt?uploadId="+uploadID, nil, statusCode(204))
+	doReq(t, "PUT", "/test/aborted.txt?partNumber=2&uploadId="+uploadID,
+		strings.NewReader("aborted"), statusCode(404))
+
+	// the common prefixes are counted against max-uploads
+	uploadIDs := make(map[string]string)
+	for _, k := range []string{"dir1/a", "dir2/a", "dir2/b", "top"} {
+		doReq(t, "POST", "/test/"+k+"?uploads", nil, initiate)
+		uploadIDs[k] = uploadID
+	}
+	listUploads := func(query, awaited string) {
+		doReq(t, "GET", "/test/?uploads&delimiter=/&max-uploads=2"+query, nil,
+			func(r *httptest.ResponseRecorder) error {
+				if err := status200(r); err != nil {
+					return err
+				}
+				var res struct {
+					NextKeyMarker  string
+					IsTruncated    bool
+					Keys           []string `xml:"Upload>Key"`
+					CommonPrefixes []string `xml:"CommonPrefixes>Prefix"`
+				}
+				if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+					return err
+				}
+				got := fmt.Sprintf("%s %s next=%s truncated=%t", strings.Join(res.CommonPrefixes, ","),
+					strings.Join(res.Keys, ","), res.NextKeyMarker, res.IsTruncated)
+				if got != awaited {
+					return fmt.Errorf("got %q, awaited %q", got, awaited)
+				}
+				return nil
+			})
+	}
+	listUploads("", "dir1/,dir2/  next=dir2/ truncated=true")
+	listUploads("&key-marker=dir2/", " top next=top truncated=false")
+	for k, id := range uploadIDs {
+		doReq(t, "DELETE", "/test/"+k+"?uploadId="+id, nil, statusCode(204))
+	}
 }
 
-func init() {
-	s3srv.Debug = Debug
-	s3intf.Debug = false
-	backers = append(backers, dirS3.NewDirS3("/tmp"))
+func Test06Range(t *testing.T) {
+	const content = "0123456789"
+	var etag string
+	doReq(t, "PUT", "/test/range.txt", strings.NewReader(content),
+		func(r *httptest.ResponseRecorder) error {
+			etag = r.Header().Get("ETag")
+			return status200(r)
+		})
+	for _, tc := range []struct {
+		header       []string
+		code         int
+		body, cRange string
+	}{
+		{[]string{"Range", "bytes=2-4"}, 206, "234", "bytes 2-4/10"},
+		{[]string{"Range", "bytes=7-"}, 206, "789", "bytes 7-9/10"},
+		{[]string{"Range", "bytes=-2"}, 206, "89", "bytes 8-9/10"},
+		{[]string{"Range", "bytes=0-1,4-5"}, 200, content, ""},
+		{[]string{"Range", "bytes=10-"}, 416, "", "bytes */10"},
+		{[]string{"Range", "bytes=2-4", "If-Range", etag}, 206, "234", "bytes 2-4/10"},
+		{[]string{"Range", "bytes=2-4", "If-Range", `"other"`}, 200, content, ""},
+		{[]string{"If-None-Match", etag}, 304, "", ""},
+		{[]string{"If-Match", `"other"`}, 412, "", ""},
+		{[]string{"If-Match", etag}, 200, content, ""},
+	} {
+		header := tc.header
+		doReqHeader(t, "GET", "/test/range.txt", nil, header,
+			func(r *httptest.ResponseRecorder) error {
+				if r.Code != tc.code {
+					return fmt.Errorf("%v: got code %d, awaited %d", header, r.Code, tc.code)
+				}
+				if got := r.Header().Get("Content-Range"); got != tc.cRange {
+					return fmt.Errorf("%v: got Content-Range %q, awaited %q", header, got, tc.cRange)
+				}
+				if tc.code < 300 && r.Body.String() != tc.body {
+					return fmt.Errorf("%v: got %q, awaited %q", header, r.Body.String(), tc.body)
+				}
+				return nil
+			})
+	}
+}
 
-	for _, b := range backers {
-		handlers = append(handlers, s3srv.NewService(serviceHost, b))
+func Test07Head(t *testing.T) {
+	const content = "0123456789"
+	var etag string
+	doReq(t, "PUT", "/test/head.txt", strings.NewReader(content),
+		func(r *httptest.ResponseRecorder) error {
+			etag = r.Header().Get("ETag")
+			return status200(r)
+		})
+	doReq(t, "HEAD", "/test/head.txt", nil,
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if got := r.Header().Get("Content-Length"); got != "10" {
+				return fmt.Errorf("got Content-Length %q, awaited 10", got)
+			}
+			if got := r.Header().Get("ETag"); got != etag {
+				return fmt.Errorf("got ETag %q, awaited %q", got, etag)
+			}
+			if r.Header().Get("Last-Modified") == "" {
+				return errors.New("no Last-Modified")
+			}
+			if r.Body.Len() != 0 {
+				return fmt.Errorf("got body %q for HEAD", r.Body.String())
+			}
+			return nil
+		})
+	doReqHeader(t, "HEAD", "/test/head.txt", nil, []string{"If-None-Match", etag}, statusCode(304))
+	doReqHeader(t, "HEAD", "/test/head.txt", nil, []string{"Range", "bytes=20-"}, statusCode(416))
+	doReq(t, "HEAD", "/test/nonexistent.txt", nil, statusCode(404))
+}
+
+func Test08Copy(t *testing.T) {
+	const content = "copied content"
+	var etag string
+	doReqHeader(t, "PUT", "/test/copy-src.txt", strings.NewReader(content),
+		[]string{"Content-Type", "text/plain"},
+		func(r *httptest.ResponseRecorder) error {
+			etag = r.Header().Get("ETag")
+			return status200(r)
+		})
+	doReqHeader(t, "PUT", "/test/copy-dst.txt", nil,
+		[]string{"X-Amz-Copy-Source", "/test/copy-src.txt"},
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			var res struct {
+				ETag, LastModified string
+			}
+			if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+				return err
+			}
+			if res.ETag != etag || res.LastModified == "" {
+				return fmt.Errorf("got %+v, awaited ETag %s", res, etag)
+			}
+			return nil
+		})
+	// the copy must survive the deletion of the source
+	doReq(t, "DELETE", "/test/copy-src.txt", nil, nil)
+	doReq(t, "GET", "/test/copy-dst.txt", nil,
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if r.Body.String() != content {
+				return fmt.Errorf("got %q, awaited %q", r.Body.String(), content)
+			}
+			if got := r.Header().Get("Content-Type"); got != "text/plain" {
+				return fmt.Errorf("got Content-Type %q, awaited text/plain", got)
+			}
+			return nil
+		})
+	doReq(t, "GET", "/test/copy-src.txt", nil, statusCode(404))
+
+	for _, tc := range []struct {
+		header []string
+		code   int
+	}{
+		{[]string{"X-Amz-Copy-Source", "test/copy-src.txt"}, 404},
+		{[]string{"X-Amz-Copy-Source", "test/copy-dst.txt"}, 400},
+		{[]string{"X-Amz-Copy-Source", "test/copy-dst.txt", "X-Amz-Metadata-Directive", "MOVE"}, 400},
+		{[]string{"X-Amz-Copy-Source", "test/copy-dst.txt", "X-Amz-Copy-Source-If-None-Match", etag,
+			"X-Amz-Metadata-Directive", "REPLACE"}, 412},
+		{[]string{"X-Amz-Copy-Source", "test/copy-dst.txt", "X-Amz-Copy-Source-If-Match", etag,
+			"X-Amz-Metadata-Directive", "REPLACE", "Content-Type", "text/html"}, 200},
+	} {
+		doReqHeader(t, "PUT", "/test/copy-dst.txt", nil, tc.header, statusCode(tc.code))
 	}
+	doReq(t, "HEAD", "/test/copy-dst.txt", nil,
+		func(r *httptest.ResponseRecorder) error {
+			if got := r.Header().Get("Content-Type"); got != "text/html" {
+				return fmt.Errorf("got Content-Type %q, awaited text/html", got)
+			}
+			return nil
+		})
 }
 
-type ResponseChecker func(r *httptest.ResponseRecorder) error
+func Test09MultiDelete(t *testing.T) {
+	keys := []string{"mdel/a.txt", "mdel/b.txt", "mdel/c.txt"}
+	for _, k := range keys {
+		doReq(t, "PUT", "/test/"+k, strings.NewReader(k), status200)
+	}
+	body := "<Delete>"
+	for _, k := range []string{keys[0], keys[1], "mdel/nonexistent.txt"} {
+		body += "<Object><Key>" + k + "</Key></Object>"
+	}
+	body += "</Delete>"
+	doReq(t, "POST", "/test/?delete", strings.NewReader(body),
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			var res struct {
+				Deleted []struct{ Key string }
+				Error   []struct{ Key, Code string }
+			}
+			if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+				return err
+			}
+			if len(res.Deleted) != 3 || len(res.Error) != 0 {
+				return fmt.Errorf("got %+v, awaited 3 deleted", res)
+			}
+			return nil
+		})
+	doReq(t, "GET", "/test/mdel/a.txt", nil, statusCode(404))
+	doReq(t, "GET", "/test/mdel/c.txt", nil, status200)
 
-func doReq(t *testing.T, method, path string, body io.Reader, check ResponseChecker) {
-	req, err := http.NewRequest(method, path, body)
-	if err != nil {
-		t.Fatalf("cannot create request: " + err.Error())
+	doReq(t, "POST", "/test/?delete",
+		strings.NewReader("<Delete><Quiet>true</Quiet><Object><Key>mdel/c.txt</Key></Object></Delete>"),
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if bytes.Contains(r.Body.Bytes(), []byte("<Deleted>")) {
+				return errors.New("quiet response contains Deleted")
+			}
+			return nil
+		})
+	doReq(t, "GET", "/test/mdel/c.txt", nil, statusCode(404))
+	doReq(t, "POST", "/test/?delete", strings.NewReader("<Delete></Delete>"), statusCode(400))
+}
+
+func Test10ListV2(t *testing.T) {
+	for _, k := range []string{"v2/a", "v2/b", "v2/c/1", "v2/c/2", "v2/d", "v2enc/a b"} {
+		doReq(t, "PUT", "/test/"+k, strings.NewReader(k), status200)
 	}
-	req.Host = serviceHost
-	//req.URL.Host = req.Host
-	var o s3intf.Owner
-	for i, b := range backers {
-		if o, err = b.GetOwner("test"); err != nil {
-			t.Errorf("cannot get owner for test: %s", err)
-			continue
+	type listResult struct {
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string
+		Contents              []struct {
+			Key   string
+			Owner *struct{ ID string }
+		}
+		CommonPrefixes []struct{ Prefix string }
+	}
+	list := func(query string, check func(listResult) error) {
+		doReq(t, "GET", "/test/?list-type=2&"+query, nil,
+			func(r *httptest.ResponseRecorder) error {
+				if err := status200(r); err != nil {
+					return err
+				}
+				var res listResult
+				if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+					return err
+				}
+				return check(res)
+			})
+	}
+	keys := func(res listResult) string {
+		var ks []string
+		for _, c := range res.Contents {
+			ks = append(ks, c.Key)
+		}
+		for _, cp := range res.CommonPrefixes {
+			ks = append(ks, cp.Prefix)
+		}
+		return strings.Join(ks, ",")
+	}
+	var token string
+	list("prefix=v2/&delimiter=/&max-keys=2", func(res listResult) error {
+		if got := keys(res); got != "v2/a,v2/b" || !res.IsTruncated || res.KeyCount != 2 {
+			return fmt.Errorf("got %s (%+v)", got, res)
 		}
-		if Debug {
-			log.Printf("===")
-			s3intf.Debug = Debug
+		if res.Contents[0].Owner != nil {
+			return errors.New("got Owner without fetch-owner")
 		}
-		bts := s3intf.GetBytesToSign(req, serviceHost)
-		if Debug {
-			log.Printf("bts: %q", bts)
-			log.Printf("---")
+		token = res.NextContinuationToken
+		return nil
+	})
+	list("prefix=v2/&delimiter=/&max-keys=2&continuation-token="+url.QueryEscape(token),
+		func(res listResult) error {
+			if got := keys(res); got != "v2/d,v2/c/" || res.IsTruncated {
+				return fmt.Errorf("got %s (%+v)", got, res)
+			}
+			return nil
+		})
+	list("prefix=v2/&start-after=v2/c/1&fetch-owner=true", func(res listResult) error {
+		if got := keys(res); got != "v2/c/2,v2/d" {
+			return fmt.Errorf("got %s (%+v)", got, res)
+		}
+		if res.Contents[0].Owner == nil || res.Contents[0].Owner.ID != "test" {
+			return fmt.Errorf("bad owner %+v", res.Contents[0].Owner)
+		}
+		return nil
+	})
+	list("prefix=v2enc/&encoding-type=url", func(res listResult) error {
+		if got := keys(res); got != "v2enc%2Fa+b" {
+			return fmt.Errorf("got %s (%+v)", got, res)
 		}
-		t.Logf("owner: %s bts=%q", o, bts)
-		actsign := b64.EncodeToString(o.CalcHash(bts))
-		req.Header.Set("Authorization", "AWS test:"+actsign)
+		return nil
+	})
+	doReq(t, "GET", "/test/?list-type=2&encoding-type=base64", nil, statusCode(400))
+}
 
-		rw := httptest.NewRecorder()
-		handlers[i].ServeHTTP(rw, req)
-		if check != nil {
-			if err = check(rw); err != nil {
-				t.Fatalf("bad response for %s %s: %s (body:%q)", method, path,
-					err.Error(), rw.Body.Bytes())
+func Test11ListMarker(t *testing.T) {
+	// uses the objects of Test10ListV2
+	for _, tc := range []struct {
+		query, keys, nextMarker string
+	}{
+		{"prefix=v2/&delimiter=/&max-keys=2", "v2/a,v2/b", "v2/b"},
+		{"prefix=v2/&delimiter=/&max-keys=2&marker=v2/b", "v2/d,v2/c/", ""},
+		{"prefix=v2/&delimiter=/&marker=v2/c/1", "v2/d", ""},
+		{"prefix=v2/&max-keys=2&marker=v2/b", "v2/c/1,v2/c/2", ""},
+	} {
+		query := tc.query
+		doReq(t, "GET", "/test/?"+query, nil,
+			func(r *httptest.ResponseRecorder) error {
+				if err := status200(r); err != nil {
+					return err
+				}
+				var res struct {
+					NextMarker     string
+					Contents       []struct{ Key string }
+					CommonPrefixes []struct{ Prefix string }
+				}
+				if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+					return err
+				}
+				var ks []string
+				for _, c := range res.Contents {
+					ks = append(ks, c.Key)
+				}
+				for _, cp := range res.CommonPrefixes {
+					ks = append(ks, cp.Prefix)
+				}
+				if got := strings.Join(ks, ","); got != tc.keys || res.NextMarker != tc.nextMarker {
+					return fmt.Errorf("%s: got %s (next %q), awaited %s (next %q)", query,
+						got, res.NextMarker, tc.keys, tc.nextMarker)
+				}
+				return nil
+			})
+	}
+}
+
+func Test12Versioning(t *testing.T) {
+	doReq(t, "PUT", "/vers", nil, status200)
+	doReq(t, "GET", "/vers/?versioning", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if bytes.Contains(r.Body.Bytes(), []byte("<Status>")) {
+			return fmt.Errorf("new bucket is versioned: %q", r.Body.Bytes())
+		}
+		return nil
+	})
+	doReq(t, "PUT", "/vers/?versioning",
+		strings.NewReader("<VersioningConfiguration><Status>On</Status></VersioningConfiguration>"),
+		statusCode(400))
+	doReq(t, "PUT", "/vers/?versioning",
+		strings.NewReader("<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>"),
+		status200)
+
+	versionID := func(dst *string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if r.Code != http.StatusOK && r.Code != http.StatusNoContent {
+				return fmt.Errorf("bad status %d: %q", r.Code, r.Body.Bytes())
+			}
+			if *dst = r.Header().Get("X-Amz-Version-Id"); *dst == "" {
+				return errors.New("no x-amz-version-id")
+			}
+			return nil
+		}
+	}
+	content := func(awaited string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if got := r.Body.String(); got != awaited {
+				return fmt.Errorf("got %q, awaited %q", got, awaited)
+			}
+			return nil
+		}
+	}
+	var first, second, marker string
+	doReq(t, "PUT", "/vers/obj", strings.NewReader("first"), versionID(&first))
+	doReq(t, "PUT", "/vers/obj", strings.NewReader("second"), versionID(&second))
+	if first == second {
+		t.Errorf("the versions have the same ID %q", first)
+	}
+	doReq(t, "GET", "/vers/obj", nil, content("second"))
+	doReq(t, "GET", "/vers/obj?versionId="+first, nil, content("first"))
+	doReq(t, "GET", "/vers/obj?versionId=nonexistent", nil, statusCode(404))
+
+	// copy an older version
+	var copied string
+	doReqHeader(t, "PUT", "/vers/copy", nil, []string{"x-amz-copy-source", "/vers/obj?versionId=" + first},
+		func(r *httptest.ResponseRecorder) error {
+			if err := versionID(&copied)(r); err != nil {
+				return err
+			}
+			if got := r.Header().Get("X-Amz-Copy-Source-Version-Id"); got != first {
+				return fmt.Errorf("got source version %q, awaited %q", got, first)
+			}
+			return nil
+		})
+	doReq(t, "GET", "/vers/copy", nil, content("first"))
+	doReqHeader(t, "PUT", "/vers/copy", nil, []string{"x-amz-copy-source", "/vers/obj?versionId=nonexistent"},
+		awsError(404, "NoSuchVersion"))
+	doReq(t, "DELETE", "/vers/copy?versionId="+copied, nil, statusCode(204))
+
+	// complete a multipart upload
+	var uploadID, multi string
+	doReq(t, "POST", "/vers/multi?uploads", nil, func(r *httptest.ResponseRecorder) error {
+		var res struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		uploadID = res.UploadID
+		return status200(r)
+	})
+	var etag string
+	doReq(t, "PUT", "/vers/multi?partNumber=1&uploadId="+uploadID, strings.NewReader("multi"),
+		func(r *httptest.ResponseRecorder) error {
+			etag = r.Header().Get("ETag")
+			return status200(r)
+		})
+	doReq(t, "POST", "/vers/multi?uploadId="+uploadID, strings.NewReader(
+		"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"+etag+
+			"</ETag></Part></CompleteMultipartUpload>"), versionID(&multi))
+	doReq(t, "GET", "/vers/multi?versionId="+multi, nil, content("multi"))
+	doReq(t, "DELETE", "/vers/multi?versionId="+multi, nil, statusCode(204))
+
+	doReq(t, "DELETE", "/vers/obj", nil, versionID(&marker))
+	doReq(t, "GET", "/vers/obj", nil, statusCode(404))
+	doReq(t, "HEAD", "/vers/obj?versionId="+marker, nil, statusCode(405))
+	doReqHeader(t, "PUT", "/vers/copy", nil, []string{"x-amz-copy-source", "/vers/obj?versionId=" + marker},
+		awsError(400, "InvalidRequest"))
+	doReq(t, "GET", "/vers/?versions", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var res struct {
+			Entries []struct {
+				XMLName   xml.Name
+				Key       string
+				VersionId string
+				IsLatest  bool
+			} `xml:",any"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		var got []string
+		for _, e := range res.Entries {
+			if e.Key != "" {
+				got = append(got, fmt.Sprintf("%s:%s:%t", e.XMLName.Local, e.VersionId, e.IsLatest))
 			}
 		}
+		awaited := []string{"DeleteMarker:" + marker + ":true",
+			"Version:" + second + ":false", "Version:" + first + ":false"}
+		if strings.Join(got, ",") != strings.Join(awaited, ",") {
+			return fmt.Errorf("got %q, awaited %q", got, awaited)
+		}
+		return nil
+	})
+
+	// deleting the delete marker restores the object
+	doReq(t, "DELETE", "/vers/obj?versionId="+marker, nil, statusCode(204))
+	doReq(t, "GET", "/vers/obj", nil, content("second"))
+	doReq(t, "DELETE", "/vers/obj?versionId="+second, nil, statusCode(204))
+	doReq(t, "GET", "/vers/obj", nil, content("first"))
+	doReq(t, "DELETE", "/vers/obj?versionId="+first, nil, statusCode(204))
+	doReq(t, "GET", "/vers/obj", nil, statusCode(404))
+
+	// multi-object delete of keys and versions
+	type deleted struct {
+		Key, VersionId, DeleteMarkerVersionId string
+		DeleteMarker                          bool
+	}
+	multiDel := func(body string, awaited ...deleted) {
+		doReq(t, "POST", "/vers/?delete", strings.NewReader("<Delete>"+body+"</Delete>"),
+			func(r *httptest.ResponseRecorder) error {
+				if err := status200(r); err != nil {
+					return err
+				}
+				var res struct {
+					Deleted []deleted
+					Error   []struct{ Key, VersionId, Code string }
+				}
+				if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+					return err
+				}
+				if len(res.Error) != 0 || fmt.Sprintf("%+v", res.Deleted) != fmt.Sprintf("%+v", awaited) {
+					return fmt.Errorf("got %+v, awaited %+v", res, awaited)
+				}
+				return nil
+			})
 	}
+	doReq(t, "PUT", "/vers/md", strings.NewReader("first"), versionID(&first))
+	doReq(t, "POST", "/vers/?delete", strings.NewReader(
+		"<Delete><Object><Key>md</Key></Object></Delete>"), func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var res struct{ Deleted []deleted }
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		if len(res.Deleted) != 1 || !res.Deleted[0].DeleteMarker || res.Deleted[0].DeleteMarkerVersionId == "" {
+			return fmt.Errorf("no delete marker in %q", r.Body.Bytes())
+		}
+		marker = res.Deleted[0].DeleteMarkerVersionId
+		return nil
+	})
+	doReq(t, "GET", "/vers/md", nil, statusCode(404))
+	multiDel("<Object><Key>md</Key><VersionId>"+marker+"</VersionId></Object>",
+		deleted{Key: "md", VersionId: marker, DeleteMarker: true, DeleteMarkerVersionId: marker})
+	doReq(t, "GET", "/vers/md", nil, content("first"))
+	multiDel("<Object><Key>md</Key><VersionId>"+first+"</VersionId></Object>",
+		deleted{Key: "md", VersionId: first})
+	doReq(t, "GET", "/vers/md?versionId="+first, nil, statusCode(404))
+	doReq(t, "DELETE", "/vers", nil, status200)
 }
 
-func status200(r *httptest.ResponseRecorder) error {
-	if r.Code != 200 {
-		return fmt.Errorf("bad response code: %d", r.Code)
+func Test13Metadata(t *testing.T) {
+	metaHeaders := func(awaited ...string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			for i := 0; i < len(awaited); i += 2 {
+				if got := r.Header().Get(awaited[i]); got != awaited[i+1] {
+					return fmt.Errorf("%s: got %q, awaited %q", awaited[i], got, awaited[i+1])
+				}
+			}
+			return nil
+		}
+	}
+	doReqHeader(t, "PUT", "/test/meta.txt", strings.NewReader("meta"),
+		[]string{"X-Amz-Meta-Reviewedby", "joe@example.com", "Cache-Control", "max-age=60",
+			"Content-Language", "hu"}, status200)
+	for _, method := range []string{"GET", "HEAD"} {
+		doReq(t, method, "/test/meta.txt", nil, metaHeaders("X-Amz-Meta-Reviewedby", "joe@example.com",
+			"Cache-Control", "max-age=60", "Content-Language", "hu"))
+	}
+	doReq(t, "GET", "/test/meta.txt?response-cache-control=no-cache", nil,
+		metaHeaders("Cache-Control", "no-cache"))
+
+	doReqHeader(t, "PUT", "/test/meta-copy.txt", nil,
+		[]string{"X-Amz-Copy-Source", "/test/meta.txt"}, status200)
+	doReq(t, "HEAD", "/test/meta-copy.txt", nil, metaHeaders("X-Amz-Meta-Reviewedby", "joe@example.com"))
+	doReqHeader(t, "PUT", "/test/meta-copy.txt", nil,
+		[]string{"X-Amz-Copy-Source", "/test/meta.txt", "X-Amz-Metadata-Directive", "REPLACE",
+			"X-Amz-Meta-Color", "red"}, status200)
+	doReq(t, "HEAD", "/test/meta-copy.txt", nil, metaHeaders("X-Amz-Meta-Color", "red",
+		"X-Amz-Meta-Reviewedby", "", "Cache-Control", ""))
+
+	doReqHeader(t, "PUT", "/test/meta-big.txt", strings.NewReader("big"),
+		[]string{"X-Amz-Meta-Big", strings.Repeat("x", 2048)}, statusCode(400))
+	doReq(t, "HEAD", "/test/meta-big.txt", nil, statusCode(404))
+	for _, k := range []string{"meta.txt", "meta-copy.txt"} {
+		doReq(t, "DELETE", "/test/"+k, nil, statusCode(204))
 	}
-	return nil
 }
 
-//<?xml version="1.0" encoding="UTF-8"?>
-//<Error>
-//<Code>NoSuchKey</Code>
-//<Message>The resource you requested does not exist</Message>
-//<Resource>/mybucket/myfoto.jpg</Resource>
-//<RequestId>4442587FB7D0A2F9</RequestId>
-//</Error>
-type AWSError struct {
-	Error struct {
-		Code, Message, Resource string
-		RequestID               string `xml:"RequestId"`
+func Test14Errors(t *testing.T) {
+	doReq(t, "GET", "/test/no-such-key", nil, awsError(404, "NoSuchKey"))
+	doReq(t, "HEAD", "/test/no-such-key", nil, statusCode(404))
+	doReq(t, "GET", "/no-such-bucket/key", nil, awsError(404, "NoSuchBucket"))
+	doReq(t, "GET", "/no-such-bucket/", nil, awsError(404, "NoSuchBucket"))
+	doReq(t, "PUT", "/test", nil, awsError(409, "BucketAlreadyOwnedByYou"))
+	doReq(t, "PUT", "/test/errors.txt", strings.NewReader("errors"), status200)
+	doReq(t, "DELETE", "/test", nil, awsError(409, "BucketNotEmpty"))
+	doReq(t, "DELETE", "/test/errors.txt", nil, statusCode(204))
+	doReqHeader(t, "PUT", "/test/trailer.txt", strings.NewReader("6\r\ntrailer\r\n0\r\n\r\n"),
+		[]string{"x-amz-content-sha256", "STREAMING-UNSIGNED-PAYLOAD-TRAILER"}, awsError(501, "NotImplemented"))
+}
+
+func Test15ACL(t *testing.T) {
+	other := func(method, path string, body io.Reader, header []string, check ResponseChecker) {
+		doReqAs(t, otherAccessKey, method, path, body, header, check)
+	}
+	doReq(t, "PUT", "/test/private.txt", strings.NewReader("private"), status200)
+	other("GET", "/test/private.txt", nil, nil, awsError(403, "AccessDenied"))
+	other("GET", "/test/", nil, nil, awsError(403, "AccessDenied"))
+	other("PUT", "/test/other.txt", strings.NewReader("other"), nil, awsError(403, "AccessDenied"))
+	other("GET", "/test/private.txt?acl", nil, nil, awsError(403, "AccessDenied"))
+	other("PUT", "/test", nil, nil, awsError(409, "BucketAlreadyExists"))
+
+	doReqHeader(t, "PUT", "/test/public.txt", strings.NewReader("public"),
+		[]string{"x-amz-acl", "public-read"}, status200)
+	other("GET", "/test/public.txt", nil, nil, status200)
+	other("PUT", "/test/public.txt", strings.NewReader("overwrite"), nil, awsError(403, "AccessDenied"))
+	doReqHeader(t, "PUT", "/test/bad.txt", strings.NewReader("bad"),
+		[]string{"x-amz-acl", "no-such-acl"}, awsError(400, "InvalidArgument"))
+
+	doReq(t, "GET", "/test/public.txt?acl", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var policy struct {
+			Owner  struct{ ID string }
+			Grants []struct {
+				Grantee    struct{ ID, URI string }
+				Permission string
+			} `xml:"AccessControlList>Grant"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &policy); err != nil {
+			return err
+		}
+		if policy.Owner.ID != "test" || len(policy.Grants) != 2 ||
+			policy.Grants[1].Grantee.URI != s3intf.AllUsers || policy.Grants[1].Permission != "READ" {
+			return fmt.Errorf("bad policy %+v", policy)
+		}
+		return nil
+	})
+
+	// explicit grant, then back to private
+	doReqHeader(t, "PUT", "/test/private.txt?acl", nil,
+		[]string{"x-amz-grant-read", `id="other"`}, status200)
+	other("GET", "/test/private.txt", nil, nil, status200)
+	doReq(t, "PUT", "/test/private.txt?acl", strings.NewReader(`<AccessControlPolicy>
+<Owner><ID>test</ID></Owner>
+<AccessControlList><Grant>
+<Grantee xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="CanonicalUser"><ID>test</ID></Grantee>
+<Permission>FULL_CONTROL</Permission>
+</Grant></AccessControlList>
+</AccessControlPolicy>`), status200)
+	other("GET", "/test/private.txt", nil, nil, awsError(403, "AccessDenied"))
+	doReq(t, "PUT", "/test/private.txt?acl", strings.NewReader("<AccessControlPolicy>"),
+		awsError(400, "MalformedACLError"))
+
+	// bucket ACL: the other user can write into the bucket, but cannot list it
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-grant-write", `id="other"`}, status200)
+	other("PUT", "/test/other.txt", strings.NewReader("other"), nil, status200)
+	other("GET", "/test/other.txt", nil, nil, status200)
+	// the initiator of an upload is the requester, the owner is the bucket's owner
+	var otherUpload string
+	other("POST", "/test/other-upload.txt?uploads", nil, nil, func(r *httptest.ResponseRecorder) error {
+		var res struct{ UploadID string `xml:"UploadId"` }
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		otherUpload = res.UploadID
+		return status200(r)
+	})
+	doReq(t, "GET", "/test/?uploads&prefix=other-upload", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var res struct {
+			Initiator []string `xml:"Upload>Initiator>ID"`
+			Owner     []string `xml:"Upload>Owner>ID"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		if len(res.Initiator) != 1 || res.Initiator[0] != "other" || len(res.Owner) != 1 || res.Owner[0] != "test" {
+			return fmt.Errorf("bad initiator or owner in %s", r.Body.Bytes())
+		}
+		return nil
+	})
+	doReq(t, "DELETE", "/test/other-upload.txt?uploadId="+otherUpload, nil, statusCode(204))
+	other("GET", "/test/", nil, nil, awsError(403, "AccessDenied"))
+	other("PUT", "/test?acl", nil, []string{"x-amz-acl", "public-read"}, awsError(403, "AccessDenied"))
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-acl", "authenticated-read"}, status200)
+	other("GET", "/test/", nil, nil, status200)
+	other("PUT", "/test/other2.txt", strings.NewReader("other"), nil, awsError(403, "AccessDenied"))
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-acl", "private"}, status200)
+
+	// the ACL given at the initiation of a multipart upload is set on completion
+	doReqHeader(t, "POST", "/test/multi-public.txt?uploads", nil,
+		[]string{"x-amz-acl", "no-such-acl"}, awsError(400, "InvalidArgument"))
+	var uploadID string
+	doReqHeader(t, "POST", "/test/multi-public.txt?uploads", nil,
+		[]string{"x-amz-acl", "public-read"}, func(r *httptest.ResponseRecorder) error {
+			var res struct{ UploadID string `xml:"UploadId"` }
+			if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+				return err
+			}
+			uploadID = res.UploadID
+			return status200(r)
+		})
+	var etag string
+	doReq(t, "PUT", "/test/multi-public.txt?partNumber=1&uploadId="+uploadID,
+		strings.NewReader("public"), func(r *httptest.ResponseRecorder) error {
+			etag = r.Header().Get("ETag")
+			return status200(r)
+		})
+	doReq(t, "POST", "/test/multi-public.txt?uploadId="+uploadID, strings.NewReader(
+		"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"+etag+
+			"</ETag></Part></CompleteMultipartUpload>"), status200)
+	other("GET", "/test/multi-public.txt", nil, nil, status200)
+
+	for _, key := range []string{"private.txt", "public.txt", "other.txt", "multi-public.txt"} {
+		doReq(t, "DELETE", "/test/"+key, nil, statusCode(204))
+	}
+}
+
+func Test16Anonymous(t *testing.T) {
+	anon := func(method, path string, body io.Reader, header []string, check ResponseChecker) {
+		doReqAs(t, "", method, path, body, header, check)
+	}
+	doReq(t, "PUT", "/test/secret.png", strings.NewReader("secret"), status200)
+	doReqHeader(t, "PUT", "/test/logo.png", strings.NewReader("logo"),
+		[]string{"x-amz-acl", "public-read"}, status200)
+	anon("GET", "/", nil, nil, awsError(403, "AccessDenied"))
+	anon("PUT", "/anonymous", nil, nil, awsError(403, "AccessDenied"))
+	anon("GET", "/test/secret.png", nil, nil, awsError(403, "AccessDenied"))
+	anon("GET", "/test/", nil, nil, awsError(403, "AccessDenied"))
+	anon("PUT", "/test/anon.png", strings.NewReader("anon"), nil, awsError(403, "AccessDenied"))
+	anon("GET", "/test/logo.png", nil, nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if r.Body.String() != "logo" {
+			return fmt.Errorf("got %q, awaited %q", r.Body.String(), "logo")
+		}
+		return nil
+	})
+	// virtual host
+	for _, h := range handlers {
+		req, err := http.NewRequest("GET", "/logo.png", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "test." + serviceHost
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if err = status200(rw); err != nil {
+			t.Errorf("virtual host GET: %s (body:%q)", err, rw.Body.Bytes())
+		}
+	}
+	// authenticated-read is not for anonymous requests
+	doReqHeader(t, "PUT", "/test/logo.png?acl", nil, []string{"x-amz-acl", "authenticated-read"}, status200)
+	anon("GET", "/test/logo.png", nil, nil, awsError(403, "AccessDenied"))
+
+	// public-read-write bucket
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-acl", "public-read-write"}, status200)
+	anon("PUT", "/test/anon.png", strings.NewReader("anon"), nil, status200)
+	anon("GET", "/test/", nil, nil, status200)
+	anon("GET", "/test?acl", nil, nil, awsError(403, "AccessDenied"))
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-acl", "private"}, status200)
+	anon("GET", "/test/", nil, nil, awsError(403, "AccessDenied"))
+
+	for _, key := range []string{"secret.png", "logo.png", "anon.png"} {
+		doReq(t, "DELETE", "/test/"+key, nil, statusCode(204))
+	}
+}
+
+func Test17Policy(t *testing.T) {
+	other := func(method, path string, body io.Reader, header []string, check ResponseChecker) {
+		doReqAs(t, otherAccessKey, method, path, body, header, check)
+	}
+	anon := func(method, path string, body io.Reader, header []string, check ResponseChecker) {
+		doReqAs(t, "", method, path, body, header, check)
+	}
+	policy := `{"Version": "2012-10-17", "Statement": [
+  {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::test/pub/*"},
+  {"Effect": "Allow", "Principal": {"AWS": "other"}, "Action": ["s3:PutObject", "s3:DeleteObject"],
+   "Resource": "arn:aws:s3:::test/*"},
+  {"Effect": "Deny", "Principal": {"AWS": "other"}, "Action": "s3:PutObject", "Resource": "arn:aws:s3:::test/locked/*"},
+  {"Effect": "Deny", "Principal": "*", "Action": "s3:DeleteObject", "Resource": "arn:aws:s3:::test/keep*"},
+  {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::test/img/*",
+   "Condition": {"StringLike": {"aws:Referer": "http://example.com/*"}}}
+]}`
+	doReq(t, "GET", "/test?policy", nil, awsError(404, "NoSuchBucketPolicy"))
+	doReq(t, "PUT", "/test?policy", strings.NewReader(`{"Statement": {"Effect": "Allow"}}`),
+		awsError(400, "MalformedPolicy"))
+	doReq(t, "PUT", "/test?policy", strings.NewReader(strings.Replace(policy, "test/", "test2/", 1)),
+		awsError(400, "MalformedPolicy"))
+	other("PUT", "/test?policy", strings.NewReader(policy), nil, awsError(403, "AccessDenied"))
+	doReq(t, "PUT", "/test?policy", strings.NewReader(policy), statusCode(204))
+	doReq(t, "GET", "/test?policy", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if r.Body.String() != policy {
+			return fmt.Errorf("got policy %q", r.Body.String())
+		}
+		return nil
+	})
+
+	for _, key := range []string{"pub/a.txt", "priv.txt", "keep.txt", "img/a.png"} {
+		doReq(t, "PUT", "/test/"+key, strings.NewReader(key), status200)
+	}
+	anon("GET", "/test/pub/a.txt", nil, nil, status200)
+	anon("GET", "/test/priv.txt", nil, nil, awsError(403, "AccessDenied"))
+	anon("GET", "/test/img/a.png", nil, []string{"Referer", "http://example.com/index.html"}, status200)
+	anon("GET", "/test/img/a.png", nil, []string{"Referer", "http://evil.com/"}, awsError(403, "AccessDenied"))
+	anon("GET", "/test/img/a.png", nil, nil, awsError(403, "AccessDenied"))
+	other("PUT", "/test/x.txt", strings.NewReader("x"), nil, status200)
+	other("PUT", "/test/locked/x.txt", strings.NewReader("x"), nil, awsError(403, "AccessDenied"))
+	other("GET", "/test/", nil, nil, awsError(403, "AccessDenied"))
+
+	// explicit deny overrides the owner's permissions, too
+	doReq(t, "DELETE", "/test/keep.txt", nil, awsError(403, "AccessDenied"))
+	other("POST", "/test/?delete", strings.NewReader(`<Delete><Object><Key>x.txt</Key></Object>
+<Object><Key>keep.txt</Key></Object></Delete>`), nil,
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			body := r.Body.String()
+			if !strings.Contains(body, "<Deleted><Key>x.txt</Key></Deleted>") ||
+				!strings.Contains(body, "<Key>keep.txt</Key><Code>AccessDenied</Code>") {
+				return fmt.Errorf("bad delete result %q", body)
+			}
+			return nil
+		})
+
+	doReq(t, "DELETE", "/test?policy", nil, statusCode(204))
+	doReq(t, "GET", "/test?policy", nil, awsError(404, "NoSuchBucketPolicy"))
+	anon("GET", "/test/pub/a.txt", nil, nil, awsError(403, "AccessDenied"))
+	for _, key := range []string{"pub/a.txt", "priv.txt", "keep.txt", "img/a.png"} {
+		doReq(t, "DELETE", "/test/"+key, nil, statusCode(204))
+	}
+
+	// a recreated bucket does not inherit the policy of the deleted one
+	doReq(t, "PUT", "/polbucket", nil, status200)
+	doReq(t, "PUT", "/polbucket?policy", strings.NewReader(`{"Statement": {"Effect": "Allow", "Principal": "*",
+  "Action": "s3:GetObject", "Resource": "arn:aws:s3:::polbucket/*"}}`), statusCode(204))
+	doReq(t, "PUT", "/polbucket/a.txt", strings.NewReader("a"), status200)
+	anon("GET", "/polbucket/a.txt", nil, nil, status200)
+	doReq(t, "DELETE", "/polbucket/a.txt", nil, statusCode(204))
+	doReq(t, "DELETE", "/polbucket", nil, status200)
+	doReq(t, "PUT", "/polbucket", nil, status200)
+	doReq(t, "PUT", "/polbucket/a.txt", strings.NewReader("a"), status200)
+	anon("GET", "/polbucket/a.txt", nil, nil, awsError(403, "AccessDenied"))
+	doReq(t, "DELETE", "/polbucket/a.txt", nil, statusCode(204))
+	doReq(t, "DELETE", "/polbucket", nil, status200)
+}
+
+func Test18PostUpload(t *testing.T) {
+	o, err := backers[0].GetOwner(testAccessKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := func(expiration string, conditions ...string) string {
+		return b64.EncodeToString([]byte(`{"expiration": "` + expiration + `", "conditions": [` +
+			strings.Join(conditions, ",") + `]}`))
+	}
+	v2 := func(policy string, fields ...string) []string {
+		return append([]string{"AWSAccessKeyId", testAccessKey, "policy", policy,
+			"signature", b64.EncodeToString(o.CalcHash([]byte(policy)))}, fields...)
+	}
+	post := func(fields []string, content string, check ResponseChecker) {
+		body, ct := postForm(fields, `C:\photos\photo.txt`, content)
+		doReqAs(t, "", "POST", "/test", body, []string{"Content-Type", ct}, check)
+	}
+	expiration := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	conds := []string{`{"bucket": "test"}`, `["starts-with", "$key", "uploads/"]`,
+		`["content-length-range", 1, 10]`, `{"success_action_status": "201"}`,
+		`["starts-with", "$Content-Type", "text/"]`}
+	fields := []string{"key", "uploads/${filename}", "success_action_status", "201",
+		"Content-Type", "text/plain"}
+
+	post(v2(policy(expiration, conds...), fields...), "hello", func(r *httptest.ResponseRecorder) error {
+		if err := statusCode(201)(r); err != nil {
+			return err
+		}
+		var res struct {
+			Location, Bucket, Key, ETag string
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &res); err != nil {
+			return err
+		}
+		if res.Bucket != "test" || res.Key != "uploads/photo.txt" ||
+			res.ETag != `"5d41402abc4b2a76b9719d911017c592"` || res.ETag != r.Header().Get("ETag") {
+			return fmt.Errorf("bad response %+v", res)
+		}
+		return nil
+	})
+	doReq(t, "GET", "/test/uploads/photo.txt", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if r.Body.String() != "hello" || r.Header().Get("Content-Type") != "text/plain" {
+			return fmt.Errorf("got %q (%s)", r.Body.String(), r.Header().Get("Content-Type"))
+		}
+		return nil
+	})
+
+	post(v2(policy("2013-01-01T00:00:00Z", conds...), fields...), "hello", awsError(403, "AccessDenied"))
+	post(v2(policy(expiration, conds...), "key", "other/x", "success_action_status", "201",
+		"Content-Type", "text/plain"), "hello", awsError(403, "AccessDenied"))
+	post(v2(policy(expiration, conds...), append(fields, "x-amz-meta-extra", "1")...), "hello",
+		awsError(403, "AccessDenied"))
+	post(v2(policy(expiration, conds...), fields...), "hello world", awsError(400, "EntityTooLarge"))
+	post(v2(policy(expiration, conds...), fields...), "", awsError(400, "EntityTooSmall"))
+	post(append([]string{"AWSAccessKeyId", testAccessKey, "policy", policy(expiration, conds...),
+		"signature", b64.EncodeToString([]byte("bad signature"))}, fields...), "hello",
+		awsError(403, "SignatureDoesNotMatch"))
+	post([]string{"policy", "bad policy", "key", "uploads/x"}, "hello", awsError(400, "InvalidPolicyDocument"))
+	post([]string{"key", "uploads/anonymous"}, "hello", awsError(403, "AccessDenied"))
+
+	// Signature Version 4, with redirect
+	now := time.Now().UTC()
+	credential := testAccessKey + "/" + now.Format("20060102") + "/us-east-1/s3/aws4_request"
+	p := policy(expiration, `{"bucket": "test"}`, `["starts-with", "$key", "uploads/"]`,
+		`{"success_action_redirect": "http://example.com/done?a=b"}`,
+		`{"x-amz-algorithm": "AWS4-HMAC-SHA256"}`, `{"x-amz-credential": "`+credential+`"}`,
+		`{"x-amz-date": "`+now.Format(s3intf.ISO8601Format)+`"}`)
+	v4fields := []string{"key", "uploads/v4.txt", "policy", p,
+		"success_action_redirect", "http://example.com/done?a=b",
+		"x-amz-algorithm", "AWS4-HMAC-SHA256", "x-amz-credential", credential,
+		"x-amz-date", now.Format(s3intf.ISO8601Format),
+		"x-amz-signature", hex.EncodeToString(s3intf.HMACSHA256(
+			o.SigningKey(now.Format("20060102"), "us-east-1", "s3"), []byte(p)))}
+	post(v4fields, "v4", func(r *httptest.ResponseRecorder) error {
+		if err := statusCode(303)(r); err != nil {
+			return err
+		}
+		u, err := url.Parse(r.Header().Get("Location"))
+		if err != nil {
+			return err
+		}
+		q := u.Query()
+		if u.Host != "example.com" || q.Get("a") != "b" || q.Get("bucket") != "test" ||
+			q.Get("key") != "uploads/v4.txt" || q.Get("etag") != r.Header().Get("ETag") {
+			return fmt.Errorf("bad redirect %s", u)
+		}
+		return nil
+	})
+	v4fields[len(v4fields)-1] = strings.Repeat("0", 64)
+	post(v4fields, "v4", awsError(403, "SignatureDoesNotMatch"))
+
+	for _, key := range []string{"uploads/photo.txt", "uploads/v4.txt"} {
+		doReq(t, "DELETE", "/test/"+key, nil, statusCode(204))
+	}
+}
+
+func Test19CORS(t *testing.T) {
+	anon := func(method, path string, header []string, check ResponseChecker) {
+		doReqAs(t, "", method, path, nil, header, check)
+	}
+	corsHeaders := func(origin, methods, credentials string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			h := r.Header()
+			if h.Get("Access-Control-Allow-Origin") != origin ||
+				h.Get("Access-Control-Allow-Methods") != methods ||
+				h.Get("Access-Control-Allow-Credentials") != credentials {
+				return fmt.Errorf("bad CORS headers %v", h)
+			}
+			return nil
+		}
+	}
+	preflight := func(origin, method, headers string) []string {
+		return []string{"Origin", origin, "Access-Control-Request-Method", method,
+			"Access-Control-Request-Headers", headers}
+	}
+
+	anon("OPTIONS", "/test/cors.txt", preflight("http://www.example.com", "PUT", ""),
+		awsError(403, "AccessForbidden"))
+	doReq(t, "GET", "/test?cors", nil, awsError(404, "NoSuchCORSConfiguration"))
+	doReq(t, "PUT", "/test?cors", strings.NewReader(`<CORSConfiguration>
+  <CORSRule><AllowedMethod>PATCH</AllowedMethod><AllowedOrigin>*</AllowedOrigin></CORSRule>
+</CORSConfiguration>`), awsError(400, "InvalidRequest"))
+	doReqAs(t, otherAccessKey, "PUT", "/test?cors", strings.NewReader(`<CORSConfiguration/>`), nil,
+		awsError(403, "AccessDenied"))
+	doReq(t, "PUT", "/test?cors", strings.NewReader(`<CORSConfiguration>
+  <CORSRule>
+    <AllowedOrigin>http://www.example.com</AllowedOrigin>
+    <AllowedMethod>PUT</AllowedMethod>
+    <AllowedMethod>DELETE</AllowedMethod>
+    <AllowedHeader>Content-*</AllowedHeader>
+    <AllowedHeader>x-amz-*</AllowedHeader>
+    <ExposeHeader>ETag</ExposeHeader>
+    <MaxAgeSeconds>3000</MaxAgeSeconds>
+  </CORSRule>
+  <CORSRule>
+    <AllowedOrigin>*</AllowedOrigin>
+    <AllowedMethod>GET</AllowedMethod>
+  </CORSRule>
+</CORSConfiguration>`), status200)
+	doReq(t, "GET", "/test?cors", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var conf struct {
+			Rules []struct {
+				AllowedOrigin []string
+				MaxAgeSeconds int
+			} `xml:"CORSRule"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &conf); err != nil {
+			return err
+		}
+		if len(conf.Rules) != 2 || conf.Rules[0].MaxAgeSeconds != 3000 ||
+			len(conf.Rules[1].AllowedOrigin) != 1 || conf.Rules[1].AllowedOrigin[0] != "*" {
+			return fmt.Errorf("bad CORS configuration %s", r.Body.Bytes())
+		}
+		return nil
+	})
+
+	anon("OPTIONS", "/test/cors.txt", preflight("http://www.example.com", "PUT", "content-type, x-amz-date"),
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if err := corsHeaders("http://www.example.com", "PUT, DELETE", "true")(r); err != nil {
+				return err
+			}
+			h := r.Header()
+			if h.Get("Access-Control-Allow-Headers") != "content-type, x-amz-date" ||
+				h.Get("Access-Control-Expose-Headers") != "ETag" || h.Get("Access-Control-Max-Age") != "3000" {
+				return fmt.Errorf("bad CORS headers %v", h)
+			}
+			return nil
+		})
+	anon("OPTIONS", "/test/cors.txt", preflight("http://www.example.com", "PUT", "authorization"),
+		awsError(403, "AccessForbidden"))
+	anon("OPTIONS", "/test/cors.txt", preflight("http://evil.com", "PUT", ""),
+		awsError(403, "AccessForbidden"))
+	anon("OPTIONS", "/test/cors.txt", preflight("http://evil.com", "GET", ""), corsHeaders("*", "GET", ""))
+	anon("OPTIONS", "/test/cors.txt", []string{"Origin", "http://evil.com"}, awsError(400, "InvalidRequest"))
+
+	// the actual requests get the headers, too
+	doReqHeader(t, "PUT", "/test/cors.txt", strings.NewReader("cors"), []string{"Origin", "http://www.example.com"},
+		func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			return corsHeaders("http://www.example.com", "PUT, DELETE", "true")(r)
+		})
+	doReqHeader(t, "GET", "/test/cors.txt", nil, []string{"Origin", "http://evil.com"},
+		corsHeaders("*", "GET", ""))
+	doReqHeader(t, "HEAD", "/test/cors.txt", nil, []string{"Origin", "http://evil.com"}, corsHeaders("", "", ""))
+	doReq(t, "DELETE", "/test/cors.txt", nil, statusCode(204))
+
+	doReq(t, "DELETE", "/test?cors", nil, statusCode(204))
+	doReq(t, "GET", "/test?cors", nil, awsError(404, "NoSuchCORSConfiguration"))
+	anon("OPTIONS", "/test/cors.txt", preflight("http://evil.com", "GET", ""), awsError(403, "AccessForbidden"))
+}
+
+func Test20Website(t *testing.T) {
+	website := func(method, path string, check ResponseChecker) {
+		for _, h := range handlers {
+			req, err := http.NewRequest(method, path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "test." + websiteHost
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if err = check(rw); err != nil {
+				t.Fatalf("bad website response for %s %s: %s (body:%q)", method, path, err, rw.Body.Bytes())
+			}
+		}
+	}
+	page := func(status int, content string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if err := statusCode(status)(r); err != nil {
+				return err
+			}
+			if !strings.Contains(r.Body.String(), content) {
+				return fmt.Errorf("awaited %q in the body", content)
+			}
+			return nil
+		}
+	}
+	redirect := func(status int, location string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if err := statusCode(status)(r); err != nil {
+				return err
+			}
+			if loc := r.Header().Get("Location"); loc != location {
+				return fmt.Errorf("got Location %q, awaited %q", loc, location)
+			}
+			return nil
+		}
+	}
+
+	website("GET", "/", page(404, "NoSuchWebsiteConfiguration"))
+	doReq(t, "GET", "/test?website", nil, awsError(404, "NoSuchWebsiteConfiguration"))
+	doReq(t, "PUT", "/test?website", strings.NewReader(`<WebsiteConfiguration>
+  <ErrorDocument><Key>error.html</Key></ErrorDocument>
+</WebsiteConfiguration>`), awsError(400, "InvalidArgument"))
+	doReq(t, "PUT", "/test?website", strings.NewReader(`<WebsiteConfiguration>
+  <IndexDocument><Suffix>index.html</Suffix></IndexDocument>
+  <ErrorDocument><Key>error.html</Key></ErrorDocument>
+  <RoutingRules>
+    <RoutingRule>
+      <Condition><KeyPrefixEquals>docs/</KeyPrefixEquals></Condition>
+      <Redirect><ReplaceKeyPrefixWith>documents/</ReplaceKeyPrefixWith></Redirect>
+    </RoutingRule>
+    <RoutingRule>
+      <Condition>
+        <KeyPrefixEquals>old/</KeyPrefixEquals>
+        <HttpErrorCodeReturnedEquals>404</HttpErrorCodeReturnedEquals>
+      </Condition>
+      <Redirect>
+        <HostName>example.com</HostName>
+        <ReplaceKeyPrefixWith>new/</ReplaceKeyPrefixWith>
+        <HttpRedirectCode>302</HttpRedirectCode>
+      </Redirect>
+    </RoutingRule>
+  </RoutingRules>
+</WebsiteConfiguration>`), status200)
+	doReq(t, "GET", "/test?website", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var conf struct {
+			Suffix string `xml:"IndexDocument>Suffix"`
+			Rules  []struct {
+				HostName string `xml:"Redirect>HostName"`
+			} `xml:"RoutingRules>RoutingRule"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &conf); err != nil {
+			return err
+		}
+		if conf.Suffix != "index.html" || len(conf.Rules) != 2 || conf.Rules[1].HostName != "example.com" {
+			return fmt.Errorf("bad website configuration %s", r.Body.Bytes())
+		}
+		return nil
+	})
+
+	for _, o := range []struct{ key, content, redirect string }{
+		{"index.html", "home", ""},
+		{"sub/index.html", "sub", ""},
+		{"error.html", "oops", ""},
+		{"moved.html", "moved", "/index.html"},
+	} {
+		header := []string{"x-amz-acl", "public-read", "Content-Type", "text/html"}
+		if o.redirect != "" {
+			header = append(header, "x-amz-website-redirect-location", o.redirect)
+		}
+		doReqHeader(t, "PUT", "/test/"+o.key, strings.NewReader(o.content), header, status200)
+	}
+	doReq(t, "PUT", "/test/private.html", strings.NewReader("private"), status200)
+	doReqHeader(t, "PUT", "/test/bad-redirect.html", strings.NewReader("bad"),
+		[]string{"x-amz-website-redirect-location", "example.com/index.html"},
+		awsError(400, "InvalidRedirectLocation"))
+
+	website("GET", "/", page(200, "home"))
+	website("GET", "/index.html", page(200, "home"))
+	website("GET", "/sub/", page(200, "sub"))
+	website("HEAD", "/sub/", statusCode(200))
+	website("GET", "/sub", redirect(302, "/sub/"))
+	website("GET", "/private.html", page(403, "oops"))
+	website("GET", "/moved.html", redirect(301, "/index.html"))
+	website("GET", "/docs/a.html", redirect(301, "http://test."+websiteHost+"/documents/a.html"))
+	// the missing keys are forbidden while the bucket is not readable
+	website("GET", "/missing.html", page(403, "oops"))
+	website("GET", "/old/a.html", page(403, "oops"))
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-acl", "public-read"}, status200)
+	website("GET", "/missing.html", page(404, "oops"))
+	website("GET", "/old/a.html", redirect(302, "http://example.com/new/a.html"))
+	doReqHeader(t, "PUT", "/test?acl", nil, []string{"x-amz-acl", "private"}, status200)
+	website("PUT", "/index.html", page(405, "MethodNotAllowed"))
+	// the REST endpoint returns the object itself
+	doReq(t, "GET", "/test/moved.html", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if r.Header().Get("X-Amz-Website-Redirect-Location") != "/index.html" {
+			return fmt.Errorf("no redirect location in %v", r.Header())
+		}
+		return nil
+	})
+
+	doReq(t, "DELETE", "/test?website", nil, statusCode(204))
+	website("GET", "/", page(404, "NoSuchWebsiteConfiguration"))
+	for _, key := range []string{"index.html", "sub/index.html", "error.html", "moved.html", "private.html"} {
+		doReq(t, "DELETE", "/test/"+key, nil, statusCode(204))
+	}
+}
+
+func Test21Routing(t *testing.T) {
+	for i, b := range backers {
+		routed := s3srv.NewService(serviceHost, b)
+		routed.SetRouter(s3intf.Router{Domains: []string{serviceHost, "s3.other.org:8080"},
+			CNAMEs: map[string]string{"static.example.com": "test"}})
+		pathStyle := s3srv.NewService(serviceHost, b)
+		pathStyle.SetRouter(s3intf.Router{Domains: []string{serviceHost}, PathStyleOnly: true})
+		o, err := b.GetOwner(testAccessKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// get signs the request for the signedBucket (the bucket of the Host, "" for path style)
+		get := func(h http.Handler, host, path, signedBucket string, check ResponseChecker) {
+			req, err := http.NewRequest("GET", path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = host
+			req.RequestURI = path
+			req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			req.Header.Set("Authorization", "AWS "+testAccessKey+":"+
+				b64.EncodeToString(o.CalcHash(s3intf.RoutedBytesToSign(req, signedBucket))))
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if err = check(rw); err != nil {
+				t.Fatalf("%d. bad response for GET %s%s: %s (body:%q)", i, host, path, err, rw.Body.Bytes())
+			}
+		}
+
+		get(routed, serviceHost, "/test/", "", status200)
+		get(routed, "test."+serviceHost, "/", "test", status200)
+		get(routed, "test.s3.other.org", "/", "test", status200)
+		get(routed, "s3.other.org:8080", "/test/", "", status200)
+		get(routed, "static.example.com", "/", "test", status200)
+		// the signature must use the same bucket as the routing
+		get(routed, "static.example.com", "/", "static.example.com", awsError(403, "SignatureDoesNotMatch"))
+		get(routed, "test.s3.other.org", "/", "", awsError(403, "SignatureDoesNotMatch"))
+		get(routed, "unknown.org", "/", "", awsError(400, "InvalidURI"))
+		get(routed, "x", "/test/", "", awsError(400, "InvalidURI"))
+		// the default routing does not panic on unknown hosts
+		get(handlers[i], "x", "/", "", awsError(400, "InvalidURI"))
+
+		get(pathStyle, serviceHost, "/test/", "", status200)
+		get(pathStyle, "test."+serviceHost, "/", "test", awsError(400, "InvalidURI"))
+	}
+}
+
+func Test22Tagging(t *testing.T) {
+	tagsOf := func(tags ...string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			var tagging struct {
+				Tags []struct{ Key, Value string } `xml:"TagSet>Tag"`
+			}
+			if err := xml.Unmarshal(r.Body.Bytes(), &tagging); err != nil {
+				return err
+			}
+			var got []string
+			for _, tag := range tagging.Tags {
+				got = append(got, tag.Key, tag.Value)
+			}
+			if strings.Join(got, ",") != strings.Join(tags, ",") {
+				return fmt.Errorf("got tags %q, awaited %q", got, tags)
+			}
+			return nil
+		}
+	}
+	tagCount := func(n string) ResponseChecker {
+		return func(r *httptest.ResponseRecorder) error {
+			if err := status200(r); err != nil {
+				return err
+			}
+			if got := r.Header().Get("X-Amz-Tagging-Count"); got != n || r.Header().Get("X-Amz-Tagging") != "" {
+				return fmt.Errorf("got tag count %q (%v), awaited %q", got, r.Header(), n)
+			}
+			return nil
+		}
+	}
+
+	doReqHeader(t, "PUT", "/test/tagged.txt", strings.NewReader("tagged"),
+		[]string{"X-Amz-Tagging", "project=s3weed&env=test"}, status200)
+	doReqHeader(t, "PUT", "/test/tagged.txt", strings.NewReader("tagged"),
+		[]string{"X-Amz-Tagging", "a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10&k=11"}, awsError(400, "InvalidTag"))
+	doReq(t, "HEAD", "/test/tagged.txt", nil, tagCount("2"))
+	doReq(t, "GET", "/test/tagged.txt?tagging", nil, tagsOf("env", "test", "project", "s3weed"))
+	doReqAs(t, otherAccessKey, "GET", "/test/tagged.txt?tagging", nil, nil, awsError(403, "AccessDenied"))
+	doReq(t, "GET", "/test/missing.txt?tagging", nil, awsError(404, "NoSuchKey"))
+
+	doReq(t, "PUT", "/test/tagged.txt?tagging", strings.NewReader(`<Tagging><TagSet>
+  <Tag><Key>a</Key><Value>1</Value></Tag><Tag><Key>a</Key><Value>2</Value></Tag>
+</TagSet></Tagging>`), awsError(400, "InvalidTag"))
+	doReq(t, "PUT", "/test/tagged.txt?tagging", strings.NewReader(`<Tagging><TagSet>
+  <Tag><Key>project</Key><Value>other</Value></Tag>
+</TagSet></Tagging>`), status200)
+	doReq(t, "GET", "/test/tagged.txt?tagging", nil, tagsOf("project", "other"))
+	doReq(t, "GET", "/test/tagged.txt", nil, tagCount("1"))
+
+	// the tags are copied with the object, unless the tagging directive is REPLACE
+	doReqHeader(t, "PUT", "/test/tagged-copy.txt", nil,
+		[]string{"X-Amz-Copy-Source", "/test/tagged.txt"}, status200)
+	doReq(t, "GET", "/test/tagged-copy.txt?tagging", nil, tagsOf("project", "other"))
+	doReqHeader(t, "PUT", "/test/tagged-copy.txt", nil,
+		[]string{"X-Amz-Copy-Source", "/test/tagged.txt", "X-Amz-Metadata-Directive", "REPLACE",
+			"X-Amz-Meta-Color", "red"}, status200)
+	doReq(t, "GET", "/test/tagged-copy.txt?tagging", nil, tagsOf("project", "other"))
+	doReqHeader(t, "PUT", "/test/tagged-copy.txt", nil,
+		[]string{"X-Amz-Copy-Source", "/test/tagged.txt", "X-Amz-Tagging-Directive", "REPLACE",
+			"X-Amz-Tagging", "copied=yes"}, status200)
+	doReq(t, "GET", "/test/tagged-copy.txt?tagging", nil, tagsOf("copied", "yes"))
+
+	// the tags can be used in the conditions of the bucket policy
+	doReq(t, "PUT", "/test?policy", strings.NewReader(`{"Statement": {"Effect": "Allow", "Principal": "*",
+  "Action": "s3:GetObject", "Resource": "arn:aws:s3:::test/*",
+  "Condition": {"StringEquals": {"s3:ExistingObjectTag/public": "yes"}}}}`), statusCode(204))
+	doReqAs(t, "", "GET", "/test/tagged.txt", nil, nil, awsError(403, "AccessDenied"))
+	doReq(t, "PUT", "/test/tagged.txt?tagging", strings.NewReader(`<Tagging><TagSet>
+  <Tag><Key>public</Key><Value>yes</Value></Tag>
+</TagSet></Tagging>`), status200)
+	doReqAs(t, "", "GET", "/test/tagged.txt", nil, nil, status200)
+	doReq(t, "DELETE", "/test?policy", nil, statusCode(204))
+
+	doReq(t, "DELETE", "/test/tagged.txt?tagging", nil, statusCode(204))
+	doReq(t, "GET", "/test/tagged.txt?tagging", nil, tagsOf())
+
+	doReq(t, "GET", "/test?tagging", nil, awsError(404, "NoSuchTagSet"))
+	doReq(t, "PUT", "/test?tagging", strings.NewReader(`<Tagging><TagSet>
+  <Tag><Key>cost-center</Key><Value>42</Value></Tag>
+</TagSet></Tagging>`), status200)
+	doReq(t, "GET", "/test?tagging", nil, tagsOf("cost-center", "42"))
+	doReq(t, "DELETE", "/test?tagging", nil, statusCode(204))
+	doReq(t, "GET", "/test?tagging", nil, awsError(404, "NoSuchTagSet"))
+
+	for _, key := range []string{"tagged.txt", "tagged-copy.txt"} {
+		doReq(t, "DELETE", "/test/"+key, nil, statusCode(204))
+	}
+}
+
+func Test23Lifecycle(t *testing.T) {
+	doReq(t, "PUT", "/lc", nil, status200)
+	doReq(t, "GET", "/lc?lifecycle", nil, awsError(404, "NoSuchLifecycleConfiguration"))
+	doReq(t, "PUT", "/lc?lifecycle", strings.NewReader(`<LifecycleConfiguration><Rule>
+  <ID>none</ID><Filter><Prefix>tmp/</Prefix></Filter><Status>Enabled</Status>
+</Rule></LifecycleConfiguration>`), awsError(400, "InvalidRequest"))
+	doReq(t, "PUT", "/lc?lifecycle", strings.NewReader(`<LifecycleConfiguration><Rule>
+  <Status>On</Status><Expiration><Days>1</Days></Expiration>
+</Rule></LifecycleConfiguration>`), awsError(400, "MalformedXML"))
+	doReqAs(t, otherAccessKey, "PUT", "/lc?lifecycle", strings.NewReader(`<LifecycleConfiguration/>`), nil,
+		awsError(403, "AccessDenied"))
+	doReq(t, "PUT", "/lc?versioning",
+		strings.NewReader("<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>"),
+		status200)
+	doReq(t, "PUT", "/lc?lifecycle", strings.NewReader(`<LifecycleConfiguration>
+  <Rule><ID>tmp</ID><Prefix>tmp/</Prefix><Status>Enabled</Status>
+    <Expiration><Days>1</Days></Expiration></Rule>
+  <Rule><ID>temp</ID><Filter><Tag><Key>temp</Key><Value>yes</Value></Tag></Filter><Status>Enabled</Status>
+    <Expiration><Days>2</Days></Expiration></Rule>
+  <Rule><ID>disabled</ID><Filter><Prefix></Prefix></Filter><Status>Disabled</Status>
+    <Expiration><Days>1</Days></Expiration></Rule>
+  <Rule><ID>old</ID><Filter><Prefix>ver/</Prefix></Filter><Status>Enabled</Status>
+    <NoncurrentVersionExpiration><NoncurrentDays>1</NoncurrentDays></NoncurrentVersionExpiration></Rule>
+  <Rule><ID>uploads</ID><Filter><Prefix></Prefix></Filter><Status>Enabled</Status>
+    <AbortIncompleteMultipartUpload><DaysAfterInitiation>1</DaysAfterInitiation></AbortIncompleteMultipartUpload></Rule>
+</LifecycleConfiguration>`), status200)
+	doReq(t, "GET", "/lc?lifecycle", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		var conf struct {
+			Rules []struct {
+				ID     string
+				Prefix string `xml:"Filter>Prefix"`
+			} `xml:"Rule"`
+		}
+		if err := xml.Unmarshal(r.Body.Bytes(), &conf); err != nil {
+			return err
+		}
+		if len(conf.Rules) != 5 || conf.Rules[0].ID != "tmp" || conf.Rules[0].Prefix != "tmp/" {
+			return fmt.Errorf("bad lifecycle configuration %s", r.Body.Bytes())
+		}
+		return nil
+	})
+
+	for _, key := range []string{"tmp/a.txt", "keep.txt", "ver/obj", "ver/obj"} {
+		doReq(t, "PUT", "/lc/"+key, strings.NewReader(key), status200)
+	}
+	doReqHeader(t, "PUT", "/lc/tagged.txt", strings.NewReader("tagged"),
+		[]string{"X-Amz-Tagging", "temp=yes"}, status200)
+	doReq(t, "POST", "/lc/upload.bin?uploads", nil, status200)
+
+	run := func(b s3intf.Storage, dryRun bool, now time.Time, awaited ...string) {
+		o, err := b.GetOwner(testAccessKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions, err := s3lifecycle.Worker{Storage: b, DryRun: dryRun}.RunBucket(o, "lc", now)
+		if err != nil {
+			t.Fatalf("lifecycle: %s", err)
+		}
+		got := make([]string, len(actions))
+		for i, a := range actions {
+			got[i] = a.Kind + " " + a.Key + " " + a.Rule
+		}
+		if strings.Join(got, ", ") != strings.Join(awaited, ", ") {
+			t.Errorf("lifecycle at %s: got %q, awaited %q", now, got, awaited)
+		}
+	}
+	now := time.Now()
+	for _, b := range backers {
+		run(b, true, now)
+		run(b, true, now.AddDate(0, 0, 2), "Expiration tmp/a.txt tmp",
+			"NoncurrentVersionExpiration ver/obj old", "AbortIncompleteMultipartUpload upload.bin uploads")
+		run(b, false, now.AddDate(0, 0, 3), "Expiration tagged.txt temp", "Expiration tmp/a.txt tmp",
+			"NoncurrentVersionExpiration ver/obj old", "AbortIncompleteMultipartUpload upload.bin uploads")
+		run(b, true, now.AddDate(0, 0, 3))
+	}
+	doReq(t, "GET", "/lc/tmp/a.txt", nil, awsError(404, "NoSuchKey"))
+	doReq(t, "GET", "/lc/keep.txt", nil, status200)
+	doReq(t, "GET", "/lc/ver/obj", nil, status200)
+	doReq(t, "GET", "/lc?uploads", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		if bytes.Contains(r.Body.Bytes(), []byte("<Upload>")) {
+			return fmt.Errorf("the upload is not aborted: %s", r.Body.Bytes())
+		}
+		return nil
+	})
+
+	doReq(t, "DELETE", "/lc?lifecycle", nil, statusCode(204))
+	doReq(t, "GET", "/lc?lifecycle", nil, awsError(404, "NoSuchLifecycleConfiguration"))
+	for _, b := range backers {
+		o, err := b.GetOwner(testAccessKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := b.(s3intf.Versioner)
+		versions, _, _, err := v.ListVersions(o, "lc", "", "", "", "", 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ver := range versions {
+			if err = v.DelVersion(o, "lc", ver.Key, ver.VersionID); err != nil {
+				t.Errorf("deleting %s?versionId=%s: %s", ver.Key, ver.VersionID, err)
+			}
+		}
+	}
+	doReq(t, "DELETE", "/lc", nil, status200)
+}
+
+func Test99Delete(t *testing.T) {
+	keyID := regexp.MustCompile("<Key>[^<]+</Key>")
+	doReq(t, "GET", "/test/", nil, func(r *httptest.ResponseRecorder) error {
+		if err := status200(r); err != nil {
+			return err
+		}
+		for _, key := range keyID.FindAll(r.Body.Bytes(), -1) {
+			key = key[5 : len(key)-6]
+			t.Logf("deleting %s", key)
+		}
+		return nil
+	})
+}
+
+func init() {
+	s3srv.Debug = Debug
+	s3intf.Debug = false
+	creds, err := s3intf.OpenFileCredentials(filepath.Join(os.TempDir(), "s3weed-test-auth.json"))
+	if err != nil {
+		log.Fatalf("cannot open credentials: %s", err)
+	}
+	secret, err := s3intf.HashSecret("testsecret")
+	if err != nil {
+		log.Fatalf("cannot hash secret: %s", err)
+	}
+	for _, u := range []struct{ id, name, accessKey string }{
+		{"test", "Test User", testAccessKey},
+		{"other", "Other User", otherAccessKey},
+	} {
+		if err = creds.PutUser(s3intf.User{ID: u.id, Name: u.name}); err != nil {
+			log.Fatalf("cannot store user: %s", err)
+		}
+		if err = creds.PutCredential(s3intf.Credential{AccessKey: u.accessKey,
+			Secret: secret, UserID: u.id}); err != nil {
+			log.Fatalf("cannot store credential: %s", err)
+		}
+	}
+	dir, err := ioutil.TempDir("", "s3weed-test-")
+	if err != nil {
+		log.Fatalf("cannot create temp dir: %s", err)
+	}
+	backers = append(backers, dirS3.NewDirS3(dir, creds))
+
+	for _, b := range backers {
+		srvc := s3srv.NewService(serviceHost, b)
+		srvc.SetWebsiteHost(websiteHost)
+		handlers = append(handlers, srvc)
+	}
+}
+
+type ResponseChecker func(r *httptest.ResponseRecorder) error
+
+func doReq(t *testing.T, method, path string, body io.Reader, check ResponseChecker) {
+	doReqHeader(t, method, path, body, nil, check)
+}
+
+// doReqHeader is doReq with additional headers (name, value pairs)
+func doReqHeader(t *testing.T, method, path string, body io.Reader, header []string, check ResponseChecker) {
+	doReqAs(t, testAccessKey, method, path, body, header, check)
+}
+
+// doReqAs is doReqHeader, signed with the given access key - unsigned if it is empty
+func doReqAs(t *testing.T, accessKey, method, path string, body io.Reader, header []string,
+	check ResponseChecker) {
+	req, err := http.NewRequest(method, path, body)
+	if err != nil {
+		t.Fatalf("cannot create request: " + err.Error())
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	req.Host = serviceHost
+	//req.URL.Host = req.Host
+	var o s3intf.Owner
+	for i, b := range backers {
+		if accessKey != "" {
+			if o, err = b.GetOwner(accessKey); err != nil {
+				t.Errorf("cannot get owner for %s: %s", accessKey, err)
+				continue
+			}
+			if Debug {
+				log.Printf("===")
+				s3intf.Debug = Debug
+			}
+			bts := s3intf.GetBytesToSign(req, serviceHost)
+			if Debug {
+				log.Printf("bts: %q", bts)
+				log.Printf("---")
+			}
+			t.Logf("owner: %s bts=%q", o, bts)
+			actsign := b64.EncodeToString(o.CalcHash(bts))
+			req.Header.Set("Authorization", "AWS "+accessKey+":"+actsign)
+		}
+
+		rw := httptest.NewRecorder()
+		handlers[i].ServeHTTP(rw, req)
+		if check != nil {
+			if err = check(rw); err != nil {
+				t.Fatalf("bad response for %s %s: %s (body:%q)", method, path,
+					err.Error(), rw.Body.Bytes())
+			}
+		}
+	}
+}
+
+// postForm returns the multipart/form-data body of a POST upload with the fields
+// (name, value pairs) and the file, and its content type
+func postForm(fields []string, filename, content string) (io.Reader, string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for i := 0; i+1 < len(fields); i += 2 {
+		mw.WriteField(fields[i], fields[i+1])
+	}
+	fw, _ := mw.CreateFormFile("file", filename)
+	io.WriteString(fw, content)
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+// presignV4 sets the X-Amz-* query parameters of a presigned URL on the request
+func presignV4(req *http.Request, accessKey string, o s3intf.Owner, date time.Time, expires int) {
+	sig := s3intf.SignatureV4{AccessKey: accessKey, Date: date,
+		ScopeDate: date.Format("20060102"), Region: "us-east-1", Service: "s3",
+		SignedHeaders: []string{"host"}}
+	q := req.URL.Query()
+	q.Set("X-Amz-Algorithm", s3intf.SignV4Algorithm)
+	q.Set("X-Amz-Credential", sig.AccessKey+"/"+sig.Scope())
+	q.Set("X-Amz-Date", date.Format(s3intf.ISO8601Format))
+	q.Set("X-Amz-Expires", strconv.Itoa(expires))
+	q.Set("X-Amz-SignedHeaders", "host")
+	req.URL.RawQuery = q.Encode()
+	sts := s3intf.StringToSignV4(date, sig.Scope(),
+		s3intf.CanonicalRequestV4(req, sig.SignedHeaders, s3intf.UnsignedPayload))
+	q.Set("X-Amz-Signature", hex.EncodeToString(s3intf.HMACSHA256(
+		o.SigningKey(sig.ScopeDate, sig.Region, sig.Service), sts)))
+	req.URL.RawQuery = q.Encode()
+	req.RequestURI = req.URL.RequestURI()
+}
+
+func status200(r *httptest.ResponseRecorder) error {
+	if r.Code != 200 {
+		return fmt.Errorf("bad response code: %d", r.Code)
+	}
+	return nil
+}
+
+func statusCode(code int) ResponseChecker {
+	return func(r *httptest.ResponseRecorder) error {
+		if r.Code != code {
+			return fmt.Errorf("bad response code: %d, awaited %d", r.Code, code)
+		}
+		return nil
+	}
+}
+
+//<?xml version="1.0" encoding="UTF-8"?>
+//<Error>
+//<Code>NoSuchKey</Code>
+//<Message>The resource you requested does not exist</Message>
+//<Resource>/mybucket/myfoto.jpg</Resource>
+//<RequestId>4442587FB7D0A2F9</RequestId>
+//</Error>
+type AWSError struct {
+	Error struct {
+		Code, Message, Resource string
+		RequestID               string `xml:"RequestId"`
+	}
+}
+
+// awsError checks that the response is an AWS error with the given status and code,
+// and the same request ID in the body as in the X-Amz-Request-Id header
+func awsError(status int, code string) ResponseChecker {
+	return func(r *httptest.ResponseRecorder) error {
+		if err := statusCode(status)(r); err != nil {
+			return err
+		}
+		var e AWSError
+		if err := xml.Unmarshal(r.Body.Bytes(), &e.Error); err != nil {
+			return fmt.Errorf("cannot decode error: %s", err)
+		}
+		if e.Error.Code != code {
+			return fmt.Errorf("got code %q, awaited %q", e.Error.Code, code)
+		}
+		if e.Error.RequestID == "" || e.Error.RequestID != r.Header().Get("X-Amz-Request-Id") {
+			return fmt.Errorf("request ID mismatch: %q and header %q", e.Error.RequestID,
+				r.Header().Get("X-Amz-Request-Id"))
+		}
+		return nil
+	}
+}
+
+func TestUserID(t *testing.T) {
+	for i, tc := range []struct {
+		id string
+		ok bool
+	}{
+		{"test", true}, {"a.b", true},
+		{"", false}, {".", false}, {"..", false}, {".hidden", false},
+		{"a/b", false}, {"a..b", false}, {"../root", false},
+	} {
+		if err := checkUserID(tc.id); (err == nil) != tc.ok {
+			t.Errorf("%d. %q: got %v", i, tc.id, err)
+		}
+	}
+}
+
+func TestDefaultDomain(t *testing.T) {
+	defer func(d, h string) { *domains, *hostPort = d, h }(*domains, *hostPort)
+	for i, tc := range [][3]string{
+		{"", "s3.localhost:8080", "s3.localhost"},
+		{"", ":8080", "localhost"},
+		{"s3.example.com", "s3.localhost:8080", "s3.example.com"},
+	} {
+		*domains, *hostPort = tc[0], tc[1]
+		router, err := newRouter()
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if len(router.Domains) != 1 || router.Domains[0] != tc[2] {
+			t.Errorf("%d. got %q, awaited %q", i, router.Domains, tc[2])
+		}
 	}
 }
@@ -0,0 +1,67 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+	"github.com/tgulacsi/s3weed/s3lifecycle"
+)
+
+const lifecycleUsage = `usage:
+	lifecycle run [-at=YYYY-MM-DD]`
+
+// lifecycleCmd runs the lifecycle rules of every bucket as a dry run: it lists
+// what the lifecycle worker of the server would delete (now, or at the -at date)
+func lifecycleCmd(impl s3intf.Storage, creds s3intf.CredentialStore, args []string) error {
+	if len(args) == 0 || args[0] != "run" {
+		return errors.New(lifecycleUsage)
+	}
+	fs := flag.NewFlagSet("lifecycle run", flag.ExitOnError)
+	at := fs.String("at", "", "apply the rules as of this date (default: now)")
+	fs.Parse(args[1:])
+	if fs.NArg() != 0 {
+		return errors.New(lifecycleUsage)
+	}
+	now := time.Now()
+	if *at != "" {
+		var err error
+		if now, err = time.Parse("2006-01-02", *at); err != nil {
+			return fmt.Errorf("bad date %q: %s", *at, err)
+		}
+	}
+	actions, err := s3lifecycle.Worker{Storage: impl, Users: creds, DryRun: true}.Run(now)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "ACTION\tOWNER\tBUCKET\tKEY\tVERSION/UPLOAD\tRULE")
+	for _, a := range actions {
+		id := a.VersionID
+		if a.UploadID != "" {
+			id = a.UploadID
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.Kind, a.Owner, a.Bucket, a.Key, id, a.Rule)
+	}
+	if flushErr := tw.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
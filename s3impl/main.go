@@ -18,6 +18,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -25,21 +26,30 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/tgulacsi/s3weed/s3impl/dirS3"
 	"github.com/tgulacsi/s3weed/s3impl/weedS3"
 	"github.com/tgulacsi/s3weed/s3impl/weedS3/weedutils"
 	"github.com/tgulacsi/s3weed/s3intf"
+	"github.com/tgulacsi/s3weed/s3lifecycle"
 	"github.com/tgulacsi/s3weed/s3srv"
 
 	"github.com/cznic/kv"
 )
 
 var (
-	dir      = flag.String("dir", "", "use dirS3 with the given dir as base (i.e. -dir=/tmp)")
-	weed     = flag.String("weed", "", "use weedS3 with the given master url (i.e. -weed=localhost:9333)")
-	weedDb   = flag.String("db", "", "weedS3's db dir")
-	hostPort = flag.String("http", ":8080", "host:port to listen on")
+	dir       = flag.String("dir", "", "use dirS3 with the given dir as base (i.e. -dir=/tmp)")
+	weed      = flag.String("weed", "", "use weedS3 with the given master url (i.e. -weed=localhost:9333)")
+	weedDb    = flag.String("db", "", "weedS3's db dir")
+	hostPort  = flag.String("http", ":8080", "host:port to listen on")
+	authFile  = flag.String("auth", "", "credentials file (default: auth.json under -dir, auth.kv under -db)")
+	website   = flag.String("website", "", "host of the website endpoint (i.e. -website=s3-website.example.com)")
+	domains   = flag.String("domains", "", "comma separated base domains of the service (i.e. -domains=s3.example.com,s3.local; default: the host of -http, or localhost)")
+	cnames    = flag.String("cnames", "", "comma separated custom domain=bucket mappings (i.e. -cnames=static.example.com=static)")
+	pathStyle = flag.Bool("path-style", false, "serve path-style requests only, no virtual-host buckets")
+	lifecycle = flag.Duration("lifecycle", time.Hour, "interval of applying the buckets' lifecycle rules (0 disables it)")
 )
 
 func main() {
@@ -57,27 +67,128 @@ func main() {
 			log.Fatalf("error dumping %s: %s", *weedDb, err)
 		}
 
+	case "user", "key":
+		creds, err := openCredentials()
+		if err != nil {
+			log.Fatalf("cannot open credentials: %s", err)
+		}
+		if cmd == "user" {
+			err = userCmd(creds, flag.Args()[1:])
+		} else {
+			err = keyCmd(creds, flag.Args()[1:])
+		}
+		if err != nil {
+			log.Fatalf("%s: %s", cmd, err)
+		}
+
+	case "lifecycle":
+		creds, err := openCredentials()
+		if err != nil {
+			log.Fatalf("cannot open credentials: %s", err)
+		}
+		impl, err := openStorage(creds)
+		if err != nil {
+			log.Fatalf("cannot open storage: %s", err)
+		}
+		if err = lifecycleCmd(impl, creds, flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %s", cmd, err)
+		}
+
 	default: //server
 		s3srv.Debug = true
 		s3intf.Debug = true
-		var (
-			impl s3intf.Storage
-			err  error
-		)
-		if *dir != "" {
-			impl = dirS3.NewDirS3(*dir)
-		} else if *weed != "" && *weedDb != "" {
-			if impl, err = weedS3.NewWeedS3(*weed, *weedDb); err != nil {
-				log.Fatalf("cannot create WeedS3(%s, %s): %s", *weed, *weedDb, err)
-			}
-		} else {
-			log.Fatalf("dir OR weed AND db is required!")
+		creds, err := openCredentials()
+		if err != nil {
+			log.Fatalf("cannot open credentials: %s", err)
+		}
+		impl, err := openStorage(creds)
+		if err != nil {
+			log.Fatalf("cannot open storage: %s", err)
+		}
+		if *lifecycle > 0 {
+			go s3lifecycle.Worker{Storage: impl, Users: creds}.Start(*lifecycle, nil)
+		}
+		router, err := newRouter()
+		if err != nil {
+			log.Fatalf("bad routing: %s", err)
+		}
+		srvc := s3srv.NewService(router.Domains[0], impl)
+		srvc.SetRouter(router)
+		if *website != "" {
+			srvc.SetWebsiteHost(*website)
 		}
-		srvc := s3srv.NewService(*hostPort, impl)
 		log.Fatal(http.ListenAndServe(*hostPort, srvc))
 	}
 }
 
+// openStorage opens the dirS3 (-dir) or weedS3 (-weed and -db) Storage
+func openStorage(creds s3intf.CredentialStore) (s3intf.Storage, error) {
+	switch {
+	case *dir != "":
+		return dirS3.NewDirS3(*dir, creds), nil
+	case *weed != "" && *weedDb != "":
+		impl, err := weedS3.NewWeedS3(*weed, *weedDb, creds)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create WeedS3(%s, %s): %s", *weed, *weedDb, err)
+		}
+		return impl, nil
+	}
+	return nil, errors.New("dir OR weed AND db is required")
+}
+
+// newRouter returns the routing of the -domains, -cnames and -path-style flags
+func newRouter() (s3intf.Router, error) {
+	router := s3intf.Router{PathStyleOnly: *pathStyle}
+	list := *domains
+	if list == "" {
+		if list = s3intf.StripPort(*hostPort); list == "" {
+			list = "localhost"
+		}
+	}
+	for _, d := range strings.Split(list, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			router.Domains = append(router.Domains, d)
+		}
+	}
+	if len(router.Domains) == 0 {
+		return router, errors.New("at least one domain is required")
+	}
+	for _, c := range strings.Split(*cnames, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			continue
+		}
+		i := strings.Index(c, "=")
+		if i <= 0 || i == len(c)-1 {
+			return router, fmt.Errorf("bad cname %q, awaited domain=bucket", c)
+		}
+		if router.CNAMEs == nil {
+			router.CNAMEs = make(map[string]string)
+		}
+		router.CNAMEs[c[:i]] = c[i+1:]
+	}
+	return router, nil
+}
+
+// openCredentials opens the -auth file, or the default one of the -dir or -db:
+// a .kv file is opened as a weedS3.Credentials, anything else as s3intf.FileCredentials.
+func openCredentials() (s3intf.CredentialStore, error) {
+	fn := *authFile
+	if fn == "" {
+		switch {
+		case *dir != "":
+			fn = filepath.Join(*dir, "auth.json")
+		case *weedDb != "":
+			fn = filepath.Join(*weedDb, "auth.kv")
+		default:
+			return nil, errors.New("-auth, -dir or -db is required")
+		}
+	}
+	if strings.HasSuffix(fn, ".kv") {
+		return weedS3.OpenCredentials(fn)
+	}
+	return s3intf.OpenFileCredentials(fn)
+}
+
 func dumpAll(dbdir string) (err error) {
 	dirs := make(chan string)
 	go func() {
@@ -128,7 +239,7 @@ func dumpBuckets(w io.Writer, dbs <-chan *kv.DB) (err error) {
 	for db := range dbs {
 		//log.Printf("calling dumpBucket(%s, %s)", w, db)
 		if err = dumpBucket(w, db); err != nil {
-			log.Printf("error dumping %s: %s", db, err)
+			log.Printf("error dumping %s: %s", db.Name(), err)
 			db.Close()
 			return
 		}
@@ -0,0 +1,186 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+const userUsage = `usage:
+	user add [-name=display name] <id>
+	user list
+	user disable <id>
+	user enable <id>
+	user delete <id>`
+
+const keyUsage = `usage:
+	key create <user id>
+	key rotate [-revoke] <access key>
+	key revoke <access key>`
+
+// userCmd manages the users in the credential store
+func userCmd(creds s3intf.CredentialStore, args []string) error {
+	if len(args) == 0 {
+		return errors.New(userUsage)
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	name := fs.String("name", "", "display name (default: the id)")
+	fs.Parse(args[1:])
+	if args[0] == "list" {
+		return listUsers(creds)
+	}
+	if fs.NArg() != 1 {
+		return errors.New(userUsage)
+	}
+	id := fs.Arg(0)
+
+	switch args[0] {
+	case "add":
+		if err := checkUserID(id); err != nil {
+			return err
+		}
+		if *name == "" {
+			*name = id
+		}
+		if _, err := getUser(creds, id); err == nil {
+			return errors.New("user " + id + " already exists")
+		}
+		return creds.PutUser(s3intf.User{ID: id, Name: *name, Created: time.Now()})
+	case "disable", "enable":
+		u, err := getUser(creds, id)
+		if err != nil {
+			return err
+		}
+		u.Disabled = args[0] == "disable"
+		return creds.PutUser(u)
+	case "delete":
+		return creds.DelUser(id)
+	}
+	return errors.New(userUsage)
+}
+
+// keyCmd manages the access keys in the credential store
+func keyCmd(creds s3intf.CredentialStore, args []string) error {
+	if len(args) == 0 {
+		return errors.New(keyUsage)
+	}
+	fs := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	revoke := fs.Bool("revoke", false, "revoke the old key immediately")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		return errors.New(keyUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		u, err := getUser(creds, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		return createKey(creds, u.ID)
+	case "rotate":
+		// The old key remains usable till it is revoked, so the clients can
+		// be switched to the new key without downtime.
+		old, _, err := creds.GetCredential(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("cannot get key %s: %s", fs.Arg(0), err)
+		}
+		if err = createKey(creds, old.UserID); err != nil {
+			return err
+		}
+		if *revoke {
+			return creds.DelCredential(old.AccessKey)
+		}
+		fmt.Printf("revoke the old key with\n\tkey revoke %s\n", old.AccessKey)
+		return nil
+	case "revoke":
+		return creds.DelCredential(fs.Arg(0))
+	}
+	return errors.New(keyUsage)
+}
+
+// checkUserID checks that the id is usable as a path element,
+// as the backends store the users' buckets under it
+func checkUserID(id string) error {
+	if id == "" || strings.HasPrefix(id, ".") || strings.Contains(id, "/") || strings.Contains(id, "..") {
+		return errors.New("bad user id " + id + ": must not start with '.' or contain '/' or '..'")
+	}
+	return nil
+}
+
+// getUser returns the user with the given id
+func getUser(creds s3intf.CredentialStore, id string) (s3intf.User, error) {
+	users, err := creds.ListUsers()
+	if err != nil {
+		return s3intf.User{}, err
+	}
+	for _, u := range users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return s3intf.User{}, errors.New("unknown user " + id)
+}
+
+// createKey creates a new credential for the user, and prints the keys
+func createKey(creds s3intf.CredentialStore, userID string) error {
+	cred, secret, err := s3intf.NewCredential(userID)
+	if err != nil {
+		return err
+	}
+	if err = creds.PutCredential(cred); err != nil {
+		return err
+	}
+	fmt.Printf("access key: %s\nsecret key: %s\n", cred.AccessKey, secret)
+	return nil
+}
+
+// listUsers prints the users with their access keys
+func listUsers(creds s3intf.CredentialStore) error {
+	users, err := creds.ListUsers()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tCREATED\tACCESS KEYS")
+	for _, u := range users {
+		keys, err := creds.ListCredentials(u.ID)
+		if err != nil {
+			return err
+		}
+		status := "active"
+		if u.Disabled {
+			status = "disabled"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t", u.ID, u.Name, status, u.Created.Format(time.RFC3339))
+		for i, k := range keys {
+			if i > 0 {
+				fmt.Fprint(tw, ",")
+			}
+			fmt.Fprint(tw, k.AccessKey)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"encoding/json"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The ACL of a bucket is its "acl" record in the config db, the ACL of an
+// object is in its ValInfo, so it is reset when the object is replaced.
+
+// BucketOwner returns the ID of the owner of the bucket
+func (m *master) BucketOwner(bucket string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	for id, o := range m.owners {
+		o.Lock()
+		_, ok := o.buckets[bucket]
+		o.Unlock()
+		if ok {
+			return id, nil
+		}
+	}
+	return "", s3intf.NoSuchBucket
+}
+
+// GetACL returns the ACL of the bucket or the object
+func (m *master) GetACL(owner s3intf.Owner, bucket, object string) (s3intf.ACL, error) {
+	acl := s3intf.PrivateACL(owner.ID())
+	var val []byte
+	if object == "" {
+		if _, err := m.getBucket(owner, bucket); err != nil {
+			return acl, s3intf.NoSuchBucket
+		}
+		var err error
+		if val, err = m.config.Get(nil, configKey(owner, bucket, "acl")); err != nil {
+			return acl, err
+		}
+	} else {
+		vi, _, err := m.valInfo(owner, bucket, object)
+		if err != nil {
+			return acl, err
+		}
+		val = vi.ACL
+	}
+	if len(val) == 0 {
+		return acl, nil
+	}
+	err := json.Unmarshal(val, &acl)
+	return acl, err
+}
+
+// SetACL sets the ACL of the bucket or the object
+func (m *master) SetACL(owner s3intf.Owner, bucket, object string, acl s3intf.ACL) error {
+	val, err := json.Marshal(acl)
+	if err != nil {
+		return err
+	}
+	b, err := m.getBucket(owner, bucket)
+	if err != nil {
+		return s3intf.NoSuchBucket
+	}
+	if object == "" {
+		return m.config.Set(configKey(owner, bucket, "acl"), val)
+	}
+	vi, _, err := m.valInfo(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	vi.ACL = val
+	if val, err = vi.Encode(nil); err != nil {
+		return err
+	}
+	return b.db.Set([]byte(object), val)
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cznic/kv"
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// key prefixes in the credentials db
+const (
+	userPrefix = "u/"
+	credPrefix = "k/"
+)
+
+// Credentials is an s3intf.CredentialStore stored in a kv database
+// (basedir/auth.kv), with "u/"+ID keys for the users and "k/"+AccessKey
+// keys for the credentials, gob encoded.
+//
+// The db is opened only for the time of reading or changing it, so it can
+// be changed while the server is running; the server rereads it on change.
+type Credentials struct {
+	filename string
+	modTime  time.Time
+	size     int64
+	users    map[string]s3intf.User
+	creds    map[string]s3intf.Credential
+	sync.Mutex
+}
+
+// OpenCredentials returns the Credentials stored in the given kv file,
+// which is created on the first change if not exists.
+func OpenCredentials(filename string) (*Credentials, error) {
+	c := &Credentials{filename: filename}
+	c.Lock()
+	defer c.Unlock()
+	return c, c.load()
+}
+
+// load rereads the db if it has changed
+func (c *Credentials) load() error {
+	fi, err := os.Stat(c.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if c.users == nil {
+				c.users = make(map[string]s3intf.User)
+				c.creds = make(map[string]s3intf.Credential)
+			}
+			return nil
+		}
+		return err
+	}
+	if c.users != nil && fi.ModTime().Equal(c.modTime) && fi.Size() == c.size {
+		return nil
+	}
+	db, err := kv.Open(c.filename, kvOptions())
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", c.filename, err)
+	}
+	defer db.Close()
+	users := make(map[string]s3intf.User)
+	creds := make(map[string]s3intf.Credential)
+	enum, err := db.SeekFirst()
+	if err != nil {
+		if err != io.EOF {
+			return err
+		}
+	} else {
+		var k, v []byte
+		for {
+			if k, v, err = enum.Next(); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			switch {
+			case bytes.HasPrefix(k, []byte(userPrefix)):
+				var u s3intf.User
+				if err = gob.NewDecoder(bytes.NewReader(v)).Decode(&u); err != nil {
+					return fmt.Errorf("error decoding %q: %s", k, err)
+				}
+				users[u.ID] = u
+			case bytes.HasPrefix(k, []byte(credPrefix)):
+				var cr s3intf.Credential
+				if err = gob.NewDecoder(bytes.NewReader(v)).Decode(&cr); err != nil {
+					return fmt.Errorf("error decoding %q: %s", k, err)
+				}
+				creds[cr.AccessKey] = cr
+			}
+		}
+	}
+	c.users, c.creds = users, creds
+	c.modTime, c.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// update opens the db (creating it if not exists, readable by the owner only),
+// and calls todo in a transaction
+func (c *Credentials) update(todo func(db *kv.DB) error) error {
+	var (
+		db  *kv.DB
+		err error
+	)
+	if _, err = os.Stat(c.filename); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(c.filename), 0750); err != nil {
+			return err
+		}
+		db, err = kv.Create(c.filename, kvOptions())
+	} else {
+		db, err = kv.Open(c.filename, kvOptions())
+	}
+	if err != nil {
+		return fmt.Errorf("error opening %s: %s", c.filename, err)
+	}
+	// the stored secrets are as sensitive as the secret keys
+	if err = os.Chmod(c.filename, 0600); err != nil {
+		db.Close()
+		return err
+	}
+	if err = db.BeginTransaction(); err == nil {
+		if err = todo(db); err != nil {
+			db.Rollback()
+		} else {
+			err = db.Commit()
+		}
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// force reread
+	c.users = nil
+	return c.load()
+}
+
+// set stores the gob encoded value under the key in the db
+func set(db *kv.DB, key string, value interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		return err
+	}
+	return db.Set([]byte(key), buf.Bytes())
+}
+
+// GetCredential implements s3intf.CredentialProvider.GetCredential
+func (c *Credentials) GetCredential(accessKey string) (s3intf.Credential, s3intf.User, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(); err != nil {
+		return s3intf.Credential{}, s3intf.User{}, err
+	}
+	cr, ok := c.creds[accessKey]
+	if !ok {
+		return s3intf.Credential{}, s3intf.User{}, s3intf.NotFound
+	}
+	u, ok := c.users[cr.UserID]
+	if !ok {
+		return s3intf.Credential{}, s3intf.User{}, s3intf.NotFound
+	}
+	return cr, u, nil
+}
+
+// PutUser stores the user
+func (c *Credentials) PutUser(u s3intf.User) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.update(func(db *kv.DB) error {
+		return set(db, userPrefix+u.ID, u)
+	})
+}
+
+// PutCredential stores the credential
+func (c *Credentials) PutCredential(cr s3intf.Credential) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if _, ok := c.users[cr.UserID]; !ok {
+		return errors.New("unknown user " + cr.UserID)
+	}
+	return c.update(func(db *kv.DB) error {
+		return set(db, credPrefix+cr.AccessKey, cr)
+	})
+}
+
+// DelUser deletes the user and its credentials
+func (c *Credentials) DelUser(id string) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if _, ok := c.users[id]; !ok {
+		return s3intf.NotFound
+	}
+	return c.update(func(db *kv.DB) error {
+		for k, cr := range c.creds {
+			if cr.UserID == id {
+				if err := db.Delete([]byte(credPrefix + k)); err != nil {
+					return err
+				}
+			}
+		}
+		return db.Delete([]byte(userPrefix + id))
+	})
+}
+
+// ListUsers returns the users, ordered by ID
+func (c *Credentials) ListUsers() ([]s3intf.User, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	users := make([]s3intf.User, 0, len(c.users))
+	for _, u := range c.users {
+		users = append(users, u)
+	}
+	s3intf.SortUsers(users)
+	return users, nil
+}
+
+// DelCredential deletes the credential
+func (c *Credentials) DelCredential(accessKey string) error {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(); err != nil {
+		return err
+	}
+	if _, ok := c.creds[accessKey]; !ok {
+		return s3intf.NotFound
+	}
+	return c.update(func(db *kv.DB) error {
+		return db.Delete([]byte(credPrefix + accessKey))
+	})
+}
+
+// ListCredentials returns the credentials of the user, ordered by creation time
+func (c *Credentials) ListCredentials(userID string) ([]s3intf.Credential, error) {
+	c.Lock()
+	defer c.Unlock()
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	creds := make([]s3intf.Credential, 0, 2)
+	for _, cr := range c.creds {
+		if cr.UserID == userID {
+			creds = append(creds, cr)
+		}
+	}
+	s3intf.SortCredentials(creds)
+	return creds, nil
+}
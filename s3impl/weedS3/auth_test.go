@@ -0,0 +1,49 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+func TestCredentialsMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weedS3-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "auth.kv")
+	c, err := OpenCredentials(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.PutUser(s3intf.User{ID: "test", Name: "Test"}); err != nil {
+		t.Fatalf("PutUser: %s", err)
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("%s has mode %o, awaited 0600", fn, mode)
+	}
+}
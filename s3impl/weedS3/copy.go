@@ -0,0 +1,179 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3impl/weedS3/weedutils"
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The refs db contains the fid => number of additional references records
+// (as kv.DB.Inc stores them): a fid without record is used by one object only.
+// A copy references the same fids as its source, so a fid is deleted from
+// Weed-FS only when its last referencing object is deleted.
+
+// fids returns the fids the object's content is stored in
+func fids(vi *weedutils.ValInfo) []string {
+	if len(vi.Parts) == 0 {
+		return []string{vi.Fid}
+	}
+	fids := make([]string, len(vi.Parts))
+	for i, p := range vi.Parts {
+		fids[i] = p.Fid
+	}
+	return fids
+}
+
+// retain adds a reference to each fid
+func (m *master) retain(fids []string) error {
+	m.refsLock.Lock()
+	defer m.refsLock.Unlock()
+	for _, fid := range fids {
+		if _, err := m.refs.Inc([]byte(fid), 1); err != nil {
+			return fmt.Errorf("error incrementing the references of %s: %s", fid, err)
+		}
+	}
+	return nil
+}
+
+// release removes a reference from each fid, deleting the unreferenced ones
+func (m *master) release(fids []string) error {
+	unused, err := m.unref(fids)
+	if err != nil {
+		return err
+	}
+	return m.deleteFids(unused)
+}
+
+// unref removes a reference from each fid, and returns the unreferenced ones
+func (m *master) unref(fids []string) ([]string, error) {
+	m.refsLock.Lock()
+	defer m.refsLock.Unlock()
+	unused := make([]string, 0, len(fids))
+	for _, fid := range fids {
+		val, err := m.refs.Get(nil, []byte(fid))
+		if err != nil {
+			return unused, fmt.Errorf("error getting the references of %s: %s", fid, err)
+		}
+		if val == nil {
+			unused = append(unused, fid)
+			continue
+		}
+		n, err := m.refs.Inc([]byte(fid), -1)
+		if err != nil {
+			return unused, fmt.Errorf("error decrementing the references of %s: %s", fid, err)
+		}
+		if n <= 0 {
+			if err = m.refs.Delete([]byte(fid)); err != nil {
+				return unused, err
+			}
+		}
+	}
+	return unused, nil
+}
+
+// deleteConcurrency is the number of concurrent deletes sent to Weed-FS
+const deleteConcurrency = 8
+
+// deleteFids deletes the fids from Weed-FS, concurrently, returning the first error
+func (m *master) deleteFids(fids []string) error {
+	if len(fids) == 1 {
+		return m.wm.Delete(fids[0])
+	}
+	var (
+		wg    sync.WaitGroup
+		errMu sync.Mutex
+		err   error
+	)
+	ch := make(chan string)
+	for i := 0; i < deleteConcurrency && i < len(fids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for fid := range ch {
+				if e := m.wm.Delete(fid); e != nil {
+					errMu.Lock()
+					if err == nil {
+						err = fmt.Errorf("error deleting %s: %s", fid, e)
+					}
+					errMu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, fid := range fids {
+		ch <- fid
+	}
+	close(ch)
+	wg.Wait()
+	return err
+}
+
+// Copy copies the object by storing the source's ValInfo under the destination
+// key, referencing the same fids - the content is not copied.
+func (m *master) Copy(owner s3intf.Owner, srcBucket, srcObject, srcVersionID, dstBucket, dstObject,
+	filename, media string, meta s3intf.Metadata) (s3intf.Object, error) {
+
+	vi, obj, err := m.versionValInfo(owner, srcBucket, srcObject, srcVersionID)
+	if err != nil {
+		return obj, err
+	}
+	b, err := m.getBucket(owner, dstBucket)
+	if err != nil {
+		return obj, err
+	}
+	if filename != "" {
+		vi.Filename = filename
+	}
+	if media != "" {
+		vi.ContentType = media
+	}
+	if meta != nil {
+		vi.Meta = meta
+	}
+	vi.Created = time.Now()
+	if vi.VersionID, err = m.newVersionID(owner, dstBucket); err != nil {
+		return obj, err
+	}
+	val, err := vi.Encode(nil)
+	if err != nil {
+		return obj, fmt.Errorf("error serializing %v: %s", vi, err)
+	}
+	if err = m.retain(fids(vi)); err != nil {
+		return obj, err
+	}
+	old, err := b.db.Get(nil, []byte(dstObject))
+	if err == nil {
+		err = b.db.Set([]byte(dstObject), val)
+	}
+	if err != nil {
+		m.release(fids(vi))
+		return obj, fmt.Errorf("error storing %s: %s", dstObject, err)
+	}
+	if vi.VersionID != "" { // the old version is kept
+		err = m.addVersion(owner, dstBucket, dstObject, vi)
+	} else if err = m.releaseReplaced(old); err != nil {
+		return obj, err
+	}
+	obj.Key, obj.LastModified, obj.VersionID = dstObject, vi.Created, vi.VersionID
+	obj.Filename, obj.ContentType, obj.Metadata = vi.Filename, vi.ContentType, vi.Meta
+	return obj, err
+}
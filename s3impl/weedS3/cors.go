@@ -0,0 +1,55 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"encoding/json"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// GetCORS returns the CORS rules of the bucket: its "cors" record in the config db, as JSON
+func (m *master) GetCORS(owner s3intf.Owner, bucket string) ([]s3intf.CORSRule, error) {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return nil, s3intf.NoSuchBucket
+	}
+	val, err := m.config.Get(nil, configKey(owner, bucket, "cors"))
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, s3intf.NoSuchCORSConfiguration
+	}
+	var rules []s3intf.CORSRule
+	err = json.Unmarshal(val, &rules)
+	return rules, err
+}
+
+// SetCORS sets (or deletes, if empty) the CORS rules of the bucket
+func (m *master) SetCORS(owner s3intf.Owner, bucket string, rules []s3intf.CORSRule) error {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return s3intf.NoSuchBucket
+	}
+	if len(rules) == 0 {
+		return m.config.Delete(configKey(owner, bucket, "cors"))
+	}
+	val, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return m.config.Set(configKey(owner, bucket, "cors"), val)
+}
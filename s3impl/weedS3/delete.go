@@ -0,0 +1,88 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/tgulacsi/s3weed/s3impl/weedS3/weedutils"
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// DelMulti deletes the objects from the bucket's db in one transaction,
+// then deletes their unreferenced fids from Weed-FS.
+// As the objects are already deleted then, the errors of the Weed-FS deletes
+// are only logged.
+// In a versioned bucket, a delete marker is added for each object (see Del).
+func (m *master) DelMulti(owner s3intf.Owner, bucket string, objects []string) (
+	errs []error, err error) {
+
+	b, err := m.getBucket(owner, bucket)
+	if err != nil {
+		return nil, err
+	}
+	errs = make([]error, len(objects))
+	if state, err := m.Versioning(owner, bucket); err != nil {
+		return nil, err
+	} else if state != "" { // delete markers are added, nothing is deleted
+		for i, object := range objects {
+			errs[i] = m.Del(owner, bucket, object)
+		}
+		return errs, nil
+	}
+	if err = b.db.BeginTransaction(); err != nil {
+		return nil, fmt.Errorf("cannot start transaction: %s", err)
+	}
+	var (
+		all []string
+		val []byte
+	)
+	for i, object := range objects {
+		if val, err = b.db.Extract(nil, []byte(object)); err != nil {
+			b.db.Rollback()
+			return nil, fmt.Errorf("cannot get %s object: %s", object, err)
+		}
+		if val == nil {
+			errs[i] = s3intf.NotFound
+			continue
+		}
+		vi := new(weedutils.ValInfo)
+		if errs[i] = vi.Decode(val); errs[i] != nil {
+			errs[i] = fmt.Errorf("error deserializing %s: %s", val, errs[i])
+			// keep it
+			if err = b.db.Set([]byte(object), val); err != nil {
+				b.db.Rollback()
+				return nil, err
+			}
+			continue
+		}
+		all = append(all, fids(vi)...)
+	}
+	if err = b.db.Commit(); err != nil {
+		return nil, err
+	}
+
+	unused, err := m.unref(all)
+	if err == nil {
+		err = m.deleteFids(unused)
+	}
+	if err != nil {
+		log.Printf("error deleting the fids of %s objects: %s", bucket, err)
+	}
+	return errs, nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"encoding/json"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// GetLifecycle returns the lifecycle rules of the bucket: its "lifecycle" record
+// in the config db, as JSON
+func (m *master) GetLifecycle(owner s3intf.Owner, bucket string) ([]s3intf.LifecycleRule, error) {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return nil, s3intf.NoSuchBucket
+	}
+	val, err := m.config.Get(nil, configKey(owner, bucket, "lifecycle"))
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, s3intf.NoSuchLifecycleConfiguration
+	}
+	var rules []s3intf.LifecycleRule
+	err = json.Unmarshal(val, &rules)
+	return rules, err
+}
+
+// SetLifecycle sets (or deletes, if empty) the lifecycle rules of the bucket
+func (m *master) SetLifecycle(owner s3intf.Owner, bucket string, rules []s3intf.LifecycleRule) error {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return s3intf.NoSuchBucket
+	}
+	if len(rules) == 0 {
+		return m.config.Delete(configKey(owner, bucket, "lifecycle"))
+	}
+	val, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return m.config.Set(configKey(owner, bucket, "lifecycle"), val)
+}
@@ -0,0 +1,413 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cznic/kv"
+	"github.com/tgulacsi/s3weed/s3impl/weedS3/weedutils"
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The uploads db contains the uploadID => uploadInfo
+// and the uploadID/00001 => partInfo records, gob encoded.
+// Each part is stored in its own fid, and the completed object consists of
+// these fids (see weedutils.ValInfo.Parts).
+
+type uploadInfo struct {
+	Owner, Bucket, Object    string
+	Filename, Media          string
+	Initiated                time.Time
+	Initiator, InitiatorName string
+	Meta                     map[string]string
+	ACL                      *s3intf.ACL
+}
+
+type partInfo struct {
+	Fid     string
+	Size    int64
+	MD5     []byte
+	Created time.Time
+}
+
+func openDB(filename string) (*kv.DB, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return kv.Create(filename, kvOptions())
+	}
+	db, err := kv.Open(filename, kvOptions())
+	if err != nil {
+		return nil, fmt.Errorf("error opening db %s: %s", filename, err)
+	}
+	return db, nil
+}
+
+func partKey(uploadID string, partNumber int) []byte {
+	return []byte(fmt.Sprintf("%s/%05d", uploadID, partNumber))
+}
+
+func gobDecode(val []byte, dst interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(val)).Decode(dst)
+}
+
+func gobEncode(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(val)
+	return buf.Bytes(), err
+}
+
+// getBucket returns the owner's bucket
+func (m *master) getBucket(owner s3intf.Owner, bucket string) (wBucket, error) {
+	m.Lock()
+	o, ok := m.owners[owner.ID()]
+	m.Unlock()
+	if !ok {
+		return wBucket{}, s3intf.NotFound
+	}
+	o.Lock()
+	b, ok := o.buckets[bucket]
+	o.Unlock()
+	if !ok {
+		return wBucket{}, s3intf.NotFound
+	}
+	return b, nil
+}
+
+// getUpload returns the upload's info, checking that it belongs to the object.
+// Must be called with uploadsLock held.
+func (m *master) getUpload(owner s3intf.Owner, bucket, object, uploadID string) (uploadInfo, error) {
+	var info uploadInfo
+	if uploadID == "" || strings.IndexByte(uploadID, '/') >= 0 {
+		return info, s3intf.NoSuchUpload
+	}
+	val, err := m.uploads.Get(nil, []byte(uploadID))
+	if err != nil {
+		return info, err
+	}
+	if val == nil {
+		return info, s3intf.NoSuchUpload
+	}
+	if err = gobDecode(val, &info); err != nil {
+		return info, fmt.Errorf("error decoding upload %s: %s", uploadID, err)
+	}
+	if info.Owner != owner.ID() || info.Bucket != bucket || info.Object != object {
+		return info, s3intf.NoSuchUpload
+	}
+	return info, nil
+}
+
+// listParts returns the parts of the upload, ordered by number.
+// Must be called with uploadsLock held.
+func (m *master) listParts(uploadID string) ([]s3intf.Part, []partInfo, error) {
+	prefix := []byte(uploadID + "/")
+	enum, _, err := m.uploads.Seek(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		parts []s3intf.Part
+		infos []partInfo
+		k, v  []byte
+	)
+	for {
+		if k, v, err = enum.Next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		number, err := strconv.Atoi(string(k[len(prefix):]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad part key %q", k)
+		}
+		var pi partInfo
+		if err = gobDecode(v, &pi); err != nil {
+			return nil, nil, fmt.Errorf("error decoding %q: %s", k, err)
+		}
+		parts = append(parts, s3intf.Part{Number: number, ETag: hex.EncodeToString(pi.MD5),
+			Size: pi.Size, LastModified: pi.Created})
+		infos = append(infos, pi)
+	}
+	return parts, infos, nil
+}
+
+// delUpload deletes the upload's records, and returns the parts' infos.
+// Must be called with uploadsLock held.
+func (m *master) delUpload(uploadID string) (infos []partInfo, err error) {
+	if err = m.uploads.BeginTransaction(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			m.uploads.Rollback()
+		}
+	}()
+	parts, infos, err := m.listParts(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		if err = m.uploads.Delete(partKey(uploadID, p.Number)); err != nil {
+			return nil, err
+		}
+	}
+	if err = m.uploads.Delete([]byte(uploadID)); err != nil {
+		return nil, err
+	}
+	return infos, m.uploads.Commit()
+}
+
+// InitMultipart initiates a multipart upload, and returns its ID
+func (m *master) InitMultipart(owner, initiator s3intf.Owner, bucket, object, filename, media string,
+	meta s3intf.Metadata, acl *s3intf.ACL) (string, error) {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return "", err
+	}
+	uploadID, err := s3intf.NewUploadID()
+	if err != nil {
+		return "", err
+	}
+	val, err := gobEncode(uploadInfo{Owner: owner.ID(), Bucket: bucket, Object: object,
+		Filename: filename, Media: media, Meta: meta, ACL: acl, Initiated: time.Now(),
+		Initiator: initiator.ID(), InitiatorName: initiator.Name()})
+	if err != nil {
+		return "", err
+	}
+	m.uploadsLock.Lock()
+	defer m.uploadsLock.Unlock()
+	return uploadID, m.uploads.Set([]byte(uploadID), val)
+}
+
+// PutPart uploads the part into a new fid
+func (m *master) PutPart(owner s3intf.Owner, bucket, object, uploadID string, partNumber int,
+	body io.Reader, size int64, md5hash []byte) error {
+	m.uploadsLock.Lock()
+	info, err := m.getUpload(owner, bucket, object, uploadID)
+	m.uploadsLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fid, publicURL, err := m.wm.AssignFid()
+	if err != nil {
+		return fmt.Errorf("error getting fid: %s", err)
+	}
+	var hsh hash.Hash
+	if md5hash == nil {
+		hsh = md5.New()
+		body = io.TeeReader(body, hsh)
+	}
+	if _, err = m.wm.UploadAssigned(fid, publicURL, info.Filename, info.Media, body); err != nil {
+		return fmt.Errorf("error uploading to %s: %s", fid, err)
+	}
+	if hsh != nil {
+		md5hash = hsh.Sum(nil)
+	}
+	val, err := gobEncode(partInfo{Fid: fid, Size: size, MD5: md5hash, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	m.uploadsLock.Lock()
+	defer m.uploadsLock.Unlock()
+	// the upload may be completed or aborted in the meantime
+	if _, err = m.getUpload(owner, bucket, object, uploadID); err != nil {
+		m.wm.Delete(fid)
+		return err
+	}
+	old, err := m.uploads.Get(nil, partKey(uploadID, partNumber))
+	if err != nil {
+		return err
+	}
+	if err = m.uploads.Set(partKey(uploadID, partNumber), val); err != nil {
+		return err
+	}
+	if old != nil {
+		var pi partInfo
+		if err = gobDecode(old, &pi); err == nil {
+			m.wm.Delete(pi.Fid)
+		}
+	}
+	return nil
+}
+
+// CompleteMultipart stores the object as the list of the parts' fids
+func (m *master) CompleteMultipart(owner s3intf.Owner, bucket, object, uploadID string,
+	parts []s3intf.Part) (string, string, error) {
+	b, err := m.getBucket(owner, bucket)
+	if err != nil {
+		return "", "", err
+	}
+	m.uploadsLock.Lock()
+	defer m.uploadsLock.Unlock()
+	info, err := m.getUpload(owner, bucket, object, uploadID)
+	if err != nil {
+		return "", "", err
+	}
+	uploaded, infos, err := m.listParts(uploadID)
+	if err != nil {
+		return "", "", err
+	}
+	if parts, err = s3intf.CompleteParts(uploaded, parts); err != nil {
+		return "", "", err
+	}
+	byNumber := make(map[int]partInfo, len(infos))
+	for i, p := range uploaded {
+		byNumber[p.Number] = infos[i]
+	}
+	versionID, err := m.newVersionID(owner, bucket)
+	if err != nil {
+		return "", "", err
+	}
+	vi := weedutils.ValInfo{Filename: info.Filename, ContentType: info.Media,
+		Created: time.Now(), Parts: make([]weedutils.Part, len(parts)),
+		ETag: s3intf.MultipartETag(parts), VersionID: versionID, Meta: info.Meta}
+	used := make(map[string]bool, len(parts))
+	for i, p := range parts {
+		pi := byNumber[p.Number]
+		vi.Parts[i] = weedutils.Part{Fid: pi.Fid, Size: pi.Size}
+		vi.Size += pi.Size
+		used[pi.Fid] = true
+	}
+	val, err := vi.Encode(nil)
+	if err != nil {
+		return "", "", fmt.Errorf("error serializing %v: %s", vi, err)
+	}
+	if err = b.db.BeginTransaction(); err != nil {
+		return "", "", fmt.Errorf("cannot start transaction: %s", err)
+	}
+	old, err := b.db.Extract(nil, []byte(object))
+	if err == nil {
+		err = b.db.Set([]byte(object), val)
+	}
+	if err != nil {
+		b.db.Rollback()
+		return "", "", fmt.Errorf("error storing key in db: %s", err)
+	}
+	if err = b.db.Commit(); err != nil {
+		return "", "", err
+	}
+	if versionID != "" { // the old version is kept
+		err = m.addVersion(owner, bucket, object, &vi)
+	} else {
+		err = m.releaseReplaced(old)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if infos, err = m.delUpload(uploadID); err != nil {
+		return "", "", err
+	}
+	for _, pi := range infos {
+		if !used[pi.Fid] {
+			m.wm.Delete(pi.Fid)
+		}
+	}
+	return vi.ETag, versionID, nil
+}
+
+// AbortMultipart deletes the upload with all its parts
+func (m *master) AbortMultipart(owner s3intf.Owner, bucket, object, uploadID string) error {
+	m.uploadsLock.Lock()
+	defer m.uploadsLock.Unlock()
+	if _, err := m.getUpload(owner, bucket, object, uploadID); err != nil {
+		return err
+	}
+	infos, err := m.delUpload(uploadID)
+	if err != nil {
+		return err
+	}
+	for _, pi := range infos {
+		if e := m.wm.Delete(pi.Fid); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ListParts returns the uploaded parts, ordered by number
+func (m *master) ListParts(owner s3intf.Owner, bucket, object, uploadID string) ([]s3intf.Part, error) {
+	m.uploadsLock.Lock()
+	defer m.uploadsLock.Unlock()
+	if _, err := m.getUpload(owner, bucket, object, uploadID); err != nil {
+		return nil, err
+	}
+	parts, _, err := m.listParts(uploadID)
+	return parts, err
+}
+
+// ListMultipartUploads returns the uploads in progress, ordered by key and initiation time
+func (m *master) ListMultipartUploads(owner s3intf.Owner, bucket, prefix string) ([]s3intf.Upload, error) {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return nil, err
+	}
+	m.uploadsLock.Lock()
+	defer m.uploadsLock.Unlock()
+	enum, err := m.uploads.SeekFirst()
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var (
+		uploads []s3intf.Upload
+		k, v    []byte
+	)
+	for {
+		if k, v, err = enum.Next(); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		if bytes.IndexByte(k, '/') >= 0 {
+			continue
+		}
+		var info uploadInfo
+		if err = gobDecode(v, &info); err != nil {
+			return nil, fmt.Errorf("error decoding upload %s: %s", k, err)
+		}
+		if info.Owner != owner.ID() || info.Bucket != bucket || !strings.HasPrefix(info.Object, prefix) {
+			continue
+		}
+		uploads = append(uploads, s3intf.Upload{Key: info.Object, UploadID: string(k),
+			Initiated: info.Initiated, Initiator: info.Initiator, InitiatorName: info.InitiatorName,
+			ACL: info.ACL})
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		if uploads[i].Key != uploads[j].Key {
+			return uploads[i].Key < uploads[j].Key
+		}
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
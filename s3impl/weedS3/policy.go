@@ -0,0 +1,47 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// GetPolicy returns the policy of the bucket: its "policy" record in the config db
+func (m *master) GetPolicy(owner s3intf.Owner, bucket string) ([]byte, error) {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return nil, s3intf.NoSuchBucket
+	}
+	val, err := m.config.Get(nil, configKey(owner, bucket, "policy"))
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, s3intf.NoSuchBucketPolicy
+	}
+	return val, nil
+}
+
+// SetPolicy sets (or deletes, if empty) the policy of the bucket
+func (m *master) SetPolicy(owner s3intf.Owner, bucket string, policy []byte) error {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return s3intf.NoSuchBucket
+	}
+	if len(policy) == 0 {
+		return m.config.Delete(configKey(owner, bucket, "policy"))
+	}
+	return m.config.Set(configKey(owner, bucket, "policy"), policy)
+}
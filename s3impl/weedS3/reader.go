@@ -0,0 +1,196 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3impl/weedS3/weedutils"
+)
+
+// segment is a byte range of a fid
+type segment struct {
+	fid            string
+	offset, length int64
+	// whole is true if the segment is the whole fid
+	whole bool
+}
+
+// partsReader reads the segments one after the other
+type partsReader struct {
+	m        *master
+	segments []segment
+	cur      io.ReadCloser
+}
+
+// newPartsReader returns a reader of the n bytes from start
+// of the object consisting of the parts
+func newPartsReader(m *master, parts []weedutils.Part, start, n int64) *partsReader {
+	r := &partsReader{m: m, segments: make([]segment, 0, len(parts))}
+	for _, p := range parts {
+		if n <= 0 {
+			break
+		}
+		if start >= p.Size {
+			start -= p.Size
+			continue
+		}
+		length := p.Size - start
+		if length > n {
+			length = n
+		}
+		r.segments = append(r.segments, segment{fid: p.Fid, offset: start, length: length,
+			whole: start == 0 && length == p.Size})
+		n -= length
+		start = 0
+	}
+	return r
+}
+
+// Read implements io.Reader
+func (r *partsReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.segments) == 0 {
+				return 0, io.EOF
+			}
+			seg := r.segments[0]
+			r.segments = r.segments[1:]
+			var err error
+			if seg.whole {
+				r.cur, err = r.m.wm.Download(seg.fid)
+			} else {
+				r.cur, err = r.m.downloadRange(seg.fid, seg.offset, seg.length)
+			}
+			if err != nil {
+				return 0, fmt.Errorf("error downloading %s: %s", seg.fid, err)
+			}
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close implements io.Closer
+func (r *partsReader) Close() error {
+	r.segments = nil
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// limitedReadCloser reads from the Reader and closes the Closer
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// downloadRange downloads the length bytes from offset of the fid,
+// asking the volume server for that range only
+func (m *master) downloadRange(fid string, offset, length int64) (io.ReadCloser, error) {
+	url, err := m.lookup(fid)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK: // the volume server ignored the range
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("error downloading %s: %s", url, resp.Status)
+	}
+	return limitedReadCloser{Reader: io.LimitReader(resp.Body, length), Closer: resp.Body}, nil
+}
+
+// lookup returns the URL of the fid on a volume server, asking the master
+func (m *master) lookup(fid string) (string, error) {
+	u, err := lookupURL(m.masterURL, fid)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Locations []struct {
+			URL string `json:"url"`
+		} `json:"locations"`
+		Error string `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("error decoding lookup response: %s", err)
+	}
+	if res.Error != "" {
+		return "", errors.New(res.Error)
+	}
+	if len(res.Locations) == 0 {
+		return "", fmt.Errorf("no location for volume of %s", fid)
+	}
+	return httpURL(res.Locations[0].URL) + "/" + fid, nil
+}
+
+// lookupURL returns the URL for looking up the volume of fid on the master
+// (masterURL must have a scheme, see httpURL)
+func lookupURL(masterURL, fid string) (string, error) {
+	i := strings.IndexByte(fid, ',')
+	if i <= 0 {
+		return "", fmt.Errorf("bad fid %q", fid)
+	}
+	return masterURL + "/dir/lookup?volumeId=" + url.QueryEscape(fid[:i]), nil
+}
+
+// httpURL prepends http:// to the host[:port] address if it has no scheme,
+// and trims the trailing slash
+func httpURL(addr string) string {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import "testing"
+
+func TestLookupURL(t *testing.T) {
+	for i, tc := range []struct {
+		master, fid, url string
+	}{
+		{"localhost:9333", "3,01637037d6", "http://localhost:9333/dir/lookup?volumeId=3"},
+		{"localhost:9333/", "3,01637037d6", "http://localhost:9333/dir/lookup?volumeId=3"},
+		{"http://weed:9333", "12,ab", "http://weed:9333/dir/lookup?volumeId=12"},
+		{"https://weed", "7,ab", "https://weed/dir/lookup?volumeId=7"},
+		{"localhost:9333", "01637037d6", ""},
+		{"localhost:9333", ",01637037d6", ""},
+	} {
+		got, err := lookupURL(httpURL(tc.master), tc.fid)
+		if tc.url == "" {
+			if err == nil {
+				t.Errorf("%d. %q: awaited error, got %q", i, tc.fid, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %q: %s", i, tc.fid, err)
+		} else if got != tc.url {
+			t.Errorf("%d. %s %q: got %q, awaited %q", i, tc.master, tc.fid, got, tc.url)
+		}
+	}
+}
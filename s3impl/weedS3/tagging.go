@@ -0,0 +1,92 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"encoding/json"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The tags of a bucket are its "tagging" record in the config db, as JSON,
+// the tags of an object are in the Meta of its ValInfo (and of its latest version).
+
+// GetTags returns the tags of the bucket or the object
+func (m *master) GetTags(owner s3intf.Owner, bucket, object string) (s3intf.Tags, error) {
+	if object != "" {
+		_, obj, err := m.valInfo(owner, bucket, object)
+		if err != nil {
+			return nil, err
+		}
+		return obj.Metadata.Tags(), nil
+	}
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return nil, s3intf.NoSuchBucket
+	}
+	val, err := m.config.Get(nil, configKey(owner, bucket, "tagging"))
+	if err != nil {
+		return nil, err
+	}
+	if len(val) == 0 {
+		return nil, s3intf.NoSuchTagSet
+	}
+	var tags s3intf.Tags
+	err = json.Unmarshal(val, &tags)
+	return tags, err
+}
+
+// SetTags sets (or deletes, if empty) the tags of the bucket or the object
+func (m *master) SetTags(owner s3intf.Owner, bucket, object string, tags s3intf.Tags) error {
+	b, err := m.getBucket(owner, bucket)
+	if err != nil {
+		return s3intf.NoSuchBucket
+	}
+	if object == "" {
+		if len(tags) == 0 {
+			return m.config.Delete(configKey(owner, bucket, "tagging"))
+		}
+		val, err := json.Marshal(tags)
+		if err != nil {
+			return err
+		}
+		return m.config.Set(configKey(owner, bucket, "tagging"), val)
+	}
+	vi, _, err := m.valInfo(owner, bucket, object)
+	if err != nil {
+		return err
+	}
+	vi.Meta = s3intf.Metadata(vi.Meta).SetTags(tags)
+	val, err := vi.Encode(nil)
+	if err != nil {
+		return err
+	}
+	if err = b.db.Set([]byte(object), val); err != nil {
+		return err
+	}
+
+	m.versionsLock.Lock()
+	defer m.versionsLock.Unlock()
+	vis, keys, err := m.objectVersions(owner, bucket, object)
+	if err != nil || len(vis) == 0 || vis[0].DeleteMarker {
+		return err
+	}
+	vis[0].Meta = s3intf.Metadata(vis[0].Meta).SetTags(tags)
+	if val, err = vis[0].Encode(nil); err != nil {
+		return err
+	}
+	return m.versions.Set(keys[0], val)
+}
@@ -0,0 +1,381 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package weedS3
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3impl/weedS3/weedutils"
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The versions db contains every version of the objects of the versioned
+// buckets, as owner/bucket/object\x00order => ValInfo records, where order is
+// s3intf.VersionOrder of the version's creation, so the newest is the first.
+// The bucket's db contains the current version (if it is not a delete marker),
+// too, but the fids are owned by the versions: they are released when the
+// version is deleted (see DelVersion).
+//
+// The config db contains the owner/bucket/name => value records of the
+// buckets' configuration, such as the versioning state.
+
+// configKey returns the config db key of the bucket's named configuration
+func configKey(owner s3intf.Owner, bucket, name string) []byte {
+	return []byte(owner.ID() + "/" + bucket + "/" + name)
+}
+
+// versionsPrefix returns the versions db key prefix of the bucket
+func versionsPrefix(owner s3intf.Owner, bucket string) []byte {
+	return []byte(owner.ID() + "/" + bucket + "/")
+}
+
+// versionKey returns the versions db key of the object's version
+func versionKey(owner s3intf.Owner, bucket, object string, created time.Time) []byte {
+	return []byte(owner.ID() + "/" + bucket + "/" + object + "\x00" + s3intf.VersionOrder(created))
+}
+
+// Versioning returns the versioning state of the bucket
+func (m *master) Versioning(owner s3intf.Owner, bucket string) (string, error) {
+	if _, err := m.getBucket(owner, bucket); err != nil {
+		return "", err
+	}
+	val, err := m.config.Get(nil, configKey(owner, bucket, "versioning"))
+	return string(val), err
+}
+
+// newVersionID returns the ID of a new version of an object in the bucket:
+// "" if the bucket is not versioned
+func (m *master) newVersionID(owner s3intf.Owner, bucket string) (string, error) {
+	state, err := m.Versioning(owner, bucket)
+	if err != nil || state == "" {
+		return "", err
+	}
+	if state == s3intf.VersioningSuspended {
+		return s3intf.NullVersionID, nil
+	}
+	return s3intf.NewUploadID()
+}
+
+// SetVersioning sets the versioning state of the bucket.
+// When versioning is enabled first, the existing objects become null versions.
+func (m *master) SetVersioning(owner s3intf.Owner, bucket, state string) error {
+	if err := s3intf.CheckVersioning(state); err != nil {
+		return err
+	}
+	old, err := m.Versioning(owner, bucket)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		b, _ := m.getBucket(owner, bucket)
+		var keys, vals [][]byte
+		enum, err := b.db.SeekFirst()
+		for err == nil {
+			var key, val []byte
+			if key, val, err = enum.Next(); err == nil {
+				keys, vals = append(keys, key), append(vals, val)
+			}
+		}
+		if err != io.EOF {
+			return err
+		}
+		for i, key := range keys {
+			vi := new(weedutils.ValInfo)
+			if err = vi.Decode(vals[i]); err != nil {
+				return fmt.Errorf("error deserializing %s: %s", key, err)
+			}
+			vi.VersionID = s3intf.NullVersionID
+			val, err := vi.Encode(nil)
+			if err != nil {
+				return err
+			}
+			if err = b.db.Set(key, val); err != nil {
+				return err
+			}
+			if err = m.addVersion(owner, bucket, string(key), vi); err != nil {
+				return err
+			}
+		}
+	}
+	return m.config.Set(configKey(owner, bucket, "versioning"), []byte(state))
+}
+
+// addVersion stores the version - replacing the null version if vi is one
+func (m *master) addVersion(owner s3intf.Owner, bucket, object string, vi *weedutils.ValInfo) error {
+	val, err := vi.Encode(nil)
+	if err != nil {
+		return fmt.Errorf("error serializing %v: %s", vi, err)
+	}
+	m.versionsLock.Lock()
+	defer m.versionsLock.Unlock()
+	if vi.VersionID == s3intf.NullVersionID {
+		vis, keys, err := m.objectVersions(owner, bucket, object)
+		if err != nil {
+			return err
+		}
+		for i, v := range vis {
+			if v.VersionID != s3intf.NullVersionID {
+				continue
+			}
+			if err = m.versions.Delete(keys[i]); err != nil {
+				return err
+			}
+			if !v.DeleteMarker {
+				if err = m.release(fids(v)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return m.versions.Set(versionKey(owner, bucket, object, vi.Created), val)
+}
+
+// objectVersions returns the versions of the object (the newest first),
+// and their keys. Must be called with versionsLock held.
+func (m *master) objectVersions(owner s3intf.Owner, bucket, object string) (
+	vis []*weedutils.ValInfo, keys [][]byte, err error) {
+
+	prefix := []byte(owner.ID() + "/" + bucket + "/" + object + "\x00")
+	enum, _, err := m.versions.Seek(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	for {
+		key, val, err := enum.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, err
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		vi := new(weedutils.ValInfo)
+		if err = vi.Decode(val); err != nil {
+			return nil, nil, fmt.Errorf("error deserializing %s: %s", key, err)
+		}
+		vis = append(vis, vi)
+		keys = append(keys, key)
+	}
+	return vis, keys, nil
+}
+
+// findVersion returns the index of the version in vis (0 if versionID is empty), or -1
+func findVersion(vis []*weedutils.ValInfo, versionID string) int {
+	if versionID == "" && len(vis) > 0 {
+		return 0
+	}
+	for i, vi := range vis {
+		if vi.VersionID == versionID {
+			return i
+		}
+	}
+	return -1
+}
+
+// StatVersion returns the version of the object
+func (m *master) StatVersion(owner s3intf.Owner, bucket, object, versionID string) (s3intf.Version, error) {
+	m.versionsLock.Lock()
+	vis, _, err := m.objectVersions(owner, bucket, object)
+	m.versionsLock.Unlock()
+	if err != nil {
+		return s3intf.Version{}, err
+	}
+	if len(vis) == 0 { // not versioned
+		if versionID != "" && versionID != s3intf.NullVersionID {
+			return s3intf.Version{}, s3intf.NoSuchVersion
+		}
+		obj, err := m.Stat(owner, bucket, object)
+		return s3intf.Version{Object: obj, IsLatest: true}, err
+	}
+	i := findVersion(vis, versionID)
+	if i < 0 {
+		return s3intf.Version{}, s3intf.NoSuchVersion
+	}
+	return s3intf.Version{Object: objectOf(owner, object, vis[i]),
+		IsLatest: i == 0, DeleteMarker: vis[i].DeleteMarker}, nil
+}
+
+// versionValInfo returns the ValInfo of the object's version,
+// as valInfo does for the latest one (if versionID is empty)
+func (m *master) versionValInfo(owner s3intf.Owner, bucket, object, versionID string) (
+	*weedutils.ValInfo, s3intf.Object, error) {
+
+	if versionID == "" {
+		return m.valInfo(owner, bucket, object)
+	}
+	m.versionsLock.Lock()
+	vis, _, err := m.objectVersions(owner, bucket, object)
+	m.versionsLock.Unlock()
+	if err != nil {
+		return nil, s3intf.Object{}, err
+	}
+	if len(vis) == 0 { // not versioned
+		if versionID != s3intf.NullVersionID {
+			return nil, s3intf.Object{}, s3intf.NoSuchVersion
+		}
+		return m.valInfo(owner, bucket, object)
+	}
+	i := findVersion(vis, versionID)
+	if i < 0 {
+		return nil, s3intf.Object{}, s3intf.NoSuchVersion
+	}
+	if vis[i].DeleteMarker {
+		return nil, s3intf.Object{}, s3intf.NotFound
+	}
+	return vis[i], objectOf(owner, object, vis[i]), nil
+}
+
+// GetVersion retrieves the version of the object
+func (m *master) GetVersion(owner s3intf.Owner, bucket, object, versionID string, offset, length int64) (
+	s3intf.Object, io.ReadCloser, error) {
+
+	m.versionsLock.Lock()
+	vis, _, err := m.objectVersions(owner, bucket, object)
+	m.versionsLock.Unlock()
+	if err != nil {
+		return s3intf.Object{}, nil, err
+	}
+	if len(vis) == 0 { // not versioned
+		if versionID != "" && versionID != s3intf.NullVersionID {
+			return s3intf.Object{}, nil, s3intf.NoSuchVersion
+		}
+		return m.Get(owner, bucket, object, offset, length)
+	}
+	i := findVersion(vis, versionID)
+	if i < 0 {
+		return s3intf.Object{}, nil, s3intf.NoSuchVersion
+	}
+	if vis[i].DeleteMarker {
+		return s3intf.Object{}, nil, s3intf.NotFound
+	}
+	obj := objectOf(owner, object, vis[i])
+	body, err := m.open(vis[i], offset, length)
+	return obj, body, err
+}
+
+// DelVersion deletes the version permanently
+func (m *master) DelVersion(owner s3intf.Owner, bucket, object, versionID string) error {
+	b, err := m.getBucket(owner, bucket)
+	if err != nil {
+		return err
+	}
+	m.versionsLock.Lock()
+	vis, keys, err := m.objectVersions(owner, bucket, object)
+	if err == nil && len(vis) == 0 {
+		m.versionsLock.Unlock()
+		if versionID == s3intf.NullVersionID { // not versioned
+			return m.Del(owner, bucket, object)
+		}
+		return s3intf.NoSuchVersion
+	}
+	defer m.versionsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	i := findVersion(vis, versionID)
+	if i < 0 {
+		return s3intf.NoSuchVersion
+	}
+	if err = m.versions.Delete(keys[i]); err != nil {
+		return err
+	}
+	if i == 0 { // the previous version becomes the current
+		if len(vis) > 1 && !vis[1].DeleteMarker {
+			val, err := vis[1].Encode(nil)
+			if err != nil {
+				return err
+			}
+			if err = b.db.Set([]byte(object), val); err != nil {
+				return err
+			}
+		} else if err = b.db.Delete([]byte(object)); err != nil {
+			return err
+		}
+	}
+	if vis[i].DeleteMarker {
+		return nil
+	}
+	return m.release(fids(vis[i]))
+}
+
+// ListVersions lists the versions of the bucket
+func (m *master) ListVersions(owner s3intf.Owner, bucket, prefix, delimiter, keyMarker, versionIDMarker string,
+	limit int) (versions []s3intf.Version, commonprefixes []string, truncated bool, err error) {
+
+	if _, err = m.getBucket(owner, bucket); err != nil {
+		return
+	}
+	bPrefix := versionsPrefix(owner, bucket)
+	start := append(append([]byte{}, bPrefix...), prefix...)
+	m.versionsLock.Lock()
+	enum, _, err := m.versions.Seek(start)
+	if err != nil {
+		m.versionsLock.Unlock()
+		return
+	}
+	var all []s3intf.Version
+	for {
+		key, val, e := enum.Next()
+		if e != nil {
+			if e != io.EOF {
+				err = e
+			}
+			break
+		}
+		if !bytes.HasPrefix(key, start) {
+			break
+		}
+		object := string(key[len(bPrefix):bytes.LastIndexByte(key, 0)])
+		vi := new(weedutils.ValInfo)
+		if err = vi.Decode(val); err != nil {
+			break
+		}
+		all = append(all, s3intf.Version{Object: objectOf(owner, object, vi),
+			IsLatest: len(all) == 0 || all[len(all)-1].Key != object, DeleteMarker: vi.DeleteMarker})
+	}
+	m.versionsLock.Unlock()
+	if err != nil {
+		return
+	}
+	versions, commonprefixes, truncated = s3intf.FilterVersions(all, prefix, delimiter,
+		keyMarker, versionIDMarker, limit)
+	return
+}
+
+// hasVersions returns whether the bucket has any version stored
+func (m *master) hasVersions(owner s3intf.Owner, bucket string) (bool, error) {
+	prefix := versionsPrefix(owner, bucket)
+	m.versionsLock.Lock()
+	defer m.versionsLock.Unlock()
+	enum, _, err := m.versions.Seek(prefix)
+	if err != nil {
+		return false, err
+	}
+	key, _, err := enum.Next()
+	if err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.HasPrefix(key, prefix), nil
+}
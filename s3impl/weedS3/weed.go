@@ -20,9 +20,7 @@ limitations under the License.
 package weedS3
 
 import (
-	"crypto/hmac"
 	"crypto/md5"
-	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -58,47 +56,37 @@ type wOwner struct {
 	sync.Mutex
 }
 
-func (o wOwner) ID() string {
-	return filepath.Base(o.dir)
-}
-
-// Name returns then name of this owner
-func (o wOwner) Name() string {
-	return filepath.Base(o.dir)
-}
-
-// GetHMAC returns a HMAC initialized with the secret key
-func (o wOwner) GetHMAC(h func() hash.Hash) hash.Hash {
-	return hmac.New(h, nil)
-}
-
-// Check checks the validity of the authorization
-func (o wOwner) CalcHash(bytesToSign []byte) []byte {
-	return s3intf.CalcHash(hmac.New(sha1.New, nil), bytesToSign)
-}
-
 type master struct {
-	wm      weed.WeedClient // master weed node's URL
-	baseDir string
-	owners  map[string]wOwner
+	wm        weed.WeedClient // master weed node's URL
+	masterURL string
+	baseDir   string
+	owners    map[string]*wOwner
+	creds     s3intf.CredentialProvider
 	sync.Mutex
+	// uploads is the db of the multipart uploads in progress (basedir/uploads.kv)
+	uploads     *kv.DB
+	uploadsLock sync.Mutex
+	// refs is the db of the fids shared by copied objects (basedir/refs.kv)
+	refs     *kv.DB
+	refsLock sync.Mutex
+	// versions is the db of the object versions of the versioned buckets (basedir/versions.kv)
+	versions     *kv.DB
+	versionsLock sync.Mutex
+	// config is the db of the buckets' configuration (basedir/config.kv)
+	config *kv.DB
 }
 
 // GetOwner returns the Owner for the accessKey - or an error
-func (m master) GetOwner(accessKey string) (s3intf.Owner, error) {
-	m.Lock()
-	defer m.Unlock()
-	if o, ok := m.owners[accessKey]; ok {
-		return o, nil
-	}
-	return nil, errors.New("owner " + accessKey + " not found")
+func (m *master) GetOwner(accessKey string) (s3intf.Owner, error) {
+	return s3intf.GetCredentialOwner(m.creds, accessKey)
 }
 
 // NewWeedS3 stores everything in the given master Weed-FS node
 // buckets are stored
-func NewWeedS3(masterURL, dbdir string) (s3intf.Storage, error) {
-	m := master{wm: weed.NewWeedClient(masterURL), baseDir: dbdir,
-		owners: make(map[string]wOwner, 4)}
+// The owners are looked up in creds (see OpenCredentials).
+func NewWeedS3(masterURL, dbdir string, creds s3intf.CredentialProvider) (s3intf.Storage, error) {
+	m := &master{wm: weed.NewWeedClient(masterURL), masterURL: httpURL(masterURL), baseDir: dbdir,
+		owners: make(map[string]*wOwner, 4), creds: creds}
 	dh, err := os.Open(dbdir)
 	if err != nil {
 		if _, ok := err.(*os.PathError); !ok {
@@ -107,6 +95,18 @@ func NewWeedS3(masterURL, dbdir string) (s3intf.Storage, error) {
 		os.MkdirAll(dbdir, 0750)
 	}
 	defer dh.Close()
+	if m.uploads, err = openDB(filepath.Join(dbdir, "uploads.kv")); err != nil {
+		return nil, err
+	}
+	if m.refs, err = openDB(filepath.Join(dbdir, "refs.kv")); err != nil {
+		return nil, err
+	}
+	if m.versions, err = openDB(filepath.Join(dbdir, "versions.kv")); err != nil {
+		return nil, err
+	}
+	if m.config, err = openDB(filepath.Join(dbdir, "config.kv")); err != nil {
+		return nil, err
+	}
 	var nm string
 	err = weedutils.MapDirItems(dbdir,
 		func(fi os.FileInfo) bool {
@@ -120,9 +120,8 @@ func NewWeedS3(masterURL, dbdir string) (s3intf.Storage, error) {
 	return m, err
 }
 
-func openOwner(dir string) (o wOwner, err error) {
-	o.dir = dir
-	o.buckets = make(map[string]wBucket, 4)
+func openOwner(dir string) (o *wOwner, err error) {
+	o = &wOwner{dir: dir, buckets: make(map[string]wBucket, 4)}
 
 	var k, nm string
 
@@ -162,12 +161,12 @@ func openBucket(filename string) (b wBucket, err error) {
 }
 
 // ListBuckets list all buckets owned by the given owner
-func (m master) ListBuckets(owner s3intf.Owner) ([]s3intf.Bucket, error) {
+func (m *master) ListBuckets(owner s3intf.Owner) ([]s3intf.Bucket, error) {
 	m.Lock()
 	o, ok := m.owners[owner.ID()]
 	m.Unlock()
-	if !ok {
-		return nil, fmt.Errorf("unkown owner %s", owner.ID())
+	if !ok { // the owner's directory is created with the first bucket
+		return nil, nil
 	}
 	buckets := make([]s3intf.Bucket, len(o.buckets))
 	i := 0
@@ -180,7 +179,7 @@ func (m master) ListBuckets(owner s3intf.Owner) ([]s3intf.Bucket, error) {
 }
 
 // CreateBucket creates a new bucket
-func (m master) CreateBucket(owner s3intf.Owner, bucket string) error {
+func (m *master) CreateBucket(owner s3intf.Owner, bucket string) error {
 	m.Lock()
 	defer m.Unlock()
 	o, ok := m.owners[owner.ID()]
@@ -190,7 +189,7 @@ func (m master) CreateBucket(owner s3intf.Owner, bucket string) error {
 		if err != nil {
 			return err
 		}
-		o = wOwner{dir: dir, buckets: make(map[string]wBucket, 1)}
+		o = &wOwner{dir: dir, buckets: make(map[string]wBucket, 1)}
 		m.owners[owner.ID()] = o
 		//} else if o.buckets == nil {
 		//	o.buckets = make(map[string]wBucket, 1)
@@ -199,7 +198,7 @@ func (m master) CreateBucket(owner s3intf.Owner, bucket string) error {
 	defer o.Unlock()
 	_, ok = o.buckets[bucket]
 	if ok {
-		return nil //AlreadyExists ?
+		return s3intf.BucketAlreadyOwnedByYou
 	}
 	b := wBucket{filename: filepath.Join(o.dir, bucket+".kv"), created: time.Now()}
 	var err error
@@ -211,7 +210,7 @@ func (m master) CreateBucket(owner s3intf.Owner, bucket string) error {
 }
 
 // CheckBucket returns whether the owner has a bucket named as given
-func (m master) CheckBucket(owner s3intf.Owner, bucket string) bool {
+func (m *master) CheckBucket(owner s3intf.Owner, bucket string) bool {
 	m.Lock()
 	defer m.Unlock()
 	if o, ok := m.owners[owner.ID()]; ok {
@@ -224,7 +223,7 @@ func (m master) CheckBucket(owner s3intf.Owner, bucket string) bool {
 }
 
 // DelBucket deletes a bucket
-func (m master) DelBucket(owner s3intf.Owner, bucket string) error {
+func (m *master) DelBucket(owner s3intf.Owner, bucket string) error {
 	m.Lock()
 	defer m.Unlock()
 	o, ok := m.owners[owner.ID()]
@@ -235,12 +234,22 @@ func (m master) DelBucket(owner s3intf.Owner, bucket string) error {
 	defer o.Unlock()
 	b, ok := o.buckets[bucket]
 	if !ok {
-		return fmt.Errorf("bucket %s not exists!", bucket)
+		return s3intf.NoSuchBucket
 	}
 	if k, v, err := b.db.First(); err != nil {
 		return err
 	} else if k != nil || v != nil {
-		return errors.New("cannot delete non-empty bucket")
+		return s3intf.BucketNotEmpty
+	}
+	if has, err := m.hasVersions(owner, bucket); err != nil {
+		return err
+	} else if has {
+		return s3intf.BucketNotEmpty
+	}
+	for _, name := range []string{"versioning", "acl", "policy", "cors", "website", "tagging", "lifecycle"} {
+		if err := m.config.Delete(configKey(owner, bucket, name)); err != nil {
+			return err
+		}
 	}
 	b.db.Close()
 	b.db = nil
@@ -251,7 +260,7 @@ func (m master) DelBucket(owner s3intf.Owner, bucket string) error {
 // List lists a bucket, all objects Key starts with prefix, delimiter segments
 // Key, thus the returned commonprefixes (think a generalized filepath
 // structure, where / is the delimiter, a commonprefix is a subdir)
-func (m master) List(owner s3intf.Owner, bucket, prefix, delimiter, marker string,
+func (m *master) List(owner s3intf.Owner, bucket, prefix, delimiter, marker string,
 	limit, skip int) (
 	objects []s3intf.Object, commonprefixes []string,
 	truncated bool, err error) {
@@ -268,63 +277,51 @@ func (m master) List(owner s3intf.Owner, bucket, prefix, delimiter, marker strin
 	o.Unlock()
 	m.Unlock()
 	if !ok {
-		err = fmt.Errorf("unknown bucket %s", bucket)
+		err = s3intf.NoSuchBucket
 		return
 	}
 
-	err = nil
-	enum, e := b.db.SeekFirst()
-	if e != nil {
-		if e == io.EOF { //empty
-			return
-		}
-		err = fmt.Errorf("error getting first: %s", e)
-		return
-	}
-	var (
-		key, val []byte
-		vi       = new(weedutils.ValInfo)
-		etag     string
-	)
+	seeker := &kvSeeker{db: b.db}
 	objects = make([]s3intf.Object, 0, 64)
-	f := s3intf.NewListFilter(prefix, delimiter, marker, limit, skip)
-	for {
-		if key, val, e = enum.Next(); e != nil {
-			if e == io.EOF {
-				break
-			}
-			err = fmt.Errorf("error seeking next: %s", e)
-			return
-		}
-		//log.Printf("key=%q", key)
-		if ok, e = f.Check(string(key)); e != nil {
-			if e == io.EOF {
-				break
-			}
-			err = fmt.Errorf("error checking %s: %s", key, e)
-			return
-		} else if ok {
-			if err = vi.Decode(val); err != nil {
-				return
-			}
-			if vi.MD5 != nil && len(vi.MD5) == 16 {
-				etag = hex.EncodeToString(vi.MD5)
-			} else {
-				etag = ""
+	commonprefixes, truncated, err = s3intf.SeekList(seeker, prefix, delimiter, marker, limit, skip,
+		func(key string) error {
+			vi := new(weedutils.ValInfo)
+			if err := vi.Decode(seeker.val); err != nil {
+				return fmt.Errorf("error deserializing %s: %s", key, err)
 			}
-			objects = append(objects,
-				s3intf.Object{Key: string(key), Owner: owner,
-					ETag: etag, LastModified: vi.Created, Size: vi.Size})
-		}
-	}
-	commonprefixes, truncated = f.Result()
+			objects = append(objects, objectOf(owner, key, vi))
+			return nil
+		})
+	return
+}
+
+// kvSeeker is an s3intf.KeySeeker on a kv.DB, holding the value of the current key
+type kvSeeker struct {
+	db   *kv.DB
+	enum *kv.Enumerator
+	val  []byte
+}
+
+// Seek implements s3intf.KeySeeker.Seek
+func (s *kvSeeker) Seek(key string) (err error) {
+	s.enum, _, err = s.db.Seek([]byte(key))
 	return
 }
 
+// Next implements s3intf.KeySeeker.Next
+func (s *kvSeeker) Next() (string, error) {
+	key, val, err := s.enum.Next()
+	if err != nil {
+		return "", err
+	}
+	s.val = val
+	return string(key), nil
+}
+
 // Put puts a file as a new object into the bucket
-func (m master) Put(owner s3intf.Owner, bucket, object, filename, media string,
-	body io.Reader, size int64, md5hash []byte) (
-	err error) {
+func (m *master) Put(owner s3intf.Owner, bucket, object, filename, media string,
+	body io.Reader, size int64, md5hash []byte, meta s3intf.Metadata) (
+	versionID string, err error) {
 
 	m.Lock()
 	o, ok := m.owners[owner.ID()]
@@ -337,12 +334,15 @@ func (m master) Put(owner s3intf.Owner, bucket, object, filename, media string,
 	b, ok := o.buckets[bucket]
 	o.Unlock()
 	if !ok {
-		err = errors.New("cannot find bucket " + bucket)
+		err = s3intf.NoSuchBucket
 		return
 	}
 
+	if versionID, err = m.newVersionID(owner, bucket); err != nil {
+		return
+	}
 	if err = b.db.BeginTransaction(); err != nil {
-		return fmt.Errorf("cannot start transaction: %s", err)
+		return "", fmt.Errorf("cannot start transaction: %s", err)
 	}
 	defer func() {
 		if err != nil {
@@ -356,12 +356,18 @@ func (m master) Put(owner s3intf.Owner, bucket, object, filename, media string,
 		return
 	}
 	vi := weedutils.ValInfo{Filename: filename, ContentType: media,
-		Fid: fid, Created: time.Now(), Size: size, MD5: md5hash}
+		Fid: fid, Created: time.Now(), Size: size, MD5: md5hash, VersionID: versionID, Meta: meta}
 	val, err := vi.Encode(nil)
 	if err != nil {
 		err = fmt.Errorf("error serializing %v: %s", vi, err)
 		return
 	}
+	// the replaced object's fids are released after the commit
+	old, err := b.db.Extract(nil, []byte(object))
+	if err != nil {
+		err = fmt.Errorf("error getting %s: %s", object, err)
+		return
+	}
 	if err = b.db.Set([]byte(object), val); err != nil {
 		err = fmt.Errorf("error storing key in db: %s", err)
 		return
@@ -390,13 +396,30 @@ func (m master) Put(owner s3intf.Owner, bucket, object, filename, media string,
 	}
 
 	//log.Printf("uploading %s [%d] resulted in %s", filename, size, resp)
-	err = nil
-	return b.db.Commit()
+	if err = b.db.Commit(); err != nil {
+		return
+	}
+	if versionID != "" { // the old version is kept
+		return versionID, m.addVersion(owner, bucket, object, &vi)
+	}
+	return "", m.releaseReplaced(old)
 }
 
-// Get retrieves an object from the bucket
-func (m master) Get(owner s3intf.Owner, bucket, object string) (
-	filename, media string, body io.ReadCloser, size int64, md5 []byte, err error) {
+// releaseReplaced releases the fids of the replaced (encoded) ValInfo, if any
+func (m *master) releaseReplaced(old []byte) error {
+	if old == nil {
+		return nil
+	}
+	ovi := new(weedutils.ValInfo)
+	if err := ovi.Decode(old); err != nil {
+		return fmt.Errorf("error deserializing %s: %s", old, err)
+	}
+	return m.release(fids(ovi))
+}
+
+// valInfo returns the stored ValInfo of the object, and the Object made of it
+func (m *master) valInfo(owner s3intf.Owner, bucket, object string) (
+	vi *weedutils.ValInfo, obj s3intf.Object, err error) {
 
 	m.Lock()
 	o, ok := m.owners[owner.ID()]
@@ -409,7 +432,7 @@ func (m master) Get(owner s3intf.Owner, bucket, object string) (
 	b, ok := o.buckets[bucket]
 	o.Unlock()
 	if !ok {
-		err = errors.New("cannot find bucket " + bucket)
+		err = s3intf.NoSuchBucket
 		return
 	}
 
@@ -422,19 +445,60 @@ func (m master) Get(owner s3intf.Owner, bucket, object string) (
 		err = s3intf.NotFound
 		return
 	}
-	vi := new(weedutils.ValInfo)
+	vi = new(weedutils.ValInfo)
 	if err = vi.Decode(val); err != nil {
 		err = fmt.Errorf("error deserializing %s: %s", val, err)
 		return
 	}
-	filename, media, size, md5 = vi.Filename, vi.ContentType, vi.Size, vi.MD5
+	return vi, objectOf(owner, object, vi), nil
+}
+
+// objectOf returns the Object described by vi
+func objectOf(owner s3intf.Owner, object string, vi *weedutils.ValInfo) s3intf.Object {
+	obj := s3intf.Object{Key: object, Owner: owner, Size: vi.Size, LastModified: vi.Created,
+		Filename: vi.Filename, ContentType: vi.ContentType, ETag: vi.ETag, VersionID: vi.VersionID,
+		Metadata: vi.Meta}
+	if obj.ETag == "" && !vi.DeleteMarker {
+		obj.ETag = hex.EncodeToString(vi.MD5)
+	}
+	return obj
+}
+
+// Stat returns the object's data, from the bucket's db only
+func (m *master) Stat(owner s3intf.Owner, bucket, object string) (s3intf.Object, error) {
+	_, obj, err := m.valInfo(owner, bucket, object)
+	return obj, err
+}
 
-	body, err = m.wm.Download(vi.Fid)
+// Get retrieves an object from the bucket
+func (m *master) Get(owner s3intf.Owner, bucket, object string, offset, length int64) (
+	obj s3intf.Object, body io.ReadCloser, err error) {
+
+	vi, obj, err := m.valInfo(owner, bucket, object)
+	if err != nil {
+		return
+	}
+	body, err = m.open(vi, offset, length)
 	return
 }
 
+// open returns the length bytes from offset of the content described by vi
+func (m *master) open(vi *weedutils.ValInfo, offset, length int64) (io.ReadCloser, error) {
+	start, n, err := s3intf.ResolveRange(offset, length, vi.Size)
+	if err != nil {
+		return nil, err
+	}
+	if len(vi.Parts) == 0 {
+		if start == 0 && n == vi.Size {
+			return m.wm.Download(vi.Fid)
+		}
+		vi.Parts = []weedutils.Part{{Fid: vi.Fid, Size: vi.Size}}
+	}
+	return newPartsReader(m, vi.Parts, start, n), nil
+}
+
 // Del deletes the object from the bucket
-func (m master) Del(owner s3intf.Owner, bucket, object string) (err error) {
+func (m *master) Del(owner s3intf.Owner, bucket, object string) (err error) {
 	m.Lock()
 	o, ok := m.owners[owner.ID()]
 	m.Unlock()
@@ -445,7 +509,19 @@ func (m master) Del(owner s3intf.Owner, bucket, object string) (err error) {
 	b, ok := o.buckets[bucket]
 	o.Unlock()
 	if !ok {
-		return errors.New("cannot find bucket " + bucket)
+		return s3intf.NoSuchBucket
+	}
+
+	versionID, err := m.newVersionID(owner, bucket)
+	if err != nil {
+		return
+	}
+	if versionID != "" { // the current version is kept
+		if err = b.db.Delete([]byte(object)); err != nil {
+			return
+		}
+		return m.addVersion(owner, bucket, object, &weedutils.ValInfo{
+			VersionID: versionID, Created: time.Now(), DeleteMarker: true})
 	}
 
 	if err = b.db.BeginTransaction(); err != nil {
@@ -471,9 +547,8 @@ func (m master) Del(owner s3intf.Owner, bucket, object string) (err error) {
 		err = fmt.Errorf("error deserializing %s: %s", val, err)
 		return
 	}
-	if err = m.wm.Delete(vi.Fid); err != nil {
+	if err = m.release(fids(vi)); err != nil {
 		return
 	}
-	err = nil
 	return b.db.Commit()
 }
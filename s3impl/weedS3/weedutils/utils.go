@@ -117,6 +117,25 @@ type ValInfo struct {
 	Created time.Time `json:"created"`
 	Size    int64     `json:"size"`
 	MD5     []byte    `json:"md5"`
+	// Parts are the fids of an object assembled from a multipart upload
+	// (then Fid and MD5 are empty)
+	Parts []Part `json:"parts,omitempty"`
+	// ETag is the multipart ETag (md5 of the parts' md5 - number of parts)
+	ETag string `json:"etag,omitempty"`
+	// VersionID is the object's version, in a versioned bucket
+	VersionID string `json:"version-id,omitempty"`
+	// DeleteMarker is true for the delete markers (in the versions db only)
+	DeleteMarker bool `json:"delete-marker,omitempty"`
+	// Meta is the metadata given at upload
+	Meta map[string]string `json:"meta,omitempty"`
+	// ACL is the JSON encoded ACL of the object (in the bucket's db only)
+	ACL []byte `json:"acl,omitempty"`
+}
+
+// Part is a part of an object, stored in a separate fid
+type Part struct {
+	Fid  string `json:"fid"`
+	Size int64  `json:"size"`
 }
 
 // Decode decodes into the struct from bytes
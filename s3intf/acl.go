@@ -0,0 +1,166 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+// The permissions of the grants.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html#permissions
+const (
+	PermRead        = "READ"
+	PermWrite       = "WRITE"
+	PermReadACP     = "READ_ACP"
+	PermWriteACP    = "WRITE_ACP"
+	PermFullControl = "FULL_CONTROL"
+)
+
+// The grantee URIs of the predefined groups
+const (
+	AllUsers           = "http://acs.amazonaws.com/groups/global/AllUsers"
+	AuthenticatedUsers = "http://acs.amazonaws.com/groups/global/AuthenticatedUsers"
+)
+
+// The canned ACLs (x-amz-acl header values).
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/acl-overview.html#canned-acl
+const (
+	ACLPrivate                = "private"
+	ACLPublicRead             = "public-read"
+	ACLPublicReadWrite        = "public-read-write"
+	ACLAuthenticatedRead      = "authenticated-read"
+	ACLBucketOwnerRead        = "bucket-owner-read"
+	ACLBucketOwnerFullControl = "bucket-owner-full-control"
+)
+
+// Grant gives the Permission to the Grantee, which is a canonical user ID,
+// or the URI of a group (AllUsers or AuthenticatedUsers)
+type Grant struct {
+	Grantee    string `json:"grantee"`
+	Permission string `json:"permission"`
+}
+
+// ACL is the access control list of a bucket or an object
+type ACL struct {
+	// Owner is the canonical ID of the owner of the bucket or the object
+	Owner  string  `json:"owner"`
+	Grants []Grant `json:"grants"`
+}
+
+// PrivateACL returns the ACL which grants FULL_CONTROL to the owner only:
+// this is the ACL of the buckets and objects without a stored one
+func PrivateACL(owner string) ACL {
+	return ACL{Owner: owner, Grants: []Grant{{Grantee: owner, Permission: PermFullControl}}}
+}
+
+// CannedACL returns the named canned ACL of the owner;
+// bucketOwner is the owner of the bucket, used by the bucket-owner-* ACLs of objects
+func CannedACL(name, owner, bucketOwner string) (ACL, error) {
+	acl := PrivateACL(owner)
+	switch name {
+	case ACLPrivate:
+	case ACLPublicRead:
+		acl.Grants = append(acl.Grants, Grant{AllUsers, PermRead})
+	case ACLPublicReadWrite:
+		acl.Grants = append(acl.Grants, Grant{AllUsers, PermRead}, Grant{AllUsers, PermWrite})
+	case ACLAuthenticatedRead:
+		acl.Grants = append(acl.Grants, Grant{AuthenticatedUsers, PermRead})
+	case ACLBucketOwnerRead:
+		if bucketOwner != "" && bucketOwner != owner {
+			acl.Grants = append(acl.Grants, Grant{bucketOwner, PermRead})
+		}
+	case ACLBucketOwnerFullControl:
+		if bucketOwner != "" && bucketOwner != owner {
+			acl.Grants = append(acl.Grants, Grant{bucketOwner, PermFullControl})
+		}
+	default:
+		return acl, NewError("InvalidArgument", "unknown canned ACL "+name)
+	}
+	return acl, nil
+}
+
+// CheckPermission returns an InvalidArgument error if perm is not a permission
+func CheckPermission(perm string) error {
+	switch perm {
+	case PermRead, PermWrite, PermReadACP, PermWriteACP, PermFullControl:
+		return nil
+	}
+	return NewError("InvalidArgument", "unknown permission "+perm)
+}
+
+// Allows returns whether the ACL grants the permission to the requester
+// (a canonical user ID, or "" for anonymous requests).
+// FULL_CONTROL includes every permission, and the owner can always
+// read and write the ACL.
+func (acl ACL) Allows(requester, perm string) bool {
+	if requester != "" && requester == acl.Owner && (perm == PermReadACP || perm == PermWriteACP) {
+		return true
+	}
+	for _, g := range acl.Grants {
+		if g.Permission != perm && g.Permission != PermFullControl {
+			continue
+		}
+		switch g.Grantee {
+		case AllUsers:
+			return true
+		case AuthenticatedUsers:
+			if requester != "" {
+				return true
+			}
+		case requester:
+			if requester != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ACLer is an optional interface of a Storage, for access control lists.
+// Without it, only the owner of a bucket can access it.
+// The buckets and objects without a stored ACL have the PrivateACL of the
+// bucket's owner.
+type ACLer interface {
+	// BucketOwner returns the canonical ID of the owner of the bucket - or NoSuchBucket
+	BucketOwner(bucket string) (string, error)
+	// GetACL returns the ACL of the bucket (if object is empty) or the object
+	GetACL(owner Owner, bucket, object string) (ACL, error)
+	// SetACL sets the ACL of the bucket (if object is empty) or the object.
+	// The ACL of an object is reset when the object is replaced or deleted.
+	SetACL(owner Owner, bucket, object string, acl ACL) error
+}
+
+// Anonymous is the requester of the unsigned requests (see NoAuthorization):
+// its ID is "", thus it is granted the permissions of the AllUsers group only.
+var Anonymous = OwnerOf("")
+
+// OwnerOf returns an Owner known only by its canonical ID, such as the owner
+// of a bucket accessed by an other user through its ACL. It cannot be used
+// for authentication: CalcHash and SigningKey return nil.
+func OwnerOf(id string) Owner {
+	return idOwner(id)
+}
+
+type idOwner string
+
+// ID returns the canonical ID
+func (o idOwner) ID() string { return string(o) }
+
+// Name returns the canonical ID, as the display name is unknown
+func (o idOwner) Name() string { return string(o) }
+
+// CalcHash returns nil
+func (o idOwner) CalcHash(bytesToSign []byte) []byte { return nil }
+
+// SigningKey returns nil
+func (o idOwner) SigningKey(date, region, service string) []byte { return nil }
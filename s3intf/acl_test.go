@@ -0,0 +1,57 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import "testing"
+
+func TestCannedACL(t *testing.T) {
+	for i, tc := range []struct {
+		canned, requester, perm string
+		allowed                 bool
+	}{
+		{ACLPrivate, "owner", PermWrite, true},
+		{ACLPrivate, "other", PermRead, false},
+		{ACLPrivate, "", PermRead, false},
+		{ACLPublicRead, "", PermRead, true},
+		{ACLPublicRead, "other", PermWrite, false},
+		{ACLPublicReadWrite, "", PermWrite, true},
+		{ACLPublicReadWrite, "", PermReadACP, false},
+		{ACLAuthenticatedRead, "", PermRead, false},
+		{ACLAuthenticatedRead, "other", PermRead, true},
+		{ACLBucketOwnerRead, "bucketowner", PermRead, true},
+		{ACLBucketOwnerRead, "bucketowner", PermWrite, false},
+		{ACLBucketOwnerFullControl, "bucketowner", PermWriteACP, true},
+		{ACLBucketOwnerFullControl, "other", PermRead, false},
+	} {
+		acl, err := CannedACL(tc.canned, "owner", "bucketowner")
+		if err != nil {
+			t.Errorf("%d. %s: %s", i, tc.canned, err)
+			continue
+		}
+		if got := acl.Allows(tc.requester, tc.perm); got != tc.allowed {
+			t.Errorf("%d. %s allows %s to %s: got %t, awaited %t", i, tc.canned,
+				tc.requester, tc.perm, got, tc.allowed)
+		}
+	}
+	if _, err := CannedACL("no-such-acl", "owner", ""); ErrorCode(err) != "InvalidArgument" {
+		t.Errorf("unknown canned ACL: got %v", err)
+	}
+	// the owner can always change the ACL
+	if !(ACL{Owner: "owner"}).Allows("owner", PermWriteACP) {
+		t.Errorf("owner cannot write the ACL")
+	}
+}
@@ -25,6 +25,7 @@ import (
 	"log"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -41,14 +42,38 @@ var Debug = false
 
 // GetOwner returns the Owner identified by the AccessKeyId in the request - if the authentication succeeds
 // See http://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html#ConstructingTheAuthenticationHeader
+// and http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-auth-using-authorization-header.html
+//
+// Presigned URLs (both the Expires and the X-Amz-Expires form) are checked for expiration, too.
+//
+// The bucket of the virtual-host requests is derived from the service's host (see HostBucket).
 func GetOwner(b Storage, r *http.Request, serviceHost string) (owner Owner, err error) {
+	return GetRoutedOwner(b, r, HostBucket(r.Host, serviceHost))
+}
+
+// GetRoutedOwner is GetOwner for a request routed by a Router: hostBucket is
+// the bucket given by the Host header, "" for path-style requests.
+func GetRoutedOwner(b Storage, r *http.Request, hostBucket string) (owner Owner, err error) {
+	if strings.HasPrefix(r.Header.Get("Authorization"), SignV4Algorithm+" ") {
+		return getOwnerV4(b, r, false)
+	}
 	var access, signature string
 
 	params := r.URL.Query()
-	if _, ok := params["Expires"]; ok {
+	if _, ok := params["X-Amz-Algorithm"]; ok {
+		return getOwnerV4(b, r, true)
+	}
+	if v, ok := params["Expires"]; ok {
 		// Query string request authentication alternative.
-		//expires = true
-		//date = v[0]
+		expires, e := strconv.ParseInt(v[0], 10, 64)
+		if e != nil {
+			err = errors.New("bad Expires: " + e.Error())
+			return
+		}
+		if now().Unix() > expires {
+			err = RequestExpired
+			return
+		}
 		access = params.Get("AWSAccessKeyId")
 		signature = params.Get("Signature")
 	}
@@ -67,19 +92,12 @@ func GetOwner(b Storage, r *http.Request, serviceHost string) (owner Owner, err
 			access, signature = auth[:i], auth[i+1:]
 		}
 		if access == "" || signature == "" {
-			err = errors.New("No authorization header")
+			err = NoAuthorization
 			return
 		}
 	}
 
 	// Signature = Base64( HMAC-SHA1( YourSecretAccessKeyID, UTF-8-Encoding-Of( StringToSign ) ) );
-	/*
-		host := StripPort(r.Host)
-		serviceHost = StripPort(serviceHost)
-		if len(host) > len(serviceHost) {
-			bucket = host[:len(host)-len(serviceHost)-1]
-		}
-	*/
 	challenge, e := b64.DecodeString(signature)
 	if e != nil {
 		err = errors.New("not base64-encoded signature: " + e.Error())
@@ -89,12 +107,12 @@ func GetOwner(b Storage, r *http.Request, serviceHost string) (owner Owner, err
 	if o, err = b.GetOwner(access); err != nil {
 		return
 	}
-	bts := GetBytesToSign(r, serviceHost)
+	bts := RoutedBytesToSign(r, hostBucket)
 	if Debug {
-		log.Printf("%s serviceHost=%s owner=%s bts=%q", r, serviceHost, o.ID(), bts)
+		log.Printf("%s %s hostBucket=%s owner=%s bts=%q", r.Method, r.URL, hostBucket, o.ID(), bts)
 	}
 	if !Check(o, bts, challenge) {
-		err = errors.New("signature mismatch")
+		err = SignatureDoesNotMatch
 		return
 	}
 	return o, nil
@@ -108,18 +126,24 @@ func cr(w io.Writer) {
 // Copied from launchpad.net/goamz/s3/sign.go
 var s3ParamsToSign = map[string]bool{
 	"acl":                          true,
+	"cors":                         true,
+	"delete":                       true,
+	"lifecycle":                    true,
 	"location":                     true,
 	"logging":                      true,
 	"notification":                 true,
 	"partNumber":                   true,
 	"policy":                       true,
 	"requestPayment":               true,
+	"restore":                      true,
+	"tagging":                      true,
 	"torrent":                      true,
 	"uploadId":                     true,
 	"uploads":                      true,
 	"versionId":                    true,
 	"versioning":                   true,
 	"versions":                     true,
+	"website":                      true,
 	"response-content-type":        true,
 	"response-content-language":    true,
 	"response-expires":             true,
@@ -131,7 +155,16 @@ var s3ParamsToSign = map[string]bool{
 // GetBytesToSign returns the StringToSign
 // (see http://docs.aws.amazon.com/AmazonS3/latest/dev/RESTAuthentication.html#ConstructingTheAuthenticationHeader)
 // Most of it is copied from launchpad.net/goamz/s3/sign.go
+//
+// The bucket of the virtual-host requests is derived from the service's host (see HostBucket).
 func GetBytesToSign(r *http.Request, serviceHost string) []byte {
+	return RoutedBytesToSign(r, HostBucket(r.Host, serviceHost))
+}
+
+// RoutedBytesToSign is GetBytesToSign for a request routed by a Router: the
+// canonicalized resource starts with hostBucket (the bucket given by the Host
+// header, "" for path-style requests).
+func RoutedBytesToSign(r *http.Request, hostBucket string) []byte {
 	headers := r.Header
 	params := r.URL.Query()
 	if Debug {
@@ -187,19 +220,8 @@ func GetBytesToSign(r *http.Request, serviceHost string) []byte {
 	}
 	// canonicalPath must start with "/" + Bucket
 	canonicalPath := ""
-	host := StripPort(r.Host)
-	if Debug {
-		log.Printf("%s.Host: %s => %s, serviceHost: %s => %s", r,
-			r.Host, StripPort(r.Host),
-			serviceHost, StripPort(serviceHost))
-	}
-	serviceHost = StripPort(serviceHost)
-	if serviceHost == "" {
-		canonicalPath = "/" + host
-	} else {
-		if len(host) > len(serviceHost) { // bucket name is from host name
-			canonicalPath = "/" + host[:len(host)-len(serviceHost)-1]
-		}
+	if hostBucket != "" {
+		canonicalPath = "/" + hostBucket
 	}
 	//Append the path part of the un-decoded HTTP Request-URI,
 	//up-to but not including the query string.
@@ -0,0 +1,430 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignV4Algorithm is the algorithm name of AWS Signature Version 4
+	SignV4Algorithm = "AWS4-HMAC-SHA256"
+	// UnsignedPayload is the x-amz-content-sha256 value for not signed payloads
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// StreamingPayload is the x-amz-content-sha256 value for aws-chunked
+	// payloads with chunk signatures
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// EmptySHA256 is the hex encoded SHA256 hash of the empty string
+	EmptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// ISO8601Format is the format of X-Amz-Date
+	ISO8601Format = "20060102T150405Z"
+	yyyymmdd      = "20060102"
+)
+
+// MaxPresignedExpires is the maximum validity of a presigned URL (7 days)
+const MaxPresignedExpires = 7 * 24 * time.Hour
+
+// MaxClockSkew is the maximum allowed difference between the request's date
+// and the server's clock
+var MaxClockSkew = 15 * time.Minute
+
+// now is time.Now, replaceable for testing
+var now = time.Now
+
+// SignatureV4 contains the parsed parts of an AWS Signature Version 4 authorization
+// See http://docs.aws.amazon.com/general/latest/gr/sigv4-create-string-to-sign.html
+type SignatureV4 struct {
+	AccessKey string
+	// Date is the request's time (X-Amz-Date)
+	Date time.Time
+	// ScopeDate (YYYYMMDD), Region and Service are from the credential scope
+	ScopeDate, Region, Service string
+	// SignedHeaders is the lowercased, sorted list of the signed header names
+	SignedHeaders []string
+	// Signature is the hex encoded signature
+	Signature string
+	// Expires is the validity of a presigned URL (X-Amz-Expires), 0 for header authorization
+	Expires time.Duration
+}
+
+// Scope returns the credential scope (date/region/service/aws4_request)
+func (s SignatureV4) Scope() string {
+	return s.ScopeDate + "/" + s.Region + "/" + s.Service + "/aws4_request"
+}
+
+// ParseSignatureV4 parses the AWS4-HMAC-SHA256 Authorization header of the request
+//
+// Authorization: AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request,
+// SignedHeaders=host;x-amz-date, Signature=5fa00fa3...
+func ParseSignatureV4(r *http.Request) (*SignatureV4, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, SignV4Algorithm+" ") {
+		return nil, errors.New("not an " + SignV4Algorithm + " authorization")
+	}
+	var credential, signedHeaders, signature string
+	for _, part := range strings.Split(auth[len(SignV4Algorithm)+1:], ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed authorization part %q", part)
+		}
+		switch part[:i] {
+		case "Credential":
+			credential = part[i+1:]
+		case "SignedHeaders":
+			signedHeaders = part[i+1:]
+		case "Signature":
+			signature = part[i+1:]
+		}
+	}
+	if credential == "" || signedHeaders == "" || signature == "" {
+		return nil, errors.New("Credential, SignedHeaders and Signature are required")
+	}
+	sig := &SignatureV4{SignedHeaders: strings.Split(signedHeaders, ";"),
+		Signature: signature}
+	if err := sig.parseCredential(credential); err != nil {
+		return nil, err
+	}
+	var err error
+	if sig.Date, err = requestDate(r.Header); err != nil {
+		return nil, err
+	}
+	return sig, sig.check()
+}
+
+// ParsePresignedV4 parses the X-Amz-* query parameters of a presigned URL
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func ParsePresignedV4(r *http.Request) (*SignatureV4, error) {
+	params := r.URL.Query()
+	if alg := params.Get("X-Amz-Algorithm"); alg != SignV4Algorithm {
+		return nil, fmt.Errorf("unsupported X-Amz-Algorithm %q", alg)
+	}
+	for _, k := range []string{"X-Amz-Credential", "X-Amz-Date", "X-Amz-Expires",
+		"X-Amz-SignedHeaders", "X-Amz-Signature"} {
+		if params.Get(k) == "" {
+			return nil, errors.New(k + " is required")
+		}
+	}
+	sig := &SignatureV4{SignedHeaders: strings.Split(params.Get("X-Amz-SignedHeaders"), ";"),
+		Signature: params.Get("X-Amz-Signature")}
+	if err := sig.parseCredential(params.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	var err error
+	if sig.Date, err = time.Parse(ISO8601Format, params.Get("X-Amz-Date")); err != nil {
+		return nil, fmt.Errorf("bad X-Amz-Date: %s", err)
+	}
+	expires, err := strconv.ParseInt(params.Get("X-Amz-Expires"), 10, 64)
+	if err != nil || expires <= 0 {
+		return nil, fmt.Errorf("bad X-Amz-Expires %q", params.Get("X-Amz-Expires"))
+	}
+	sig.Expires = time.Duration(expires) * time.Second
+	if sig.Expires > MaxPresignedExpires {
+		return nil, fmt.Errorf("X-Amz-Expires must be less than %s", MaxPresignedExpires)
+	}
+	return sig, sig.check()
+}
+
+// parseCredential parses the AKIDEXAMPLE/20150830/us-east-1/service/aws4_request credential
+func (s *SignatureV4) parseCredential(credential string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return fmt.Errorf("malformed credential %q", credential)
+	}
+	s.AccessKey, s.ScopeDate, s.Region, s.Service = parts[0], parts[1], parts[2], parts[3]
+	return nil
+}
+
+// check checks the consistency of the parsed values
+func (s SignatureV4) check() error {
+	if s.Date.Format(yyyymmdd) != s.ScopeDate {
+		return fmt.Errorf("credential date %s does not match request date %s",
+			s.ScopeDate, s.Date.Format(ISO8601Format))
+	}
+	if !sort.StringsAreSorted(s.SignedHeaders) {
+		return errors.New("SignedHeaders are not sorted")
+	}
+	for _, h := range s.SignedHeaders {
+		if h == "host" {
+			return nil
+		}
+	}
+	return errors.New("host header must be signed")
+}
+
+// requestDate returns the X-Amz-Date, or the Date header's time
+func requestDate(headers http.Header) (time.Time, error) {
+	if d := headers.Get("X-Amz-Date"); d != "" {
+		return time.Parse(ISO8601Format, d)
+	}
+	if d := headers.Get("Date"); d != "" {
+		return http.ParseTime(d)
+	}
+	return time.Time{}, errors.New("X-Amz-Date or Date header is required")
+}
+
+// getOwnerV4 is GetOwner for AWS Signature Version 4 signed requests
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-auth-using-authorization-header.html
+// and http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func getOwnerV4(b Storage, r *http.Request, presigned bool) (Owner, error) {
+	var (
+		sig         *SignatureV4
+		payloadHash string
+		err         error
+	)
+	if presigned {
+		if sig, err = ParsePresignedV4(r); err != nil {
+			return nil, err
+		}
+		t := now()
+		if t.Before(sig.Date.Add(-MaxClockSkew)) {
+			return nil, NewError("AccessDenied", fmt.Sprintf("request date %s is in the future", sig.Date))
+		}
+		if t.After(sig.Date.Add(sig.Expires)) {
+			return nil, RequestExpired
+		}
+		// the payload is not known when presigning
+		payloadHash = UnsignedPayload
+	} else {
+		if sig, err = ParseSignatureV4(r); err != nil {
+			return nil, err
+		}
+		if d := now().Sub(sig.Date); d > MaxClockSkew || d < -MaxClockSkew {
+			return nil, NewError("RequestTimeTooSkewed", fmt.Sprintf("request time %s is too skewed", sig.Date))
+		}
+		if payloadHash, err = payloadSHA256(r); err != nil {
+			return nil, err
+		}
+	}
+	o, err := b.GetOwner(sig.AccessKey)
+	if err != nil {
+		return nil, err
+	}
+	creq := CanonicalRequestV4(r, sig.SignedHeaders, payloadHash)
+	sts := StringToSignV4(sig.Date, sig.Scope(), creq)
+	if Debug {
+		log.Printf("%s %s owner=%s creq=%q sts=%q", r.Method, r.URL, o.ID(), creq, sts)
+	}
+	if !CheckV4(o, sig, sts) {
+		return nil, SignatureDoesNotMatch
+	}
+	return o, nil
+}
+
+// payloadSHA256 returns the hashed payload for the canonical request.
+// If x-amz-content-sha256 holds a hash, then the body is checked against it
+// while it is read; a request with a body but without such header is rejected,
+// as the body is not read before the signature is checked.
+func payloadSHA256(r *http.Request) (string, error) {
+	given := r.Header.Get("X-Amz-Content-Sha256")
+	switch {
+	case given == UnsignedPayload || given == StreamingPayload:
+		// the chunk signatures of StreamingPayload are checked by the reader of the body
+		return given, nil
+	case strings.HasPrefix(given, "STREAMING-"):
+		return "", CheckStreamingPayload(given)
+	case given != "":
+		want, err := hex.DecodeString(given)
+		if err != nil || len(want) != sha256.Size {
+			return "", fmt.Errorf("bad x-amz-content-sha256 %q", given)
+		}
+		if r.Body != nil {
+			r.Body = &sha256Reader{ReadCloser: r.Body, hsh: sha256.New(), want: want}
+		}
+		return given, nil
+	}
+	if r.Body == nil || r.ContentLength == 0 {
+		return EmptySHA256, nil
+	}
+	return "", ErrMissingContentSHA256
+}
+
+// CheckStreamingPayload returns a NotImplemented error for the aws-chunked
+// x-amz-content-sha256 values other than StreamingPayload (the variants with
+// trailers, unsigned chunks or other algorithms), nil otherwise.
+func CheckStreamingPayload(given string) error {
+	if strings.HasPrefix(given, "STREAMING-") && given != StreamingPayload {
+		return NewError("NotImplemented", "x-amz-content-sha256 "+given+" is not supported")
+	}
+	return nil
+}
+
+// ErrMissingContentSHA256 is returned for signed requests with a body
+// but without the x-amz-content-sha256 header
+var ErrMissingContentSHA256 = NewError("InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+
+// ErrContentSHA256Mismatch is returned when reading a body
+// whose hash differs from the x-amz-content-sha256 header
+var ErrContentSHA256Mismatch = NewError("XAmzContentSHA256Mismatch", "the provided x-amz-content-sha256 header does not match what was computed")
+
+// sha256Reader checks the read content's SHA256 hash at EOF
+type sha256Reader struct {
+	io.ReadCloser
+	hsh  hash.Hash
+	want []byte
+}
+
+// Read implements io.Reader, returns ErrContentSHA256Mismatch at the end
+// if the hash does not match
+func (r *sha256Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hsh.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.hsh.Sum(nil), r.want) {
+		err = ErrContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// CanonicalRequestV4 returns the canonical request of AWS Signature Version 4
+// See http://docs.aws.amazon.com/general/latest/gr/sigv4-create-canonical-request.html
+//
+// The path is URI-encoded only once, and not normalized, as S3 requires.
+func CanonicalRequestV4(r *http.Request, signedHeaders []string, payloadHash string) []byte {
+	res := bytes.NewBuffer(make([]byte, 0, 256))
+	res.WriteString(r.Method)
+	cr(res)
+	path := r.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	res.WriteString(URIEncode(path, false))
+	cr(res)
+	res.WriteString(canonicalQueryV4(r))
+	cr(res)
+	for _, k := range signedHeaders {
+		res.WriteString(k)
+		res.WriteByte(':')
+		res.WriteString(canonicalHeaderValue(r, k))
+		cr(res)
+	}
+	cr(res)
+	res.WriteString(strings.Join(signedHeaders, ";"))
+	cr(res)
+	res.WriteString(payloadHash)
+	return res.Bytes()
+}
+
+// canonicalQueryV4 returns the sorted, URI-encoded query string
+func canonicalQueryV4(r *http.Request) string {
+	params := r.URL.Query()
+	sarray := make([]string, 0, len(params))
+	for k, v := range params {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		ek := URIEncode(k, true) + "="
+		for _, vi := range v {
+			sarray = append(sarray, ek+URIEncode(vi, true))
+		}
+	}
+	sort.Strings(sarray)
+	return strings.Join(sarray, "&")
+}
+
+// canonicalHeaderValue returns the trimmed, comma joined values of the header
+func canonicalHeaderValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if r.Header.Get("Content-Length") == "" && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+	values := r.Header[textproto.CanonicalMIMEHeaderKey(name)]
+	vals := make([]string, len(values))
+	for i, v := range values {
+		vals[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(vals, ",")
+}
+
+// StringToSignV4 returns the string to sign of AWS Signature Version 4
+// See http://docs.aws.amazon.com/general/latest/gr/sigv4-create-string-to-sign.html
+func StringToSignV4(date time.Time, scope string, canonicalRequest []byte) []byte {
+	hsh := sha256.Sum256(canonicalRequest)
+	return []byte(SignV4Algorithm + "\n" + date.UTC().Format(ISO8601Format) + "\n" +
+		scope + "\n" + hex.EncodeToString(hsh[:]))
+}
+
+// CheckV4 checks the AWS Signature Version 4 signature of the stringToSign
+func CheckV4(prov Hasher, sig *SignatureV4, stringToSign []byte) bool {
+	challenge, err := hex.DecodeString(sig.Signature)
+	if err != nil || len(challenge) != sha256.Size {
+		return false
+	}
+	key := prov.SigningKey(sig.ScopeDate, sig.Region, sig.Service)
+	if key == nil {
+		return false
+	}
+	return hmac.Equal(HMACSHA256(key, stringToSign), challenge)
+}
+
+// HMACSHA256 returns the HMAC-SHA256 of data with the given key
+func HMACSHA256(key, data []byte) []byte {
+	return CalcHash(hmac.New(sha256.New, key), data)
+}
+
+// DeriveSigningKey derives the AWS Signature Version 4 signing key from the
+// secret key, for the given date (YYYYMMDD), region and service
+// See http://docs.aws.amazon.com/general/latest/gr/sigv4-calculate-signature.html
+func DeriveSigningKey(secret, date, region, service string) []byte {
+	return signingKey(HMACSHA256([]byte("AWS4"+secret), []byte(date)), region, service)
+}
+
+// signingKey derives the signing key from kDate
+func signingKey(kDate []byte, region, service string) []byte {
+	kRegion := HMACSHA256(kDate, []byte(region))
+	kService := HMACSHA256(kRegion, []byte(service))
+	return HMACSHA256(kService, []byte("aws4_request"))
+}
+
+// URIEncode encodes the string as AWS requires: every byte except the unreserved
+// characters (A-Z, a-z, 0-9, '-', '.', '_', '~') is percent-encoded with
+// uppercase hex digits. The '/' is left as is if encodeSlash is false.
+func URIEncode(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	res := make([]byte, 0, len(s)+8)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			res = append(res, c)
+		case c == '/' && !encodeSlash:
+			res = append(res, c)
+		default:
+			res = append(res, '%', hexChars[c>>4], hexChars[c&15])
+		}
+	}
+	return string(res)
+}
@@ -22,12 +22,16 @@ import (
 	//"hash"
 	"errors"
 	"io"
+	"strings"
 	"time"
 )
 
 // NotFound prints Not Found
 var NotFound = errors.New("Not Found")
 
+// InvalidRange is returned when the requested range cannot be satisfied
+var InvalidRange = NewError("InvalidRange", "the requested range is not satisfiable")
+
 // Bucket is a holder for objects
 type Bucket struct {
 	Name    string
@@ -38,15 +42,75 @@ type Bucket struct {
 type Object struct {
 	Key          string
 	LastModified time.Time
-	ETag         string
-	Size         int64
-	Owner        Owner
+	// ETag is the hex encoded MD5 hash of the content (or the multipart ETag), unquoted
+	ETag  string
+	Size  int64
+	Owner Owner
+	// Filename and ContentType are as given at upload
+	Filename    string
+	ContentType string
+	// VersionID is the object's version, in a versioned bucket (see Versioner)
+	VersionID string
+	// Metadata is as given at upload
+	Metadata Metadata
+}
+
+// MetadataPrefix is the prefix of the user metadata headers
+const MetadataPrefix = "X-Amz-Meta-"
+
+// MaxMetadataSize is the maximal size of the user metadata of an object (see Metadata.UserSize)
+const MaxMetadataSize = 2 << 10
+
+// Metadata is stored with the object: the user metadata (x-amz-meta-* headers)
+// and the Cache-Control, Content-Encoding, Content-Language and Expires headers,
+// keyed by the canonical header names
+type Metadata map[string]string
+
+// UserSize returns the size of the user metadata: the sum of the length of
+// the names (without MetadataPrefix) and the values
+func (m Metadata) UserSize() int {
+	var n int
+	for k, v := range m {
+		if strings.HasPrefix(k, MetadataPrefix) {
+			n += len(k) - len(MetadataPrefix) + len(v)
+		}
+	}
+	return n
+}
+
+// ResolveRange returns the start and the length of the requested range
+// of an object with the given size.
+// A negative offset means the last -offset bytes, a negative length means
+// till the end of the object; thus offset=0, length=-1 means the whole object.
+// Returns InvalidRange if the range starts after the end of the object.
+func ResolveRange(offset, length, size int64) (start, n int64, err error) {
+	switch {
+	case offset == 0 && length < 0:
+		return 0, size, nil
+	case offset < 0:
+		if size == 0 {
+			return 0, 0, InvalidRange
+		}
+		if -offset > size {
+			offset = -size
+		}
+		return size + offset, -offset, nil
+	case offset >= size:
+		return 0, 0, InvalidRange
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return offset, length, nil
 }
 
 // Hasher is an interface for hashign for authorization (checking)
 type Hasher interface {
 	// CalcHash calculates the hash of bytesToSign
 	CalcHash(bytesToSign []byte) []byte
+	// SigningKey returns the AWS Signature Version 4 signing key derived for
+	// the given date (YYYYMMDD), region and service (see DeriveSigningKey)
+	SigningKey(date, region, service string) []byte
 }
 
 // Check checks the validity of the authorization,
@@ -86,14 +150,45 @@ type Storage interface {
 	//Prefix limits results to only those keys that begin with the specified prefix,
 	//and delimiter causes list to roll up all keys that share a common prefix
 	//into a single summary list result.
+	//Only the keys after marker are listed, the objects and the commonprefixes
+	//(which include the delimiter) are in lexicographical order.
 	List(owner Owner, bucket, prefix, delimiter, marker string, limit, skip int) (
 		objects []Object, commonprefixes []string, truncated bool, err error)
-	// Put puts a file as a new object into the bucket
-	Put(owner Owner, bucket, object, filename, media string, body io.Reader, size int64, md5hash []byte) error
-	// Get retrieves an object from the bucket
-	Get(owner Owner, bucket, object string) (filename, media string, body io.ReadCloser, size int64, md5hash []byte, err error)
+	// Put puts a file as a new object into the bucket, with the metadata,
+	// and returns the ID of the created version ("" if the bucket is not versioned)
+	Put(owner Owner, bucket, object, filename, media string, body io.Reader, size int64, md5hash []byte,
+		meta Metadata) (versionID string, err error)
+	// Get retrieves an object from the bucket: the length bytes from offset
+	// (see ResolveRange), so ranged reads need not read the skipped bytes.
+	// The returned Object's Size is the size of the whole object; on InvalidRange
+	// error, the Object is filled, too.
+	Get(owner Owner, bucket, object string, offset, length int64) (Object, io.ReadCloser, error)
+	// Stat returns the object's data (size, ETag, content type, modification time,
+	// metadata), without opening its content
+	Stat(owner Owner, bucket, object string) (Object, error)
 	// Del deletes the object from the bucket
 	Del(owner Owner, bucket, object string) error
 	// GetOwner returns the Owner for the accessKey - or an error
 	GetOwner(accessKey string) (Owner, error)
 }
+
+// Copier is an optional interface of a Storage, for copying objects without
+// reading and writing their content
+type Copier interface {
+	// Copy copies the source object (its version with srcVersionID, or the latest
+	// one, if srcVersionID is empty) to the destination (replacing it, if exists),
+	// and returns the new object (with the ID of the created version).
+	// The filename and media of the source are kept, if the given ones are empty,
+	// and the metadata, if meta is nil.
+	Copy(owner Owner, srcBucket, srcObject, srcVersionID, dstBucket, dstObject, filename, media string,
+		meta Metadata) (Object, error)
+}
+
+// MultiDeleter is an optional interface of a Storage, for deleting many objects
+// of a bucket at once
+type MultiDeleter interface {
+	// DelMulti deletes the objects from the bucket. The returned errs has
+	// an error (or nil) for each object; NotFound counts as deleted.
+	// err is returned if none of the objects could be deleted.
+	DelMulti(owner Owner, bucket string, objects []string) (errs []error, err error)
+}
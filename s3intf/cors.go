@@ -0,0 +1,148 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NoSuchCORSConfiguration is returned by CORSer.GetCORS if the bucket has no CORS configuration
+var NoSuchCORSConfiguration = NewError("NoSuchCORSConfiguration", "the CORS configuration does not exist")
+
+// MaxCORSRules is the maximal number of the rules of a CORS configuration
+const MaxCORSRules = 100
+
+// CORSRule is a rule of the cross-origin resource sharing configuration of a bucket.
+// The AllowedOrigins and the AllowedHeaders may contain one * wildcard.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/cors.html
+type CORSRule struct {
+	ID             string   `json:"id,omitempty"`
+	AllowedOrigins []string `json:"allowedOrigins"`
+	// AllowedMethods are GET, PUT, POST, DELETE or HEAD
+	AllowedMethods []string `json:"allowedMethods"`
+	AllowedHeaders []string `json:"allowedHeaders,omitempty"`
+	ExposeHeaders  []string `json:"exposeHeaders,omitempty"`
+	// MaxAgeSeconds is how long the browser may cache the preflight response; 0 if not given
+	MaxAgeSeconds int `json:"maxAgeSeconds,omitempty"`
+}
+
+// CORSer is an optional interface of a Storage, for the CORS configuration of the buckets
+type CORSer interface {
+	// GetCORS returns the CORS rules of the bucket - or NoSuchCORSConfiguration
+	GetCORS(owner Owner, bucket string) ([]CORSRule, error)
+	// SetCORS sets the CORS rules of the bucket; no rules deletes the configuration
+	SetCORS(owner Owner, bucket string, rules []CORSRule) error
+}
+
+// CheckCORSRules checks the rules: every rule must have at least one origin and
+// one method, the methods must be supported, and the origins and headers may
+// have at most one * wildcard.
+func CheckCORSRules(rules []CORSRule) error {
+	if len(rules) == 0 {
+		return NewError("MalformedXML", "no CORSRule given")
+	}
+	if len(rules) > MaxCORSRules {
+		return NewError("InvalidRequest", "at most "+strconv.Itoa(MaxCORSRules)+" CORSRules are allowed")
+	}
+	for _, rule := range rules {
+		if len(rule.AllowedOrigins) == 0 || len(rule.AllowedMethods) == 0 {
+			return NewError("MalformedXML", "CORSRule needs AllowedOrigin and AllowedMethod")
+		}
+		for _, m := range rule.AllowedMethods {
+			switch m {
+			case "GET", "PUT", "POST", "DELETE", "HEAD":
+			default:
+				return NewError("InvalidRequest", "Found unsupported HTTP method in CORS config. "+
+					"Unsupported method is "+m)
+			}
+		}
+		for _, o := range rule.AllowedOrigins {
+			if strings.Count(o, "*") > 1 {
+				return NewError("InvalidRequest", "AllowedOrigin "+o+" can not have more than one wildcard.")
+			}
+		}
+		for _, h := range rule.AllowedHeaders {
+			if strings.Count(h, "*") > 1 {
+				return NewError("InvalidRequest", "AllowedHeader "+h+" can not have more than one wildcard.")
+			}
+		}
+		if rule.MaxAgeSeconds < 0 {
+			return NewError("MalformedXML", "MaxAgeSeconds must not be negative")
+		}
+	}
+	return nil
+}
+
+// MatchCORS returns the first rule which allows the origin to do the request with
+// the method and the (request) headers - or nil, if there is no such rule.
+func MatchCORS(rules []CORSRule, origin, method string, headers []string) *CORSRule {
+Rules:
+	for i, rule := range rules {
+		if !rule.AllowsOrigin(origin) {
+			continue
+		}
+		ok := false
+		for _, m := range rule.AllowedMethods {
+			if m == method {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		for _, h := range headers {
+			if !rule.allowsHeader(h) {
+				continue Rules
+			}
+		}
+		return &rules[i]
+	}
+	return nil
+}
+
+// AllowsOrigin returns whether the origin is one of the AllowedOrigins
+func (rule CORSRule) AllowsOrigin(origin string) bool {
+	for _, o := range rule.AllowedOrigins {
+		if corsMatch(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeader returns whether the header is one of the AllowedHeaders (case insensitive)
+func (rule CORSRule) allowsHeader(header string) bool {
+	header = strings.ToLower(header)
+	for _, h := range rule.AllowedHeaders {
+		if corsMatch(strings.ToLower(h), header) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMatch returns whether s matches the pattern with at most one * wildcard
+func corsMatch(pattern, s string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == s
+	}
+	return len(s) >= len(pattern)-1 && strings.HasPrefix(s, pattern[:i]) &&
+		strings.HasSuffix(s, pattern[i+1:])
+}
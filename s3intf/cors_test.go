@@ -0,0 +1,69 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import "testing"
+
+func TestMatchCORS(t *testing.T) {
+	rules := []CORSRule{
+		{ID: "write", AllowedOrigins: []string{"http://www.example.com", "https://*.example.com"},
+			AllowedMethods: []string{"PUT", "POST", "DELETE"}, AllowedHeaders: []string{"Content-*", "x-amz-*"}},
+		{ID: "read", AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}},
+	}
+	if err := CheckCORSRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		origin, method string
+		headers        []string
+		awaited        string
+	}{
+		{"http://www.example.com", "PUT", nil, "write"},
+		{"http://www.example.com", "PUT", []string{"content-type", "X-Amz-Date"}, "write"},
+		{"https://img.example.com", "DELETE", nil, "write"},
+		{"https://example.com", "DELETE", nil, ""},
+		{"http://img.example.com", "DELETE", nil, ""},
+		{"http://www.example.com", "PUT", []string{"authorization"}, ""},
+		{"http://www.example.com", "GET", nil, "read"},
+		{"http://evil.com", "GET", nil, "read"},
+		{"http://evil.com", "GET", []string{"x-amz-date"}, ""},
+		{"http://evil.com", "PUT", nil, ""},
+		{"http://www.example.com", "HEAD", nil, ""},
+	} {
+		rule := MatchCORS(rules, tc.origin, tc.method, tc.headers)
+		got := ""
+		if rule != nil {
+			got = rule.ID
+		}
+		if got != tc.awaited {
+			t.Errorf("%d. %s %s %q: got %q, awaited %q", i, tc.origin, tc.method, tc.headers, got, tc.awaited)
+		}
+	}
+
+	for i, rules := range [][]CORSRule{
+		nil,
+		{{AllowedMethods: []string{"GET"}}},
+		{{AllowedOrigins: []string{"*"}}},
+		{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"PATCH"}}},
+		{{AllowedOrigins: []string{"http://*.*.com"}, AllowedMethods: []string{"GET"}}},
+		{{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}, MaxAgeSeconds: -1}},
+	} {
+		if err := CheckCORSRules(rules); err == nil {
+			t.Errorf("%d. awaited error for %v", i, rules)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// User is an owner of buckets
+type User struct {
+	// ID is the canonical ID of the user
+	ID string `json:"id"`
+	// Name is the display name of the user
+	Name string `json:"name"`
+	// Disabled users cannot authenticate with any of their keys
+	Disabled bool      `json:"disabled,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// Credential is an access key of a User. A User may have more than one
+// credential, to be able to rotate the keys without downtime.
+type Credential struct {
+	AccessKey string    `json:"access_key"`
+	Secret    Secret    `json:"secret"`
+	UserID    string    `json:"user_id"`
+	Created   time.Time `json:"created"`
+}
+
+// CredentialProvider looks up the credentials of the users
+type CredentialProvider interface {
+	// GetCredential returns the Credential of the access key and its User - or NotFound
+	GetCredential(accessKey string) (Credential, User, error)
+}
+
+// CredentialStore is a CredentialProvider which can be listed and changed
+type CredentialStore interface {
+	CredentialProvider
+	// PutUser stores (creates or updates) the user
+	PutUser(User) error
+	// DelUser deletes the user with all its credentials
+	DelUser(id string) error
+	// ListUsers returns all the users, ordered by ID
+	ListUsers() ([]User, error)
+	// PutCredential stores the credential - the user must exist
+	PutCredential(Credential) error
+	// DelCredential deletes the credential
+	DelCredential(accessKey string) error
+	// ListCredentials lists the credentials of the user, ordered by creation time
+	ListCredentials(userID string) ([]Credential, error)
+}
+
+// NewCredential returns a new credential with random access and secret keys for the user.
+// The secret key is returned, as it is stored only in hashed form.
+func NewCredential(userID string) (Credential, string, error) {
+	b := make([]byte, 12+30)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return Credential{}, "", err
+	}
+	accessKey := strings.TrimRight(base32.StdEncoding.EncodeToString(b[:12]), "=")
+	secret := base64.StdEncoding.EncodeToString(b[12:])
+	hashed, err := HashSecret(secret)
+	if err != nil {
+		return Credential{}, "", err
+	}
+	return Credential{AccessKey: accessKey, Secret: hashed, UserID: userID,
+		Created: time.Now()}, secret, nil
+}
+
+// GetCredentialOwner returns the Owner of the access key, as the provider knows it
+func GetCredentialOwner(p CredentialProvider, accessKey string) (Owner, error) {
+	cred, user, err := p.GetCredential(accessKey)
+	if err != nil {
+		if err == NotFound {
+			return nil, NewError("InvalidAccessKeyId", "owner of "+accessKey+" not found")
+		}
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, NewError("AccessDenied", "user "+user.ID+" is disabled")
+	}
+	return credOwner{User: user, secret: cred.Secret}, nil
+}
+
+// credOwner is an Owner with a (hashed) secret key
+type credOwner struct {
+	User
+	secret Secret
+}
+
+// ID returns the canonical ID of the user
+func (o credOwner) ID() string {
+	return o.User.ID
+}
+
+// Name returns the display name of the user
+func (o credOwner) Name() string {
+	return o.User.Name
+}
+
+// CalcHash calculates the HMAC-SHA1 of bytesToSign with the secret key
+func (o credOwner) CalcHash(bytesToSign []byte) []byte {
+	hsh, err := o.secret.HMACSHA1()
+	if err != nil {
+		return nil
+	}
+	return CalcHash(hsh, bytesToSign)
+}
+
+// SigningKey returns the AWS Signature Version 4 signing key
+func (o credOwner) SigningKey(date, region, service string) []byte {
+	return o.secret.SigningKey(date, region, service)
+}
+
+// Secret is a secret access key, hashed at rest: only the precomputed
+// inner and outer states of the HMACs needed for authentication are stored
+// (HMAC-SHA1 with the secret for Signature Version 2, and HMAC-SHA256 with
+// "AWS4"+secret for Signature Version 4), not the secret itself.
+// These states are enough to sign requests, so for this server they are
+// equivalent to the secret, and must be protected like it.
+type Secret struct {
+	SHA1Inner   []byte `json:"sha1_inner"`
+	SHA1Outer   []byte `json:"sha1_outer"`
+	SHA256Inner []byte `json:"sha256_inner"`
+	SHA256Outer []byte `json:"sha256_outer"`
+}
+
+// HashSecret returns the hashed form of the secret
+func HashSecret(secret string) (s Secret, err error) {
+	if s.SHA1Inner, s.SHA1Outer, err = hmacStates(sha1.New, []byte(secret)); err != nil {
+		return
+	}
+	s.SHA256Inner, s.SHA256Outer, err = hmacStates(sha256.New, []byte("AWS4"+secret))
+	return
+}
+
+// HMACSHA1 returns the HMAC-SHA1 keyed with the secret
+func (s Secret) HMACSHA1() (hash.Hash, error) {
+	return newPrecomputedHMAC(sha1.New, s.SHA1Inner, s.SHA1Outer)
+}
+
+// SigningKey derives the AWS Signature Version 4 signing key, as DeriveSigningKey
+func (s Secret) SigningKey(date, region, service string) []byte {
+	hsh, err := newPrecomputedHMAC(sha256.New, s.SHA256Inner, s.SHA256Outer)
+	if err != nil {
+		return nil
+	}
+	return signingKey(CalcHash(hsh, []byte(date)), region, service)
+}
+
+// hmacStates returns the marshaled states of the hash after writing the
+// key^ipad and key^opad blocks, as the HMAC does.
+func hmacStates(h func() hash.Hash, key []byte) (inner, outer []byte, err error) {
+	hsh := h()
+	bs := hsh.BlockSize()
+	if len(key) > bs {
+		hsh.Write(key)
+		key = hsh.Sum(nil)
+		hsh.Reset()
+	}
+	ipad, opad := make([]byte, bs), make([]byte, bs)
+	copy(ipad, key)
+	copy(opad, key)
+	for i := range ipad {
+		ipad[i] ^= 0x36
+		opad[i] ^= 0x5c
+	}
+	m, ok := hsh.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T cannot be marshaled", hsh)
+	}
+	hsh.Write(ipad)
+	if inner, err = m.MarshalBinary(); err != nil {
+		return
+	}
+	hsh.Reset()
+	hsh.Write(opad)
+	outer, err = m.MarshalBinary()
+	return
+}
+
+// precomputedHMAC is a HMAC starting from the precomputed states
+type precomputedHMAC struct {
+	hash.Hash
+	h            func() hash.Hash
+	inner, outer []byte
+}
+
+func newPrecomputedHMAC(h func() hash.Hash, inner, outer []byte) (hash.Hash, error) {
+	if len(inner) == 0 || len(outer) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	p := &precomputedHMAC{Hash: h(), h: h, inner: inner, outer: outer}
+	return p, p.reset()
+}
+
+func (p *precomputedHMAC) reset() error {
+	return p.Hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(p.inner)
+}
+
+// Reset implements hash.Hash.Reset
+func (p *precomputedHMAC) Reset() {
+	p.reset()
+}
+
+// Sum implements hash.Hash.Sum
+func (p *precomputedHMAC) Sum(b []byte) []byte {
+	in := p.Hash.Sum(nil)
+	out := p.h()
+	if err := out.(encoding.BinaryUnmarshaler).UnmarshalBinary(p.outer); err != nil {
+		return nil
+	}
+	out.Write(in)
+	return out.Sum(b)
+}
+
+// FileCredentials is a CredentialStore stored in a JSON file:
+//
+//	{"users": [{"id": "...", "name": "..."}],
+//	 "credentials": [{"access_key": "...", "user_id": "...", "secret": {...}}]}
+//
+// The file is reread when it changes.
+type FileCredentials struct {
+	filename string
+	modTime  time.Time
+	size     int64
+	users    map[string]User
+	creds    map[string]Credential
+	sync.Mutex
+}
+
+// credFile is the format of the FileCredentials' file
+type credFile struct {
+	Users       []User       `json:"users"`
+	Credentials []Credential `json:"credentials"`
+}
+
+// OpenFileCredentials returns the FileCredentials of the given file,
+// which is created on the first change if not exists.
+func OpenFileCredentials(filename string) (*FileCredentials, error) {
+	fc := &FileCredentials{filename: filename}
+	fc.Lock()
+	defer fc.Unlock()
+	return fc, fc.load()
+}
+
+// load (re)reads the file if it has changed
+func (fc *FileCredentials) load() error {
+	fi, err := os.Stat(fc.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if fc.users == nil {
+				fc.users = make(map[string]User)
+				fc.creds = make(map[string]Credential)
+			}
+			return nil
+		}
+		return err
+	}
+	if fc.users != nil && fi.ModTime().Equal(fc.modTime) && fi.Size() == fc.size {
+		return nil
+	}
+	b, err := ioutil.ReadFile(fc.filename)
+	if err != nil {
+		return err
+	}
+	var cf credFile
+	if err = json.Unmarshal(b, &cf); err != nil {
+		return fmt.Errorf("error parsing %s: %s", fc.filename, err)
+	}
+	fc.users = make(map[string]User, len(cf.Users))
+	for _, u := range cf.Users {
+		fc.users[u.ID] = u
+	}
+	fc.creds = make(map[string]Credential, len(cf.Credentials))
+	for _, c := range cf.Credentials {
+		fc.creds[c.AccessKey] = c
+	}
+	fc.modTime, fc.size = fi.ModTime(), fi.Size()
+	return nil
+}
+
+// save writes the file (atomically, through a temporary file)
+func (fc *FileCredentials) save() error {
+	cf := credFile{Users: make([]User, 0, len(fc.users)),
+		Credentials: make([]Credential, 0, len(fc.creds))}
+	for _, u := range fc.users {
+		cf.Users = append(cf.Users, u)
+	}
+	for _, c := range fc.creds {
+		cf.Credentials = append(cf.Credentials, c)
+	}
+	b, err := json.MarshalIndent(cf, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(fc.filename), 0750); err != nil {
+		return err
+	}
+	fh, err := ioutil.TempFile(filepath.Dir(fc.filename), filepath.Base(fc.filename)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(b); err == nil {
+		err = fh.Chmod(0600)
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), fc.filename)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	if fi, err := os.Stat(fc.filename); err == nil {
+		fc.modTime, fc.size = fi.ModTime(), fi.Size()
+	}
+	return nil
+}
+
+// GetCredential implements CredentialProvider.GetCredential
+func (fc *FileCredentials) GetCredential(accessKey string) (Credential, User, error) {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return Credential{}, User{}, err
+	}
+	c, ok := fc.creds[accessKey]
+	if !ok {
+		return Credential{}, User{}, NotFound
+	}
+	u, ok := fc.users[c.UserID]
+	if !ok {
+		return Credential{}, User{}, NotFound
+	}
+	return c, u, nil
+}
+
+// PutUser stores the user
+func (fc *FileCredentials) PutUser(u User) error {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return err
+	}
+	fc.users[u.ID] = u
+	return fc.save()
+}
+
+// PutCredential stores the credential
+func (fc *FileCredentials) PutCredential(c Credential) error {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return err
+	}
+	if _, ok := fc.users[c.UserID]; !ok {
+		return errors.New("unknown user " + c.UserID)
+	}
+	fc.creds[c.AccessKey] = c
+	return fc.save()
+}
+
+// DelUser deletes the user and its credentials
+func (fc *FileCredentials) DelUser(id string) error {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return err
+	}
+	if _, ok := fc.users[id]; !ok {
+		return NotFound
+	}
+	delete(fc.users, id)
+	for k, c := range fc.creds {
+		if c.UserID == id {
+			delete(fc.creds, k)
+		}
+	}
+	return fc.save()
+}
+
+// ListUsers returns the users, ordered by ID
+func (fc *FileCredentials) ListUsers() ([]User, error) {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(fc.users))
+	for _, u := range fc.users {
+		users = append(users, u)
+	}
+	SortUsers(users)
+	return users, nil
+}
+
+// DelCredential deletes the credential
+func (fc *FileCredentials) DelCredential(accessKey string) error {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return err
+	}
+	if _, ok := fc.creds[accessKey]; !ok {
+		return NotFound
+	}
+	delete(fc.creds, accessKey)
+	return fc.save()
+}
+
+// ListCredentials returns the credentials of the user, ordered by creation time
+func (fc *FileCredentials) ListCredentials(userID string) ([]Credential, error) {
+	fc.Lock()
+	defer fc.Unlock()
+	if err := fc.load(); err != nil {
+		return nil, err
+	}
+	creds := make([]Credential, 0, 2)
+	for _, c := range fc.creds {
+		if c.UserID == userID {
+			creds = append(creds, c)
+		}
+	}
+	SortCredentials(creds)
+	return creds, nil
+}
+
+// SortUsers sorts the users by ID
+func SortUsers(users []User) {
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+}
+
+// SortCredentials sorts the credentials by creation time
+func SortCredentials(creds []Credential) {
+	sort.Slice(creds, func(i, j int) bool {
+		if creds[i].Created.Equal(creds[j].Created) {
+			return creds[i].AccessKey < creds[j].AccessKey
+		}
+		return creds[i].Created.Before(creds[j].Created)
+	})
+}
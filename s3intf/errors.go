@@ -0,0 +1,79 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+// Error is an error with an S3 error code (such as NoSuchKey), which the
+// server sends to the client, with the HTTP status belonging to the code.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
+type Error struct {
+	Code    string
+	Message string
+}
+
+// Error implements error.Error (returns the message)
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// NewError returns a new Error with the S3 error code and the message
+func NewError(code, message string) error {
+	return &Error{Code: code, Message: message}
+}
+
+// ErrorCode returns the S3 error code of the error, or "" if it is not an *Error
+func ErrorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+// IsNotFound returns whether the error means that the bucket or the object
+// does not exist
+func IsNotFound(err error) bool {
+	if err == NotFound {
+		return true
+	}
+	switch ErrorCode(err) {
+	case "NoSuchBucket", "NoSuchKey":
+		return true
+	}
+	return false
+}
+
+// The errors a Storage may return, besides NotFound - which the server
+// reports as NoSuchBucket or NoSuchKey, depending on the request.
+var (
+	NoSuchBucket            = NewError("NoSuchBucket", "the specified bucket does not exist")
+	NoSuchKey               = NewError("NoSuchKey", "the specified key does not exist")
+	BucketNotEmpty          = NewError("BucketNotEmpty", "the bucket you tried to delete is not empty")
+	BucketAlreadyOwnedByYou = NewError("BucketAlreadyOwnedByYou",
+		"the bucket you tried to create already exists, and you own it")
+	BucketAlreadyExists = NewError("BucketAlreadyExists", "the requested bucket name is not available")
+)
+
+// The errors of the authentication (GetOwner)
+var (
+	AccessDenied          = NewError("AccessDenied", "access denied")
+	InvalidAccessKeyId    = NewError("InvalidAccessKeyId", "the AWS access key Id you provided does not exist in our records")
+	SignatureDoesNotMatch = NewError("SignatureDoesNotMatch",
+		"the request signature we calculated does not match the signature you provided")
+	RequestExpired = NewError("AccessDenied", "request has expired")
+	// NoAuthorization is returned for unsigned requests, which may continue
+	// as Anonymous
+	NoAuthorization = NewError("AccessDenied", "no authorization header")
+)
@@ -0,0 +1,137 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NoSuchLifecycleConfiguration is returned by Lifecycler.GetLifecycle if the
+// bucket has no lifecycle configuration
+var NoSuchLifecycleConfiguration = NewError("NoSuchLifecycleConfiguration",
+	"the lifecycle configuration does not exist")
+
+// MaxLifecycleRules is the maximal number of the lifecycle rules of a bucket
+const MaxLifecycleRules = 1000
+
+// LifecycleRule is a rule of the lifecycle configuration of a bucket: the
+// objects matching its filter (Prefix and Tags) expire after ExpirationDays
+// (or at ExpirationDate), their noncurrent versions after NoncurrentDays,
+// and the incomplete multipart uploads are aborted after AbortIncompleteDays.
+// The zero values mean no such action.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/object-lifecycle-mgmt.html
+type LifecycleRule struct {
+	ID      string `json:"id,omitempty"`
+	Enabled bool   `json:"enabled"`
+	Prefix  string `json:"prefix,omitempty"`
+	// Tags must all be among the tags of the object
+	Tags                Tags      `json:"tags,omitempty"`
+	ExpirationDays      int       `json:"expirationDays,omitempty"`
+	ExpirationDate      time.Time `json:"expirationDate"`
+	NoncurrentDays      int       `json:"noncurrentDays,omitempty"`
+	AbortIncompleteDays int       `json:"abortIncompleteDays,omitempty"`
+}
+
+// Lifecycler is an optional interface of a Storage, for storing the lifecycle
+// configuration of the buckets (applied by s3lifecycle.Worker)
+type Lifecycler interface {
+	// GetLifecycle returns the lifecycle rules of the bucket -
+	// NoSuchLifecycleConfiguration if it has none
+	GetLifecycle(owner Owner, bucket string) ([]LifecycleRule, error)
+	// SetLifecycle sets (or deletes, if nil) the lifecycle rules of the bucket
+	SetLifecycle(owner Owner, bucket string, rules []LifecycleRule) error
+}
+
+// CheckLifecycleRules checks the lifecycle rules: there must be some (at most
+// MaxLifecycleRules), with unique IDs, and each must have an action with valid
+// days or date. The tag filters cannot be used with AbortIncompleteDays.
+func CheckLifecycleRules(rules []LifecycleRule) error {
+	if len(rules) == 0 {
+		return NewError("MalformedXML", "at least one lifecycle rule is required")
+	}
+	if len(rules) > MaxLifecycleRules {
+		return NewError("InvalidArgument", "at most "+strconv.Itoa(MaxLifecycleRules)+
+			" lifecycle rules are allowed")
+	}
+	ids := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if len(rule.ID) > 255 {
+			return NewError("InvalidArgument", "the ID of the rule is longer than 255 characters")
+		}
+		if rule.ID != "" {
+			if ids[rule.ID] {
+				return NewError("InvalidArgument", "rule ID "+rule.ID+" must be unique")
+			}
+			ids[rule.ID] = true
+		}
+		if rule.ExpirationDays == 0 && rule.ExpirationDate.IsZero() &&
+			rule.NoncurrentDays == 0 && rule.AbortIncompleteDays == 0 {
+			return NewError("InvalidRequest", "rule "+rule.ID+" has no action")
+		}
+		if rule.ExpirationDays < 0 || rule.NoncurrentDays < 0 || rule.AbortIncompleteDays < 0 {
+			return NewError("InvalidArgument", "the days of rule "+rule.ID+" must be positive")
+		}
+		if rule.ExpirationDays > 0 && !rule.ExpirationDate.IsZero() {
+			return NewError("InvalidArgument", "rule "+rule.ID+" cannot have both expiration days and date")
+		}
+		if d := rule.ExpirationDate; !d.IsZero() && !d.Equal(midnight(d)) {
+			return NewError("InvalidArgument", "the expiration date of rule "+rule.ID+
+				" must be at midnight GMT")
+		}
+		if rule.AbortIncompleteDays > 0 && len(rule.Tags) > 0 {
+			return NewError("InvalidRequest", "rule "+rule.ID+
+				" cannot abort incomplete multipart uploads with tag filter")
+		}
+		if err := rule.Tags.Check(MaxObjectTags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Matches returns whether the rule is enabled, and applies to the object with
+// the key and the tags
+func (rule LifecycleRule) Matches(key string, tags Tags) bool {
+	return rule.Enabled && strings.HasPrefix(key, rule.Prefix) && tags.Matches(rule.Tags)
+}
+
+// Expired returns whether the object created at the given time is expired
+// at now, by ExpirationDays or ExpirationDate
+func (rule LifecycleRule) Expired(created, now time.Time) bool {
+	if !rule.ExpirationDate.IsZero() {
+		return !now.Before(rule.ExpirationDate)
+	}
+	return rule.ExpirationDays > 0 && !now.Before(ExpirationTime(created, rule.ExpirationDays))
+}
+
+// ExpirationTime returns the time when something from t expires after the
+// given days: t plus the days, rounded up to the next midnight UTC, as S3 does
+func ExpirationTime(t time.Time, days int) time.Time {
+	t = t.UTC().AddDate(0, 0, days)
+	if d := midnight(t); !d.Equal(t) {
+		return d.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// midnight returns the start of the day of t, in UTC
+func midnight(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
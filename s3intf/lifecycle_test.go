@@ -0,0 +1,78 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifecycleRules(t *testing.T) {
+	date := time.Date(2013, 12, 31, 0, 0, 0, 0, time.UTC)
+	for i, tc := range []struct {
+		rules []LifecycleRule
+		code  string
+	}{
+		{[]LifecycleRule{{ID: "tmp", Enabled: true, Prefix: "tmp/", ExpirationDays: 1},
+			{ID: "old", NoncurrentDays: 30, Tags: Tags{"keep": "no"}},
+			{AbortIncompleteDays: 7}, {ExpirationDate: date}}, ""},
+		{nil, "MalformedXML"},
+		{[]LifecycleRule{{ID: "a", ExpirationDays: 1}, {ID: "a", NoncurrentDays: 1}}, "InvalidArgument"},
+		{[]LifecycleRule{{ID: "none", Prefix: "x"}}, "InvalidRequest"},
+		{[]LifecycleRule{{ExpirationDays: -1}}, "InvalidArgument"},
+		{[]LifecycleRule{{ExpirationDays: 1, ExpirationDate: date}}, "InvalidArgument"},
+		{[]LifecycleRule{{ExpirationDate: date.Add(time.Hour)}}, "InvalidArgument"},
+		{[]LifecycleRule{{AbortIncompleteDays: 1, Tags: Tags{"a": "b"}}}, "InvalidRequest"},
+		{[]LifecycleRule{{ExpirationDays: 1, Tags: Tags{"aws:x": "b"}}}, "InvalidTag"},
+	} {
+		if got := ErrorCode(CheckLifecycleRules(tc.rules)); got != tc.code {
+			t.Errorf("%d. got %q, awaited %q", i, got, tc.code)
+		}
+	}
+
+	created := time.Date(2013, 8, 16, 12, 0, 0, 0, time.UTC)
+	if got, awaited := ExpirationTime(created, 1), time.Date(2013, 8, 18, 0, 0, 0, 0, time.UTC); !got.Equal(awaited) {
+		t.Errorf("ExpirationTime: got %s, awaited %s", got, awaited)
+	}
+	if got := ExpirationTime(date, 1); !got.Equal(date.AddDate(0, 0, 1)) {
+		t.Errorf("ExpirationTime of midnight: got %s", got)
+	}
+	rule := LifecycleRule{Enabled: true, Prefix: "tmp/", Tags: Tags{"temp": "yes"}, ExpirationDays: 1}
+	for i, tc := range []struct {
+		key     string
+		tags    Tags
+		now     time.Time
+		awaited bool
+	}{
+		{"tmp/a", Tags{"temp": "yes", "x": "y"}, created.Add(36 * time.Hour), true},
+		{"tmp/a", Tags{"temp": "yes"}, created.Add(35 * time.Hour), false},
+		{"tmp/a", Tags{"temp": "no"}, created.Add(36 * time.Hour), false},
+		{"tmp/a", nil, created.Add(36 * time.Hour), false},
+		{"a", Tags{"temp": "yes"}, created.Add(36 * time.Hour), false},
+	} {
+		if got := rule.Matches(tc.key, tc.tags) && rule.Expired(created, tc.now); got != tc.awaited {
+			t.Errorf("%d. %s %v at %s: got %t, awaited %t", i, tc.key, tc.tags, tc.now, got, tc.awaited)
+		}
+	}
+	rule = LifecycleRule{Enabled: true, ExpirationDate: date}
+	if rule.Expired(created, date.Add(-time.Second)) || !rule.Expired(created, date) {
+		t.Errorf("ExpirationDate is not honored")
+	}
+	if rule.Enabled = false; rule.Matches("a", nil) {
+		t.Errorf("disabled rule matches")
+	}
+}
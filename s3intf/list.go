@@ -30,18 +30,22 @@ type ListFilter interface {
 	//Prefix limits results to only those keys that begin with the specified prefix,
 	//and delimiter causes list to roll up all keys that share a common prefix
 	//into a single summary list result.
+	//The names must be checked in lexicographical order.
 	Check(name string) (bool, error)
 
 	// Result returns the gathered common prefixes and whether the result is truncated
 	Result() (commonprefixes []string, truncated bool)
 }
 
-// NewListFilter returns a new filter with the given prefix, delimiter, marker, limit and skip
+// NewListFilter returns a new filter with the given prefix, delimiter, marker, limit and skip.
+// Only the names after the marker are listed (a common prefix is listed only
+// if the marker does not start with it), and the first skip of them are skipped.
+// Both the keys and the common prefixes count in the limit.
 func NewListFilter(prefix, delimiter, marker string, limit, skip int) ListFilter {
 	f := &listFilter{prefix: prefix, delimiter: delimiter, marker: marker,
 		limit: limit, skip: skip}
 	if f.delimiter != "" {
-		f.prefixes = make(map[string]bool, 4)
+		f.seen = make(map[string]bool, 4)
 	}
 	return f
 }
@@ -51,65 +55,139 @@ type listFilter struct {
 	limit, skip               int
 	n                         int
 	truncated                 bool
-	prefixes                  map[string]bool
+	seen                      map[string]bool
+	prefixes                  []string
 }
 
 // Check implements ListFilter.Check
 func (f *listFilter) Check(name string) (bool, error) {
+	if f.marker != "" && name <= f.marker || !strings.HasPrefix(name, f.prefix) {
+		return false, nil
+	}
+	//The prefix and delimiter parameters limit the kind of results returned by a list operation.
+	//Prefix limits results to only those keys that begin with the specified prefix,
+	//and delimiter causes list to roll up all keys that share a common prefix
+	//into a single summary list result.
+	var dir string
+	if f.delimiter != "" {
+		if i := strings.Index(name[len(f.prefix):], f.delimiter); i >= 0 {
+			dir = name[:len(f.prefix)+i+len(f.delimiter)]
+			if f.seen[dir] || strings.HasPrefix(f.marker, dir) {
+				return false, nil
+			}
+			f.seen[dir] = true
+		}
+	}
 	n := f.n
 	f.n++
 	if Debug {
-		log.Printf("Check(%s) n=%d skip=%d limit=%d", name, n, f.skip, f.limit)
+		log.Printf("Check(%s) n=%d skip=%d limit=%d dir=%q", name, n, f.skip, f.limit, dir)
 	}
 	if n < f.skip {
 		return false, nil
 	}
-	if n-f.skip > f.limit {
+	if n-f.skip >= f.limit {
 		f.truncated = true
 		return false, io.EOF
 	}
+	if dir == "" {
+		return true, nil
+	}
+	f.prefixes = append(f.prefixes, dir)
+	return false, nil
+}
 
-	//The prefix and delimiter parameters limit the kind of results returned by a list operation.
-	//Prefix limits results to only those keys that begin with the specified prefix,
-	//and delimiter causes list to roll up all keys that share a common prefix
-	//into a single summary list result.
+// Result implements ListFilter.Result
+func (f *listFilter) Result() (commonprefixes []string, truncated bool) {
+	return f.prefixes, f.truncated
+}
+
+// KeySeeker is an ordered (lexicographically) enumerator of keys, which can be
+// positioned - a Storage whose keys are in such an index (as a B-tree) can list
+// with SeekList, without reading the keys before the marker and the keys
+// rolled up into common prefixes.
+type KeySeeker interface {
+	// Seek positions the enumerator before the first key which is >= key
+	Seek(key string) error
+	// Next returns the next key, or io.EOF at the end
+	Next() (string, error)
+}
+
+// SeekList lists the keys of s with a ListFilter (see NewListFilter), calling fn
+// for each key to be listed. Instead of checking each key, it seeks to the
+// marker, and over the common prefixes; and stops at the end of the prefix.
+func SeekList(s KeySeeker, prefix, delimiter, marker string, limit, skip int,
+	fn func(key string) error) (commonprefixes []string, truncated bool, err error) {
+
+	f := NewListFilter(prefix, delimiter, marker, limit, skip).(*listFilter)
+	start := prefix
+	if marker != "" && marker >= start {
+		start = marker + "\x00" // the least string after marker
+		if delimiter != "" && strings.HasPrefix(marker, prefix) {
+			// the marker may be (in) a common prefix
+			if i := strings.Index(marker[len(prefix):], delimiter); i >= 0 {
+				start = prefixEnd(marker[:len(prefix)+i+len(delimiter)])
+			}
+		}
+	}
+	if err = s.Seek(start); err != nil {
+		return
+	}
 	var (
-		i   int
+		key string
 		ok  bool
-		dir string
 	)
-	if f.delimiter == "" {
-		i = -1
-	}
-
-	if f.prefix == "" || strings.HasPrefix(name, f.prefix) {
-		var base string
-		if f.delimiter != "" {
-			base = name[len(f.prefix):]
-			i = strings.Index(base, f.delimiter)
+	for {
+		if key, err = s.Next(); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		if !strings.HasPrefix(key, prefix) {
+			if key > prefix {
+				break // after all the keys with prefix
+			}
+			continue
 		}
-		if Debug {
-			log.Printf("delim=%q name=%q => base=%q i=%d", f.delimiter, name, base, i)
+		n := len(f.prefixes)
+		if ok, err = f.Check(key); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
 		}
-		if i < 0 {
-			return true, nil
-		} // delimiter != "" && delimiter in key[len(prefix):]
-		dir = base[:i]
-		if _, ok = f.prefixes[dir]; !ok {
-			f.prefixes[dir] = true
+		if ok {
+			if err = fn(key); err != nil {
+				return
+			}
+			continue
+		}
+		if len(f.prefixes) > n { // new common prefix: seek over it
+			end := prefixEnd(f.prefixes[n])
+			if end == "" {
+				break
+			}
+			if err = s.Seek(end); err != nil {
+				return
+			}
 		}
 	}
-	return false, nil
+	commonprefixes, truncated = f.Result()
+	return
 }
 
-// Result implements ListFilter.Result
-func (f *listFilter) Result() (commonprefixes []string, truncated bool) {
-	truncated = f.truncated
-	if len(f.prefixes) > 0 {
-		commonprefixes = make([]string, 0, len(f.prefixes))
-		for dir := range f.prefixes {
-			commonprefixes = append(commonprefixes, dir)
+// prefixEnd returns the least string which is greater than all strings
+// starting with prefix, or "" if there is no such string
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
 		}
 	}
-	return
+	return ""
 }
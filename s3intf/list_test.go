@@ -0,0 +1,110 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sliceSeeker is a KeySeeker on a sorted slice, counting the returned keys
+type sliceSeeker struct {
+	keys []string
+	i, n int
+}
+
+func (s *sliceSeeker) Seek(key string) error {
+	s.i = sort.SearchStrings(s.keys, key)
+	return nil
+}
+
+func (s *sliceSeeker) Next() (string, error) {
+	if s.i >= len(s.keys) {
+		return "", io.EOF
+	}
+	s.i++
+	s.n++
+	return s.keys[s.i-1], nil
+}
+
+func TestList(t *testing.T) {
+	keys := []string{"a", "b/1", "b/2", "b/3", "c", "d/1", "d/2/x", "e", "f"}
+	for i, tc := range []struct {
+		prefix, delimiter, marker string
+		limit                     int
+		awaited                   string
+		truncated                 bool
+		// maxRead is the maximal number of keys SeekList may read
+		maxRead int
+	}{
+		{"", "", "", 1000, "a,b/1,b/2,b/3,c,d/1,d/2/x,e,f", false, 9},
+		{"", "", "", 3, "a,b/1,b/2", true, 4},
+		{"", "", "b/2", 3, "b/3,c,d/1", true, 4},
+		{"", "/", "", 3, "a,b/,c", true, 5},
+		{"", "/", "c", 3, "d/,e,f", false, 4},
+		// the marker is in a common prefix
+		{"", "/", "b/1", 1000, "c,d/,e,f", false, 4},
+		{"", "/", "b/", 2, "c,d/", true, 4},
+		{"d/", "/", "", 1000, "d/1,d/2/", false, 3},
+		{"b", "", "b/1", 1000, "b/2,b/3", false, 3},
+		{"x", "", "", 1000, "", false, 0},
+	} {
+		var listed []string
+		add := func(key string) error {
+			listed = append(listed, key)
+			return nil
+		}
+		merge := func(commonprefixes []string) string {
+			all := append(listed, commonprefixes...)
+			sort.Strings(all)
+			return strings.Join(all, ",")
+		}
+
+		f := NewListFilter(tc.prefix, tc.delimiter, tc.marker, tc.limit, 0)
+		for _, k := range keys {
+			ok, err := f.Check(k)
+			if err == io.EOF {
+				break
+			}
+			if ok {
+				add(k)
+			}
+		}
+		commonprefixes, truncated := f.Result()
+		if got := merge(commonprefixes); got != tc.awaited || truncated != tc.truncated {
+			t.Errorf("%d. filter: got %q (%t), awaited %q (%t)", i, got, truncated,
+				tc.awaited, tc.truncated)
+		}
+
+		listed = listed[:0]
+		s := &sliceSeeker{keys: keys}
+		commonprefixes, truncated, err := SeekList(s, tc.prefix, tc.delimiter, tc.marker, tc.limit, 0, add)
+		if err != nil {
+			t.Errorf("%d. SeekList: %s", i, err)
+			continue
+		}
+		if got := merge(commonprefixes); got != tc.awaited || truncated != tc.truncated {
+			t.Errorf("%d. SeekList: got %q (%t), awaited %q (%t)", i, got, truncated,
+				tc.awaited, tc.truncated)
+		}
+		if s.n > tc.maxRead {
+			t.Errorf("%d. SeekList read %d keys, awaited at most %d", i, s.n, tc.maxRead)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxPartNumber is the maximal part number of a multipart upload
+const MaxPartNumber = 10000
+
+// MinPartSize is the minimal size of a part - except the last one
+var MinPartSize int64 = 5 << 20
+
+var (
+	// NoSuchUpload is returned for unknown (or already completed/aborted) upload IDs
+	NoSuchUpload = NewError("NoSuchUpload", "the specified multipart upload does not exist")
+	// InvalidPart is returned when a part to be completed is not uploaded,
+	// or its ETag does not match
+	InvalidPart = NewError("InvalidPart", "one or more of the specified parts could not be found")
+	// InvalidPartOrder is returned when the parts to be completed are not
+	// in ascending order
+	InvalidPartOrder = NewError("InvalidPartOrder", "the list of parts was not in ascending order")
+	// EntityTooSmall is returned when a part (except the last) is smaller
+	// than MinPartSize
+	EntityTooSmall = NewError("EntityTooSmall", "your proposed upload is smaller than the minimum allowed object size")
+)
+
+// Part is an uploaded part of a multipart upload
+type Part struct {
+	// Number is the part number (1..MaxPartNumber)
+	Number int
+	// ETag is the hex encoded MD5 hash of the part
+	ETag         string
+	Size         int64
+	LastModified time.Time
+}
+
+// Upload is an initiated, not completed (nor aborted) multipart upload
+type Upload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+	// Initiator is the canonical ID, InitiatorName is the display name
+	// of the user who initiated the upload
+	Initiator, InitiatorName string
+	// ACL is the ACL given at the initiation, to be set on the completed object;
+	// nil if there is no such
+	ACL *ACL
+}
+
+// Multiparter is an optional interface of Storage, for multipart uploads
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/mpuoverview.html
+type Multiparter interface {
+	// InitMultipart initiates a multipart upload (of an object with the metadata
+	// and the ACL, which may be nil) for the initiator, and returns its ID
+	InitMultipart(owner, initiator Owner, bucket, object, filename, media string, meta Metadata,
+		acl *ACL) (uploadID string, err error)
+	// PutPart stores a part of the upload, replacing the previously
+	// uploaded part with the same number
+	PutPart(owner Owner, bucket, object, uploadID string, partNumber int,
+		body io.Reader, size int64, md5hash []byte) error
+	// CompleteMultipart assembles the object from the given parts (see CompleteParts),
+	// deletes the not used parts, and returns the object's ETag and the ID of
+	// the created version ("" if the bucket is not versioned)
+	CompleteMultipart(owner Owner, bucket, object, uploadID string, parts []Part) (
+		etag, versionID string, err error)
+	// AbortMultipart deletes the upload with all its parts
+	AbortMultipart(owner Owner, bucket, object, uploadID string) error
+	// ListParts returns the uploaded parts, ordered by number
+	ListParts(owner Owner, bucket, object, uploadID string) ([]Part, error)
+	// ListMultipartUploads returns the uploads in progress whose key starts
+	// with prefix, ordered by key and initiation time
+	ListMultipartUploads(owner Owner, bucket, prefix string) ([]Upload, error)
+}
+
+// NewUploadID returns a new, random upload ID
+func NewUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CompleteParts checks the requested parts against the uploaded ones,
+// and returns the uploaded parts in the requested order.
+// The requested parts must be in ascending order, uploaded with the given ETag,
+// and at least MinPartSize big - except the last one.
+func CompleteParts(uploaded, requested []Part) ([]Part, error) {
+	if len(requested) == 0 {
+		return nil, InvalidPart
+	}
+	byNumber := make(map[int]Part, len(uploaded))
+	for _, p := range uploaded {
+		byNumber[p.Number] = p
+	}
+	parts := make([]Part, len(requested))
+	for i, req := range requested {
+		if i > 0 && req.Number <= requested[i-1].Number {
+			return nil, InvalidPartOrder
+		}
+		p, ok := byNumber[req.Number]
+		if !ok || !strings.EqualFold(strings.Trim(req.ETag, `"`), p.ETag) {
+			return nil, InvalidPart
+		}
+		if p.Size < MinPartSize && i < len(requested)-1 {
+			return nil, EntityTooSmall
+		}
+		parts[i] = p
+	}
+	return parts, nil
+}
+
+// MultipartETag returns the ETag of an object assembled from the parts,
+// as S3 computes it: the MD5 hash of the parts' MD5 hashes, and the number of parts.
+func MultipartETag(parts []Part) string {
+	hsh := md5.New()
+	for _, p := range parts {
+		b, _ := hex.DecodeString(p.ETag)
+		hsh.Write(b)
+	}
+	return hex.EncodeToString(hsh.Sum(nil)) + "-" + strconv.Itoa(len(parts))
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+// NoSuchBucketPolicy is returned by PolicyStorer.GetPolicy if the bucket has no policy
+var NoSuchBucketPolicy = NewError("NoSuchBucketPolicy", "the bucket policy does not exist")
+
+// PolicyStorer is an optional interface of a Storage, for storing the bucket
+// policies (JSON documents, see the s3policy package).
+// The policies grant access to others than the bucket's owner only if the
+// Storage is an ACLer, too.
+type PolicyStorer interface {
+	// GetPolicy returns the policy of the bucket - or NoSuchBucketPolicy
+	GetPolicy(owner Owner, bucket string) ([]byte, error)
+	// SetPolicy sets the policy of the bucket; an empty policy deletes it
+	SetPolicy(owner Owner, bucket string, policy []byte) error
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PostPolicy is the policy document of a browser-based POST upload.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-HTTPPOSTConstructPolicy.html
+type PostPolicy struct {
+	Expiration time.Time
+	Conditions []PostCondition
+	// MinLength and MaxLength are the content-length-range; MaxLength is -1 if not given
+	MinLength, MaxLength int64
+}
+
+// PostCondition is a condition of a PostPolicy on a form field
+type PostCondition struct {
+	// Op is "eq" or "starts-with"
+	Op string
+	// Field is the lowercased name of the form field, without the $ prefix
+	Field string
+	Value string
+}
+
+// postExempt are the form fields which need no condition in the policy
+var postExempt = map[string]bool{"awsaccesskeyid": true, "signature": true, "policy": true,
+	"file": true, "x-amz-signature": true}
+
+// ParsePostPolicy decodes the base64 encoded policy document.
+// Its errors have the InvalidPolicyDocument code.
+func ParsePostPolicy(policy string) (*PostPolicy, error) {
+	b, err := b64.DecodeString(policy)
+	if err != nil {
+		return nil, NewError("InvalidPolicyDocument", "policy is not base64 encoded: "+err.Error())
+	}
+	var doc struct {
+		Expiration string
+		Conditions []json.RawMessage
+	}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		return nil, NewError("InvalidPolicyDocument", "cannot parse policy: "+err.Error())
+	}
+	p := &PostPolicy{MaxLength: -1}
+	if p.Expiration, err = time.Parse(time.RFC3339, doc.Expiration); err != nil {
+		return nil, NewError("InvalidPolicyDocument", "bad expiration "+doc.Expiration)
+	}
+	for _, raw := range doc.Conditions {
+		var m map[string]string
+		if err = json.Unmarshal(raw, &m); err == nil {
+			// {"bucket": "name"} is an exact match
+			for k, v := range m {
+				p.Conditions = append(p.Conditions, PostCondition{Op: "eq",
+					Field: strings.ToLower(strings.TrimPrefix(k, "$")), Value: v})
+			}
+			continue
+		}
+		var arr []interface{}
+		if err = json.Unmarshal(raw, &arr); err != nil || len(arr) != 3 {
+			return nil, NewError("InvalidPolicyDocument", "bad condition "+string(raw))
+		}
+		op, _ := arr[0].(string)
+		switch op = strings.ToLower(op); op {
+		case "content-length-range":
+			min, ok1 := arr[1].(float64)
+			max, ok2 := arr[2].(float64)
+			if !ok1 || !ok2 || min < 0 || max < min {
+				return nil, NewError("InvalidPolicyDocument", "bad content-length-range "+string(raw))
+			}
+			p.MinLength, p.MaxLength = int64(min), int64(max)
+		case "eq", "starts-with":
+			field, ok1 := arr[1].(string)
+			value, ok2 := arr[2].(string)
+			if !ok1 || !ok2 || !strings.HasPrefix(field, "$") {
+				return nil, NewError("InvalidPolicyDocument", "bad condition "+string(raw))
+			}
+			p.Conditions = append(p.Conditions, PostCondition{Op: op,
+				Field: strings.ToLower(field[1:]), Value: value})
+		default:
+			return nil, NewError("InvalidPolicyDocument", "unknown condition "+op)
+		}
+	}
+	return p, nil
+}
+
+// Check checks the form fields (keyed by the lowercased names, with the bucket
+// name under "bucket") against the policy: it must not be expired, every
+// condition must hold, and every field (but the signature and the x-ignore-*
+// ones) must have a condition. The content-length-range is not checked here.
+func (p PostPolicy) Check(fields map[string]string) error {
+	if !now().Before(p.Expiration) {
+		return NewError("AccessDenied", "Invalid according to Policy: Policy expired.")
+	}
+	covered := make(map[string]bool, len(p.Conditions))
+	for _, c := range p.Conditions {
+		covered[c.Field] = true
+		v := fields[c.Field]
+		if c.Op == "eq" && v != c.Value || c.Op == "starts-with" && !strings.HasPrefix(v, c.Value) {
+			return NewError("AccessDenied", fmt.Sprintf(
+				"Invalid according to Policy: Policy Condition failed: [%q, \"$%s\", %q]",
+				c.Op, c.Field, c.Value))
+		}
+	}
+	for k := range fields {
+		if !(covered[k] || postExempt[k] || k == "bucket" || strings.HasPrefix(k, "x-ignore-")) {
+			return NewError("AccessDenied",
+				"Invalid according to Policy: Extra input fields: "+k)
+		}
+	}
+	return nil
+}
+
+// GetPostOwner returns the Owner who signed the policy of the POST form
+// (fields keyed by the lowercased names), with AWS Signature Version 2
+// (AWSAccessKeyId, signature) or 4 (x-amz-algorithm, x-amz-credential,
+// x-amz-date, x-amz-signature).
+// It returns NoAuthorization if the form is not signed.
+func GetPostOwner(b Storage, fields map[string]string) (Owner, error) {
+	policy := fields["policy"]
+	if alg := fields["x-amz-algorithm"]; alg != "" {
+		if alg != SignV4Algorithm {
+			return nil, NewError("InvalidArgument", "unsupported x-amz-algorithm "+alg)
+		}
+		sig := &SignatureV4{Signature: fields["x-amz-signature"]}
+		if err := sig.parseCredential(fields["x-amz-credential"]); err != nil {
+			return nil, NewError("InvalidArgument", err.Error())
+		}
+		var err error
+		if sig.Date, err = time.Parse(ISO8601Format, fields["x-amz-date"]); err != nil {
+			return nil, NewError("InvalidArgument", "bad x-amz-date: "+err.Error())
+		}
+		if sig.Date.Format(yyyymmdd) != sig.ScopeDate {
+			return nil, NewError("InvalidArgument", "credential date "+sig.ScopeDate+
+				" does not match x-amz-date")
+		}
+		if policy == "" {
+			return nil, NewError("InvalidArgument", "policy is required for signed POST")
+		}
+		owner, err := b.GetOwner(sig.AccessKey)
+		if err != nil {
+			return nil, InvalidAccessKeyId
+		}
+		if !CheckV4(owner, sig, []byte(policy)) {
+			return nil, SignatureDoesNotMatch
+		}
+		return owner, nil
+	}
+	access := fields["awsaccesskeyid"]
+	if access == "" {
+		return nil, NoAuthorization
+	}
+	if policy == "" || fields["signature"] == "" {
+		return nil, NewError("InvalidArgument", "policy and signature are required for signed POST")
+	}
+	owner, err := b.GetOwner(access)
+	if err != nil {
+		return nil, InvalidAccessKeyId
+	}
+	challenge, err := b64.DecodeString(fields["signature"])
+	if err != nil || !Check(owner, []byte(policy), challenge) {
+		return nil, SignatureDoesNotMatch
+	}
+	return owner, nil
+}
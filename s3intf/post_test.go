@@ -0,0 +1,83 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPostPolicy(t *testing.T) {
+	defer func(f func() time.Time) { now = f }(now)
+	now = func() time.Time { return time.Date(2013, 8, 16, 12, 0, 0, 0, time.UTC) }
+
+	p, err := ParsePostPolicy(b64.EncodeToString([]byte(`{"expiration": "2013-08-17T00:00:00Z",
+		"conditions": [{"bucket": "b"}, ["starts-with", "$key", "user/"], {"acl": "public-read"},
+		["eq", "$Content-Type", "image/png"], ["content-length-range", 1, 1024]]}`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MinLength != 1 || p.MaxLength != 1024 || len(p.Conditions) != 4 {
+		t.Fatalf("bad policy %+v", p)
+	}
+	base := map[string]string{"bucket": "b", "key": "user/a.png", "acl": "public-read",
+		"content-type": "image/png", "policy": "x", "signature": "y", "awsaccesskeyid": "z"}
+	for i, tc := range []struct {
+		field, value string
+		ok           bool
+	}{
+		{"", "", true},
+		{"key", "other/a.png", false},
+		{"acl", "private", false},
+		{"content-type", "image/jpeg", false},
+		{"bucket", "c", false},
+		{"x-amz-meta-extra", "1", false},
+		{"x-ignore-this", "1", true},
+	} {
+		fields := make(map[string]string, len(base)+1)
+		for k, v := range base {
+			fields[k] = v
+		}
+		if tc.field != "" {
+			fields[tc.field] = tc.value
+		}
+		err := p.Check(fields)
+		if tc.ok && err != nil {
+			t.Errorf("%d. %s=%q: %s", i, tc.field, tc.value, err)
+		} else if !tc.ok && ErrorCode(err) != "AccessDenied" {
+			t.Errorf("%d. %s=%q: awaited AccessDenied, got %v", i, tc.field, tc.value, err)
+		}
+	}
+	now = func() time.Time { return time.Date(2013, 8, 17, 0, 0, 1, 0, time.UTC) }
+	if err = p.Check(base); ErrorCode(err) != "AccessDenied" {
+		t.Errorf("expired policy: awaited AccessDenied, got %v", err)
+	}
+
+	for i, policy := range []string{
+		"not base64!",
+		b64.EncodeToString([]byte(`not json`)),
+		b64.EncodeToString([]byte(`{"expiration": "tomorrow", "conditions": []}`)),
+		b64.EncodeToString([]byte(`{"expiration": "2013-08-17T00:00:00Z", "conditions": [["gt", "$key", "a"]]}`)),
+		b64.EncodeToString([]byte(`{"expiration": "2013-08-17T00:00:00Z", "conditions": [["eq", "key", "a"]]}`)),
+		b64.EncodeToString([]byte(`{"expiration": "2013-08-17T00:00:00Z",
+			"conditions": [["content-length-range", 10, 1]]}`)),
+	} {
+		if _, err := ParsePostPolicy(policy); ErrorCode(err) != "InvalidPolicyDocument" {
+			t.Errorf("%d. awaited InvalidPolicyDocument, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import "strings"
+
+// UnknownHost is returned by Router.Route for the hosts which are not served
+var UnknownHost = NewError("InvalidURI", "the host is not served here")
+
+// Router decides which bucket a request is for, by its Host header: a base
+// domain is for path-style requests (/bucket/key), its subdomains are the
+// virtual-host style buckets (bucket.domain/key), and custom domains can be
+// mapped to buckets (CNAMEs).
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/VirtualHosting.html
+type Router struct {
+	// Domains are the base domains of the service
+	Domains []string
+	// CNAMEs maps the custom domains (such as static.johnsmith.net) to the buckets
+	CNAMEs map[string]string
+	// PathStyleOnly disables the virtual-host style buckets (but the CNAMEs)
+	PathStyleOnly bool
+}
+
+// Route returns the bucket given by the host, "" for path-style requests;
+// or UnknownHost. A subdomain is matched to the longest base domain.
+func (rt Router) Route(host string) (string, error) {
+	host = strings.ToLower(StripPort(host))
+	for name, bucket := range rt.CNAMEs {
+		if strings.ToLower(StripPort(name)) == host {
+			return bucket, nil
+		}
+	}
+	var bucket, domain string
+	found := false
+	for _, d := range rt.Domains {
+		d = strings.ToLower(StripPort(d))
+		switch {
+		case d == "":
+		case host == d:
+			return "", nil
+		case rt.PathStyleOnly || len(d) <= len(domain):
+		case strings.HasSuffix(host, "."+d):
+			bucket, domain, found = host[:len(host)-len(d)-1], d, true
+		}
+	}
+	if !found {
+		return "", UnknownHost
+	}
+	return bucket, nil
+}
+
+// HostBucket returns the bucket given by the host for the service's host:
+// the subdomain of serviceHost, or the whole host if serviceHost is empty
+// (as a CNAME of the bucket); "" for path-style requests (or other hosts).
+func HostBucket(host, serviceHost string) string {
+	host = StripPort(host)
+	if serviceHost == "" {
+		return host
+	}
+	bucket, err := Router{Domains: []string{serviceHost}}.Route(host)
+	if err != nil {
+		return ""
+	}
+	return bucket
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	rt := Router{Domains: []string{"s3.amazonaws.com", "amazonaws.com", "localhost:8080"},
+		CNAMEs: map[string]string{"static.johnsmith.net": "static.johnsmith.net", "www.example.com": "site"}}
+	for i, tc := range []struct {
+		host, bucket string
+		pathStyle    bool
+		err          error
+	}{
+		{"s3.amazonaws.com", "", false, nil},
+		{"S3.amazonaws.com:443", "", false, nil},
+		{"johnsmith.s3.amazonaws.com", "johnsmith", false, nil},
+		{"johnsmith.s3.amazonaws.com", "", true, UnknownHost},
+		{"my.bucket.s3.amazonaws.com", "my.bucket", false, nil},
+		{"johnsmith.amazonaws.com", "johnsmith", false, nil},
+		{"amazonaws.com", "", false, nil},
+		{"localhost", "", false, nil},
+		{"test.localhost:8080", "test", false, nil},
+		{"static.johnsmith.net:8080", "static.johnsmith.net", false, nil},
+		{"www.example.com", "site", true, nil},
+		{"example.com", "", false, UnknownHost},
+		{"s3amazonaws.com", "", false, UnknownHost},
+		{"evil.com", "", false, UnknownHost},
+	} {
+		rt.PathStyleOnly = tc.pathStyle
+		bucket, err := rt.Route(tc.host)
+		if bucket != tc.bucket || err != tc.err {
+			t.Errorf("%d. %s: got %q, %v; awaited %q, %v", i, tc.host, bucket, err, tc.bucket, tc.err)
+		}
+	}
+
+	for i, tc := range []struct {
+		host, serviceHost, awaited string
+	}{
+		{"johnsmith.s3.amazonaws.com", "s3.amazonaws.com", "johnsmith"},
+		{"s3.amazonaws.com", "s3.amazonaws.com", ""},
+		{"static.johnsmith.net:8080", "", "static.johnsmith.net"},
+		// not a subdomain
+		{"localhost", "s3.amazonaws.com", ""},
+		{"x", "s3.amazonaws.com", ""},
+	} {
+		if got := HostBucket(tc.host, tc.serviceHost); got != tc.awaited {
+			t.Errorf("%d. %s (%s): got %q, awaited %q", i, tc.host, tc.serviceHost, got, tc.awaited)
+		}
+	}
+}
+
+func TestRoutedBytesToSign(t *testing.T) {
+	r, err := http.NewRequest("GET", "http://www.example.com/photos/puppy.jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RequestURI = "/photos/puppy.jpg"
+	r.Header.Set("Date", "Tue, 27 Mar 2007 19:36:42 +0000")
+	bucket, err := Router{CNAMEs: map[string]string{"www.example.com": "site"}}.Route(r.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(RoutedBytesToSign(r, bucket)); !strings.HasSuffix(got, "\n/site/photos/puppy.jpg") {
+		t.Errorf("got %q", got)
+	}
+	if got := string(GetBytesToSign(r, "s3.amazonaws.com")); !strings.HasSuffix(got, "\n/photos/puppy.jpg") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// TaggingMetadata is the metadata of an object which holds its tags, URL query
+// encoded (as in the x-amz-tagging header), so they are stored with the object
+const TaggingMetadata = "X-Amz-Tagging"
+
+// The limits of the tags.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/object-tagging.html
+const (
+	MaxObjectTags     = 10
+	MaxBucketTags     = 50
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+)
+
+// NoSuchTagSet is returned by Tagger.GetTags if the bucket has no tags
+var NoSuchTagSet = NewError("NoSuchTagSet", "there is no tag set associated with the bucket")
+
+// Tags are the key-value pairs of the tag set of an object or a bucket
+type Tags map[string]string
+
+// Tagger is an optional interface of a Storage which can store the tags of the
+// objects and of the buckets (the object's tags belong to its Metadata,
+// under TaggingMetadata, so they are replaced with the object).
+type Tagger interface {
+	// GetTags returns the tags of the object, or of the bucket, if object is
+	// empty - NoSuchTagSet if the bucket has no tags
+	GetTags(owner Owner, bucket, object string) (Tags, error)
+	// SetTags replaces the tags of the object, or of the bucket, if object is
+	// empty; empty tags delete the tag set
+	SetTags(owner Owner, bucket, object string, tags Tags) error
+}
+
+// ParseTagging parses the URL query encoded tags (such as key1=value1&key2=value2)
+// of the x-amz-tagging header. Its errors have the InvalidTag code.
+func ParseTagging(s string) (Tags, error) {
+	if s == "" {
+		return nil, nil
+	}
+	q, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, NewError("InvalidTag", "cannot parse tags "+s+": "+err.Error())
+	}
+	tags := make(Tags, len(q))
+	for k, v := range q {
+		if len(v) > 1 {
+			return nil, NewError("InvalidTag", "cannot provide multiple tags with the same key "+k)
+		}
+		tags[k] = v[0]
+	}
+	return tags, nil
+}
+
+// Encode returns the URL query encoding of the tags, sorted by the keys
+func (tags Tags) Encode() string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf []string
+	for _, k := range keys {
+		buf = append(buf, url.QueryEscape(k)+"="+url.QueryEscape(tags[k]))
+	}
+	return strings.Join(buf, "&")
+}
+
+// Check checks that there are at most max tags, with non-empty keys
+// (not in the reserved aws: namespace) of at most MaxTagKeyLength characters,
+// and values of at most MaxTagValueLength characters.
+// Its errors have the InvalidTag code.
+func (tags Tags) Check(max int) error {
+	if len(tags) > max {
+		return NewError("InvalidTag", "cannot have more than "+strconv.Itoa(max)+" tags")
+	}
+	for k, v := range tags {
+		if k == "" || utf8.RuneCountInString(k) > MaxTagKeyLength {
+			return NewError("InvalidTag", "the tag key "+k+" has invalid length")
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return NewError("InvalidTag", "the tag key "+k+" uses the reserved aws: prefix")
+		}
+		if utf8.RuneCountInString(v) > MaxTagValueLength {
+			return NewError("InvalidTag", "the value of the tag "+k+" is too long")
+		}
+	}
+	return nil
+}
+
+// Matches returns whether the tags include every tag of filter
+func (tags Tags) Matches(filter Tags) bool {
+	for k, v := range filter {
+		if w, ok := tags[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Tags returns the tags stored in the metadata (under TaggingMetadata)
+func (m Metadata) Tags() Tags {
+	tags, err := ParseTagging(m[TaggingMetadata])
+	if err != nil {
+		return nil
+	}
+	return tags
+}
+
+// SetTags stores the tags in the metadata (under TaggingMetadata), or
+// deletes them, if tags is empty. It returns the (maybe new) metadata.
+func (m Metadata) SetTags(tags Tags) Metadata {
+	if len(tags) == 0 {
+		delete(m, TaggingMetadata)
+		return m
+	}
+	if m == nil {
+		m = make(Metadata, 1)
+	}
+	m[TaggingMetadata] = tags.Encode()
+	return m
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTags(t *testing.T) {
+	for i, tc := range []struct {
+		tagging, encoded string
+		ok               bool
+	}{
+		{"", "", true},
+		{"b=2&a=1", "a=1&b=2", true},
+		{"project=s3%20weed&empty=", "empty=&project=s3+weed", true},
+		{"a=1&a=2", "", false},
+		{"=1", "", false},
+		{"aws:created=1", "", false},
+		{strings.Repeat("k", MaxTagKeyLength+1) + "=1", "", false},
+		{"k=" + strings.Repeat("v", MaxTagValueLength+1), "", false},
+		{"a=1&b=2&c=3&d=4&e=5&f=6&g=7&h=8&i=9&j=10&k=11", "", false},
+		{"a=%zz", "", false},
+	} {
+		tags, err := ParseTagging(tc.tagging)
+		if err == nil {
+			err = tags.Check(MaxObjectTags)
+		}
+		if !tc.ok {
+			if ErrorCode(err) != "InvalidTag" {
+				t.Errorf("%d. %q: awaited InvalidTag error, got %v", i, tc.tagging, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. %q: %s", i, tc.tagging, err)
+			continue
+		}
+		if got := tags.Encode(); got != tc.encoded {
+			t.Errorf("%d. %q: got %q, awaited %q", i, tc.tagging, got, tc.encoded)
+		}
+		meta := Metadata(nil).SetTags(tags)
+		if got := meta.Tags(); len(got) != len(tags) || !got.Matches(tags) {
+			t.Errorf("%d. %q: metadata round trip gave %v", i, tc.tagging, got)
+		}
+	}
+
+	tags := Tags{"project": "s3weed", "env": "test"}
+	for i, tc := range []struct {
+		filter  Tags
+		awaited bool
+	}{
+		{nil, true},
+		{Tags{"env": "test"}, true},
+		{Tags{"env": "test", "project": "s3weed"}, true},
+		{Tags{"env": "prod"}, false},
+		{Tags{"owner": ""}, false},
+	} {
+		if got := tags.Matches(tc.filter); got != tc.awaited {
+			t.Errorf("%d. %v matches %v: got %t, awaited %t", i, tags, tc.filter, got, tc.awaited)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// The versioning states of a bucket - an unversioned bucket's state is "".
+// Once enabled, versioning can only be suspended.
+const (
+	VersioningEnabled   = "Enabled"
+	VersioningSuspended = "Suspended"
+)
+
+// NullVersionID is the version ID of the objects stored while the bucket's
+// versioning was not enabled
+const NullVersionID = "null"
+
+// NoSuchVersion is returned for an unknown version ID
+var NoSuchVersion = NewError("NoSuchVersion", "the specified version does not exist")
+
+// Version is a version of an object, or a delete marker
+type Version struct {
+	Object
+	// IsLatest is true for the current version of the object
+	IsLatest bool
+	// DeleteMarker is true if the object was deleted by this version
+	DeleteMarker bool
+}
+
+// Versioner is an optional interface of a Storage, for keeping the versions
+// of the objects.
+// In a versioned (Enabled or Suspended) bucket, Put keeps the previous version
+// (except the null version, in a Suspended bucket), and Del adds a delete marker;
+// Get, Stat and List return the latest version only, if it is not a delete marker.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/Versioning.html
+type Versioner interface {
+	// Versioning returns the versioning state of the bucket
+	Versioning(owner Owner, bucket string) (string, error)
+	// SetVersioning sets the versioning state of the bucket (Enabled or Suspended)
+	SetVersioning(owner Owner, bucket, state string) error
+	// StatVersion returns the version of the object; the latest one (which may
+	// be a delete marker) if versionID is empty
+	StatVersion(owner Owner, bucket, object, versionID string) (Version, error)
+	// GetVersion retrieves the version of the object, as Storage.Get does
+	// (NotFound for a delete marker)
+	GetVersion(owner Owner, bucket, object, versionID string, offset, length int64) (Object, io.ReadCloser, error)
+	// DelVersion deletes the version permanently; the previous version
+	// becomes the current one
+	DelVersion(owner Owner, bucket, object, versionID string) error
+	// ListVersions lists the versions (the newest first, for each key) and the
+	// delete markers of the bucket, as FilterVersions filters them
+	ListVersions(owner Owner, bucket, prefix, delimiter, keyMarker, versionIDMarker string,
+		limit int) (versions []Version, commonprefixes []string, truncated bool, err error)
+}
+
+// CheckVersioning returns an error if state is not a settable versioning state
+func CheckVersioning(state string) error {
+	if state != VersioningEnabled && state != VersioningSuspended {
+		return fmt.Errorf("bad versioning state %q", state)
+	}
+	return nil
+}
+
+// VersionOrder returns a string for ordering the versions by their creation
+// time, the newest first
+func VersionOrder(created time.Time) string {
+	return fmt.Sprintf("%016x", math.MaxInt64-created.UnixNano())
+}
+
+// FilterVersions returns the versions (which must be ordered by key, then the
+// newest first) after keyMarker (and versionIDMarker, if given) with the prefix,
+// rolling up the keys to common prefixes by the delimiter, as ListFilter does.
+func FilterVersions(versions []Version, prefix, delimiter, keyMarker, versionIDMarker string,
+	limit int) (listed []Version, commonprefixes []string, truncated bool) {
+
+	f := NewListFilter(prefix, delimiter, "", limit, 0).(*listFilter)
+	// the common prefix the marker is in
+	var markerDir string
+	if delimiter != "" && strings.HasPrefix(keyMarker, prefix) {
+		if i := strings.Index(keyMarker[len(prefix):], delimiter); i >= 0 {
+			markerDir = keyMarker[:len(prefix)+i+len(delimiter)]
+		}
+	}
+	afterVersion := false
+	for _, v := range versions {
+		if keyMarker != "" {
+			if v.Key < keyMarker || markerDir != "" && strings.HasPrefix(v.Key, markerDir) {
+				continue
+			}
+			if v.Key == keyMarker && !afterVersion {
+				afterVersion = versionIDMarker != "" && v.VersionID == versionIDMarker
+				continue
+			}
+		}
+		ok, err := f.Check(v.Key)
+		if err == io.EOF {
+			break
+		}
+		if ok {
+			listed = append(listed, v)
+		}
+	}
+	commonprefixes, truncated = f.Result()
+	return
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NoSuchWebsiteConfiguration is returned by Websiter.GetWebsite if the bucket
+// is not configured as a website
+var NoSuchWebsiteConfiguration = NewError("NoSuchWebsiteConfiguration",
+	"the specified bucket does not have a website configuration")
+
+// WebsiteMetadata is the metadata (header) of an object which redirects its
+// website requests to the value (another object, or an external URL)
+const WebsiteMetadata = "X-Amz-Website-Redirect-Location"
+
+// CheckRedirectLocation returns an InvalidRedirectLocation error if loc
+// (the value of WebsiteMetadata) is not an absolute path (but not "//"),
+// nor an http:// or https:// URL.
+func CheckRedirectLocation(loc string) error {
+	if strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") ||
+		strings.HasPrefix(loc, "http://") || strings.HasPrefix(loc, "https://") {
+		return nil
+	}
+	return NewError("InvalidRedirectLocation",
+		"the website redirect location must start with /, http:// or https://")
+}
+
+// WebsiteConfig is the static website configuration of a bucket.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/WebsiteHosting.html
+type WebsiteConfig struct {
+	// IndexSuffix is appended to the requests for a directory (such as index.html)
+	IndexSuffix string `json:"indexSuffix,omitempty"`
+	// ErrorKey is the key of the object returned on 4xx errors
+	ErrorKey string `json:"errorKey,omitempty"`
+	// RedirectAllRequestsTo redirects every request to another host, if not nil
+	RedirectAllRequestsTo *WebsiteRedirect `json:"redirectAllRequestsTo,omitempty"`
+	RoutingRules          []RoutingRule    `json:"routingRules,omitempty"`
+}
+
+// RoutingRule redirects the requests matching its conditions
+type RoutingRule struct {
+	// KeyPrefixEquals is the condition on the prefix of the requested key
+	KeyPrefixEquals string `json:"keyPrefixEquals,omitempty"`
+	// HTTPErrorCodeReturnedEquals is the condition on the error code (such as 404);
+	// without it, the rule applies before getting the object
+	HTTPErrorCodeReturnedEquals string          `json:"httpErrorCodeReturnedEquals,omitempty"`
+	Redirect                    WebsiteRedirect `json:"redirect"`
+}
+
+// WebsiteRedirect is where a website request is redirected to; the empty fields
+// are the same as of the request.
+type WebsiteRedirect struct {
+	// Protocol is http or https
+	Protocol string `json:"protocol,omitempty"`
+	HostName string `json:"hostName,omitempty"`
+	// ReplaceKeyPrefixWith replaces the KeyPrefixEquals of the rule in the key
+	ReplaceKeyPrefixWith string `json:"replaceKeyPrefixWith,omitempty"`
+	// ReplaceKeyWith replaces the whole key
+	ReplaceKeyWith string `json:"replaceKeyWith,omitempty"`
+	// HTTPRedirectCode is the 3xx status of the redirect; 301 if not given
+	HTTPRedirectCode string `json:"httpRedirectCode,omitempty"`
+}
+
+// Websiter is an optional interface of a Storage, for the static website
+// configuration of the buckets
+type Websiter interface {
+	// GetWebsite returns the website configuration of the bucket - or NoSuchWebsiteConfiguration
+	GetWebsite(owner Owner, bucket string) (*WebsiteConfig, error)
+	// SetWebsite sets the website configuration of the bucket; nil deletes it
+	SetWebsite(owner Owner, bucket string, config *WebsiteConfig) error
+}
+
+// Check checks the configuration: it needs an IndexSuffix (without a slash),
+// or a RedirectAllRequestsTo with a HostName (and nothing else).
+func (c WebsiteConfig) Check() error {
+	if c.RedirectAllRequestsTo != nil {
+		rd := c.RedirectAllRequestsTo
+		if c.IndexSuffix != "" || c.ErrorKey != "" || len(c.RoutingRules) > 0 {
+			return NewError("InvalidArgument", "RedirectAllRequestsTo cannot be given with other elements")
+		}
+		if rd.HostName == "" {
+			return NewError("InvalidArgument", "RedirectAllRequestsTo needs a HostName")
+		}
+		return rd.check()
+	}
+	if c.IndexSuffix == "" || strings.IndexByte(c.IndexSuffix, '/') >= 0 {
+		return NewError("InvalidArgument", "the IndexDocument Suffix must not be empty nor contain a slash")
+	}
+	for _, rule := range c.RoutingRules {
+		if rule.HTTPErrorCodeReturnedEquals != "" {
+			if code, err := strconv.Atoi(rule.HTTPErrorCodeReturnedEquals); err != nil || code < 400 || code > 599 {
+				return NewError("InvalidArgument", "invalid HttpErrorCodeReturnedEquals "+
+					rule.HTTPErrorCodeReturnedEquals)
+			}
+		}
+		if err := rule.Redirect.check(); err != nil {
+			return err
+		}
+		if rule.Redirect.ReplaceKeyPrefixWith != "" && rule.Redirect.ReplaceKeyWith != "" {
+			return NewError("InvalidArgument", "ReplaceKeyPrefixWith and ReplaceKeyWith cannot be given together")
+		}
+	}
+	return nil
+}
+
+func (rd WebsiteRedirect) check() error {
+	if rd.Protocol != "" && rd.Protocol != "http" && rd.Protocol != "https" {
+		return NewError("InvalidArgument", "invalid Protocol "+rd.Protocol)
+	}
+	if rd.HTTPRedirectCode != "" {
+		if code, err := strconv.Atoi(rd.HTTPRedirectCode); err != nil || code < 300 || code > 399 {
+			return NewError("InvalidArgument", "invalid HttpRedirectCode "+rd.HTTPRedirectCode)
+		}
+	}
+	return nil
+}
+
+// Route returns the first routing rule which applies to the key - before getting
+// the object if code is 0, or after the error with the code (such as 404).
+func (c WebsiteConfig) Route(key string, code int) *RoutingRule {
+	errorCode := ""
+	if code != 0 {
+		errorCode = strconv.Itoa(code)
+	}
+	for i, rule := range c.RoutingRules {
+		if rule.HTTPErrorCodeReturnedEquals == errorCode && strings.HasPrefix(key, rule.KeyPrefixEquals) {
+			return &c.RoutingRules[i]
+		}
+	}
+	return nil
+}
+
+// Key returns the key the rule redirects the key to
+func (rule RoutingRule) Key(key string) string {
+	switch {
+	case rule.Redirect.ReplaceKeyWith != "":
+		return rule.Redirect.ReplaceKeyWith
+	case rule.Redirect.ReplaceKeyPrefixWith != "":
+		return rule.Redirect.ReplaceKeyPrefixWith + strings.TrimPrefix(key, rule.KeyPrefixEquals)
+	}
+	return key
+}
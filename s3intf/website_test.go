@@ -0,0 +1,92 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3intf
+
+import "testing"
+
+func TestWebsiteRoute(t *testing.T) {
+	conf := WebsiteConfig{IndexSuffix: "index.html", ErrorKey: "error.html",
+		RoutingRules: []RoutingRule{
+			{KeyPrefixEquals: "docs/", Redirect: WebsiteRedirect{ReplaceKeyPrefixWith: "documents/"}},
+			{KeyPrefixEquals: "images/", Redirect: WebsiteRedirect{ReplaceKeyWith: "error.html"}},
+			{HTTPErrorCodeReturnedEquals: "404",
+				Redirect: WebsiteRedirect{HostName: "example.com", ReplaceKeyPrefixWith: "report-404/"}},
+		}}
+	if err := conf.Check(); err != nil {
+		t.Fatal(err)
+	}
+	for i, tc := range []struct {
+		key     string
+		code    int
+		awaited string
+	}{
+		{"docs/a.html", 0, "documents/a.html"},
+		{"docs/", 0, "documents/"},
+		{"images/a.png", 0, "error.html"},
+		{"a.html", 0, ""},
+		{"a.html", 404, "report-404/a.html"},
+		{"docs/a.html", 404, "report-404/docs/a.html"},
+		{"a.html", 403, ""},
+	} {
+		got := ""
+		if rule := conf.Route(tc.key, tc.code); rule != nil {
+			got = rule.Key(tc.key)
+		}
+		if got != tc.awaited {
+			t.Errorf("%d. %s %d: got %q, awaited %q", i, tc.key, tc.code, got, tc.awaited)
+		}
+	}
+
+	for i, c := range []WebsiteConfig{
+		{},
+		{IndexSuffix: "a/index.html"},
+		{IndexSuffix: "index.html", RedirectAllRequestsTo: &WebsiteRedirect{HostName: "example.com"}},
+		{RedirectAllRequestsTo: &WebsiteRedirect{Protocol: "ftp", HostName: "example.com"}},
+		{RedirectAllRequestsTo: &WebsiteRedirect{}},
+		{IndexSuffix: "index.html", RoutingRules: []RoutingRule{{HTTPErrorCodeReturnedEquals: "200"}}},
+		{IndexSuffix: "index.html", RoutingRules: []RoutingRule{{Redirect: WebsiteRedirect{HTTPRedirectCode: "200"}}}},
+		{IndexSuffix: "index.html", RoutingRules: []RoutingRule{{Redirect: WebsiteRedirect{
+			ReplaceKeyWith: "a", ReplaceKeyPrefixWith: "b"}}}},
+	} {
+		if err := c.Check(); err == nil {
+			t.Errorf("%d. awaited error for %+v", i, c)
+		}
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	for i, tc := range []struct {
+		loc string
+		ok  bool
+	}{
+		{"/index.html", true},
+		{"http://example.com/a", true},
+		{"https://example.com", true},
+		{"index.html", false},
+		{"//example.com/a", false},
+		{"javascript:alert(1)", false},
+		{"ftp://example.com/a", false},
+		{"", false},
+	} {
+		err := CheckRedirectLocation(tc.loc)
+		if tc.ok && err != nil {
+			t.Errorf("%d. %q: %s", i, tc.loc, err)
+		} else if !tc.ok && ErrorCode(err) != "InvalidRedirectLocation" {
+			t.Errorf("%d. %q: awaited InvalidRedirectLocation, got %v", i, tc.loc, err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Package s3lifecycle applies the lifecycle rules of the buckets (see s3intf.Lifecycler):
+it deletes the expired objects and noncurrent versions, and aborts the
+incomplete multipart uploads, through the s3intf.Storage interfaces.
+See http://docs.aws.amazon.com/AmazonS3/latest/dev/object-lifecycle-mgmt.html
+
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3lifecycle
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The kinds of the lifecycle actions
+const (
+	Expiration                     = "Expiration"
+	NoncurrentVersionExpiration    = "NoncurrentVersionExpiration"
+	AbortIncompleteMultipartUpload = "AbortIncompleteMultipartUpload"
+)
+
+// listLimit is the number of objects (versions) listed at once
+const listLimit = 1000
+
+// Action is a deletion due to a lifecycle rule
+type Action struct {
+	// Kind is Expiration, NoncurrentVersionExpiration or AbortIncompleteMultipartUpload
+	Kind string
+	// Rule is the ID of the rule
+	Rule          string
+	Owner, Bucket string
+	Key           string
+	// VersionID is the noncurrent version to be deleted
+	VersionID string
+	// UploadID is the multipart upload to be aborted
+	UploadID string
+}
+
+func (a Action) String() string {
+	s := a.Kind + " " + a.Owner + ":" + a.Bucket + "/" + a.Key
+	switch {
+	case a.VersionID != "":
+		s += "?versionId=" + a.VersionID
+	case a.UploadID != "":
+		s += "?uploadId=" + a.UploadID
+	}
+	if a.Rule != "" {
+		s += " (rule " + a.Rule + ")"
+	}
+	return s
+}
+
+// UserLister lists the users, the possible owners of the buckets
+// (such as an s3intf.CredentialStore)
+type UserLister interface {
+	ListUsers() ([]s3intf.User, error)
+}
+
+// Worker applies the lifecycle rules of the buckets of the Storage
+type Worker struct {
+	Storage s3intf.Storage
+	Users   UserLister
+	// DryRun means only returning the actions, without doing them
+	DryRun bool
+}
+
+// Start runs the Worker at every interval (logging the actions and the
+// errors), till stop is closed
+func (w Worker) Start(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			actions, err := w.Run(now)
+			for _, a := range actions {
+				log.Printf("lifecycle: %s", a)
+			}
+			if err != nil {
+				log.Printf("lifecycle: %s", err)
+			}
+		}
+	}
+}
+
+// Run applies the lifecycle rules of every bucket of every user, as of now,
+// and returns the actions done (or to be done, if DryRun). The errors of a
+// bucket do not stop the others, the first is returned.
+func (w Worker) Run(now time.Time) ([]Action, error) {
+	if _, ok := w.Storage.(s3intf.Lifecycler); !ok {
+		return nil, nil
+	}
+	users, err := w.Users.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	var actions []Action
+	for _, u := range users {
+		owner := s3intf.OwnerOf(u.ID)
+		buckets, e := w.Storage.ListBuckets(owner)
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		for _, b := range buckets {
+			acts, e := w.RunBucket(owner, b.Name, now)
+			actions = append(actions, acts...)
+			if e != nil {
+				log.Printf("lifecycle of %s: %s", b.Name, e)
+				if err == nil {
+					err = e
+				}
+			}
+		}
+	}
+	return actions, err
+}
+
+// RunBucket applies the lifecycle rules of the bucket, as of now, and returns
+// the actions done (or to be done, if DryRun)
+func (w Worker) RunBucket(owner s3intf.Owner, bucket string, now time.Time) ([]Action, error) {
+	lc, ok := w.Storage.(s3intf.Lifecycler)
+	if !ok {
+		return nil, nil
+	}
+	rules, err := lc.GetLifecycle(owner, bucket)
+	if err != nil {
+		if err == s3intf.NoSuchLifecycleConfiguration {
+			err = nil
+		}
+		return nil, err
+	}
+	var actions []Action
+	add := func(kind string, rule s3intf.LifecycleRule, key, versionID, uploadID string) {
+		actions = append(actions, Action{Kind: kind, Rule: rule.ID, Owner: owner.ID(), Bucket: bucket,
+			Key: key, VersionID: versionID, UploadID: uploadID})
+	}
+	// the actions are collected first, as deleting would disturb the listings
+	if err = w.expire(owner, bucket, rules, now, add); err != nil {
+		return nil, err
+	}
+	if err = w.expireNoncurrent(owner, bucket, rules, now, add); err != nil {
+		return nil, err
+	}
+	if err = w.abortUploads(owner, bucket, rules, now, add); err != nil {
+		return nil, err
+	}
+	if w.DryRun {
+		return actions, nil
+	}
+	for i, a := range actions {
+		switch a.Kind {
+		case Expiration:
+			err = w.Storage.Del(owner, bucket, a.Key)
+		case NoncurrentVersionExpiration:
+			err = w.Storage.(s3intf.Versioner).DelVersion(owner, bucket, a.Key, a.VersionID)
+		case AbortIncompleteMultipartUpload:
+			err = w.Storage.(s3intf.Multiparter).AbortMultipart(owner, bucket, a.Key, a.UploadID)
+		}
+		if err != nil && !s3intf.IsNotFound(err) {
+			return actions[:i], err
+		}
+	}
+	return actions, nil
+}
+
+type addFunc func(kind string, rule s3intf.LifecycleRule, key, versionID, uploadID string)
+
+// matchRule returns the first rule which is enabled, applies to the key, and
+// is due (by the given function); the tags are read only if a rule needs them
+func matchRule(rules []s3intf.LifecycleRule, key string, due func(s3intf.LifecycleRule) bool,
+	tags func() (s3intf.Tags, error)) (*s3intf.LifecycleRule, error) {
+	var (
+		t      s3intf.Tags
+		tagged bool
+	)
+	for i, rule := range rules {
+		if !rule.Enabled || !strings.HasPrefix(key, rule.Prefix) || !due(rule) {
+			continue
+		}
+		if len(rule.Tags) > 0 && !tagged {
+			var err error
+			if t, err = tags(); err != nil {
+				return nil, err
+			}
+			tagged = true
+		}
+		if rule.Matches(key, t) {
+			return &rules[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// expire finds the current objects expired by the Expiration of the rules
+func (w Worker) expire(owner s3intf.Owner, bucket string, rules []s3intf.LifecycleRule,
+	now time.Time, add addFunc) error {
+	var marker string
+	for {
+		objects, _, truncated, err := w.Storage.List(owner, bucket, "", "", marker, listLimit, 0)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			obj := obj
+			rule, err := matchRule(rules, obj.Key,
+				func(rule s3intf.LifecycleRule) bool { return rule.Expired(obj.LastModified, now) },
+				func() (s3intf.Tags, error) {
+					o, err := w.Storage.Stat(owner, bucket, obj.Key)
+					return o.Metadata.Tags(), err
+				})
+			if err != nil && !s3intf.IsNotFound(err) {
+				return err
+			}
+			if rule != nil {
+				add(Expiration, *rule, obj.Key, "", "")
+			}
+		}
+		if !truncated || len(objects) == 0 {
+			return nil
+		}
+		marker = objects[len(objects)-1].Key
+	}
+}
+
+// expireNoncurrent finds the noncurrent versions expired by the
+// NoncurrentDays of the rules: a version becomes noncurrent when the next
+// (newer) version is created.
+func (w Worker) expireNoncurrent(owner s3intf.Owner, bucket string, rules []s3intf.LifecycleRule,
+	now time.Time, add addFunc) error {
+	v, ok := w.Storage.(s3intf.Versioner)
+	if !ok {
+		return nil
+	}
+	var (
+		keyMarker, versionIDMarker, prevKey string
+		prevCreated                         time.Time
+	)
+	for {
+		versions, _, truncated, err := v.ListVersions(owner, bucket, "", "", keyMarker, versionIDMarker, listLimit)
+		if err != nil {
+			return err
+		}
+		for _, ver := range versions {
+			ver := ver
+			noncurrent, since := ver.Key == prevKey, prevCreated
+			prevKey, prevCreated = ver.Key, ver.LastModified
+			if !noncurrent || ver.IsLatest {
+				continue
+			}
+			rule, err := matchRule(rules, ver.Key,
+				func(rule s3intf.LifecycleRule) bool {
+					return rule.NoncurrentDays > 0 &&
+						!now.Before(s3intf.ExpirationTime(since, rule.NoncurrentDays))
+				},
+				func() (s3intf.Tags, error) {
+					if ver.DeleteMarker {
+						return nil, nil
+					}
+					sv, err := v.StatVersion(owner, bucket, ver.Key, ver.VersionID)
+					return sv.Metadata.Tags(), err
+				})
+			if err != nil && !s3intf.IsNotFound(err) && err != s3intf.NoSuchVersion {
+				return err
+			}
+			if rule != nil {
+				add(NoncurrentVersionExpiration, *rule, ver.Key, ver.VersionID, "")
+			}
+		}
+		if !truncated || len(versions) == 0 {
+			return nil
+		}
+		last := versions[len(versions)-1]
+		keyMarker, versionIDMarker = last.Key, last.VersionID
+	}
+}
+
+// abortUploads finds the multipart uploads initiated more than the
+// AbortIncompleteDays of the rules ago
+func (w Worker) abortUploads(owner s3intf.Owner, bucket string, rules []s3intf.LifecycleRule,
+	now time.Time, add addFunc) error {
+	mp, ok := w.Storage.(s3intf.Multiparter)
+	if !ok {
+		return nil
+	}
+	uploads, err := mp.ListMultipartUploads(owner, bucket, "")
+	if err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		u := u
+		rule, _ := matchRule(rules, u.Key,
+			func(rule s3intf.LifecycleRule) bool {
+				return rule.AbortIncompleteDays > 0 &&
+					!now.Before(s3intf.ExpirationTime(u.Initiated, rule.AbortIncompleteDays))
+			},
+			func() (s3intf.Tags, error) { return nil, nil })
+		if rule != nil {
+			add(AbortIncompleteMultipartUpload, *rule, u.Key, "", u.UploadID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3policy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The condition keys set by s3srv
+const (
+	KeySourceIP        = "aws:SourceIp"
+	KeyCurrentTime     = "aws:CurrentTime"
+	KeySecureTransport = "aws:SecureTransport"
+	KeyUserAgent       = "aws:UserAgent"
+	KeyReferer         = "aws:Referer"
+	KeyPrefix          = "s3:prefix"
+	KeyACL             = "s3:x-amz-acl"
+)
+
+// The prefixes of the tag condition keys: the tag's key follows the prefix
+// (such as s3:ExistingObjectTag/project)
+const (
+	KeyExistingObjectTag = "s3:ExistingObjectTag/"
+	KeyRequestObjectTag  = "s3:RequestObjectTag/"
+)
+
+// The supported condition operators; the negated ones are true if the key is missing.
+// See http://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_elements_condition_operators.html
+const (
+	StringEquals    = "StringEquals"
+	StringNotEquals = "StringNotEquals"
+	StringLike      = "StringLike"
+	StringNotLike   = "StringNotLike"
+	IPAddress       = "IpAddress"
+	NotIPAddress    = "NotIpAddress"
+	DateLessThan    = "DateLessThan"
+	DateGreaterThan = "DateGreaterThan"
+	Bool            = "Bool"
+)
+
+// checkCondition checks the value of the condition operator
+func checkCondition(op, key, value string) error {
+	var err error
+	switch op {
+	case StringEquals, StringNotEquals, StringLike, StringNotLike:
+	case IPAddress, NotIPAddress:
+		_, err = parseCIDR(value)
+	case DateLessThan, DateGreaterThan:
+		_, err = parseDate(value)
+	case Bool:
+		_, err = strconv.ParseBool(value)
+	default:
+		return s3intf.NewError("MalformedPolicy", "unsupported condition operator "+op)
+	}
+	if err != nil {
+		return s3intf.NewError("MalformedPolicy", "invalid value for "+op+" "+key+": "+err.Error())
+	}
+	return nil
+}
+
+// evalCondition returns whether the condition holds for the request: whether
+// any of the values matches the value of the key (none for the negated ones)
+func evalCondition(op, key string, values []string, r Request) bool {
+	v, ok := r.value(key)
+	negated := op == StringNotEquals || op == StringNotLike || op == NotIPAddress
+	if !ok {
+		return negated
+	}
+	var match func(string) bool
+	switch op {
+	case StringEquals, StringNotEquals:
+		match = func(s string) bool { return s == v }
+	case StringLike, StringNotLike:
+		match = func(s string) bool { return wildcardMatch(s, v) }
+	case IPAddress, NotIPAddress:
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return false
+		}
+		match = func(s string) bool {
+			ipnet, err := parseCIDR(s)
+			return err == nil && ipnet.Contains(ip)
+		}
+	case DateLessThan, DateGreaterThan:
+		t, err := parseDate(v)
+		if err != nil {
+			return false
+		}
+		match = func(s string) bool {
+			d, err := parseDate(s)
+			if err != nil {
+				return false
+			}
+			if op == DateLessThan {
+				return t.Before(d)
+			}
+			return t.After(d)
+		}
+	case Bool:
+		match = func(s string) bool { return strings.EqualFold(s, v) }
+	default:
+		return false
+	}
+	for _, s := range values {
+		if match(s) {
+			return !negated
+		}
+	}
+	return negated
+}
+
+// parseCIDR parses an IP address with or without a mask
+func parseCIDR(s string) (*net.IPNet, error) {
+	if strings.IndexByte(s, '/') < 0 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(s)
+	return ipnet, err
+}
+
+// parseDate parses an ISO 8601 date (such as 2013-08-16T12:00:00Z), or the
+// seconds since the epoch
+func parseDate(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,353 @@
+/*
+Package s3policy implements the JSON bucket policies and their evaluation.
+See http://docs.aws.amazon.com/AmazonS3/latest/dev/access-policy-language-overview.html
+
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// The effects of the statements
+const (
+	Allow = "Allow"
+	Deny  = "Deny"
+)
+
+// ARNPrefix is the prefix of the S3 resource ARNs
+const ARNPrefix = "arn:aws:s3:::"
+
+// Decision is the result of the evaluation of a policy
+type Decision int
+
+const (
+	// NotApplicable means that no statement matched the request
+	NotApplicable = Decision(iota)
+	// Allowed means that an Allow statement matched, and no Deny did
+	Allowed
+	// Denied means that a Deny statement matched - this overrides any Allow
+	Denied
+)
+
+func (d Decision) String() string {
+	switch d {
+	case Allowed:
+		return "Allowed"
+	case Denied:
+		return "Denied"
+	}
+	return "NotApplicable"
+}
+
+// Policy is a bucket policy document
+type Policy struct {
+	Version    string     `json:",omitempty"`
+	ID         string     `json:"Id,omitempty"`
+	Statements statements `json:"Statement"`
+}
+
+// Statement is one statement of a policy
+type Statement struct {
+	Sid       string    `json:",omitempty"`
+	Effect    string    `json:"Effect"`
+	Principal Principal `json:"Principal"`
+	Action    strList   `json:"Action"`
+	Resource  strList   `json:"Resource"`
+	// Condition maps the operators (such as IpAddress) to the condition keys
+	// (such as aws:SourceIp) and their values
+	Condition map[string]map[string]strList `json:",omitempty"`
+}
+
+// Principal is the set of the canonical user IDs the statement applies to;
+// "*" means everybody, including the anonymous requesters
+type Principal []string
+
+// UnmarshalJSON accepts "*", {"AWS": ids} and {"CanonicalUser": ids}, where ids is
+// a string or a list of strings: canonical IDs, or arn:aws:iam::ID:root ARNs
+func (p *Principal) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		if s != "*" {
+			return s3intf.NewError("MalformedPolicy", "invalid principal "+s)
+		}
+		*p = Principal{"*"}
+		return nil
+	}
+	var m map[string]strList
+	if err := json.Unmarshal(b, &m); err != nil {
+		return s3intf.NewError("MalformedPolicy", "invalid principal: "+err.Error())
+	}
+	*p = (*p)[:0]
+	for k, ids := range m {
+		if k != "AWS" && k != "CanonicalUser" {
+			return s3intf.NewError("MalformedPolicy", "unsupported principal type "+k)
+		}
+		for _, id := range ids {
+			if strings.HasPrefix(id, "arn:aws:iam::") && strings.HasSuffix(id, ":root") {
+				id = id[len("arn:aws:iam::") : len(id)-len(":root")]
+			}
+			*p = append(*p, id)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the principal includes the requester ("" for anonymous)
+func (p Principal) matches(requester string) bool {
+	for _, id := range p {
+		if id == "*" || requester != "" && id == requester {
+			return true
+		}
+	}
+	return false
+}
+
+// strList is a list of strings, which is a single string in JSON if it has
+// only one element
+type strList []string
+
+// UnmarshalJSON accepts a string or a list of strings
+func (sl *strList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*sl = strList{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(sl))
+}
+
+// statements is the list of statements, which is a single object in JSON if
+// it has only one element
+type statements []Statement
+
+// UnmarshalJSON accepts an object or a list of objects
+func (ss *statements) UnmarshalJSON(b []byte) error {
+	var st Statement
+	if len(b) > 0 && b[0] == '{' {
+		if err := decodeStrict(b, &st); err != nil {
+			return err
+		}
+		*ss = statements{st}
+		return nil
+	}
+	return decodeStrict(b, (*[]Statement)(ss))
+}
+
+// decodeStrict decodes the JSON, rejecting the unknown fields (such as the
+// unsupported NotAction), as ignoring them would change the meaning of the policy
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// Parse parses and checks the policy document of the bucket: its resources must
+// be in the bucket, and only the S3 actions and the supported condition operators
+// are allowed. The errors have the MalformedPolicy S3 error code.
+func Parse(b []byte, bucket string) (*Policy, error) {
+	var p Policy
+	if err := decodeStrict(b, &p); err != nil {
+		if s3intf.ErrorCode(err) == "" {
+			err = s3intf.NewError("MalformedPolicy", "cannot parse policy: "+err.Error())
+		}
+		return nil, err
+	}
+	if len(p.Statements) == 0 {
+		return nil, s3intf.NewError("MalformedPolicy", "policy has no statements")
+	}
+	for i, st := range p.Statements {
+		if err := st.check(bucket); err != nil {
+			sid := st.Sid
+			if sid == "" {
+				sid = "#" + strconv.Itoa(i)
+			}
+			return nil, s3intf.NewError("MalformedPolicy", "statement "+sid+": "+err.Error())
+		}
+	}
+	return &p, nil
+}
+
+// check checks the statement of the bucket's policy
+func (st Statement) check(bucket string) error {
+	if st.Effect != Allow && st.Effect != Deny {
+		return s3intf.NewError("MalformedPolicy", "invalid effect "+st.Effect)
+	}
+	if len(st.Principal) == 0 {
+		return s3intf.NewError("MalformedPolicy", "missing principal")
+	}
+	if len(st.Action) == 0 {
+		return s3intf.NewError("MalformedPolicy", "missing action")
+	}
+	for _, action := range st.Action {
+		if action != "*" && !strings.HasPrefix(strings.ToLower(action), "s3:") {
+			return s3intf.NewError("MalformedPolicy", "invalid action "+action)
+		}
+	}
+	if len(st.Resource) == 0 {
+		return s3intf.NewError("MalformedPolicy", "missing resource")
+	}
+	for _, res := range st.Resource {
+		rest := strings.TrimPrefix(res, ARNPrefix+bucket)
+		if !strings.HasPrefix(res, ARNPrefix) || len(rest) == len(res) ||
+			rest != "" && rest[0] != '/' {
+			return s3intf.NewError("MalformedPolicy", "resource "+res+" is not in the bucket")
+		}
+	}
+	for op, keys := range st.Condition {
+		for key, values := range keys {
+			for _, v := range values {
+				if err := checkCondition(op, key, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Request is what a policy is evaluated for
+type Request struct {
+	// Principal is the canonical ID of the requester, "" for anonymous requests
+	Principal string
+	// Action is the S3 action, such as s3:GetObject
+	Action string
+	// Resource is the ARN of the bucket or the object (see ARN)
+	Resource string
+	// Context has the values of the condition keys (such as aws:SourceIp);
+	// the keys are case insensitive
+	Context map[string]string
+}
+
+// value returns the value of the condition key
+func (r Request) value(key string) (string, bool) {
+	if v, ok := r.Context[key]; ok {
+		return v, true
+	}
+	for k, v := range r.Context {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// HasConditionKey returns whether any statement has a condition on a key
+// starting with the prefix (such as KeyExistingObjectTag), case insensitively
+func (p Policy) HasConditionKey(prefix string) bool {
+	prefix = strings.ToLower(prefix)
+	for _, st := range p.Statements {
+		for _, keys := range st.Condition {
+			for key := range keys {
+				if strings.HasPrefix(strings.ToLower(key), prefix) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ARN returns the ARN of the bucket, or the object, if it is not empty
+func ARN(bucket, object string) string {
+	if object == "" {
+		return ARNPrefix + bucket
+	}
+	return ARNPrefix + bucket + "/" + object
+}
+
+// Evaluate returns the decision of the policy on the request: Denied if any
+// Deny statement matches (explicit deny overrides any allow), Allowed if an
+// Allow statement matches, NotApplicable otherwise.
+func (p Policy) Evaluate(r Request) Decision {
+	d := NotApplicable
+	for _, st := range p.Statements {
+		if !st.matches(r) {
+			continue
+		}
+		if st.Effect == Deny {
+			return Denied
+		}
+		d = Allowed
+	}
+	return d
+}
+
+// matches returns whether the statement applies to the request
+func (st Statement) matches(r Request) bool {
+	if !st.Principal.matches(r.Principal) {
+		return false
+	}
+	ok := false
+	for _, action := range st.Action {
+		if wildcardMatch(strings.ToLower(action), strings.ToLower(r.Action)) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return false
+	}
+	ok = false
+	for _, res := range st.Resource {
+		if wildcardMatch(res, r.Resource) {
+			ok = true
+			break
+		}
+	}
+	if !ok {
+		return false
+	}
+	for op, keys := range st.Condition {
+		for key, values := range keys {
+			if !evalCondition(op, key, values, r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// wildcardMatch returns whether s matches the pattern, where * matches any
+// sequence of characters (including the empty one), ? matches one character
+func wildcardMatch(pattern, s string) bool {
+	var star, next = -1, 0
+	var i, j int
+	for j < len(s) {
+		switch {
+		case i < len(pattern) && (pattern[i] == '?' || pattern[i] == s[j]):
+			i++
+			j++
+		case i < len(pattern) && pattern[i] == '*':
+			star, next = i, j
+			i++
+		case star >= 0:
+			next++
+			i, j = star+1, next
+		default:
+			return false
+		}
+	}
+	for i < len(pattern) && pattern[i] == '*' {
+		i++
+	}
+	return i == len(pattern)
+}
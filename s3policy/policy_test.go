@@ -0,0 +1,223 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3policy
+
+import (
+	"testing"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+const testPolicy = `{
+  "Version": "2012-10-17",
+  "Id": "test",
+  "Statement": [
+    {
+      "Sid": "PublicRead",
+      "Effect": "Allow",
+      "Principal": "*",
+      "Action": ["s3:GetObject", "s3:GetObjectVersion"],
+      "Resource": "arn:aws:s3:::bucket/public/*"
+    },
+    {
+      "Sid": "DenySecret",
+      "Effect": "Deny",
+      "Principal": "*",
+      "Action": "s3:*",
+      "Resource": ["arn:aws:s3:::bucket/public/secret*", "arn:aws:s3:::bucket/private/*"]
+    },
+    {
+      "Sid": "OtherWrites",
+      "Effect": "Allow",
+      "Principal": {"AWS": ["other", "arn:aws:iam::third:root"]},
+      "Action": ["s3:Put*", "s3:ListBucket"],
+      "Resource": ["arn:aws:s3:::bucket", "arn:aws:s3:::bucket/*"]
+    },
+    {
+      "Sid": "Office",
+      "Effect": "Allow",
+      "Principal": {"CanonicalUser": "office"},
+      "Action": "s3:GetObject",
+      "Resource": "arn:aws:s3:::bucket/*",
+      "Condition": {
+        "IpAddress": {"aws:SourceIp": ["192.168.1.0/24", "10.0.0.1"]},
+        "DateLessThan": {"aws:CurrentTime": "2013-12-31T00:00:00Z"}
+      }
+    },
+    {
+      "Sid": "Referer",
+      "Effect": "Deny",
+      "Principal": "*",
+      "Action": "s3:GetObject",
+      "Resource": "arn:aws:s3:::bucket/img/*",
+      "Condition": {"StringNotLike": {"aws:Referer": ["http://www.example.com/*", "http://example.com/*"]}}
+    },
+    {
+      "Sid": "Images",
+      "Effect": "Allow",
+      "Principal": "*",
+      "Action": "s3:GetObject",
+      "Resource": "arn:aws:s3:::bucket/img/*"
+    }
+  ]
+}`
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(testPolicy), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	office := map[string]string{"aws:sourceip": "192.168.1.42", "aws:CurrentTime": "2013-08-16T12:00:00Z"}
+	for i, tc := range []struct {
+		principal, action, object string
+		context                   map[string]string
+		awaited                   Decision
+	}{
+		{"", "s3:GetObject", "public/logo.png", nil, Allowed},
+		{"", "s3:GetObjectVersion", "public/logo.png", nil, Allowed},
+		{"", "s3:PutObject", "public/logo.png", nil, NotApplicable},
+		{"", "s3:GetObject", "logo.png", nil, NotApplicable},
+		// explicit deny overrides allow
+		{"", "s3:GetObject", "public/secret.txt", nil, Denied},
+		{"other", "s3:PutObject", "public/secret.txt", nil, Denied},
+		{"other", "s3:PutObject", "private/x", nil, Denied},
+		{"other", "s3:PutObject", "x", nil, Allowed},
+		{"other", "s3:putobjectacl", "x", nil, Allowed},
+		{"third", "s3:PutObject", "x", nil, Allowed},
+		{"other", "s3:ListBucket", "", nil, Allowed},
+		{"other", "s3:DeleteObject", "x", nil, NotApplicable},
+		{"", "s3:PutObject", "x", nil, NotApplicable},
+		// conditions
+		{"office", "s3:GetObject", "x", office, Allowed},
+		{"office", "s3:GetObject", "x", map[string]string{"aws:SourceIp": "10.0.0.1",
+			"aws:CurrentTime": "2013-08-16T12:00:00Z"}, Allowed},
+		{"office", "s3:GetObject", "x", map[string]string{"aws:SourceIp": "10.0.0.2",
+			"aws:CurrentTime": "2013-08-16T12:00:00Z"}, NotApplicable},
+		{"office", "s3:GetObject", "x", map[string]string{"aws:SourceIp": "192.168.1.42",
+			"aws:CurrentTime": "2014-01-01T00:00:00Z"}, NotApplicable},
+		{"office", "s3:GetObject", "x", map[string]string{"aws:SourceIp": "192.168.1.42"}, NotApplicable},
+		{"", "s3:GetObject", "img/a.png", map[string]string{"aws:Referer": "http://example.com/a.html"}, Allowed},
+		{"", "s3:GetObject", "img/a.png", map[string]string{"aws:Referer": "http://evil.com/"}, Denied},
+		{"", "s3:GetObject", "img/a.png", nil, Denied},
+	} {
+		got := p.Evaluate(Request{Principal: tc.principal, Action: tc.action,
+			Resource: ARN("bucket", tc.object), Context: tc.context})
+		if got != tc.awaited {
+			t.Errorf("%d. %s %s %s: got %s, awaited %s", i, tc.principal, tc.action, tc.object,
+				got, tc.awaited)
+		}
+	}
+}
+
+func TestTagConditions(t *testing.T) {
+	p, err := Parse([]byte(`{"Statement": [
+	  {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+	    "Resource": "arn:aws:s3:::bucket/*",
+	    "Condition": {"StringEquals": {"s3:ExistingObjectTag/public": "yes"}}},
+	  {"Effect": "Allow", "Principal": {"AWS": "other"}, "Action": "s3:PutObject",
+	    "Resource": "arn:aws:s3:::bucket/*",
+	    "Condition": {"StringLike": {"s3:RequestObjectTag/project": "s3*"}}}]}`), "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasConditionKey(KeyExistingObjectTag) || !p.HasConditionKey("s3:requestobjecttag/") ||
+		p.HasConditionKey(KeySourceIP) {
+		t.Errorf("HasConditionKey is wrong")
+	}
+	for i, tc := range []struct {
+		principal, action string
+		context           map[string]string
+		awaited           Decision
+	}{
+		{"", "s3:GetObject", map[string]string{KeyExistingObjectTag + "public": "yes"}, Allowed},
+		{"", "s3:GetObject", map[string]string{KeyExistingObjectTag + "public": "no"}, NotApplicable},
+		{"", "s3:GetObject", nil, NotApplicable},
+		{"other", "s3:PutObject", map[string]string{KeyRequestObjectTag + "project": "s3weed"}, Allowed},
+		{"other", "s3:PutObject", map[string]string{KeyRequestObjectTag + "project": "weed"}, NotApplicable},
+	} {
+		got := p.Evaluate(Request{Principal: tc.principal, Action: tc.action,
+			Resource: ARN("bucket", "x"), Context: tc.context})
+		if got != tc.awaited {
+			t.Errorf("%d. %s %s %v: got %s, awaited %s", i, tc.principal, tc.action, tc.context,
+				got, tc.awaited)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	for i, tc := range []struct {
+		policy string
+		ok     bool
+	}{
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*"}}`, true},
+		{`{"Statement": []}`, false},
+		{`{"Statement": {"Effect": "Permit", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*"}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*"}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "someone", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*"}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "iam:GetUser",
+			"Resource": "arn:aws:s3:::bucket/*"}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket2/*"}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket"}}`, true},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "NotAction": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*"}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*",
+			"Condition": {"IpAddress": {"aws:SourceIp": "not-an-ip"}}}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*",
+			"Condition": {"NumericLessThan": {"s3:max-keys": "10"}}}}`, false},
+		{`{"Statement": {"Effect": "Allow", "Principal": "*", "Action": "s3:GetObject",
+			"Resource": "arn:aws:s3:::bucket/*",
+			"Condition": {"DateGreaterThan": {"aws:CurrentTime": "2013-08-16"}}}}`, true},
+		{`not json`, false},
+	} {
+		_, err := Parse([]byte(tc.policy), "bucket")
+		if tc.ok && err != nil {
+			t.Errorf("%d. error: %s", i, err)
+		} else if !tc.ok && s3intf.ErrorCode(err) != "MalformedPolicy" {
+			t.Errorf("%d. awaited MalformedPolicy error, got %v", i, err)
+		}
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for i, tc := range []struct {
+		pattern, s string
+		awaited    bool
+	}{
+		{"", "", true},
+		{"*", "", true},
+		{"*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*/*.png", "img/sub/a.png", true},
+		{"*.png", "a.jpg", false},
+		{"a**b", "ab", true},
+	} {
+		if got := wildcardMatch(tc.pattern, tc.s); got != tc.awaited {
+			t.Errorf("%d. %q ~ %q: got %t, awaited %t", i, tc.pattern, tc.s, got, tc.awaited)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"errors"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+	"github.com/tgulacsi/s3weed/s3policy"
+)
+
+type accessControlPolicy struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ AccessControlPolicy"`
+	Owner   xmlOwner
+	Grants  []xmlGrant `xml:"AccessControlList>Grant"`
+}
+
+type xmlGrant struct {
+	Grantee    xmlGrantee
+	Permission string
+}
+
+type xmlGrantee struct {
+	XMLNSXSI     string `xml:"xmlns:xsi,attr"`
+	Type         string `xml:"xsi:type,attr"`
+	ID           string `xml:",omitempty"`
+	DisplayName  string `xml:",omitempty"`
+	URI          string `xml:",omitempty"`
+	EmailAddress string `xml:",omitempty"`
+}
+
+// grantHeaders are the x-amz-grant-* headers and their permissions
+var grantHeaders = []struct{ header, perm string }{
+	{"X-Amz-Grant-Full-Control", s3intf.PermFullControl},
+	{"X-Amz-Grant-Read", s3intf.PermRead},
+	{"X-Amz-Grant-Read-Acp", s3intf.PermReadACP},
+	{"X-Amz-Grant-Write", s3intf.PermWrite},
+	{"X-Amz-Grant-Write-Acp", s3intf.PermWriteACP},
+}
+
+// actionPerms maps the S3 actions to the ACL permission they need; the other
+// actions (such as s3:DeleteBucket) are for the bucket's owner only - unless the
+// bucket's policy allows them. WRITE is always checked on the bucket's ACL.
+var actionPerms = map[string]string{
+	"s3:ListBucket":                 s3intf.PermRead,
+	"s3:ListBucketVersions":         s3intf.PermRead,
+	"s3:ListBucketMultipartUploads": s3intf.PermRead,
+	"s3:GetObject":                  s3intf.PermRead,
+	"s3:GetObjectVersion":           s3intf.PermRead,
+	"s3:GetObjectTagging":           s3intf.PermRead,
+	"s3:ListMultipartUploadParts":   s3intf.PermRead,
+	"s3:PutObject":                  s3intf.PermWrite,
+	"s3:DeleteObject":               s3intf.PermWrite,
+	"s3:DeleteObjectVersion":        s3intf.PermWrite,
+	"s3:PutObjectTagging":           s3intf.PermWrite,
+	"s3:DeleteObjectTagging":        s3intf.PermWrite,
+	"s3:AbortMultipartUpload":       s3intf.PermWrite,
+	"s3:GetBucketAcl":               s3intf.PermReadACP,
+	"s3:GetObjectAcl":               s3intf.PermReadACP,
+	"s3:PutBucketAcl":               s3intf.PermWriteACP,
+	"s3:PutObjectAcl":               s3intf.PermWriteACP,
+}
+
+// authenticate returns the requester of the request - s3intf.Anonymous for
+// unsigned requests
+func (bucket bucketHandler) authenticate(r *http.Request, code int, object string) (
+	s3intf.Owner, *HTTPError) {
+	requester, err := s3intf.GetRoutedOwner(bucket.Service, r, bucket.hostBucket())
+	if err == s3intf.NoAuthorization {
+		return s3intf.Anonymous, nil
+	}
+	if err != nil {
+		resource := "/" + bucket.Name
+		if object != "" {
+			resource += "/" + object
+		}
+		return nil, ownerError(code, err, resource)
+	}
+	return requester, nil
+}
+
+// authorize authenticates the request, and checks whether the requester may do
+// the action (see permit). It returns the requester, and the owner of the bucket,
+// which must be used in the Storage calls.
+func (bucket bucketHandler) authorize(r *http.Request, code int, object, action string) (
+	requester, owner s3intf.Owner, he *HTTPError) {
+	if requester, he = bucket.authenticate(r, code, object); he != nil {
+		return nil, nil, he
+	}
+	owner, he = bucket.permit(r, requester, code, object, action)
+	return requester, owner, he
+}
+
+// permit checks whether the requester may do the S3 action (such as s3:GetObject)
+// on the bucket, or on the object, if it is not empty.
+// The bucket's policy (see s3intf.PolicyStorer) is evaluated first: its explicit
+// deny overrides everything (but the owner managing the policy), its allow
+// permits the action. Otherwise the owner of the bucket is permitted everything,
+// the others need the permission of actionPerms in the ACL. If the object does
+// not exist, READ permission on the bucket is needed (to know that it does not
+// exist).
+// It returns the owner of the bucket - which is the requester, if the
+// Storage is not an s3intf.ACLer (then anonymous requests are denied).
+func (bucket bucketHandler) permit(r *http.Request, requester s3intf.Owner, code int, object, action string) (
+	s3intf.Owner, *HTTPError) {
+	resource := "/" + bucket.Name
+	if object != "" {
+		resource += "/" + object
+	}
+	anonymous := requester.ID() == ""
+	acler, isACLer := bucket.Service.Storage.(s3intf.ACLer)
+	owner := requester
+	if anonymous || !bucket.Service.CheckBucket(requester, bucket.Name) {
+		if !isACLer {
+			if anonymous {
+				return nil, ownerError(code, s3intf.NoAuthorization, resource)
+			}
+			return requester, nil
+		}
+		ownerID, err := acler.BucketOwner(bucket.Name)
+		if err != nil {
+			return nil, storageError(code, err, "NoSuchBucket", resource)
+		}
+		owner = s3intf.OwnerOf(ownerID)
+	}
+	isOwner := !anonymous && requester.ID() == owner.ID()
+
+	decision, err := bucket.evalPolicy(r, owner, requester, object, action)
+	if err != nil {
+		return nil, storageError(code, err, "NoSuchBucket", resource)
+	}
+	switch decision {
+	case s3policy.Allowed:
+		return owner, nil
+	case s3policy.Denied:
+		if !(isOwner && strings.HasSuffix(action, "BucketPolicy")) {
+			return nil, accessDenied(code, requester, resource)
+		}
+	}
+	if isOwner {
+		return owner, nil
+	}
+
+	perm := actionPerms[action]
+	if perm != "" && isACLer {
+		if perm == s3intf.PermWrite {
+			object = ""
+		}
+		acl, err := acler.GetACL(owner, bucket.Name, object)
+		if err == s3intf.NotFound && object != "" {
+			acl, err = acler.GetACL(owner, bucket.Name, "")
+			perm = s3intf.PermRead
+		}
+		if err != nil {
+			return nil, storageError(code, err, "NoSuchBucket", resource)
+		}
+		if acl.Allows(requester.ID(), perm) {
+			return owner, nil
+		}
+	}
+	return nil, accessDenied(code, requester, resource)
+}
+
+// errNoACLer is returned by bucketHandler.owner if the Storage is not an s3intf.ACLer
+var errNoACLer = errors.New("the storage cannot tell the owner of a bucket")
+
+// owner returns the owner of the bucket, for the unsigned requests which do not
+// need the owner's credentials (such as the CORS and the website requests)
+func (bucket bucketHandler) owner() (s3intf.Owner, error) {
+	acler, ok := bucket.Service.Storage.(s3intf.ACLer)
+	if !ok {
+		return nil, errNoACLer
+	}
+	id, err := acler.BucketOwner(bucket.Name)
+	if err != nil {
+		return nil, err
+	}
+	return s3intf.OwnerOf(id), nil
+}
+
+// accessDenied returns the AccessDenied HTTPError for the requester
+func accessDenied(code int, requester s3intf.Owner, resource string) *HTTPError {
+	who := requester.ID()
+	if who == "" {
+		who = "anonymous"
+	}
+	return &HTTPError{Code: code, AWSCode: "AccessDenied",
+		Message: "access denied for " + who, Resource: resource}
+}
+
+// requestACL returns the ACL given by the x-amz-acl or the x-amz-grant-* headers,
+// and whether it was given - if not, the private ACL of the owner is returned.
+// bucketOwner is the owner of the bucket, for the bucket-owner-* canned ACLs.
+func requestACL(h http.Header, owner, bucketOwner string) (s3intf.ACL, bool, error) {
+	var grants []s3intf.Grant
+	for _, gh := range grantHeaders {
+		for _, v := range h[gh.header] {
+			for _, g := range strings.Split(v, ",") {
+				i := strings.IndexByte(g, '=')
+				if i < 0 {
+					return s3intf.ACL{}, false, s3intf.NewError("InvalidArgument", "bad grantee "+g)
+				}
+				grantee, err := parseGrantee(strings.TrimSpace(g[:i]),
+					strings.Trim(strings.TrimSpace(g[i+1:]), `"`))
+				if err != nil {
+					return s3intf.ACL{}, false, err
+				}
+				grants = append(grants, s3intf.Grant{Grantee: grantee, Permission: gh.perm})
+			}
+		}
+	}
+	canned := h.Get("X-Amz-Acl")
+	switch {
+	case canned != "" && grants != nil:
+		return s3intf.ACL{}, false, s3intf.NewError("InvalidRequest",
+			"specifying both canned ACLs and header grants is not allowed")
+	case canned != "":
+		acl, err := s3intf.CannedACL(canned, owner, bucketOwner)
+		return acl, err == nil, err
+	case grants != nil:
+		return s3intf.ACL{Owner: owner, Grants: grants}, true, nil
+	}
+	return s3intf.PrivateACL(owner), false, nil
+}
+
+// parseGrantee returns the grantee of the id, uri or emailAddress ("typ") value
+func parseGrantee(typ, value string) (string, error) {
+	switch typ {
+	case "id", "ID":
+		if value != "" {
+			return value, nil
+		}
+	case "uri", "URI":
+		if value == s3intf.AllUsers || value == s3intf.AuthenticatedUsers {
+			return value, nil
+		}
+	case "emailAddress", "EmailAddress":
+		return "", s3intf.NewError("UnresolvableGrantByEmailAddress",
+			"grants by e-mail address are not supported")
+	}
+	return "", s3intf.NewError("InvalidArgument", "bad grantee "+typ+"="+value)
+}
+
+// newAccessControlPolicy returns the XML representation of the ACL; the display
+// name is known for the requester only, the others have their canonical ID.
+func newAccessControlPolicy(acl s3intf.ACL, requester s3intf.Owner) accessControlPolicy {
+	name := func(id string) string {
+		if requester != nil && id == requester.ID() {
+			return requester.Name()
+		}
+		return id
+	}
+	res := accessControlPolicy{Owner: xmlOwner{ID: acl.Owner, DisplayName: name(acl.Owner)},
+		Grants: make([]xmlGrant, len(acl.Grants))}
+	for i, g := range acl.Grants {
+		grantee := xmlGrantee{XMLNSXSI: "http://www.w3.org/2001/XMLSchema-instance"}
+		if g.Grantee == s3intf.AllUsers || g.Grantee == s3intf.AuthenticatedUsers {
+			grantee.Type, grantee.URI = "Group", g.Grantee
+		} else {
+			grantee.Type, grantee.ID, grantee.DisplayName = "CanonicalUser", g.Grantee, name(g.Grantee)
+		}
+		res.Grants[i] = xmlGrant{Grantee: grantee, Permission: g.Permission}
+	}
+	return res
+}
+
+// parseAccessControlPolicy returns the grants of the AccessControlPolicy document
+func parseAccessControlPolicy(b []byte) ([]s3intf.Grant, error) {
+	var policy struct {
+		Grants []xmlGrant `xml:"AccessControlList>Grant"`
+	}
+	if err := xml.Unmarshal(b, &policy); err != nil {
+		return nil, s3intf.NewError("MalformedACLError", err.Error())
+	}
+	grants := make([]s3intf.Grant, len(policy.Grants))
+	for i, g := range policy.Grants {
+		if err := s3intf.CheckPermission(g.Permission); err != nil {
+			return nil, err
+		}
+		var err error
+		switch {
+		case g.Grantee.ID != "":
+			grants[i].Grantee = g.Grantee.ID
+		case g.Grantee.URI != "":
+			grants[i].Grantee, err = parseGrantee("uri", g.Grantee.URI)
+		case g.Grantee.EmailAddress != "":
+			_, err = parseGrantee("emailAddress", g.Grantee.EmailAddress)
+		default:
+			err = s3intf.NewError("InvalidArgument", "no grantee given")
+		}
+		if err != nil {
+			return nil, err
+		}
+		grants[i].Permission = g.Permission
+	}
+	return grants, nil
+}
+
+// storeACL stores the ACL of the new object (see requestACL): the objects of
+// others than the owner of the bucket get their ACL even if none was given.
+func (obj objectHandler) storeACL(owner, requester s3intf.Owner, acl s3intf.ACL, given bool) error {
+	acler, ok := obj.Bucket.Service.Storage.(s3intf.ACLer)
+	if !ok || !given && requester.ID() == owner.ID() {
+		return nil
+	}
+	return acler.SetACL(owner, obj.Bucket.Name, obj.object, acl)
+}
+
+// serveACL gets (GET) or sets (PUT) the ACL of the bucket, or the object
+// (if it is not empty). The new ACL is given in the x-amz-acl or the x-amz-grant-*
+// headers, or as an AccessControlPolicy document in the body.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGETacl.html
+// and http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectPUTacl.html
+func (bucket bucketHandler) serveACL(w http.ResponseWriter, r *http.Request, object string) {
+	resource := "/" + bucket.Name
+	notFound := "NoSuchBucket"
+	if object != "" {
+		resource += "/" + object
+		notFound = "NoSuchKey"
+	}
+	acler, ok := bucket.Service.Storage.(s3intf.ACLer)
+	if !ok {
+		writeError(w, &HTTPError{Code: 65, HTTPCode: http.StatusNotImplemented,
+			Message: "ACLs are not supported", Resource: resource})
+		return
+	}
+	action := "s3:GetBucketAcl"
+	if object != "" {
+		action = "s3:GetObjectAcl"
+	}
+	if r.Method == "PUT" {
+		action = strings.Replace(action, "Get", "Put", 1)
+	}
+	requester, owner, he := bucket.authorize(r, 66, object, action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	acl, err := acler.GetACL(owner, bucket.Name, object)
+	if err != nil {
+		writeError(w, storageError(67, err, notFound, resource))
+		return
+	}
+	if r.Method == "GET" {
+		writeXML(w, newAccessControlPolicy(acl, requester))
+		return
+	}
+
+	newACL, given, err := requestACL(r.Header, acl.Owner, owner.ID())
+	if err == nil && !given {
+		var b []byte
+		if r.Body != nil {
+			defer r.Body.Close()
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		}
+		if err == nil && len(b) == 0 {
+			err = s3intf.NewError("MalformedACLError", "no ACL is given")
+		}
+		if err == nil {
+			newACL.Grants, err = parseAccessControlPolicy(b)
+		}
+	}
+	if err != nil {
+		writeError(w, &HTTPError{Code: 68, HTTPCode: http.StatusBadRequest,
+			AWSCode: s3intf.ErrorCode(err), Message: err.Error(), Resource: resource})
+		return
+	}
+	if err = acler.SetACL(owner, bucket.Name, object, newACL); err != nil {
+		writeError(w, storageError(69, err, notFound, resource))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
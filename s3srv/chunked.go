@@ -0,0 +1,134 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package s3srv
+
+import (
+	"github.com/tgulacsi/s3weed/s3intf"
+
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxChunkSize is the maximum accepted size of one aws-chunked chunk
+const maxChunkSize = 16 << 20
+
+// ErrChunkSignature is returned when a chunk's signature does not match
+var ErrChunkSignature = s3intf.NewError("SignatureDoesNotMatch", "chunk signature mismatch")
+
+// chunkedReader decodes an aws-chunked (STREAMING-AWS4-HMAC-SHA256-PAYLOAD) body,
+// checking each chunk's signature, which is chained from the seed signature.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+//
+// A chunk is
+//
+//	hex(chunk-size);chunk-signature=signature\r\n
+//	chunk-data\r\n
+//
+// and the last chunk is an empty one.
+type chunkedReader struct {
+	r                *bufio.Reader
+	key              []byte
+	date, scope      string
+	prevSig          string
+	chunk            []byte
+	decoded, awaited int64
+	err              error
+}
+
+// NewChunkedReader returns a reader which strips the chunk framing from body,
+// and checks every chunk's signature against the seed signature (the
+// Authorization header's signature), and that the decoded length is as awaited
+// (x-amz-decoded-content-length).
+func NewChunkedReader(body io.Reader, signingKey []byte, date time.Time, scope,
+	seedSignature string, decodedLength int64) io.Reader {
+	return &chunkedReader{r: bufio.NewReader(body), key: signingKey,
+		date: date.UTC().Format(s3intf.ISO8601Format), scope: scope,
+		prevSig: seedSignature, awaited: decodedLength}
+}
+
+// Read implements io.Reader
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.chunk) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.err = cr.readChunk(); cr.err == io.EOF && cr.decoded != cr.awaited {
+			cr.err = fmt.Errorf("decoded %d bytes, awaited %d", cr.decoded, cr.awaited)
+		}
+	}
+	n := copy(p, cr.chunk)
+	cr.chunk = cr.chunk[n:]
+	return n, nil
+}
+
+// readChunk reads the next chunk and checks its signature. Returns io.EOF after the last chunk.
+func (cr *chunkedReader) readChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	i := strings.Index(line, ";chunk-signature=")
+	if i < 0 {
+		return fmt.Errorf("malformed chunk header %q", line)
+	}
+	size, err := strconv.ParseInt(line[:i], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return fmt.Errorf("bad chunk size in %q", line)
+	}
+	sig := line[i+len(";chunk-signature="):]
+	data := make([]byte, size+2)
+	if _, err = io.ReadFull(cr.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return errors.New("chunk data is not followed by CRLF")
+	}
+	data = data[:size]
+
+	hsh := sha256.Sum256(data)
+	sts := "AWS4-HMAC-SHA256-PAYLOAD\n" + cr.date + "\n" + cr.scope + "\n" +
+		cr.prevSig + "\n" + s3intf.EmptySHA256 + "\n" + hex.EncodeToString(hsh[:])
+	challenge, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(s3intf.HMACSHA256(cr.key, []byte(sts)), challenge) {
+		return ErrChunkSignature
+	}
+	cr.prevSig = sig
+	if size == 0 {
+		return io.EOF
+	}
+	cr.decoded += size
+	if cr.decoded > cr.awaited {
+		return fmt.Errorf("decoded more than the awaited %d bytes", cr.awaited)
+	}
+	cr.chunk = data
+	return nil
+}
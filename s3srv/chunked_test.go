@@ -0,0 +1,75 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"github.com/tgulacsi/s3weed/s3intf"
+
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// the example of http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+func chunkedExample() (body, data []byte) {
+	data = bytes.Repeat([]byte{'a'}, 65536+1024)
+	b := bytes.NewBuffer(make([]byte, 0, 66824))
+	b.WriteString("10000;chunk-signature=ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648\r\n")
+	b.Write(data[:65536])
+	b.WriteString("\r\n400;chunk-signature=0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497\r\n")
+	b.Write(data[65536:])
+	b.WriteString("\r\n0;chunk-signature=b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9\r\n\r\n")
+	return b.Bytes(), data
+}
+
+func TestChunkedReader(t *testing.T) {
+	key := s3intf.DeriveSigningKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+		"20130524", "us-east-1", "s3")
+	date := time.Date(2013, 5, 24, 0, 0, 0, 0, time.UTC)
+	const (
+		scope = "20130524/us-east-1/s3/aws4_request"
+		seed  = "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9"
+	)
+	body, data := chunkedExample()
+	if len(body) != 66824 {
+		t.Fatalf("example body length is %d, not 66824", len(body))
+	}
+	got, err := ioutil.ReadAll(NewChunkedReader(bytes.NewReader(body), key, date, scope, seed, int64(len(data))))
+	if err != nil {
+		t.Fatalf("error reading: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, awaited %d", len(got), len(data))
+	}
+
+	tampered := append([]byte(nil), body...)
+	tampered[100] = 'b'
+	if _, err = ioutil.ReadAll(NewChunkedReader(bytes.NewReader(tampered), key, date, scope, seed, int64(len(data)))); err != ErrChunkSignature {
+		t.Errorf("tampered data: awaited signature mismatch, got %v", err)
+	}
+	if _, err = ioutil.ReadAll(NewChunkedReader(bytes.NewReader(body), key, date, scope,
+		"0"+seed[1:], int64(len(data)))); err != ErrChunkSignature {
+		t.Errorf("bad seed: awaited signature mismatch, got %v", err)
+	}
+	if _, err = ioutil.ReadAll(NewChunkedReader(bytes.NewReader(body), key, date, scope, seed, 100)); err == nil {
+		t.Errorf("bad decoded length accepted")
+	}
+	if _, err = ioutil.ReadAll(NewChunkedReader(bytes.NewReader(body[:len(body)-100]), key, date, scope, seed, int64(len(data)))); err == nil {
+		t.Errorf("truncated body accepted")
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRange parses the Range header, which must be a single byte range:
+// "bytes=first-last", "bytes=first-" or "bytes=-suffixlength".
+// The returned offset and length are as s3intf.ResolveRange awaits.
+//
+// Returns ok=false if the header is missing, malformed or contains more than
+// one range - S3 ignores such Range headers, and returns the whole object.
+func parseRange(h string) (offset, length int64, ok bool) {
+	if !strings.HasPrefix(h, "bytes=") {
+		return 0, -1, false
+	}
+	spec := strings.TrimSpace(h[6:])
+	i := strings.IndexByte(spec, '-')
+	if i < 0 || strings.IndexByte(spec, ',') >= 0 {
+		return 0, -1, false
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" { // suffix
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, -1, false
+		}
+		return -n, -1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, -1, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, -1, false
+	}
+	return start, end - start + 1, true
+}
+
+// etagMatch returns whether the list of ETags (If-Match or If-None-Match header)
+// contains the etag (or is "*")
+func etagMatch(list, etag string) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.Trim(strings.TrimPrefix(tag, "W/"), `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince returns whether modTime is after the (http formatted) date.
+// Returns ok=false if the date cannot be parsed.
+func modifiedSince(date string, modTime time.Time) (modified, ok bool) {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return false, false
+	}
+	return modTime.Truncate(time.Second).After(t), true
+}
+
+// checkPreconditions evaluates the If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since headers, in the order of RFC 7232, and returns the
+// status code which must be returned instead of the object
+// (412 Precondition Failed or 304 Not Modified), or 0.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectGET.html
+func checkPreconditions(r *http.Request, etag string, modTime time.Time) int {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagMatch(im, etag) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" {
+		if modified, ok := modifiedSince(ius, modTime); ok && modified {
+			return http.StatusPreconditionFailed
+		}
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatch(inm, etag) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" &&
+		(r.Method == "GET" || r.Method == "HEAD") {
+		if modified, ok := modifiedSince(ims, modTime); ok && !modified {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// copyPreconditions evaluates the x-amz-copy-source-if-* headers of a copy
+// request, as checkPreconditions does for the corresponding If-* headers,
+// but returns 412 Precondition Failed for every failed condition, or 0.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectCOPY.html
+func copyPreconditions(r *http.Request, etag string, modTime time.Time) int {
+	h := make(http.Header, 4)
+	for _, k := range []string{"If-Match", "If-Unmodified-Since", "If-None-Match", "If-Modified-Since"} {
+		if v := r.Header.Get("X-Amz-Copy-Source-" + k); v != "" {
+			h.Set(k, v)
+		}
+	}
+	if checkPreconditions(&http.Request{Method: "GET", Header: h}, etag, modTime) != 0 {
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+// ifRange returns whether the Range header should be honored: true if there is
+// no If-Range header, or it matches the object's ETag or modification time
+func ifRange(r *http.Request, etag string, modTime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		return strings.Trim(ir, `"`) == etag
+	}
+	if strings.HasPrefix(ir, "W/") { // weak ETags never match for ranges
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && modTime.Truncate(time.Second).Equal(t)
+}
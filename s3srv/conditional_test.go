@@ -0,0 +1,124 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"github.com/tgulacsi/s3weed/s3intf"
+
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 10
+	for i, tc := range []struct {
+		header   string
+		ok       bool
+		start, n int64
+		err      error
+	}{
+		{"", false, 0, size, nil},
+		{"bytes=2-4", true, 2, 3, nil},
+		{"bytes=2-", true, 2, 8, nil},
+		{"bytes=7-100", true, 7, 3, nil},
+		{"bytes=-3", true, 7, 3, nil},
+		{"bytes=-100", true, 0, size, nil},
+		{"bytes=10-", true, 0, 0, s3intf.InvalidRange},
+		{"bytes=0-0,5-6", false, 0, size, nil}, // multiple ranges are ignored
+		{"bytes=4-2", false, 0, size, nil},
+		{"bytes=-0", false, 0, size, nil},
+		{"items=1-2", false, 0, size, nil},
+	} {
+		offset, length, ok := parseRange(tc.header)
+		if ok != tc.ok {
+			t.Errorf("%d. %q: got ok=%t, awaited %t", i, tc.header, ok, tc.ok)
+			continue
+		}
+		start, n, err := s3intf.ResolveRange(offset, length, size)
+		if err != tc.err || err == nil && (start != tc.start || n != tc.n) {
+			t.Errorf("%d. %q: got %d,%d (%v), awaited %d,%d (%v)", i, tc.header,
+				start, n, err, tc.start, tc.n, tc.err)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	const etag = "d41d8cd98f00b204e9800998ecf8427e"
+	modTime := time.Date(2013, 8, 4, 8, 27, 5, 600, time.UTC)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	at := modTime.Format(http.TimeFormat)
+	for i, tc := range []struct {
+		method string
+		header []string
+		code   int
+	}{
+		{"GET", nil, 0},
+		{"GET", []string{"If-Match", `"` + etag + `"`}, 0},
+		{"GET", []string{"If-Match", `"other", "` + etag + `"`}, 0},
+		{"GET", []string{"If-Match", "*"}, 0},
+		{"GET", []string{"If-Match", `"other"`}, 412},
+		{"GET", []string{"If-Unmodified-Since", before}, 412},
+		{"GET", []string{"If-Unmodified-Since", at}, 0},
+		// If-Match takes precedence over If-Unmodified-Since
+		{"GET", []string{"If-Match", `"` + etag + `"`, "If-Unmodified-Since", before}, 0},
+		{"GET", []string{"If-None-Match", `"` + etag + `"`}, 304},
+		{"HEAD", []string{"If-None-Match", `W/"` + etag + `"`}, 304},
+		{"PUT", []string{"If-None-Match", "*"}, 412},
+		{"GET", []string{"If-None-Match", `"other"`}, 0},
+		{"GET", []string{"If-Modified-Since", at}, 304},
+		{"GET", []string{"If-Modified-Since", before}, 0},
+		// If-None-Match takes precedence over If-Modified-Since
+		{"GET", []string{"If-None-Match", `"other"`, "If-Modified-Since", at}, 0},
+		{"GET", []string{"If-Modified-Since", "not a date"}, 0},
+	} {
+		r, _ := http.NewRequest(tc.method, "/bucket/object", nil)
+		for j := 0; j < len(tc.header); j += 2 {
+			r.Header.Set(tc.header[j], tc.header[j+1])
+		}
+		if code := checkPreconditions(r, etag, modTime); code != tc.code {
+			t.Errorf("%d. %s %v: got %d, awaited %d", i, tc.method, tc.header, code, tc.code)
+		}
+	}
+}
+
+func TestCopyPreconditions(t *testing.T) {
+	const etag = "d41d8cd98f00b204e9800998ecf8427e"
+	modTime := time.Date(2013, 8, 4, 8, 27, 5, 600, time.UTC)
+	at := modTime.Format(http.TimeFormat)
+	for i, tc := range []struct {
+		header []string
+		code   int
+	}{
+		{nil, 0},
+		{[]string{"X-Amz-Copy-Source-If-Match", `"` + etag + `"`}, 0},
+		{[]string{"X-Amz-Copy-Source-If-Match", `"other"`}, 412},
+		{[]string{"X-Amz-Copy-Source-If-None-Match", `"` + etag + `"`}, 412},
+		{[]string{"X-Amz-Copy-Source-If-Modified-Since", at}, 412},
+		{[]string{"X-Amz-Copy-Source-If-Unmodified-Since", at}, 0},
+		// the plain conditional headers are about the destination
+		{[]string{"If-Match", `"other"`}, 0},
+	} {
+		r, _ := http.NewRequest("PUT", "/bucket/object", nil)
+		for j := 0; j < len(tc.header); j += 2 {
+			r.Header.Set(tc.header[j], tc.header[j+1])
+		}
+		if code := copyPreconditions(r, etag, modTime); code != tc.code {
+			t.Errorf("%d. %v: got %d, awaited %d", i, tc.header, code, tc.code)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+type copyObjectResult struct {
+	XMLName      xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CopyObjectResult"`
+	LastModified string
+	ETag         string
+}
+
+// parseCopySource returns the bucket, the object and the version ID of the
+// x-amz-copy-source header ("/bucket/object" or "bucket/object", URL encoded,
+// with an optional "?versionId=" suffix)
+func parseCopySource(src string) (bucket, object, versionID string, ok bool) {
+	if i := strings.IndexByte(src, '?'); i >= 0 {
+		q, err := url.ParseQuery(src[i+1:])
+		if err != nil {
+			return "", "", "", false
+		}
+		if versionID = q.Get("versionId"); versionID == "" {
+			return "", "", "", false
+		}
+		src = src[:i]
+	}
+	src, err := url.PathUnescape(strings.TrimPrefix(src, "/"))
+	if err != nil {
+		return "", "", "", false
+	}
+	i := strings.IndexByte(src, '/')
+	if i <= 0 || i == len(src)-1 {
+		return "", "", "", false
+	}
+	return src[:i], src[i+1:], versionID, true
+}
+
+// copy copies the object (or its version) named in the x-amz-copy-source header
+// to this object, honoring the x-amz-copy-source-if-*, x-amz-metadata-directive and
+// x-amz-tagging-directive headers.
+// The requester needs READ permission on the source object; the new object gets
+// the ACL (see requestACL).
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectCOPY.html
+func (obj objectHandler) copy(w http.ResponseWriter, r *http.Request, owner, requester s3intf.Owner,
+	acl s3intf.ACL, aclGiven bool) {
+	resource := "/" + obj.Bucket.Name + "/" + obj.object
+	srcBucket, srcObject, srcVersionID, ok := parseCopySource(r.Header.Get("X-Amz-Copy-Source"))
+	if !ok {
+		writeError(w, &HTTPError{Code: 43, HTTPCode: http.StatusBadRequest,
+			Message:  "bad x-amz-copy-source " + r.Header.Get("X-Amz-Copy-Source"),
+			Resource: resource})
+		return
+	}
+	var (
+		filename, media string
+		meta            s3intf.Metadata
+		tags            s3intf.Tags
+	)
+	taggingDirective := r.Header.Get("X-Amz-Tagging-Directive")
+	switch taggingDirective {
+	case "", "COPY":
+	case "REPLACE":
+		var err error
+		if tags, err = s3intf.ParseTagging(r.Header.Get("X-Amz-Tagging")); err == nil {
+			err = tags.Check(s3intf.MaxObjectTags)
+		}
+		if err != nil {
+			writeError(w, &HTTPError{Code: 61, AWSCode: s3intf.ErrorCode(err),
+				Message: err.Error(), Resource: resource})
+			return
+		}
+	default:
+		writeError(w, &HTTPError{Code: 45, HTTPCode: http.StatusBadRequest,
+			Message:  "bad x-amz-tagging-directive " + taggingDirective,
+			Resource: resource})
+		return
+	}
+	switch directive := r.Header.Get("X-Amz-Metadata-Directive"); directive {
+	case "", "COPY":
+		if srcBucket == obj.Bucket.Name && srcObject == obj.object && srcVersionID == "" &&
+			taggingDirective != "REPLACE" {
+			writeError(w, &HTTPError{Code: 44, HTTPCode: http.StatusBadRequest,
+				Message:  "cannot copy an object to itself without changing its metadata",
+				Resource: resource})
+			return
+		}
+	case "REPLACE":
+		media = r.Header.Get("Content-Type")
+		var err error
+		if filename, err = dispositionFilename(r.Header.Get("Content-Disposition")); err != nil {
+			writeError(w, &HTTPError{Code: 25, HTTPCode: http.StatusBadRequest,
+				Message:  err.Error(),
+				Resource: resource})
+			return
+		}
+		if meta, err = headerMetadata(r.Header); err != nil {
+			writeError(w, &HTTPError{Code: 61, AWSCode: s3intf.ErrorCode(err),
+				Message:  err.Error(),
+				Resource: resource})
+			return
+		}
+	default:
+		writeError(w, &HTTPError{Code: 45, HTTPCode: http.StatusBadRequest,
+			Message:  "bad x-amz-metadata-directive " + directive,
+			Resource: resource})
+		return
+	}
+
+	action := "s3:GetObject"
+	if srcVersionID != "" {
+		action = "s3:GetObjectVersion"
+	}
+	srcBucketHandler := bucketHandler{Name: srcBucket, Service: obj.Bucket.Service}
+	srcOwner, he := srcBucketHandler.permit(r, requester, 46, srcObject, action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	src, err := srcBucketHandler.statVersion(srcOwner, srcObject, srcVersionID)
+	if err != nil {
+		notFound := "NoSuchKey"
+		if !obj.Bucket.Service.CheckBucket(srcOwner, srcBucket) {
+			notFound = "NoSuchBucket"
+		}
+		he := storageError(46, err, notFound, resource)
+		he.Message = "error getting " + srcBucket + "/" + srcObject + ": " + he.Message
+		writeError(w, he)
+		return
+	}
+	if code := copyPreconditions(r, src.ETag, src.LastModified); code != 0 {
+		writeError(w, &HTTPError{Code: 64, HTTPCode: code,
+			Message: "copy source precondition failed", Resource: resource})
+		return
+	}
+	// the tags are copied with the metadata, unless x-amz-tagging-directive is REPLACE
+	switch {
+	case taggingDirective == "REPLACE":
+		if meta == nil {
+			meta = make(s3intf.Metadata, len(src.Metadata))
+			for k, v := range src.Metadata {
+				meta[k] = v
+			}
+		}
+		meta = meta.SetTags(tags)
+	case meta != nil:
+		meta = meta.SetTags(src.Metadata.Tags())
+	}
+	log.Printf("copying %s/%s to %s", srcBucket, srcObject, resource)
+	o, err := obj.copyObject(srcOwner, owner, srcBucket, srcObject, srcVersionID, filename, media, meta)
+	if err != nil {
+		he := obj.storageError(47, owner, err)
+		he.Message = "error copying " + srcBucket + "/" + srcObject + ": " + he.Message
+		writeError(w, he)
+		return
+	}
+	if err = obj.storeACL(owner, requester, acl, aclGiven); err != nil {
+		writeError(w, obj.storageError(70, owner, err))
+		return
+	}
+	if o.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", o.VersionID)
+	}
+	if src.VersionID != "" {
+		w.Header().Set("X-Amz-Copy-Source-Version-Id", src.VersionID)
+	}
+	writeXML(w, copyObjectResult{LastModified: o.LastModified.UTC().Format(S3Date),
+		ETag: `"` + o.ETag + `"`})
+}
+
+// copyObject copies the source object (of the srcOwner's bucket, its version
+// with srcVersionID, if not empty) to this object with the Storage's Copier,
+// or by getting and putting it, if the Storage is not a Copier, or the buckets
+// have different owners
+func (obj objectHandler) copyObject(srcOwner, owner s3intf.Owner, srcBucket, srcObject, srcVersionID,
+	filename, media string, meta s3intf.Metadata) (s3intf.Object, error) {
+	if c, ok := obj.Bucket.Service.Storage.(s3intf.Copier); ok && srcOwner.ID() == owner.ID() {
+		return c.Copy(owner, srcBucket, srcObject, srcVersionID, obj.Bucket.Name, obj.object,
+			filename, media, meta)
+	}
+	var (
+		src  s3intf.Object
+		body io.ReadCloser
+		err  error
+	)
+	if vr, ok := obj.Bucket.Service.Storage.(s3intf.Versioner); ok && srcVersionID != "" {
+		src, body, err = vr.GetVersion(srcOwner, srcBucket, srcObject, srcVersionID, 0, -1)
+	} else {
+		src, body, err = obj.Bucket.Service.Get(srcOwner, srcBucket, srcObject, 0, -1)
+	}
+	if err != nil {
+		return src, err
+	}
+	defer body.Close()
+	if filename == "" {
+		filename = src.Filename
+	}
+	if media == "" {
+		media = src.ContentType
+	}
+	if meta == nil {
+		meta = src.Metadata
+	}
+	md5hash, err := hex.DecodeString(src.ETag)
+	if err != nil || len(md5hash) != crypto.MD5.Size() { // multipart ETag
+		hsh := crypto.MD5.New()
+		rc, err := TeeRead(hsh, body, 1<<20)
+		if err != nil {
+			return src, err
+		}
+		defer rc.Close()
+		body, md5hash = rc, hsh.Sum(nil)
+	}
+	versionID, err := obj.Bucket.Service.Put(owner, obj.Bucket.Name, obj.object,
+		filename, media, body, src.Size, md5hash, meta)
+	if err != nil {
+		return src, err
+	}
+	o, err := obj.Bucket.Service.Stat(owner, obj.Bucket.Name, obj.object)
+	o.VersionID = versionID
+	return o, err
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// MaxCORSSize is the maximal size of a CORS configuration document
+const MaxCORSSize = 64 << 10
+
+type corsConfiguration struct {
+	XMLName xml.Name   `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CORSConfiguration"`
+	Rules   []corsRule `xml:"CORSRule"`
+}
+
+// corsRule is the XML form of s3intf.CORSRule
+type corsRule struct {
+	ID             string   `xml:",omitempty"`
+	AllowedOrigins []string `xml:"AllowedOrigin"`
+	AllowedMethods []string `xml:"AllowedMethod"`
+	AllowedHeaders []string `xml:"AllowedHeader"`
+	ExposeHeaders  []string `xml:"ExposeHeader"`
+	MaxAgeSeconds  int      `xml:",omitempty"`
+}
+
+func newCORSConfiguration(rules []s3intf.CORSRule) corsConfiguration {
+	conf := corsConfiguration{Rules: make([]corsRule, len(rules))}
+	for i, rule := range rules {
+		conf.Rules[i] = corsRule(rule)
+	}
+	return conf
+}
+
+// parseCORSConfiguration returns the checked rules of the CORSConfiguration document
+func parseCORSConfiguration(b []byte) ([]s3intf.CORSRule, error) {
+	var conf struct {
+		Rules []corsRule `xml:"CORSRule"`
+	}
+	if err := xml.Unmarshal(b, &conf); err != nil {
+		return nil, s3intf.NewError("MalformedXML", err.Error())
+	}
+	rules := make([]s3intf.CORSRule, len(conf.Rules))
+	for i, rule := range conf.Rules {
+		rules[i] = s3intf.CORSRule(rule)
+	}
+	return rules, s3intf.CheckCORSRules(rules)
+}
+
+// corsRules returns the CORS rules of the bucket, or nil if it has none.
+// The requests of CORS are usually unsigned, so the bucket's owner is found
+// with the s3intf.ACLer; without it, only the signed requests of the owner have
+// the CORS rules.
+func (bucket bucketHandler) corsRules(r *http.Request) []s3intf.CORSRule {
+	corser, ok := bucket.Service.Storage.(s3intf.CORSer)
+	if !ok {
+		return nil
+	}
+	owner, err := bucket.owner()
+	if err == errNoACLer {
+		if owner, _ = bucket.authenticate(r, 0, ""); owner == nil || owner.ID() == "" {
+			return nil
+		}
+	} else if err != nil {
+		return nil
+	}
+	rules, err := corser.GetCORS(owner, bucket.Name)
+	if err != nil {
+		if err != s3intf.NoSuchCORSConfiguration && err != s3intf.NoSuchBucket {
+			log.Printf("error getting the CORS rules of %s: %s", bucket.Name, err)
+		}
+		return nil
+	}
+	return rules
+}
+
+// setCORSHeaders sets the Access-Control-* response headers according to the rule
+func setCORSHeaders(w http.ResponseWriter, origin string, rule *s3intf.CORSRule) {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if len(rule.AllowedOrigins) == 1 && rule.AllowedOrigins[0] == "*" {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(rule.AllowedMethods, ", "))
+	if len(rule.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(rule.ExposeHeaders, ", "))
+	}
+	if rule.MaxAgeSeconds > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(rule.MaxAgeSeconds))
+	}
+}
+
+// cors adds the Access-Control-* headers of the matching CORS rule to the
+// response of the cross-origin request (one with an Origin header)
+func (bucket bucketHandler) cors(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	if rule := s3intf.MatchCORS(bucket.corsRules(r), origin, r.Method, nil); rule != nil {
+		setCORSHeaders(w, origin, rule)
+	}
+}
+
+// preflight answers the CORS preflight (OPTIONS) request.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTOPTIONSobject.html
+func (bucket bucketHandler) preflight(w http.ResponseWriter, r *http.Request, resource string) {
+	origin, method := r.Header.Get("Origin"), r.Header.Get("Access-Control-Request-Method")
+	if origin == "" || method == "" {
+		writeError(w, &HTTPError{Code: 86, HTTPCode: http.StatusBadRequest,
+			Message:  "Insufficient information. Origin and Access-Control-Request-Method request headers needed.",
+			Resource: resource})
+		return
+	}
+	var headers []string
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+	rules := bucket.corsRules(r)
+	if rules == nil {
+		writeError(w, &HTTPError{Code: 87, AWSCode: "AccessForbidden",
+			Message: "CORSResponse: CORS is not enabled for this bucket.", Resource: resource})
+		return
+	}
+	rule := s3intf.MatchCORS(rules, origin, method, headers)
+	if rule == nil {
+		writeError(w, &HTTPError{Code: 87, AWSCode: "AccessForbidden",
+			Message: "CORSResponse: This CORS request is not allowed. This is usually because the " +
+				"evaluation of Origin, request method / Access-Control-Request-Method or " +
+				"Access-Control-Request-Headers are not whitelisted by the resource's CORS spec.",
+			Resource: resource})
+		return
+	}
+	setCORSHeaders(w, origin, rule)
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// serveCORS gets (GET), sets (PUT) or deletes (DELETE) the CORS configuration of the bucket.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketPUTcors.html
+func (bucket bucketHandler) serveCORS(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	corser, ok := bucket.Service.Storage.(s3intf.CORSer)
+	if !ok {
+		writeError(w, &HTTPError{Code: 81, HTTPCode: http.StatusNotImplemented,
+			Message: "CORS configuration is not supported", Resource: resource})
+		return
+	}
+	action := "s3:PutBucketCORS"
+	if r.Method == "GET" {
+		action = "s3:GetBucketCORS"
+	}
+	_, owner, he := bucket.authorize(r, 82, "", action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		rules, err := corser.GetCORS(owner, bucket.Name)
+		if err != nil {
+			writeError(w, bucket.storageError(83, err))
+			return
+		}
+		writeXML(w, newCORSConfiguration(rules))
+		return
+	case "PUT":
+		var b []byte
+		var err error
+		if r.Body != nil {
+			defer r.Body.Close()
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxCORSSize))
+		}
+		var rules []s3intf.CORSRule
+		if err == nil {
+			rules, err = parseCORSConfiguration(b)
+		}
+		if err != nil {
+			code := s3intf.ErrorCode(err)
+			if code == "" {
+				code = "MalformedXML"
+			}
+			writeError(w, &HTTPError{Code: 84, HTTPCode: http.StatusBadRequest,
+				AWSCode: code, Message: err.Error(), Resource: resource})
+			return
+		}
+		if err = corser.SetCORS(owner, bucket.Name, rules); err != nil {
+			writeError(w, bucket.storageError(85, err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "DELETE":
+		if err := corser.SetCORS(owner, bucket.Name, nil); err != nil {
+			writeError(w, bucket.storageError(85, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// MaxDeleteKeys is the maximal number of keys in one multi-object delete request
+const MaxDeleteKeys = 1000
+
+type deleteRequest struct {
+	Quiet   bool
+	Objects []struct {
+		Key       string
+		VersionID string `xml:"VersionId"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedKey  `xml:",omitempty"`
+	Errors  []deleteError `xml:"Error,omitempty"`
+}
+
+type deletedKey struct {
+	Key                   string
+	VersionID             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:",omitempty"`
+	DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+type deleteError struct {
+	Key       string
+	VersionID string `xml:"VersionId,omitempty"`
+	Code      string
+	Message   string
+}
+
+// multiDel deletes the objects (or their versions, if VersionId is given) listed
+// in the request body, and reports the result of each (only the errors in quiet
+// mode). The s3:DeleteObject (s3:DeleteObjectVersion) permission is checked
+// for each object.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/multiobjectdeleteapi.html
+func (bucket bucketHandler) multiDel(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	requester, he := bucket.authenticate(r, 48, "")
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	if r.Body == nil {
+		writeError(w, &HTTPError{Code: 49, HTTPCode: http.StatusBadRequest,
+			Message: "nil body", Resource: resource})
+		return
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2<<20))
+	if err != nil {
+		writeError(w, &HTTPError{Code: 49, HTTPCode: http.StatusBadRequest,
+			Message: "error reading body: " + err.Error(), Resource: resource})
+		return
+	}
+	if md5Given := r.Header.Get("Content-MD5"); md5Given != "" {
+		hsh := md5.Sum(b)
+		if base64.StdEncoding.EncodeToString(hsh[:]) != md5Given {
+			writeError(w, &HTTPError{Code: 50, HTTPCode: http.StatusBadRequest,
+				Message: "Content-MD5 mismatch", Resource: resource})
+			return
+		}
+	}
+	var req deleteRequest
+	if err = xml.Unmarshal(b, &req); err != nil {
+		writeError(w, &HTTPError{Code: 51, HTTPCode: http.StatusBadRequest,
+			Message: "cannot parse request: " + err.Error(), Resource: resource})
+		return
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > MaxDeleteKeys {
+		writeError(w, &HTTPError{Code: 51, HTTPCode: http.StatusBadRequest,
+			Message:  "the number of keys must be between 1 and 1000",
+			Resource: resource})
+		return
+	}
+	deleted := make([]deletedKey, len(req.Objects))
+	errs := make([]error, len(deleted))
+	var (
+		owner   s3intf.Owner
+		allowed []string
+		idx     []int
+	)
+	for i, o := range req.Objects {
+		deleted[i] = deletedKey{Key: o.Key, VersionID: o.VersionID}
+		action := "s3:DeleteObject"
+		if o.VersionID != "" {
+			action = "s3:DeleteObjectVersion"
+		}
+		keyOwner, he := bucket.permit(r, requester, 48, o.Key, action)
+		if he != nil {
+			if he.AWSCode != "AccessDenied" {
+				writeError(w, he)
+				return
+			}
+			errs[i] = s3intf.NewError(he.AWSCode, he.Message)
+			continue
+		}
+		if o.VersionID != "" {
+			deleteMarker, err := bucket.deleteVersion(keyOwner, o.Key, o.VersionID)
+			if errs[i] = err; deleteMarker {
+				deleted[i].DeleteMarker, deleted[i].DeleteMarkerVersionID = true, o.VersionID
+			}
+			continue
+		}
+		owner = keyOwner
+		allowed = append(allowed, o.Key)
+		idx = append(idx, i)
+	}
+
+	var allowedErrs []error
+	if md, ok := bucket.Service.Storage.(s3intf.MultiDeleter); ok && len(allowed) > 0 {
+		allowedErrs, err = md.DelMulti(owner, bucket.Name, allowed)
+	} else {
+		allowedErrs = make([]error, len(allowed))
+		for i, k := range allowed {
+			allowedErrs[i] = bucket.Service.Del(owner, bucket.Name, k)
+		}
+	}
+	for i, e := range allowedErrs {
+		errs[idx[i]] = e
+	}
+	if err != nil {
+		he := bucket.storageError(52, err)
+		he.Message = "error deleting: " + he.Message
+		writeError(w, he)
+		return
+	}
+
+	var res deleteResult
+	for i, d := range deleted {
+		if err = errs[i]; err != nil && err != s3intf.NotFound {
+			log.Printf("error deleting %s/%s: %s", bucket.Name, d.Key, err)
+			code := s3intf.ErrorCode(err)
+			if code == "" {
+				code = "InternalError"
+			}
+			res.Errors = append(res.Errors, deleteError{Key: d.Key, VersionID: d.VersionID,
+				Code: code, Message: err.Error()})
+			continue
+		}
+		if req.Quiet {
+			continue
+		}
+		if d.VersionID == "" && err == nil {
+			// in a versioned bucket, a delete marker is created
+			if d.DeleteMarkerVersionID = bucket.deleteMarker(owner, d.Key); d.DeleteMarkerVersionID != "" {
+				d.DeleteMarker = true
+			}
+		}
+		res.Deleted = append(res.Deleted, d)
+	}
+	writeXML(w, res)
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// errorStatus is the HTTP status of the S3 error codes.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html#ErrorCodeList
+var errorStatus = map[string]int{
+	"AccessDenied":                    http.StatusForbidden,
+	"AccessForbidden":                 http.StatusForbidden,
+	"BadDigest":                       http.StatusBadRequest,
+	"BucketAlreadyExists":             http.StatusConflict,
+	"BucketAlreadyOwnedByYou":         http.StatusConflict,
+	"BucketNotEmpty":                  http.StatusConflict,
+	"EntityTooLarge":                  http.StatusBadRequest,
+	"EntityTooSmall":                  http.StatusBadRequest,
+	"IncompleteBody":                  http.StatusBadRequest,
+	"InternalError":                   http.StatusInternalServerError,
+	"InvalidAccessKeyId":              http.StatusForbidden,
+	"InvalidArgument":                 http.StatusBadRequest,
+	"InvalidBucketName":               http.StatusBadRequest,
+	"InvalidDigest":                   http.StatusBadRequest,
+	"InvalidPart":                     http.StatusBadRequest,
+	"InvalidPartOrder":                http.StatusBadRequest,
+	"InvalidPolicyDocument":           http.StatusBadRequest,
+	"InvalidRange":                    http.StatusRequestedRangeNotSatisfiable,
+	"InvalidRedirectLocation":         http.StatusBadRequest,
+	"InvalidRequest":                  http.StatusBadRequest,
+	"InvalidTag":                      http.StatusBadRequest,
+	"MalformedACLError":               http.StatusBadRequest,
+	"MalformedPOSTRequest":            http.StatusBadRequest,
+	"MalformedPolicy":                 http.StatusBadRequest,
+	"MalformedXML":                    http.StatusBadRequest,
+	"MaxPostPreDataLengthExceeded":    http.StatusBadRequest,
+	"MetadataTooLarge":                http.StatusBadRequest,
+	"MethodNotAllowed":                http.StatusMethodNotAllowed,
+	"NoSuchBucket":                    http.StatusNotFound,
+	"NoSuchBucketPolicy":              http.StatusNotFound,
+	"NoSuchCORSConfiguration":         http.StatusNotFound,
+	"NoSuchKey":                       http.StatusNotFound,
+	"NoSuchLifecycleConfiguration":    http.StatusNotFound,
+	"NoSuchTagSet":                    http.StatusNotFound,
+	"NoSuchUpload":                    http.StatusNotFound,
+	"NoSuchVersion":                   http.StatusNotFound,
+	"NoSuchWebsiteConfiguration":      http.StatusNotFound,
+	"NotImplemented":                  http.StatusNotImplemented,
+	"PreconditionFailed":              http.StatusPreconditionFailed,
+	"RequestTimeTooSkewed":            http.StatusForbidden,
+	"SignatureDoesNotMatch":           http.StatusForbidden,
+	"UnresolvableGrantByEmailAddress": http.StatusBadRequest,
+	"XAmzContentSHA256Mismatch":       http.StatusBadRequest,
+}
+
+// statusError is the S3 error code used for an HTTP status, if no code is given
+var statusError = map[int]string{
+	http.StatusBadRequest:                   "InvalidRequest",
+	http.StatusForbidden:                    "AccessDenied",
+	http.StatusNotFound:                     "NoSuchKey",
+	http.StatusMethodNotAllowed:             "MethodNotAllowed",
+	http.StatusPreconditionFailed:           "PreconditionFailed",
+	http.StatusRequestedRangeNotSatisfiable: "InvalidRange",
+	http.StatusNotImplemented:               "NotImplemented",
+}
+
+// errorResponse is the body of the error responses
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string `xml:",omitempty"`
+	RequestId string
+	HostId    string
+}
+
+// newRequestID returns a new request ID (x-amz-request-id) and host ID (x-amz-id-2)
+func newRequestID() (requestID, hostID string) {
+	var b [40]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b[:8])), base64.StdEncoding.EncodeToString(b[8:])
+}
+
+// storageError returns the HTTPError for an error returned by the Storage:
+// NotFound is reported with the notFound S3 error code, an *s3intf.Error with its code.
+func storageError(code int, err error, notFound, resource string) *HTTPError {
+	he := &HTTPError{Code: code, Message: err.Error(), Resource: resource}
+	if err == s3intf.NotFound {
+		he.AWSCode = notFound
+	} else {
+		he.AWSCode = s3intf.ErrorCode(err)
+	}
+	return he
+}
+
+// storageError returns the HTTPError for an error of the Storage about the bucket
+func (bucket bucketHandler) storageError(code int, err error) *HTTPError {
+	return storageError(code, err, "NoSuchBucket", "/"+bucket.Name)
+}
+
+// storageError returns the HTTPError for an error of the Storage about the object:
+// NotFound is NoSuchBucket if the bucket does not exist, NoSuchKey otherwise
+func (obj objectHandler) storageError(code int, owner s3intf.Owner, err error) *HTTPError {
+	notFound := "NoSuchKey"
+	if err == s3intf.NotFound && !obj.Bucket.Service.CheckBucket(owner, obj.Bucket.Name) {
+		notFound = "NoSuchBucket"
+	}
+	return storageError(code, err, notFound, "/"+obj.Bucket.Name+"/"+obj.object)
+}
+
+// ownerError returns the HTTPError for an error of the authentication (s3intf.GetOwner)
+func ownerError(code int, err error, resource string) *HTTPError {
+	he := &HTTPError{Code: code, Message: "error getting owner: " + err.Error(),
+		Resource: resource, AWSCode: s3intf.ErrorCode(err)}
+	if he.AWSCode == "" {
+		he.AWSCode = "AccessDenied"
+	}
+	return he
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"github.com/tgulacsi/s3weed/s3intf"
+
+	"encoding/xml"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteError(t *testing.T) {
+	for i, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{&HTTPError{Code: 1, HTTPCode: 400}, 400, "InvalidRequest"},
+		{&HTTPError{Code: 2, AWSCode: "NoSuchBucket"}, 404, "NoSuchBucket"},
+		{&HTTPError{Code: 3, HTTPCode: 400, AWSCode: "MetadataTooLarge"}, 400, "MetadataTooLarge"},
+		{&HTTPError{Code: 4}, 500, "InternalError"},
+		{storageError(5, s3intf.NotFound, "NoSuchKey", "/b/k"), 404, "NoSuchKey"},
+		{storageError(6, s3intf.BucketNotEmpty, "NoSuchBucket", "/b"), 409, "BucketNotEmpty"},
+		{ownerError(7, errors.New("no credentials"), "/b"), 403, "AccessDenied"},
+		{ownerError(8, s3intf.SignatureDoesNotMatch, "/b"), 403, "SignatureDoesNotMatch"},
+		{s3intf.InvalidRange, 416, "InvalidRange"},
+		{errors.New("unknown"), 500, "InternalError"},
+	} {
+		w := httptest.NewRecorder()
+		w.Header().Set("X-Amz-Request-Id", "0123456789ABCDEF")
+		writeError(w, tc.err)
+		var resp errorResponse
+		if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%d. cannot decode %q: %s", i, w.Body.Bytes(), err)
+			continue
+		}
+		if w.Code != tc.status || resp.Code != tc.code {
+			t.Errorf("%d. got %d %q, awaited %d %q", i, w.Code, resp.Code, tc.status, tc.code)
+		}
+		if resp.RequestId != "0123456789ABCDEF" {
+			t.Errorf("%d. got request ID %q", i, resp.RequestId)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// MaxLifecycleSize is the maximal size of a lifecycle configuration document
+const MaxLifecycleSize = 64 << 10
+
+// lifecycleDateFormat is the format of the expiration dates
+const lifecycleDateFormat = "2006-01-02T15:04:05.000Z"
+
+type lifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LifecycleConfiguration"`
+	Rules   []lifecycleRule `xml:"Rule"`
+}
+
+// lifecycleRule is the XML form of s3intf.LifecycleRule
+type lifecycleRule struct {
+	ID string `xml:",omitempty"`
+	// Prefix is the deprecated form of Filter>Prefix
+	Prefix                         *string          `xml:",omitempty"`
+	Filter                         *lifecycleFilter `xml:",omitempty"`
+	Status                         string
+	Expiration                     *lifecycleExpiration   `xml:",omitempty"`
+	NoncurrentVersionExpiration    *noncurrentExpiration  `xml:",omitempty"`
+	AbortIncompleteMultipartUpload *abortIncompleteUpload `xml:",omitempty"`
+}
+
+// lifecycleFilter has exactly one of Prefix, Tag and And
+type lifecycleFilter struct {
+	Prefix *string       `xml:",omitempty"`
+	Tag    *tag          `xml:",omitempty"`
+	And    *lifecycleAnd `xml:",omitempty"`
+}
+
+type lifecycleAnd struct {
+	Prefix string `xml:",omitempty"`
+	Tags   []tag  `xml:"Tag"`
+}
+
+type lifecycleExpiration struct {
+	Days int    `xml:",omitempty"`
+	Date string `xml:",omitempty"`
+}
+
+type noncurrentExpiration struct {
+	NoncurrentDays int
+}
+
+type abortIncompleteUpload struct {
+	DaysAfterInitiation int
+}
+
+func newLifecycleConfiguration(rules []s3intf.LifecycleRule) lifecycleConfiguration {
+	conf := lifecycleConfiguration{Rules: make([]lifecycleRule, len(rules))}
+	for i, rule := range rules {
+		r := lifecycleRule{ID: rule.ID, Status: "Disabled", Filter: new(lifecycleFilter)}
+		if rule.Enabled {
+			r.Status = "Enabled"
+		}
+		switch t := newTagging(rule.Tags).TagSet; {
+		case len(t) == 0:
+			prefix := rule.Prefix
+			r.Filter.Prefix = &prefix
+		case len(t) == 1 && rule.Prefix == "":
+			r.Filter.Tag = &t[0]
+		default:
+			r.Filter.And = &lifecycleAnd{Prefix: rule.Prefix, Tags: t}
+		}
+		if rule.ExpirationDays > 0 {
+			r.Expiration = &lifecycleExpiration{Days: rule.ExpirationDays}
+		} else if !rule.ExpirationDate.IsZero() {
+			r.Expiration = &lifecycleExpiration{Date: rule.ExpirationDate.UTC().Format(lifecycleDateFormat)}
+		}
+		if rule.NoncurrentDays > 0 {
+			r.NoncurrentVersionExpiration = &noncurrentExpiration{NoncurrentDays: rule.NoncurrentDays}
+		}
+		if rule.AbortIncompleteDays > 0 {
+			r.AbortIncompleteMultipartUpload = &abortIncompleteUpload{DaysAfterInitiation: rule.AbortIncompleteDays}
+		}
+		conf.Rules[i] = r
+	}
+	return conf
+}
+
+// parseLifecycleConfiguration returns the checked rules of the LifecycleConfiguration document
+func parseLifecycleConfiguration(b []byte) ([]s3intf.LifecycleRule, error) {
+	var conf struct {
+		Rules []lifecycleRule `xml:"Rule"`
+	}
+	if err := xml.Unmarshal(b, &conf); err != nil {
+		return nil, s3intf.NewError("MalformedXML", err.Error())
+	}
+	rules := make([]s3intf.LifecycleRule, len(conf.Rules))
+	for i, r := range conf.Rules {
+		rule := s3intf.LifecycleRule{ID: r.ID}
+		switch r.Status {
+		case "Enabled":
+			rule.Enabled = true
+		case "Disabled":
+		default:
+			return nil, s3intf.NewError("MalformedXML", "bad status "+r.Status+" of rule "+r.ID)
+		}
+		if r.Prefix != nil && r.Filter != nil {
+			return nil, s3intf.NewError("MalformedXML", "rule "+r.ID+" cannot have both Prefix and Filter")
+		}
+		if r.Prefix != nil {
+			rule.Prefix = *r.Prefix
+		}
+		if f := r.Filter; f != nil {
+			n := 0
+			if f.Prefix != nil {
+				rule.Prefix = *f.Prefix
+				n++
+			}
+			if f.Tag != nil {
+				rule.Tags = s3intf.Tags{f.Tag.Key: f.Tag.Value}
+				n++
+			}
+			if f.And != nil {
+				rule.Prefix = f.And.Prefix
+				rule.Tags = make(s3intf.Tags, len(f.And.Tags))
+				for _, t := range f.And.Tags {
+					if _, ok := rule.Tags[t.Key]; ok {
+						return nil, s3intf.NewError("InvalidTag",
+							"cannot provide multiple tags with the same key "+t.Key)
+					}
+					rule.Tags[t.Key] = t.Value
+				}
+				n++
+			}
+			if n > 1 {
+				return nil, s3intf.NewError("MalformedXML", "the Filter of rule "+r.ID+
+					" must have only one of Prefix, Tag and And")
+			}
+		}
+		if e := r.Expiration; e != nil {
+			rule.ExpirationDays = e.Days
+			if e.Date != "" {
+				date, err := time.Parse(time.RFC3339, e.Date)
+				if err != nil {
+					return nil, s3intf.NewError("InvalidArgument", "bad expiration date "+e.Date)
+				}
+				rule.ExpirationDate = date.UTC()
+			}
+		}
+		if r.NoncurrentVersionExpiration != nil {
+			rule.NoncurrentDays = r.NoncurrentVersionExpiration.NoncurrentDays
+		}
+		if r.AbortIncompleteMultipartUpload != nil {
+			rule.AbortIncompleteDays = r.AbortIncompleteMultipartUpload.DaysAfterInitiation
+		}
+		rules[i] = rule
+	}
+	return rules, s3intf.CheckLifecycleRules(rules)
+}
+
+// serveLifecycle gets (GET), sets (PUT) or deletes (DELETE) the lifecycle configuration
+// of the bucket; the rules are applied by an s3lifecycle.Worker.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketPUTlifecycle.html
+func (bucket bucketHandler) serveLifecycle(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	lc, ok := bucket.Service.Storage.(s3intf.Lifecycler)
+	if !ok {
+		writeError(w, &HTTPError{Code: 102, HTTPCode: http.StatusNotImplemented,
+			Message: "lifecycle configuration is not supported", Resource: resource})
+		return
+	}
+	action := "s3:PutLifecycleConfiguration"
+	if r.Method == "GET" {
+		action = "s3:GetLifecycleConfiguration"
+	}
+	_, owner, he := bucket.authorize(r, 103, "", action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		rules, err := lc.GetLifecycle(owner, bucket.Name)
+		if err != nil {
+			writeError(w, bucket.storageError(104, err))
+			return
+		}
+		writeXML(w, newLifecycleConfiguration(rules))
+		return
+	case "PUT":
+		var b []byte
+		var err error
+		if r.Body != nil {
+			defer r.Body.Close()
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxLifecycleSize))
+		}
+		var rules []s3intf.LifecycleRule
+		if err == nil {
+			rules, err = parseLifecycleConfiguration(b)
+		}
+		if err != nil {
+			code := s3intf.ErrorCode(err)
+			if code == "" {
+				code = "MalformedXML"
+			}
+			writeError(w, &HTTPError{Code: 105, HTTPCode: http.StatusBadRequest,
+				AWSCode: code, Message: err.Error(), Resource: resource})
+			return
+		}
+		if err = lc.SetLifecycle(owner, bucket.Name, rules); err != nil {
+			writeError(w, bucket.storageError(106, err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "DELETE":
+		if err := lc.SetLifecycle(owner, bucket.Name, nil); err != nil {
+			writeError(w, bucket.storageError(106, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
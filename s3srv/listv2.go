@@ -0,0 +1,157 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+type listBucketResultV2 struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	Contents              []xmlObject
+	CommonPrefixes        []xmlCommonPrefix `xml:",omitempty"`
+}
+
+type xmlObject struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	Owner        *xmlOwner `xml:",omitempty"`
+	StorageClass string
+}
+
+type xmlCommonPrefix struct {
+	Prefix string
+}
+
+// continuationToken returns the opaque token of the listing continuing after key
+func continuationToken(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// parseContinuationToken returns the key the listing continues after
+func parseContinuationToken(token string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	return string(b), err
+}
+
+// lastListed returns the last key or common prefix of a listing
+func lastListed(objects []s3intf.Object, commonprefixes []string) string {
+	var last string
+	if len(objects) > 0 {
+		last = objects[len(objects)-1].Key
+	}
+	if len(commonprefixes) > 0 && commonprefixes[len(commonprefixes)-1] > last {
+		last = commonprefixes[len(commonprefixes)-1]
+	}
+	return last
+}
+
+// listV2 lists the bucket as GET Bucket (List Objects) Version 2.
+// The continuation token is the last listed key (or common prefix), which is
+// the marker of the next List call.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/v2-RESTBucketGET.html
+func (bucket bucketHandler) listV2(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	res := listBucketResultV2{Name: bucket.Name, MaxKeys: 1000,
+		Prefix:            r.Form.Get("prefix"),
+		Delimiter:         r.Form.Get("delimiter"),
+		StartAfter:        r.Form.Get("start-after"),
+		ContinuationToken: r.Form.Get("continuation-token"),
+		EncodingType:      r.Form.Get("encoding-type")}
+	if res.EncodingType != "" && res.EncodingType != "url" {
+		writeError(w, &HTTPError{Code: 53, HTTPCode: http.StatusBadRequest,
+			Message: "bad encoding-type " + res.EncodingType, Resource: resource})
+		return
+	}
+	var err error
+	if maxkeys := r.Form.Get("max-keys"); maxkeys != "" {
+		if res.MaxKeys, err = strconv.Atoi(maxkeys); err != nil || res.MaxKeys < 0 {
+			writeError(w, &HTTPError{Code: 11, HTTPCode: http.StatusBadRequest,
+				Message: "bad max-keys value " + maxkeys, Resource: resource})
+			return
+		}
+		if res.MaxKeys > 1000 {
+			res.MaxKeys = 1000
+		}
+	}
+	marker := res.StartAfter
+	if res.ContinuationToken != "" {
+		if marker, err = parseContinuationToken(res.ContinuationToken); err != nil {
+			writeError(w, &HTTPError{Code: 54, HTTPCode: http.StatusBadRequest,
+				Message: "bad continuation-token: " + err.Error(), Resource: resource})
+			return
+		}
+	}
+	fetchOwner := r.Form.Get("fetch-owner") == "true"
+
+	_, owner, he := bucket.authorize(r, 13, "", "s3:ListBucket")
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	objects, commonprefixes, truncated, err := bucket.Service.List(owner,
+		bucket.Name, res.Prefix, res.Delimiter, marker, res.MaxKeys, 0)
+	if err != nil {
+		log.Printf("error with bucket.Service.List(%s, %s, %q, %q, %q, %d): %s",
+			owner.ID(), bucket.Name, res.Prefix, res.Delimiter, marker, res.MaxKeys, err)
+		writeError(w, bucket.storageError(14, err))
+		return
+	}
+
+	res.IsTruncated = truncated
+	res.KeyCount = len(objects) + len(commonprefixes)
+	if truncated {
+		res.NextContinuationToken = continuationToken(lastListed(objects, commonprefixes))
+	}
+	encode := func(s string) string { return s }
+	if res.EncodingType == "url" {
+		encode = url.QueryEscape
+		res.Prefix, res.Delimiter = encode(res.Prefix), encode(res.Delimiter)
+		res.StartAfter = encode(res.StartAfter)
+	}
+	res.Contents = make([]xmlObject, len(objects))
+	for i, o := range objects {
+		res.Contents[i] = newXMLObject(o)
+		res.Contents[i].Key = encode(o.Key)
+		if fetchOwner {
+			res.Contents[i].Owner = &xmlOwner{ID: o.Owner.ID(), DisplayName: o.Owner.Name()}
+		}
+	}
+	for _, cp := range commonprefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, xmlCommonPrefix{Prefix: encode(cp)})
+	}
+	writeXML(w, res)
+}
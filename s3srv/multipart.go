@@ -0,0 +1,446 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type xmlOwner struct {
+	ID          string
+	DisplayName string
+}
+
+type xmlPart struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string
+	Key                  string
+	UploadID             string `xml:"UploadId"`
+	Initiator            xmlOwner
+	Owner                xmlOwner
+	StorageClass         string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Parts                []xmlPart `xml:"Part"`
+}
+
+type xmlUpload struct {
+	Key          string
+	UploadID     string `xml:"UploadId"`
+	Initiator    xmlOwner
+	Owner        xmlOwner
+	StorageClass string
+	Initiated    string
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string
+	KeyMarker          string
+	UploadIDMarker     string `xml:"UploadIdMarker"`
+	NextKeyMarker      string
+	NextUploadIDMarker string `xml:"NextUploadIdMarker"`
+	Delimiter          string `xml:",omitempty"`
+	Prefix             string
+	MaxUploads         int
+	IsTruncated        bool
+	Uploads            []xmlUpload `xml:"Upload"`
+	CommonPrefixes     []struct {
+		Prefix string
+	} `xml:",omitempty"`
+}
+
+// writeXML writes the XML encoded v with the XML header
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error encoding %#v: %s", v, err)
+	}
+}
+
+// intParam returns the named query parameter's value as int, or def if it is missing
+func intParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// multipart serves the multipart upload requests (with uploads or uploadId
+// query parameter), and returns whether the request was such.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/mpuoverview.html
+func (obj objectHandler) multipart(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	_, initiate := q["uploads"]
+	uploadID := q.Get("uploadId")
+	if !(initiate && r.Method == "POST" || uploadID != "") {
+		return false
+	}
+	resource := "/" + obj.Bucket.Name + "/" + obj.object
+	mp, ok := obj.Bucket.Service.Storage.(s3intf.Multiparter)
+	if !ok {
+		writeError(w, &HTTPError{Code: 31, HTTPCode: http.StatusNotImplemented,
+			Message: "multipart upload is not supported", Resource: resource})
+		return true
+	}
+	action := "s3:PutObject"
+	switch r.Method {
+	case "DELETE":
+		action = "s3:AbortMultipartUpload"
+	case "GET":
+		action = "s3:ListMultipartUploadParts"
+	}
+	requester, owner, he := obj.Bucket.authorize(r, 32, obj.object, action)
+	if he != nil {
+		writeError(w, he)
+		return true
+	}
+
+	switch {
+	case initiate:
+		obj.initMultipart(w, r, mp, owner, requester)
+	case r.Method == "PUT":
+		obj.putPart(w, r, mp, owner, requester, uploadID)
+	case r.Method == "POST":
+		obj.completeMultipart(w, r, mp, owner, requester, uploadID)
+	case r.Method == "DELETE":
+		if err := mp.AbortMultipart(owner, obj.Bucket.Name, obj.object, uploadID); err != nil {
+			writeError(w, obj.storageError(38, owner, err))
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "GET":
+		obj.listParts(w, r, mp, owner, uploadID)
+	default:
+		writeError(w, &HTTPError{Code: 4, HTTPCode: http.StatusBadRequest,
+			Message:  "only DELETE, GET, PUT and POST allowed for multipart uploads",
+			Resource: resource})
+	}
+	return true
+}
+
+// initMultipart initiates a multipart upload and returns its upload ID.
+// The ACL (see requestACL) is stored with the upload, and set on completion.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadInitiate.html
+func (obj objectHandler) initMultipart(w http.ResponseWriter, r *http.Request,
+	mp s3intf.Multiparter, owner, requester s3intf.Owner) {
+	resource := "/" + obj.Bucket.Name + "/" + obj.object
+	acl, aclGiven, err := requestACL(r.Header, requester.ID(), owner.ID())
+	if err != nil {
+		writeError(w, &HTTPError{Code: 68, HTTPCode: http.StatusBadRequest,
+			AWSCode: s3intf.ErrorCode(err), Message: err.Error(), Resource: resource})
+		return
+	}
+	var uploadACL *s3intf.ACL
+	if aclGiven || requester.ID() != owner.ID() {
+		uploadACL = &acl
+	}
+	var fn string
+	if disp := r.Header.Get("Content-Disposition"); disp != "" {
+		if _, params, err := mime.ParseMediaType(disp); err == nil {
+			fn = params["filename"]
+		}
+	}
+	meta, err := headerMetadata(r.Header)
+	if err != nil {
+		writeError(w, &HTTPError{Code: 61, AWSCode: s3intf.ErrorCode(err),
+			Message: err.Error(), Resource: resource})
+		return
+	}
+	uploadID, err := mp.InitMultipart(owner, requester, obj.Bucket.Name, obj.object,
+		fn, r.Header.Get("Content-Type"), meta, uploadACL)
+	if err != nil {
+		writeError(w, obj.storageError(33, owner, err))
+		return
+	}
+	writeXML(w, initiateMultipartUploadResult{Bucket: obj.Bucket.Name,
+		Key: obj.object, UploadID: uploadID})
+}
+
+// putPart stores a part of a multipart upload
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadUploadPart.html
+func (obj objectHandler) putPart(w http.ResponseWriter, r *http.Request,
+	mp s3intf.Multiparter, owner, requester s3intf.Owner, uploadID string) {
+	resource := "/" + obj.Bucket.Name + "/" + obj.object
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3intf.MaxPartNumber {
+		writeError(w, &HTTPError{Code: 34, HTTPCode: http.StatusBadRequest,
+			Message:  "partNumber must be an integer between 1 and " + strconv.Itoa(s3intf.MaxPartNumber),
+			Resource: resource})
+		return
+	}
+	if r.Body == nil {
+		writeError(w, &HTTPError{Code: 23, HTTPCode: http.StatusBadRequest,
+			Message: "nil body", Resource: resource})
+		return
+	}
+	defer r.Body.Close()
+	body, size, he := obj.decodeBody(r, requester)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	body, md5hash, he := obj.hashBody(r, body)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	if err = mp.PutPart(owner, obj.Bucket.Name, obj.object, uploadID, partNumber,
+		body, size, md5hash); err != nil {
+		writeError(w, obj.storageError(35, owner, err))
+		return
+	}
+	w.Header().Set("ETag", `"`+hex.EncodeToString(md5hash)+`"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+// completeMultipart assembles the object from the parts
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadComplete.html
+func (obj objectHandler) completeMultipart(w http.ResponseWriter, r *http.Request,
+	mp s3intf.Multiparter, owner, requester s3intf.Owner, uploadID string) {
+	resource := "/" + obj.Bucket.Name + "/" + obj.object
+	var req completeMultipartUpload
+	if r.Body == nil {
+		writeError(w, &HTTPError{Code: 23, HTTPCode: http.StatusBadRequest,
+			Message: "nil body", Resource: resource})
+		return
+	}
+	err := xml.NewDecoder(r.Body).Decode(&req)
+	r.Body.Close()
+	if err != nil {
+		writeError(w, &HTTPError{Code: 36, HTTPCode: http.StatusBadRequest,
+			Message:  "cannot parse CompleteMultipartUpload: " + err.Error(),
+			Resource: resource})
+		return
+	}
+	parts := make([]s3intf.Part, len(req.Parts))
+	for i, p := range req.Parts {
+		parts[i] = s3intf.Part{Number: p.PartNumber, ETag: p.ETag}
+	}
+	upload, err := obj.upload(mp, owner, uploadID)
+	if err != nil {
+		writeError(w, obj.storageError(37, owner, err))
+		return
+	}
+	etag, versionID, err := mp.CompleteMultipart(owner, obj.Bucket.Name, obj.object, uploadID, parts)
+	if err != nil {
+		writeError(w, obj.storageError(37, owner, err))
+		return
+	}
+	if upload.ACL != nil {
+		if err = obj.storeACL(owner, requester, *upload.ACL, true); err != nil {
+			writeError(w, obj.storageError(70, owner, err))
+			return
+		}
+	}
+	setVersionHeader(w, versionID)
+	writeXML(w, completeMultipartUploadResult{
+		Location: "http://" + r.Host + r.URL.Path,
+		Bucket:   obj.Bucket.Name, Key: obj.object, ETag: `"` + etag + `"`})
+}
+
+// upload returns the upload of the object with the uploadID
+func (obj objectHandler) upload(mp s3intf.Multiparter, owner s3intf.Owner,
+	uploadID string) (s3intf.Upload, error) {
+	uploads, err := mp.ListMultipartUploads(owner, obj.Bucket.Name, obj.object)
+	if err != nil {
+		return s3intf.Upload{}, err
+	}
+	for _, u := range uploads {
+		if u.Key == obj.object && u.UploadID == uploadID {
+			return u, nil
+		}
+	}
+	return s3intf.Upload{}, s3intf.NoSuchUpload
+}
+
+// initiator returns the initiator of the upload - the owner, if it is not known
+func initiator(u s3intf.Upload, owner s3intf.Owner) xmlOwner {
+	if u.Initiator == "" {
+		return xmlOwner{ID: owner.ID(), DisplayName: owner.Name()}
+	}
+	return xmlOwner{ID: u.Initiator, DisplayName: u.InitiatorName}
+}
+
+// listParts lists the uploaded parts of a multipart upload
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadListParts.html
+func (obj objectHandler) listParts(w http.ResponseWriter, r *http.Request,
+	mp s3intf.Multiparter, owner s3intf.Owner, uploadID string) {
+	resource := "/" + obj.Bucket.Name + "/" + obj.object
+	maxParts, err := intParam(r, "max-parts", 1000)
+	if err != nil {
+		writeError(w, &HTTPError{Code: 40, HTTPCode: http.StatusBadRequest,
+			Message: "cannot parse max-parts value: " + err.Error(), Resource: resource})
+		return
+	}
+	marker, err := intParam(r, "part-number-marker", 0)
+	if err != nil {
+		writeError(w, &HTTPError{Code: 40, HTTPCode: http.StatusBadRequest,
+			Message: "cannot parse part-number-marker value: " + err.Error(), Resource: resource})
+		return
+	}
+	parts, err := mp.ListParts(owner, obj.Bucket.Name, obj.object, uploadID)
+	if err != nil {
+		writeError(w, obj.storageError(39, owner, err))
+		return
+	}
+	upload, err := obj.upload(mp, owner, uploadID)
+	if err != nil {
+		writeError(w, obj.storageError(39, owner, err))
+		return
+	}
+	o := xmlOwner{ID: owner.ID(), DisplayName: owner.Name()}
+	res := listPartsResult{Bucket: obj.Bucket.Name, Key: obj.object, UploadID: uploadID,
+		Initiator: initiator(upload, owner), Owner: o, StorageClass: "STANDARD",
+		PartNumberMarker: marker, MaxParts: maxParts,
+		Parts: make([]xmlPart, 0, len(parts))}
+	for _, p := range parts {
+		if p.Number <= marker {
+			continue
+		}
+		if len(res.Parts) >= maxParts {
+			res.IsTruncated = true
+			break
+		}
+		res.Parts = append(res.Parts, xmlPart{PartNumber: p.Number,
+			LastModified: p.LastModified.UTC().Format(S3Date),
+			ETag:         `"` + p.ETag + `"`, Size: p.Size})
+		res.NextPartNumberMarker = p.Number
+	}
+	writeXML(w, res)
+}
+
+// listUploads lists the multipart uploads in progress
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/mpUploadListMPUpload.html
+func (bucket bucketHandler) listUploads(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	mp, ok := bucket.Service.Storage.(s3intf.Multiparter)
+	if !ok {
+		writeError(w, &HTTPError{Code: 31, HTTPCode: http.StatusNotImplemented,
+			Message: "multipart upload is not supported", Resource: resource})
+		return
+	}
+	_, owner, he := bucket.authorize(r, 32, "", "s3:ListBucketMultipartUploads")
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	maxUploads, err := intParam(r, "max-uploads", 1000)
+	if err != nil {
+		writeError(w, &HTTPError{Code: 40, HTTPCode: http.StatusBadRequest,
+			Message: "cannot parse max-uploads value: " + err.Error(), Resource: resource})
+		return
+	}
+	q := r.URL.Query()
+	res := listMultipartUploadsResult{Bucket: bucket.Name,
+		KeyMarker: q.Get("key-marker"), UploadIDMarker: q.Get("upload-id-marker"),
+		Delimiter: q.Get("delimiter"), Prefix: q.Get("prefix"), MaxUploads: maxUploads}
+	uploads, err := mp.ListMultipartUploads(owner, bucket.Name, res.Prefix)
+	if err != nil {
+		writeError(w, bucket.storageError(41, err))
+		return
+	}
+
+	o := xmlOwner{ID: owner.ID(), DisplayName: owner.Name()}
+	// the key marker may be a common prefix, then all its keys were listed
+	prefixMarker := res.Delimiter != "" && strings.HasSuffix(res.KeyMarker, res.Delimiter)
+	// skip till the markers: the uploads are ordered by key and initiation
+	skip := res.KeyMarker != ""
+	seen := make(map[string]bool)
+	for _, u := range uploads {
+		if skip {
+			if u.Key < res.KeyMarker ||
+				u.Key == res.KeyMarker && res.UploadIDMarker == "" ||
+				prefixMarker && strings.HasPrefix(u.Key, res.KeyMarker) {
+				continue
+			}
+			if u.Key == res.KeyMarker {
+				if u.UploadID == res.UploadIDMarker {
+					skip = false
+				}
+				continue
+			}
+			skip = false
+		}
+		// the common prefixes are counted against max-uploads, too
+		var cp string
+		if res.Delimiter != "" {
+			if i := strings.Index(u.Key[len(res.Prefix):], res.Delimiter); i >= 0 {
+				if cp = u.Key[:len(res.Prefix)+i+len(res.Delimiter)]; seen[cp] {
+					continue
+				}
+			}
+		}
+		if len(res.Uploads)+len(res.CommonPrefixes) >= maxUploads {
+			res.IsTruncated = true
+			break
+		}
+		if cp != "" {
+			seen[cp] = true
+			res.CommonPrefixes = append(res.CommonPrefixes, struct{ Prefix string }{cp})
+			res.NextKeyMarker, res.NextUploadIDMarker = cp, ""
+			continue
+		}
+		res.Uploads = append(res.Uploads, xmlUpload{Key: u.Key, UploadID: u.UploadID,
+			Initiator: initiator(u, owner), Owner: o, StorageClass: "STANDARD",
+			Initiated: u.Initiated.UTC().Format(S3Date)})
+		res.NextKeyMarker, res.NextUploadIDMarker = u.Key, u.UploadID
+	}
+	writeXML(w, res)
+}
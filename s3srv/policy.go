@@ -0,0 +1,221 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+	"github.com/tgulacsi/s3weed/s3policy"
+)
+
+// MaxPolicySize is the maximal size of a bucket policy
+const MaxPolicySize = 20 << 10
+
+// policyCache holds the parsed policies of the buckets, keyed by the owner
+// and the bucket's name; a nil Policy means that the bucket has no policy.
+type policyCache struct {
+	sync.Mutex
+	policies map[string]*s3policy.Policy
+}
+
+// policyKey returns the key of the bucket's policy in the policyCache
+func policyKey(owner s3intf.Owner, bucket string) string {
+	return owner.ID() + "/" + bucket
+}
+
+// get returns the cached policy, or loads and caches it
+func (c *policyCache) get(key string, load func() (*s3policy.Policy, error)) (*s3policy.Policy, error) {
+	c.Lock()
+	defer c.Unlock()
+	if p, ok := c.policies[key]; ok {
+		return p, nil
+	}
+	p, err := load()
+	if err != nil {
+		return nil, err
+	}
+	if c.policies == nil {
+		c.policies = make(map[string]*s3policy.Policy)
+	}
+	c.policies[key] = p
+	return p, nil
+}
+
+// set stores the policy (nil for deletion) with store, and caches it on success
+func (c *policyCache) set(key string, p *s3policy.Policy, store func() error) error {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.policies, key)
+	if err := store(); err != nil {
+		return err
+	}
+	if c.policies == nil {
+		c.policies = make(map[string]*s3policy.Policy)
+	}
+	c.policies[key] = p
+	return nil
+}
+
+// forget drops the cached policy (of a deleted bucket)
+func (c *policyCache) forget(key string) {
+	c.Lock()
+	delete(c.policies, key)
+	c.Unlock()
+}
+
+// evalPolicy evaluates the bucket's policy (if the Storage is an s3intf.PolicyStorer,
+// and the bucket has a policy) on the requester's action. The policy is parsed
+// only on its first use, and when it is set. The tags of the existing
+// object (see s3intf.Tagger) are looked up only if the policy has conditions on them.
+func (bucket bucketHandler) evalPolicy(r *http.Request, owner, requester s3intf.Owner,
+	object, action string) (s3policy.Decision, error) {
+	ps, ok := bucket.Service.Storage.(s3intf.PolicyStorer)
+	if !ok {
+		return s3policy.NotApplicable, nil
+	}
+	policy, err := bucket.Service.policies.get(policyKey(owner, bucket.Name),
+		func() (*s3policy.Policy, error) {
+			b, err := ps.GetPolicy(owner, bucket.Name)
+			if err != nil {
+				if err == s3intf.NoSuchBucketPolicy {
+					err = nil
+				}
+				return nil, err
+			}
+			return s3policy.Parse(b, bucket.Name)
+		})
+	if err != nil || policy == nil {
+		return s3policy.NotApplicable, err
+	}
+	ctx := policyContext(r)
+	if tagger, ok := bucket.Service.Storage.(s3intf.Tagger); ok && object != "" &&
+		policy.HasConditionKey(s3policy.KeyExistingObjectTag) {
+		tags, err := tagger.GetTags(owner, bucket.Name, object)
+		if err != nil && !s3intf.IsNotFound(err) {
+			return s3policy.NotApplicable, err
+		}
+		for k, v := range tags {
+			ctx[s3policy.KeyExistingObjectTag+k] = v
+		}
+	}
+	return policy.Evaluate(s3policy.Request{Principal: requester.ID(), Action: action,
+		Resource: s3policy.ARN(bucket.Name, object), Context: ctx}), nil
+}
+
+// policyContext returns the values of the policy condition keys for the request
+func policyContext(r *http.Request) map[string]string {
+	ctx := map[string]string{
+		s3policy.KeyCurrentTime:     time.Now().UTC().Format(time.RFC3339),
+		s3policy.KeySecureTransport: strconv.FormatBool(r.TLS != nil),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ctx[s3policy.KeySourceIP] = host
+	} else if r.RemoteAddr != "" {
+		ctx[s3policy.KeySourceIP] = r.RemoteAddr
+	}
+	if ua := r.UserAgent(); ua != "" {
+		ctx[s3policy.KeyUserAgent] = ua
+	}
+	if ref := r.Referer(); ref != "" {
+		ctx[s3policy.KeyReferer] = ref
+	}
+	if q := r.URL.Query(); q != nil {
+		if v, ok := q["prefix"]; ok && len(v) > 0 {
+			ctx[s3policy.KeyPrefix] = v[0]
+		}
+	}
+	if acl := r.Header.Get("X-Amz-Acl"); acl != "" {
+		ctx[s3policy.KeyACL] = acl
+	}
+	if tags, err := s3intf.ParseTagging(r.Header.Get("X-Amz-Tagging")); err == nil {
+		for k, v := range tags {
+			ctx[s3policy.KeyRequestObjectTag+k] = v
+		}
+	}
+	return ctx
+}
+
+// servePolicy gets (GET), sets (PUT) or deletes (DELETE) the policy of the bucket.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketPUTpolicy.html
+func (bucket bucketHandler) servePolicy(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	ps, ok := bucket.Service.Storage.(s3intf.PolicyStorer)
+	if !ok {
+		writeError(w, &HTTPError{Code: 71, HTTPCode: http.StatusNotImplemented,
+			Message: "bucket policies are not supported", Resource: resource})
+		return
+	}
+	action := map[string]string{"GET": "s3:GetBucketPolicy", "PUT": "s3:PutBucketPolicy",
+		"DELETE": "s3:DeleteBucketPolicy"}[r.Method]
+	_, owner, he := bucket.authorize(r, 72, "", action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		b, err := ps.GetPolicy(owner, bucket.Name)
+		if err != nil {
+			writeError(w, bucket.storageError(73, err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.Write(b)
+		return
+	case "PUT":
+		var (
+			b      []byte
+			policy *s3policy.Policy
+			err    error
+		)
+		if r.Body != nil {
+			defer r.Body.Close()
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPolicySize))
+		}
+		if err == nil {
+			policy, err = s3policy.Parse(b, bucket.Name)
+		}
+		if err != nil {
+			code := s3intf.ErrorCode(err)
+			if code == "" {
+				code = "MalformedPolicy"
+			}
+			writeError(w, &HTTPError{Code: 74, HTTPCode: http.StatusBadRequest,
+				AWSCode: code, Message: err.Error(), Resource: resource})
+			return
+		}
+		if err = bucket.Service.policies.set(policyKey(owner, bucket.Name), policy,
+			func() error { return ps.SetPolicy(owner, bucket.Name, b) }); err != nil {
+			writeError(w, bucket.storageError(75, err))
+			return
+		}
+	case "DELETE":
+		if err := bucket.Service.policies.set(policyKey(owner, bucket.Name), nil,
+			func() error { return ps.SetPolicy(owner, bucket.Name, nil) }); err != nil {
+			writeError(w, bucket.storageError(75, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
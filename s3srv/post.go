@@ -0,0 +1,252 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// MaxPostFieldsSize is the maximal size of the form fields (but the file) of a POST upload
+const MaxPostFieldsSize = 20 << 10
+
+type postResponse struct {
+	XMLName  xml.Name `xml:"PostResponse"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// readPostForm reads the form fields till the file, and returns them keyed
+// by the lowercased names, and the file's part
+func readPostForm(r *http.Request) (map[string]string, *multipart.Part, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, s3intf.NewError("MalformedPOSTRequest", "the body of your POST request is not "+
+			"well-formed multipart/form-data: "+err.Error())
+	}
+	fields := make(map[string]string)
+	var size int64
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if err == io.EOF {
+				err = s3intf.NewError("InvalidArgument", "POST requires exactly one file upload per request")
+			} else {
+				err = s3intf.NewError("MalformedPOSTRequest", err.Error())
+			}
+			return nil, nil, err
+		}
+		name := strings.ToLower(part.FormName())
+		if name == "file" {
+			return fields, part, nil
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(part, MaxPostFieldsSize-size+1))
+		part.Close()
+		if err != nil {
+			return nil, nil, s3intf.NewError("MalformedPOSTRequest", err.Error())
+		}
+		if size += int64(len(b)); size > MaxPostFieldsSize {
+			return nil, nil, s3intf.NewError("MaxPostPreDataLengthExceeded",
+				"your POST request fields preceding the upload file were too large")
+		}
+		fields[name] = string(b)
+	}
+}
+
+// postObject stores the file of a browser-based POST upload (multipart/form-data)
+// under the form's key (${filename} replaced by the file's name; the object of
+// the URL is the default), checking the signed policy, and answers as the
+// success_action_redirect or success_action_status fields request.
+// Unsigned forms are authenticated by the Authorization header, or are anonymous.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectPOST.html
+func (bucket bucketHandler) postObject(w http.ResponseWriter, r *http.Request, defaultKey string) {
+	resource := "/" + bucket.Name
+	badRequest := func(code int, err error) {
+		writeError(w, &HTTPError{Code: code, HTTPCode: http.StatusBadRequest,
+			AWSCode: s3intf.ErrorCode(err), Message: err.Error(), Resource: resource})
+	}
+	if r.Body == nil {
+		badRequest(23, s3intf.NewError("MalformedPOSTRequest", "nil body"))
+		return
+	}
+	defer r.Body.Close()
+	fields, file, err := readPostForm(r)
+	if err != nil {
+		badRequest(76, err)
+		return
+	}
+	defer file.Close()
+
+	requester, err := s3intf.GetPostOwner(bucket.Service, fields)
+	if err == s3intf.NoAuthorization {
+		var he *HTTPError
+		if requester, he = bucket.authenticate(r, 77, ""); he != nil {
+			writeError(w, he)
+			return
+		}
+	} else if err != nil {
+		writeError(w, ownerError(77, err, resource))
+		return
+	}
+	minLength, maxLength := int64(0), int64(-1)
+	if fields["policy"] != "" {
+		policy, err := s3intf.ParsePostPolicy(fields["policy"])
+		if err != nil {
+			badRequest(78, err)
+			return
+		}
+		fields["bucket"] = bucket.Name
+		if err = policy.Check(fields); err != nil {
+			writeError(w, &HTTPError{Code: 78, AWSCode: s3intf.ErrorCode(err),
+				Message: err.Error(), Resource: resource})
+			return
+		}
+		minLength, maxLength = policy.MinLength, policy.MaxLength
+	}
+
+	key, fn := fields["key"], file.FileName()
+	if i := strings.LastIndexAny(fn, `/\`); i >= 0 {
+		fn = fn[i+1:]
+	}
+	if key == "" {
+		key = defaultKey
+	}
+	if key == "" {
+		badRequest(79, s3intf.NewError("InvalidArgument", "Bucket POST must contain a field named 'key'"))
+		return
+	}
+	key = strings.Replace(key, "${filename}", fn, -1)
+	obj := objectHandler{Bucket: bucket, object: key}
+	resource += "/" + key
+
+	owner, he := bucket.permit(r, requester, 24, key, "s3:PutObject")
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	// the fields are used as the headers of a PUT
+	header := make(http.Header, len(fields))
+	for k, v := range fields {
+		if k == "acl" {
+			k = "x-amz-acl"
+		}
+		header.Set(k, v)
+	}
+	acl, aclGiven, err := requestACL(header, requester.ID(), owner.ID())
+	if err != nil {
+		badRequest(68, err)
+		return
+	}
+	meta, err := headerMetadata(header)
+	if err != nil {
+		badRequest(61, err)
+		return
+	}
+	media := header.Get("Content-Type")
+	if media == "" {
+		media = file.Header.Get("Content-Type")
+	}
+	if disp, err := dispositionFilename(header.Get("Content-Disposition")); err == nil && disp != "" {
+		fn = disp
+	}
+
+	var body io.Reader = file
+	if maxLength >= 0 {
+		body = io.LimitReader(body, maxLength+1)
+	}
+	hsh := md5.New()
+	rc, size, err := GetReaderSize(io.TeeReader(body, hsh), 0)
+	if err != nil {
+		badRequest(29, s3intf.NewError("IncompleteBody", "error reading the file: "+err.Error()))
+		return
+	}
+	defer rc.Close()
+	if maxLength >= 0 && size > maxLength {
+		badRequest(80, s3intf.NewError("EntityTooLarge",
+			"your proposed upload exceeds the maximum allowed size"))
+		return
+	}
+	if size < minLength {
+		badRequest(80, s3intf.NewError("EntityTooSmall",
+			"your proposed upload is smaller than the minimum allowed size"))
+		return
+	}
+	md5hash := hsh.Sum(nil)
+	etag := `"` + hex.EncodeToString(md5hash) + `"`
+	if fn == "" {
+		fn = hex.EncodeToString(md5hash)
+	}
+	versionID, err := bucket.Service.Put(owner, bucket.Name, key, fn, media, rc, size, md5hash, meta)
+	if err != nil {
+		he := obj.storageError(26, owner, err)
+		he.Message = "error while storing " + fn + " in " + bucket.Name + "/" + key + ": " + he.Message
+		writeError(w, he)
+		return
+	}
+	if err = obj.storeACL(owner, requester, acl, aclGiven); err != nil {
+		writeError(w, obj.storageError(70, owner, err))
+		return
+	}
+	w.Header().Set("ETag", etag)
+	setVersionHeader(w, versionID)
+
+	redirect := fields["success_action_redirect"]
+	if redirect == "" {
+		redirect = fields["redirect"]
+	}
+	if u, err := url.Parse(redirect); redirect != "" && err == nil && u.IsAbs() {
+		q := u.Query()
+		q.Set("bucket", bucket.Name)
+		q.Set("key", key)
+		q.Set("etag", etag)
+		u.RawQuery = q.Encode()
+		w.Header().Set("Location", u.String())
+		w.WriteHeader(http.StatusSeeOther)
+		return
+	}
+	location := "http://"
+	if r.TLS != nil {
+		location = "https://"
+	}
+	location += r.Host + "/"
+	if !bucket.VirtualHost {
+		location += bucket.Name + "/"
+	}
+	location += s3intf.URIEncode(key, false)
+	w.Header().Set("Location", location)
+	switch fields["success_action_status"] {
+	case "200":
+		w.WriteHeader(http.StatusOK)
+	case "201":
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(http.StatusCreated)
+		writeXML(w, postResponse{Location: location, Bucket: bucket.Name, Key: key, ETag: etag})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
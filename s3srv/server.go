@@ -20,11 +20,11 @@ package s3srv
 import (
 	"github.com/tgulacsi/s3weed/s3intf"
 
-	"bufio"
-	"bytes"
 	"crypto"
 	_ "crypto/md5" // for crypto.MD5
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"log"
@@ -36,53 +36,124 @@ import (
 )
 
 // S3Date is a format for S3
-const S3Date = "2006-01-02T15:04:05.007Z" //%Y-%m-%dT%H:%M:%S.000Z"
+const S3Date = "2006-01-02T15:04:05.000Z" //%Y-%m-%dT%H:%M:%S.000Z"
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   xmlOwner
+	Buckets []xmlBucket `xml:"Buckets>Bucket"`
+}
+
+type xmlBucket struct {
+	Name         string
+	CreationDate string
+}
+
+type listBucketResult struct {
+	XMLName        xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string
+	Prefix         string
+	Marker         string
+	MaxKeys        int
+	Delimiter      string `xml:",omitempty"`
+	IsTruncated    bool
+	NextMarker     string `xml:",omitempty"`
+	Contents       []xmlObject
+	CommonPrefixes []xmlCommonPrefix `xml:",omitempty"`
+}
+
+// newListAllMyBucketsResult returns the GET Service response of the owner's buckets
+func newListAllMyBucketsResult(owner s3intf.Owner, buckets []s3intf.Bucket) listAllMyBucketsResult {
+	res := listAllMyBucketsResult{Owner: xmlOwner{ID: owner.ID(), DisplayName: owner.Name()},
+		Buckets: make([]xmlBucket, len(buckets))}
+	for i, b := range buckets {
+		res.Buckets[i] = xmlBucket{Name: b.Name, CreationDate: b.Created.UTC().Format(S3Date)}
+	}
+	return res
+}
+
+// newXMLObject returns the listing entry of the object
+func newXMLObject(o s3intf.Object) xmlObject {
+	return xmlObject{Key: o.Key, LastModified: o.LastModified.UTC().Format(S3Date),
+		ETag: `"` + o.ETag + `"`, Size: o.Size, StorageClass: "STANDARD"}
+}
 
 // Debug prints
 var Debug bool
 
 type service struct {
-	fqdn string
+	fqdn        string
+	websiteFQDN string
+	router      s3intf.Router
+	policies    policyCache
 	s3intf.Storage
 }
 
-// NewService returns a new service
+// NewService returns a new service, with fqdn as its only base domain
 func NewService(fqdn string, provider s3intf.Storage) *service {
 	log.Printf("Service on %q with %s", fqdn, provider)
-	return &service{fqdn: fqdn, Storage: provider}
+	return &service{fqdn: fqdn, Storage: provider,
+		router: s3intf.Router{Domains: []string{fqdn}}}
 }
 
 func (s *service) Host() string {
 	return s.fqdn
 }
 
+// SetRouter sets the routing of the requests to the buckets by their Host header:
+// the base domains, the CNAMEs and whether only the path-style requests are allowed
+func (s *service) SetRouter(router s3intf.Router) {
+	s.router = router
+}
+
+// SetWebsiteHost sets the host of the website endpoint: the requests to
+// bucket.fqdn are served from the static website of the bucket.
+func (s *service) SetWebsiteHost(fqdn string) {
+	s.websiteFQDN = fqdn
+}
+
 func (host *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID, hostID := newRequestID()
+	w.Header().Set("X-Amz-Request-Id", requestID)
+	w.Header().Set("X-Amz-Id-2", hostID)
 	if Debug {
-		log.Printf("%s.ServeHTTP %s %s", host.fqdn, r.Method, r.RequestURI)
+		log.Printf("%s.ServeHTTP %s %s (%s)", host.fqdn, r.Method, r.RequestURI, requestID)
 	}
 	if r.RequestURI == "*" || r.Host == "" || r.URL == nil || r.URL.Path == "" {
 		writeError(w, &HTTPError{Code: 1, HTTPCode: http.StatusBadRequest,
 			Message: "bad URI"})
 		return
 	}
-	if stripPort(host.fqdn) == stripPort(r.Host) { //Service level
-		log.Printf("service level request, path: %s", r.URL.Path)
-		if r.URL.Path != "/" {
-			segments := strings.SplitN(r.URL.Path[1:], "/", 2)
-			bucketHandler{Name: segments[0], Service: host}.ServeHTTP(w, r)
+	if host.websiteFQDN != "" {
+		h, suffix := stripPort(r.Host), "."+stripPort(host.websiteFQDN)
+		if strings.HasSuffix(h, suffix) && len(h) > len(suffix) {
+			bucketHandler{Name: h[:len(h)-len(suffix)], Service: host, VirtualHost: true}.serveWebsite(w, r)
 			return
 		}
-		if r.Method != "GET" {
-			writeError(w, &HTTPError{Code: 2, HTTPCode: http.StatusBadRequest,
-				Message: "only GET allowed at service level"})
-			return
-		}
-		host.serviceGet(w, r)
+	}
+	bn, err := host.router.Route(r.Host)
+	if err != nil {
+		writeError(w, &HTTPError{Code: 96, HTTPCode: http.StatusBadRequest,
+			AWSCode: s3intf.ErrorCode(err), Message: err.Error() + ": " + r.Host})
 		return
 	}
-
-	bn := r.Host[:len(stripPort(r.Host))-len(stripPort(host.fqdn))-1]
-	bucketHandler{Name: bn, Service: host, VirtualHost: true}.ServeHTTP(w, r)
+	if bn != "" {
+		bucketHandler{Name: bn, Service: host, VirtualHost: true}.ServeHTTP(w, r)
+		return
+	}
+	//Service level
+	log.Printf("service level request, path: %s", r.URL.Path)
+	if r.URL.Path != "/" {
+		segments := strings.SplitN(r.URL.Path[1:], "/", 2)
+		bucketHandler{Name: segments[0], Service: host}.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		writeError(w, &HTTPError{Code: 2, HTTPCode: http.StatusBadRequest,
+			Message: "only GET allowed at service level"})
+		return
+	}
+	host.serviceGet(w, r)
 }
 
 type bucketHandler struct {
@@ -91,6 +162,14 @@ type bucketHandler struct {
 	VirtualHost bool
 }
 
+// hostBucket returns the bucket given by the Host header, "" for path-style requests
+func (bucket bucketHandler) hostBucket() string {
+	if bucket.VirtualHost {
+		return bucket.Name
+	}
+	return ""
+}
+
 func (bucket bucketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if Debug {
 		log.Printf("bucket %s", bucket.Name)
@@ -101,24 +180,78 @@ func (bucket bucketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		path = path[len(bucket.Name)+1:]
 	}
 	//log.Printf("path=%s", path)
-	if !(path == "" || path == "/") || r.Method == "POST" {
-		if path[0] == byte('/') {
-			path = path[1:]
+	if r.Method == "OPTIONS" {
+		bucket.preflight(w, r, "/"+bucket.Name+path)
+		return
+	}
+	bucket.cors(w, r)
+	if r.Method == "POST" && (path == "" || path == "/") {
+		if _, ok := r.URL.Query()["delete"]; ok {
+			bucket.multiDel(w, r)
+			return
 		}
-		objectHandler{Bucket: bucket, object: path}.ServeHTTP(w, r)
+	}
+	if !(path == "" || path == "/") || r.Method == "POST" {
+		objectHandler{Bucket: bucket, object: strings.TrimPrefix(path, "/")}.ServeHTTP(w, r)
+		return
+	}
+	if _, ok := r.URL.Query()["policy"]; ok && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE") {
+		bucket.servePolicy(w, r)
+		return
+	}
+	if _, ok := r.URL.Query()["cors"]; ok && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE") {
+		bucket.serveCORS(w, r)
+		return
+	}
+	if _, ok := r.URL.Query()["website"]; ok && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE") {
+		bucket.serveWebsiteConfig(w, r)
+		return
+	}
+	if _, ok := r.URL.Query()["tagging"]; ok && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE") {
+		bucket.serveTagging(w, r, "")
+		return
+	}
+	if _, ok := r.URL.Query()["lifecycle"]; ok && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE") {
+		bucket.serveLifecycle(w, r)
 		return
 	}
 	switch r.Method {
 	case "DELETE":
 		bucket.del(w, r)
 	case "GET":
+		q := r.URL.Query()
+		if _, ok := q["uploads"]; ok {
+			bucket.listUploads(w, r)
+			return
+		}
+		if _, ok := q["versioning"]; ok {
+			bucket.versioning(w, r)
+			return
+		}
+		if _, ok := q["versions"]; ok {
+			bucket.listVersions(w, r)
+			return
+		}
+		if _, ok := q["acl"]; ok {
+			bucket.serveACL(w, r, "")
+			return
+		}
 		bucket.list(w, r)
 	case "HEAD":
 		bucket.check(w, r)
 	case "PUT":
+		q := r.URL.Query()
+		if _, ok := q["versioning"]; ok {
+			bucket.versioning(w, r)
+			return
+		}
+		if _, ok := q["acl"]; ok {
+			bucket.serveACL(w, r, "")
+			return
+		}
 		bucket.put(w, r)
 	default:
-		writeError(w, &HTTPError{Code: 3, HTTPCode: http.StatusBadRequest,
+		writeError(w, &HTTPError{Code: 3, HTTPCode: http.StatusMethodNotAllowed,
 			Message:  "only DELETE, GET, PUT and POST allowed at bucket level",
 			Resource: "/" + bucket.Name})
 	}
@@ -131,49 +264,64 @@ type objectHandler struct {
 
 func (obj objectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if Debug {
-		log.Printf("object %s", obj)
+		log.Printf("object %s/%s", obj.Bucket.Name, obj.object)
+	}
+	if obj.multipart(w, r) {
+		return
+	}
+	if _, ok := r.URL.Query()["acl"]; ok && (r.Method == "GET" || r.Method == "PUT") {
+		obj.Bucket.serveACL(w, r, obj.object)
+		return
+	}
+	if _, ok := r.URL.Query()["tagging"]; ok && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE") {
+		obj.Bucket.serveTagging(w, r, obj.object)
+		return
 	}
 	switch r.Method {
 	case "DELETE":
 		obj.del(w, r)
-	case "GET":
+	case "GET", "HEAD":
 		obj.get(w, r)
-	case "PUT", "POST":
+	case "PUT":
 		obj.put(w, r)
+	case "POST":
+		obj.Bucket.postObject(w, r, obj.object)
 	default:
-		writeError(w, &HTTPError{Code: 4, HTTPCode: http.StatusBadRequest,
-			Message:  "only DELETE, GET, PUT and POST allowed at object level",
+		writeError(w, &HTTPError{Code: 4, HTTPCode: http.StatusMethodNotAllowed,
+			Message:  "only DELETE, GET, HEAD, PUT and POST allowed at object level",
 			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
 	}
 }
 
+// writeError writes the error response: the S3 error code (see HTTPError), the message,
+// the resource and the request's IDs (set by service.ServeHTTP).
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/ErrorResponses.html
 func writeError(w http.ResponseWriter, err error) {
+	he, ok := err.(*HTTPError)
+	if !ok {
+		he = &HTTPError{Code: 1, Message: err.Error(), AWSCode: s3intf.ErrorCode(err)}
+	}
+	awsCode, status := he.codes()
+	log.Printf("error %s (%d): %s", awsCode, he.Code, he.Message)
 	w.Header().Set("Connection", "close")
-	w.Header().Set("Content-Type", "text/xml")
-	var (
-		he *HTTPError
-		ok bool
-	)
-	if he, ok = err.(*HTTPError); !ok {
-		he.Code, he.Message = 1, err.Error()
-	}
-	if he.HTTPCode <= 0 {
-		he.HTTPCode = http.StatusInternalServerError
-	}
-	w.WriteHeader(he.HTTPCode)
-	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>`)
-	w.Write(strconv.AppendInt(make([]byte, 0, 3), int64(he.Code), 10))
-	io.WriteString(w, `</Code><Message>`)
-	io.WriteString(w, he.Message)
-	io.WriteString(w, "</Message><Resource>")
-	io.WriteString(w, he.Resource)
-	io.WriteString(w, "</Resource></Error>")
-}
-
-// HTTPError is an error which contains the Resource and HTTPCode, too
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(errorResponse{Code: awsCode, Message: he.Message,
+		Resource: he.Resource, RequestId: w.Header().Get("X-Amz-Request-Id"),
+		HostId: w.Header().Get("X-Amz-Id-2")}); err != nil {
+		log.Printf("error encoding error response: %s", err)
+	}
+}
+
+// HTTPError is an error which contains the Resource and HTTPCode, too.
+// Code identifies the place of the error (for the logs); AWSCode is the S3
+// error code sent to the client. If HTTPCode or AWSCode is missing, it is
+// derived from the other.
 type HTTPError struct {
 	Code     int
 	HTTPCode int
+	AWSCode  string
 	Message  string
 	Resource string
 }
@@ -183,6 +331,23 @@ func (he *HTTPError) Error() string {
 	return fmt.Sprintf("(%d) %s @%s", he.Code, he.Message, he.Resource)
 }
 
+// codes returns the S3 error code and the HTTP status of the error,
+// deriving the missing one from the other
+func (he *HTTPError) codes() (string, int) {
+	awsCode, status := he.AWSCode, he.HTTPCode
+	if status <= 0 {
+		if status = errorStatus[awsCode]; status == 0 {
+			status = http.StatusInternalServerError
+		}
+	}
+	if awsCode == "" {
+		if awsCode = statusError[status]; awsCode == "" {
+			awsCode = "InternalError"
+		}
+	}
+	return awsCode, status
+}
+
 // ValidBucketName returns whether name is a valid bucket name.
 // Here are the rules, from:
 // http://docs.amazonwebservices.com/AmazonS3/2006-03-01/dev/BucketRestrictions.html
@@ -222,51 +387,37 @@ func ValidBucketName(name string) bool {
 
 //This implementation of the GET operation returns a list of all buckets owned by the authenticated sender of the request.
 func (s *service) serviceGet(w http.ResponseWriter, r *http.Request) {
-	owner, err := s3intf.GetOwner(s, r, s.fqdn)
-	log.Printf("%#v.serviceGet owner=%s err=%s", s, owner.ID(), err)
+	owner, err := s3intf.GetRoutedOwner(s, r, "")
 	if err != nil {
-		writeError(w, &HTTPError{Code: 5, Message: "error getting owner: " + err.Error()})
+		writeError(w, ownerError(5, err, ""))
 		return
 	} else if owner == nil {
 		writeError(w, &HTTPError{Code: 6, HTTPCode: 403, Message: "no owner"})
 		return
 	}
+	log.Printf("%#v.serviceGet owner=%s", s, owner.ID())
 	buckets, err := s.ListBuckets(owner)
 	if err != nil {
 		writeError(w, &HTTPError{Code: 7, Message: err.Error()})
 		return
 	}
-	w.Header().Set("Content-Type", "text/xml")
-	bw := bufio.NewWriter(w)
-	bw.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
-<ListAllMyBucketsResult xmlns="http://doc.s3.amazonaws.com/2006-03-01">
-  <Owner><ID>` + owner.ID() + "</ID><DisplayName>" + owner.Name() + "</DisplayName></Owner><Buckets>")
-	for _, bucket := range buckets {
-		bw.WriteString("<Bucket><Name>" + bucket.Name + "</Name>")
-		bw.WriteString("<CreationDate>" + bucket.Created.Format(S3Date) +
-			"</CreationDate></Bucket>")
-	}
-	bw.WriteString("</Buckets></ListAllMyBucketsResult>")
-	bw.Flush()
+	writeXML(w, newListAllMyBucketsResult(owner, buckets))
 }
 
 //This implementation of the DELETE operation deletes the bucket named in the URI.
 //All objects (including all object versions and Delete Markers) in the bucket
 //must be deleted before the bucket itself can be deleted.
 func (bucket bucketHandler) del(w http.ResponseWriter, r *http.Request) {
-	owner, err := s3intf.GetOwner(bucket.Service, r, bucket.Service.fqdn)
-	if err != nil {
-		writeError(w, &HTTPError{Code: 8, Message: "error getting owner: " + err.Error()})
+	_, owner, he := bucket.authorize(r, 8, "", "s3:DeleteBucket")
+	if he != nil {
+		writeError(w, he)
 		return
 	}
 	if err := bucket.Service.DelBucket(owner, bucket.Name); err != nil {
-		if err == s3intf.NotFound {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		writeError(w, &HTTPError{Code: 9, Message: err.Error(), Resource: "/" + bucket.Name})
+		writeError(w, bucket.storageError(9, err))
 		return
 	}
+	bucket.Service.policies.forget(policyKey(owner, bucket.Name))
 }
 
 //This implementation of the GET operation returns some or all (up to 1000)
@@ -283,6 +434,10 @@ func (bucket bucketHandler) list(w http.ResponseWriter, r *http.Request) {
 			Resource: "/" + bucket.Name})
 		return
 	}
+	if r.Form.Get("list-type") == "2" {
+		bucket.listV2(w, r)
+		return
+	}
 	delimiter := r.Form.Get("delimiter")
 	marker := r.Form.Get("marker")
 	limit := 1000
@@ -307,11 +462,9 @@ func (bucket bucketHandler) list(w http.ResponseWriter, r *http.Request) {
 	}
 	prefix := r.Form.Get("prefix")
 
-	owner, err := s3intf.GetOwner(bucket.Service, r, bucket.Service.fqdn)
-	if err != nil {
-		writeError(w, &HTTPError{Code: 13,
-			Message:  "error getting owner: " + err.Error(),
-			Resource: "/" + bucket.Name})
+	_, owner, he := bucket.authorize(r, 13, "", "s3:ListBucket")
+	if he != nil {
+		writeError(w, he)
 		return
 	}
 	if Debug {
@@ -322,76 +475,39 @@ func (bucket bucketHandler) list(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Printf("error with bucket.Service.List(%s, %s, %q, %q, %q, %d, %d): %s",
 			owner.ID(), bucket.Name, prefix, delimiter, marker, limit, skip, err)
-		if err == s3intf.NotFound {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		writeError(w, &HTTPError{Code: 14, Resource: "/" + bucket.Name,
-			Message: "error getting list: " + err.Error()})
+		writeError(w, bucket.storageError(14, err))
 		return
 	}
-	isTruncated := "false"
-	if truncated {
-		isTruncated = "true"
+	res := listBucketResult{Name: bucket.Name, Prefix: prefix, Marker: marker,
+		MaxKeys: limit, Delimiter: delimiter, IsTruncated: truncated,
+		Contents: make([]xmlObject, len(objects))}
+	if truncated && delimiter != "" {
+		res.NextMarker = lastListed(objects, commonprefixes)
 	}
-
-	w.Header().Set("Content-Type", "text/xml")
-	var (
-		logw *bytes.Buffer
-		bw   *bufio.Writer
-		etag string
-	)
-	if Debug {
-		logw = bytes.NewBuffer(nil)
-		bw = bufio.NewWriter(io.MultiWriter(w, logw))
-	} else {
-		bw = bufio.NewWriter(w)
-	}
-	bw.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
-<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>` +
-		bucket.Name + "</Name><Prefix>" + prefix + "</Prefix><Marker>" + marker +
-		"</Marker><MaxKeys>" + strconv.Itoa(limit) + "</MaxKeys><IsTruncated>" +
-		isTruncated + "</IsTruncated>")
-	for _, object := range objects {
-		etag = object.ETag
-		if etag != "" {
-			etag = "quot;" + etag + "quot;"
-		}
-		bw.WriteString("<Contents><Key>" + object.Key + "</Key><Size>" +
-			strconv.FormatInt(object.Size, 10) + "</Size><Owner><ID>" + object.Owner.ID() +
-			"</ID><DisplayName>" + object.Owner.Name() +
-			"</DisplayName></Owner>" +
-			"<LastModified>" + object.LastModified.Format(S3Date) + "</LastModified>" +
-			"<ETag>" + etag + "</ETag>" +
-			"</Contents>")
+	for i, o := range objects {
+		res.Contents[i] = newXMLObject(o)
+		res.Contents[i].Owner = &xmlOwner{ID: o.Owner.ID(), DisplayName: o.Owner.Name()}
 	}
 	for _, cp := range commonprefixes {
-		bw.WriteString("<CommonPrefixes><Prefix>" + cp + "</Prefix></CommonPrefixes>")
-	}
-	bw.WriteString("</ListBucketResult>")
-	bw.Flush()
-
-	if logw != nil {
-		log.Printf("sent %q", logw.Bytes())
+		res.CommonPrefixes = append(res.CommonPrefixes, xmlCommonPrefix{Prefix: cp})
 	}
+	writeXML(w, res)
 }
 
 //This operation is useful to determine if a bucket exists and you have permission to access it.
 //The operation returns a 200 OK if the bucket exists and you have permission to access it.
 //Otherwise, the operation might return responses such as 404 Not Found and 403 Forbidden.
 func (bucket bucketHandler) check(w http.ResponseWriter, r *http.Request) {
-	owner, err := s3intf.GetOwner(bucket.Service, r, bucket.Service.Host())
-	if err != nil {
-		writeError(w, &HTTPError{Code: 15, HTTPCode: http.StatusBadRequest,
-			Message:  "error getting owner: " + err.Error(),
-			Resource: "/" + bucket.Name})
+	_, owner, he := bucket.authorize(r, 15, "", "s3:ListBucket")
+	if he != nil {
+		writeError(w, he)
 		return
 	}
 	if bucket.Service.CheckBucket(owner, bucket.Name) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
+	writeError(w, bucket.storageError(15, s3intf.NotFound))
 	return
 }
 
@@ -402,170 +518,396 @@ func (bucket bucketHandler) check(w http.ResponseWriter, r *http.Request) {
 //Not every string is an acceptable bucket name. For information on bucket naming restrictions, see Working with Amazon S3 Buckets.
 //DNS name constraints -> max length is 63
 func (bucket bucketHandler) put(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s.put", bucket)
-	owner, err := s3intf.GetOwner(bucket.Service, r, bucket.Service.Host())
+	log.Printf("%s.put", bucket.Name)
+	owner, err := s3intf.GetRoutedOwner(bucket.Service, r, bucket.hostBucket())
 	if err != nil {
-		writeError(w, &HTTPError{Code: 16, HTTPCode: http.StatusBadRequest,
-			Message:  "error getting owner: " + err.Error(),
-			Resource: "/" + bucket.Name})
+		writeError(w, ownerError(16, err, "/"+bucket.Name))
+		return
+	}
+	acl, aclGiven, err := requestACL(r.Header, owner.ID(), owner.ID())
+	if err != nil {
+		writeError(w, &HTTPError{Code: 68, HTTPCode: http.StatusBadRequest,
+			AWSCode: s3intf.ErrorCode(err), Message: err.Error(), Resource: "/" + bucket.Name})
 		return
 	}
+	acler, isACLer := bucket.Service.Storage.(s3intf.ACLer)
+	if isACLer {
+		if id, err := acler.BucketOwner(bucket.Name); err == nil && id != owner.ID() {
+			writeError(w, &HTTPError{Code: 17, AWSCode: "BucketAlreadyExists",
+				Message: "bucket " + bucket.Name + " is owned by someone else", Resource: "/" + bucket.Name})
+			return
+		}
+	}
 	log.Printf("creating bucket %s for %s", bucket.Name, owner.ID())
 	if err := bucket.Service.CreateBucket(owner, bucket.Name); err != nil {
-		writeError(w, &HTTPError{Code: 17,
-			Message:  "error creating bucket: " + err.Error(),
-			Resource: "/" + bucket.Name})
+		he := bucket.storageError(17, err)
+		he.Message = "error creating bucket: " + he.Message
+		writeError(w, he)
 		return
 	}
+	if isACLer && aclGiven {
+		if err = acler.SetACL(owner, bucket.Name, "", acl); err != nil {
+			writeError(w, bucket.storageError(69, err))
+			return
+		}
+	}
 	w.WriteHeader(http.StatusOK)
 	return
 }
 
 func (obj objectHandler) del(w http.ResponseWriter, r *http.Request) {
-	owner, err := s3intf.GetOwner(obj.Bucket.Service, r, obj.Bucket.Service.Host())
-	if err != nil {
-		writeError(w, &HTTPError{Code: 18, HTTPCode: http.StatusBadRequest,
-			Message:  "error getting owner: " + err.Error(),
-			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
+	versionID := r.URL.Query().Get("versionId")
+	action := "s3:DeleteObject"
+	if versionID != "" {
+		action = "s3:DeleteObjectVersion"
+	}
+	_, owner, he := obj.Bucket.authorize(r, 18, obj.object, action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	if versionID != "" {
+		obj.delVersion(w, owner, versionID)
 		return
 	}
 	if err := obj.Bucket.Service.Del(owner, obj.Bucket.Name, obj.object); err != nil {
-		he := &HTTPError{Code: 19,
-			Message:  "error deleting " + obj.Bucket.Name + "/" + obj.object + ": " + err.Error(),
-			Resource: "/" + obj.Bucket.Name + "/" + obj.object}
-
-		if err == s3intf.NotFound {
-			he.HTTPCode = http.StatusNotFound
-		}
+		he := obj.storageError(19, owner, err)
+		he.Message = "error deleting " + obj.Bucket.Name + "/" + obj.object + ": " + he.Message
 		writeError(w, he)
 		return
 	}
+	// in a versioned bucket, the delete marker is the latest version
+	if versionID := obj.Bucket.deleteMarker(owner, obj.object); versionID != "" {
+		w.Header().Set("X-Amz-Version-Id", versionID)
+		w.Header().Set("X-Amz-Delete-Marker", "true")
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// get returns the object (the version given with versionId), or the requested
+// range of it (206 Partial Content), honoring the If-Match, If-None-Match,
+// If-Modified-Since, If-Unmodified-Since and If-Range headers.
+// For HEAD, only the headers are returned, and the body is not opened.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectGET.html
+// and http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectHEAD.html
 func (obj objectHandler) get(w http.ResponseWriter, r *http.Request) {
-	owner, err := s3intf.GetOwner(obj.Bucket.Service, r, obj.Bucket.Service.Host())
-	if err != nil {
-		writeError(w, &HTTPError{Code: 20, HTTPCode: http.StatusBadRequest,
-			Message:  "error getting owner: " + err.Error(),
+	action := "s3:GetObject"
+	if r.URL.Query().Get("versionId") != "" {
+		action = "s3:GetObjectVersion"
+	}
+	_, owner, he := obj.Bucket.authorize(r, 20, obj.object, action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeError(w, &HTTPError{Code: 22, HTTPCode: http.StatusBadRequest,
+			Message:  "cannot parse form values: " + err.Error(),
 			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
 		return
 	}
-	fn, media, body, size, md5, err := obj.Bucket.Service.Get(owner, obj.Bucket.Name, obj.object)
-	log.Printf("GETing %s/%s: %q %s", obj.Bucket.Name, obj.object, fn, err)
-	if err != nil {
-		if err == s3intf.NotFound {
-			w.WriteHeader(http.StatusNotFound)
-			return
+	offset, length, ranged := parseRange(r.Header.Get("Range"))
+	versionID := r.Form.Get("versionId")
+	v, body, err := obj.open(owner, versionID, r.Method != "HEAD", offset, length)
+	if err == nil && ranged && body == nil && !v.DeleteMarker {
+		_, _, err = s3intf.ResolveRange(offset, length, v.Size)
+	}
+	defer func() {
+		if body != nil {
+			body.Close()
 		}
-		writeError(w, &HTTPError{Code: 21,
-			Message:  "error getting " + obj.Bucket.Name + "/" + obj.object + ": " + err.Error(),
+	}()
+	o := v.Object
+	log.Printf("%sing %s/%s: %q %v", r.Method, obj.Bucket.Name, obj.object, o.Filename, err)
+	if err != nil && err != s3intf.InvalidRange {
+		he := obj.storageError(21, owner, err)
+		he.Message = "error getting " + obj.Bucket.Name + "/" + obj.object + ": " + he.Message
+		writeError(w, he)
+		return
+	}
+	if o.VersionID != "" {
+		w.Header().Set("X-Amz-Version-Id", o.VersionID)
+	}
+	if v.DeleteMarker {
+		w.Header().Set("X-Amz-Delete-Marker", "true")
+		he := &HTTPError{Code: 62, AWSCode: "NoSuchKey", Message: "the object is deleted",
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object}
+		if versionID != "" {
+			he.AWSCode, he.Message = "MethodNotAllowed", "the version is a delete marker"
+		}
+		writeError(w, he)
+		return
+	}
+	w.Header().Set("Last-Modified", o.LastModified.UTC().Format(http.TimeFormat))
+	if o.ETag != "" {
+		w.Header().Set("ETag", `"`+o.ETag+`"`)
+	}
+	if code := checkPreconditions(r, o.ETag, o.LastModified); code == http.StatusNotModified {
+		w.WriteHeader(code)
+		return
+	} else if code != 0 {
+		writeError(w, &HTTPError{Code: 63, HTTPCode: code, Message: "precondition failed",
 			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
 		return
 	}
-	if err = r.ParseForm(); err != nil {
-		writeError(w, &HTTPError{Code: 22, HTTPCode: http.StatusBadRequest,
-			Message:  "cannot parse form values: " + err.Error(),
+	if ranged && !ifRange(r, o.ETag, o.LastModified) {
+		// changed since the client got the first part: send the whole object
+		ranged = false
+		if body == nil { // HEAD
+			err = nil
+		} else {
+			body.Close()
+			if v, body, err = obj.open(owner, o.VersionID, true, 0, -1); err != nil {
+				writeError(w, obj.storageError(21, owner, err))
+				return
+			}
+			o = v.Object
+		}
+	}
+	if err == s3intf.InvalidRange {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(o.Size, 10))
+		writeError(w, &HTTPError{Code: 42, HTTPCode: http.StatusRequestedRangeNotSatisfiable,
+			Message:  err.Error(),
 			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
 		return
 	}
-	w.Header().Set("Content-Type", media)
-	w.Header().Set("Content-Disposition", "inline; filename=\""+fn+"\"")
-	w.Header().Set("Content-Length", strconv.Itoa(int(size)))
-	w.Header().Set("ETag", hex.EncodeToString(md5))
+
+	w.Header().Set("Content-Type", o.ContentType)
+	w.Header().Set("Content-Disposition", "inline; filename=\""+o.Filename+"\"")
+	w.Header().Set("Accept-Ranges", "bytes")
+	for k, v := range o.Metadata {
+		if k == s3intf.TaggingMetadata { // only the count of the tags is sent
+			w.Header().Set("X-Amz-Tagging-Count", strconv.Itoa(len(o.Metadata.Tags())))
+			continue
+		}
+		w.Header().Set(k, v)
+	}
 	for k, v := range r.Form {
-		k = textproto.CanonicalMIMEHeaderKey(k)
+		if !strings.HasPrefix(k, "response-") {
+			continue
+		}
+		k = textproto.CanonicalMIMEHeaderKey(k[9:])
 		switch k {
 		case "Content-Type", "Content-Language", "Expires", "Cache-Control",
-			"Content-Disposition", "Content-Encoding", "Content-Length":
+			"Content-Disposition", "Content-Encoding":
 			(map[string][]string(w.Header()))[k] = v
 		}
 	}
+	code := http.StatusOK
+	size := o.Size
+	if ranged {
+		var start int64
+		start, size, _ = s3intf.ResolveRange(offset, length, o.Size)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+size-1, o.Size))
+		code = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	if Debug {
 		log.Printf("headers: %s", w.Header())
 	}
-	io.Copy(w, body)
+	w.WriteHeader(code)
+	if body != nil {
+		io.Copy(w, body)
+	}
 }
 
 func (obj objectHandler) put(w http.ResponseWriter, r *http.Request) {
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	requester, owner, he := obj.Bucket.authorize(r, 24, obj.object, "s3:PutObject")
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	acl, aclGiven, err := requestACL(r.Header, requester.ID(), owner.ID())
+	if err != nil {
+		writeError(w, &HTTPError{Code: 68, HTTPCode: http.StatusBadRequest,
+			AWSCode: s3intf.ErrorCode(err), Message: err.Error(),
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
+		return
+	}
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		obj.copy(w, r, owner, requester, acl, aclGiven)
+		return
+	}
 	if r.Body == nil {
 		writeError(w, &HTTPError{Code: 23, HTTPCode: http.StatusBadRequest,
 			Message:  "nil body",
 			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
 		return
 	}
-	defer r.Body.Close()
-	owner, err := s3intf.GetOwner(obj.Bucket.Service, r, obj.Bucket.Service.Host())
+	media := r.Header.Get("Content-Type")
+	fn, err := dispositionFilename(r.Header.Get("Content-Disposition"))
 	if err != nil {
-		writeError(w, &HTTPError{Code: 24,
-			Message:  "error getting owner: " + err.Error(),
+		writeError(w, &HTTPError{Code: 25, HTTPCode: http.StatusBadRequest,
+			Message:  err.Error(),
 			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
 		return
 	}
-	var (
-		fn, media string
-		body      io.Reader
-		size      int64
-	)
-	if r.Method == "POST" {
-		mpf, mph, err := r.FormFile("file")
-		if err != nil {
-			return
+	meta, err := headerMetadata(r.Header)
+	if err != nil {
+		writeError(w, &HTTPError{Code: 61, AWSCode: s3intf.ErrorCode(err),
+			Message:  err.Error(),
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
+		return
+	}
+	body, size, he := obj.decodeBody(r, requester)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	body, md5hash, he := obj.hashBody(r, body)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	md5Computed := hex.EncodeToString(md5hash)
+
+	if fn == "" {
+		log.Printf("no filename in %s", r.Header)
+		fn = md5Computed
+	}
+	versionID, err := obj.Bucket.Service.Put(owner, obj.Bucket.Name, obj.object,
+		fn, media, body, size, md5hash, meta)
+	if err != nil {
+		he := obj.storageError(26, owner, err)
+		if he.AWSCode == "" {
+			he.HTTPCode = http.StatusBadRequest
 		}
-		fn = mph.Filename
-		media = mph.Header.Get("Content-Type")
-		size, _ = mpf.Seek(0, 2)
-		mpf.Seek(0, 0)
-		body = mpf
-	} else {
-		media = r.Header.Get("Content-Type")
-		if disp := r.Header.Get("Content-Disposition"); disp != "" {
-			if _, params, err := mime.ParseMediaType(disp); err == nil {
-				fn = params["filename"]
-			} else {
-				writeError(w, &HTTPError{Code: 25, HTTPCode: http.StatusBadRequest,
-					Message:  "cannot parse Content-Disposition " + disp + ": " + err.Error(),
-					Resource: "/" + obj.Bucket.Name + "/" + obj.object})
-				return
+		he.Message = "error while storing " + fn + " in " + obj.Bucket.Name + "/" + obj.object + ": " + he.Message
+		writeError(w, he)
+		return
+	}
+	if err = obj.storeACL(owner, requester, acl, aclGiven); err != nil {
+		writeError(w, obj.storageError(70, owner, err))
+		return
+	}
+	w.Header().Set("ETag", `"`+md5Computed+`"`)
+	setVersionHeader(w, versionID)
+	w.WriteHeader(http.StatusOK)
+}
+
+// dispositionFilename returns the filename parameter of the Content-Disposition header
+func dispositionFilename(disp string) (string, error) {
+	if disp == "" {
+		return "", nil
+	}
+	_, params, err := mime.ParseMediaType(disp)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse Content-Disposition %s: %s", disp, err)
+	}
+	return params["filename"], nil
+}
+
+// storedHeaders are the standard headers stored with the object (see s3intf.Metadata)
+var storedHeaders = map[string]bool{"Cache-Control": true, "Content-Encoding": true,
+	"Content-Language": true, "Expires": true, s3intf.WebsiteMetadata: true}
+
+// headerMetadata returns the metadata to be stored with the object from the
+// request's headers (with the tags of the x-amz-tagging header), or an error
+// (with S3 error code) if the user metadata exceeds s3intf.MaxMetadataSize,
+// the website redirect location or the tags are invalid.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/UsingMetadata.html
+func headerMetadata(h http.Header) (s3intf.Metadata, error) {
+	meta := make(s3intf.Metadata)
+	for k, v := range h {
+		if !(storedHeaders[k] || strings.HasPrefix(k, s3intf.MetadataPrefix)) {
+			continue
+		}
+		value := strings.Join(v, ",")
+		if k == "Content-Encoding" { // aws-chunked is the encoding of the upload only
+			var encs []string
+			for _, enc := range strings.Split(value, ",") {
+				if enc = strings.TrimSpace(enc); enc != "" && enc != "aws-chunked" {
+					encs = append(encs, enc)
+				}
+			}
+			if value = strings.Join(encs, ","); value == "" {
+				continue
 			}
 		}
-		if body, size, err = GetReaderSize(r.Body, 1<<20); err != nil {
-			writeError(w, &HTTPError{Code: 28,
-				Message:  "error reading request body: " + err.Error(),
-				Resource: "/" + obj.Bucket.Name + "/" + obj.object})
+		meta[k] = value
+	}
+	if n := meta.UserSize(); n > s3intf.MaxMetadataSize {
+		return nil, s3intf.NewError("MetadataTooLarge", fmt.Sprintf(
+			"the user metadata is %d bytes, more than the allowed %d", n, s3intf.MaxMetadataSize))
+	}
+	if loc, ok := meta[s3intf.WebsiteMetadata]; ok {
+		if err := s3intf.CheckRedirectLocation(loc); err != nil {
+			return nil, err
+		}
+	}
+	tags, err := s3intf.ParseTagging(h.Get("X-Amz-Tagging"))
+	if err == nil {
+		err = tags.Check(s3intf.MaxObjectTags)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return meta.SetTags(tags), nil
+}
+
+// decodeBody returns the request's body - decoded if it is aws-chunked - and its size
+func (obj objectHandler) decodeBody(r *http.Request, owner s3intf.Owner) (io.Reader, int64, *HTTPError) {
+	contentSHA256 := r.Header.Get("X-Amz-Content-Sha256")
+	if err := s3intf.CheckStreamingPayload(contentSHA256); err != nil {
+		return nil, 0, &HTTPError{Code: 30, AWSCode: s3intf.ErrorCode(err), Message: err.Error(),
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object}
+	}
+	var err error
+	body := io.Reader(r.Body)
+	if contentSHA256 == s3intf.StreamingPayload {
+		if body, err = obj.chunkedBody(r, owner); err != nil {
+			return nil, 0, &HTTPError{Code: 30, HTTPCode: http.StatusBadRequest,
+				Message:  "cannot decode aws-chunked body: " + err.Error(),
+				Resource: "/" + obj.Bucket.Name + "/" + obj.object}
 		}
 	}
+	body, size, err := GetReaderSize(body, 1<<20)
+	if err != nil {
+		return nil, 0, &HTTPError{Code: 28, AWSCode: s3intf.ErrorCode(err),
+			Message:  "error reading request body: " + err.Error(),
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object}
+	}
+	return body, size, nil
+}
+
+// hashBody reads the body, computing its MD5 hash, which is checked against
+// the Content-MD5 header (if given), and returns a reader of the read data
+func (obj objectHandler) hashBody(r *http.Request, body io.Reader) (io.Reader, []byte, *HTTPError) {
 	hsh := crypto.MD5.New()
-	if body, err = TeeRead(hsh, body, 1<<20); err != nil {
-		writeError(w, &HTTPError{Code: 29,
+	body, err := TeeRead(hsh, body, 1<<20)
+	if err != nil {
+		return nil, nil, &HTTPError{Code: 29, AWSCode: s3intf.ErrorCode(err),
 			Message:  "error reading request body: " + err.Error(),
-			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object}
 	}
-	md5Computed := hex.EncodeToString(hsh.Sum(nil))
+	md5hash := hsh.Sum(nil)
 	md5Given := r.Header.Get("Content-MD5")
-	if md5Given != "" && md5Computed != md5Given {
-		writeError(w, &HTTPError{Code: 27, HTTPCode: http.StatusBadRequest,
-			Message:  fmt.Sprintf("got MD5=%q computed=%q", md5Given, md5Computed),
-			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
+	if md5Given != "" && base64.StdEncoding.EncodeToString(md5hash) != md5Given {
+		return nil, nil, &HTTPError{Code: 27, AWSCode: "BadDigest",
+			Message:  fmt.Sprintf("got MD5=%q computed=%q", md5Given, hex.EncodeToString(md5hash)),
+			Resource: "/" + obj.Bucket.Name + "/" + obj.object}
 	}
+	return body, md5hash, nil
+}
 
-	if fn == "" {
-		log.Printf("no filename in %s", r.Header)
-		fn = md5Computed
+// chunkedBody returns the decoded body of an aws-chunked (STREAMING-AWS4-HMAC-SHA256-PAYLOAD)
+// request, which checks the chunk signatures against the Authorization header's
+// seed signature.
+func (obj objectHandler) chunkedBody(r *http.Request, owner s3intf.Owner) (io.Reader, error) {
+	sig, err := s3intf.ParseSignatureV4(r)
+	if err != nil {
+		return nil, err
 	}
-	if err := obj.Bucket.Service.Put(owner, obj.Bucket.Name, obj.object,
-		fn, media, body, size, hsh.Sum(nil)); err != nil {
-		if err == s3intf.NotFound {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		writeError(w, &HTTPError{Code: 26, HTTPCode: http.StatusBadRequest,
-			Message:  "error while storing " + fn + " in " + obj.Bucket.Name + "/" + obj.object + ": " + err.Error(),
-			Resource: "/" + obj.Bucket.Name + "/" + obj.object})
-		return
+	decodedLength, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad x-amz-decoded-content-length: %s", err)
 	}
-	w.Header().Set("ETag", md5Computed)
-	w.WriteHeader(http.StatusOK)
+	return NewChunkedReader(r.Body,
+		owner.SigningKey(sig.ScopeDate, sig.Region, sig.Service),
+		sig.Date, sig.Scope(), sig.Signature, decodedLength), nil
 }
 
 func stripPort(text string) string {
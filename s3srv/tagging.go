@@ -0,0 +1,143 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+// MaxTaggingSize is the maximal size of a Tagging document
+const MaxTaggingSize = 16 << 10
+
+type tagging struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+	TagSet  []tag    `xml:"TagSet>Tag"`
+}
+
+type tag struct {
+	Key   string
+	Value string
+}
+
+// newTagging returns the Tagging document of the tags, sorted by the keys
+func newTagging(tags s3intf.Tags) tagging {
+	t := tagging{TagSet: make([]tag, 0, len(tags))}
+	for k, v := range tags {
+		t.TagSet = append(t.TagSet, tag{Key: k, Value: v})
+	}
+	sort.Slice(t.TagSet, func(i, j int) bool { return t.TagSet[i].Key < t.TagSet[j].Key })
+	return t
+}
+
+// parseTagging returns the checked tags of the Tagging document (at most max)
+func parseTagging(b []byte, max int) (s3intf.Tags, error) {
+	var t struct {
+		TagSet []tag `xml:"TagSet>Tag"`
+	}
+	if err := xml.Unmarshal(b, &t); err != nil {
+		return nil, s3intf.NewError("MalformedXML", err.Error())
+	}
+	tags := make(s3intf.Tags, len(t.TagSet))
+	for _, tg := range t.TagSet {
+		if _, ok := tags[tg.Key]; ok {
+			return nil, s3intf.NewError("InvalidTag", "cannot provide multiple tags with the same key "+tg.Key)
+		}
+		tags[tg.Key] = tg.Value
+	}
+	return tags, tags.Check(max)
+}
+
+// serveTagging gets (GET), sets (PUT) or deletes (DELETE) the tags of the
+// bucket, or of the object, if it is not empty. The tags of the versions but
+// the latest are not supported.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectPUTtagging.html
+// and http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketPUTtagging.html
+func (bucket bucketHandler) serveTagging(w http.ResponseWriter, r *http.Request, object string) {
+	resource := "/" + bucket.Name
+	notFound, max := "NoSuchBucket", s3intf.MaxBucketTags
+	action := map[string]string{"GET": "s3:GetBucketTagging",
+		"PUT": "s3:PutBucketTagging", "DELETE": "s3:PutBucketTagging"}[r.Method]
+	if object != "" {
+		resource += "/" + object
+		notFound, max = "NoSuchKey", s3intf.MaxObjectTags
+		action = map[string]string{"GET": "s3:GetObjectTagging",
+			"PUT": "s3:PutObjectTagging", "DELETE": "s3:DeleteObjectTagging"}[r.Method]
+	}
+	tagger, ok := bucket.Service.Storage.(s3intf.Tagger)
+	if !ok {
+		writeError(w, &HTTPError{Code: 97, HTTPCode: http.StatusNotImplemented,
+			Message: "tagging is not supported", Resource: resource})
+		return
+	}
+	if _, ok = r.URL.Query()["versionId"]; ok {
+		writeError(w, &HTTPError{Code: 97, HTTPCode: http.StatusNotImplemented,
+			Message: "tagging of versions is not supported", Resource: resource})
+		return
+	}
+	_, owner, he := bucket.authorize(r, 98, object, action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		tags, err := tagger.GetTags(owner, bucket.Name, object)
+		if err != nil {
+			writeError(w, storageError(99, err, notFound, resource))
+			return
+		}
+		writeXML(w, newTagging(tags))
+		return
+	case "PUT":
+		var b []byte
+		var err error
+		if r.Body != nil {
+			defer r.Body.Close()
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxTaggingSize))
+		}
+		var tags s3intf.Tags
+		if err == nil {
+			tags, err = parseTagging(b, max)
+		}
+		if err != nil {
+			code := s3intf.ErrorCode(err)
+			if code == "" {
+				code = "MalformedXML"
+			}
+			writeError(w, &HTTPError{Code: 100, HTTPCode: http.StatusBadRequest,
+				AWSCode: code, Message: err.Error(), Resource: resource})
+			return
+		}
+		if err = tagger.SetTags(owner, bucket.Name, object, tags); err != nil {
+			writeError(w, storageError(101, err, notFound, resource))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "DELETE":
+		if err := tagger.SetTags(owner, bucket.Name, object, nil); err != nil {
+			writeError(w, storageError(101, err, notFound, resource))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
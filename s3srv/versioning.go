@@ -0,0 +1,296 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ VersioningConfiguration"`
+	Status  string   `xml:",omitempty"`
+}
+
+type listVersionsResult struct {
+	XMLName             xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListVersionsResult"`
+	Name                string
+	Prefix              string
+	KeyMarker           string
+	VersionIdMarker     string
+	NextKeyMarker       string `xml:",omitempty"`
+	NextVersionIdMarker string `xml:",omitempty"`
+	MaxKeys             int
+	Delimiter           string `xml:",omitempty"`
+	IsTruncated         bool
+	// Versions are xmlVersion and xmlDeleteMarker elements, in the order of the listing
+	Versions       []interface{}
+	CommonPrefixes []xmlCommonPrefix `xml:",omitempty"`
+}
+
+type xmlVersion struct {
+	XMLName      xml.Name `xml:"Version"`
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string
+	Size         int64
+	Owner        xmlOwner
+	StorageClass string
+}
+
+type xmlDeleteMarker struct {
+	XMLName      xml.Name `xml:"DeleteMarker"`
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	Owner        xmlOwner
+}
+
+// versioning gets (GET) or sets (PUT) the versioning state of the bucket.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGETversioningStatus.html
+// and http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketPUTVersioningStatus.html
+func (bucket bucketHandler) versioning(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	vr, ok := bucket.Service.Storage.(s3intf.Versioner)
+	if !ok {
+		writeError(w, &HTTPError{Code: 55, HTTPCode: http.StatusNotImplemented,
+			Message: "versioning is not supported", Resource: resource})
+		return
+	}
+	action := "s3:GetBucketVersioning"
+	if r.Method == "PUT" {
+		action = "s3:PutBucketVersioning"
+	}
+	_, owner, he := bucket.authorize(r, 56, "", action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	if r.Method == "GET" {
+		var (
+			conf versioningConfiguration
+			err  error
+		)
+		if conf.Status, err = vr.Versioning(owner, bucket.Name); err != nil {
+			writeError(w, bucket.storageError(57, err))
+			return
+		}
+		writeXML(w, conf)
+		return
+	}
+
+	if r.Body == nil {
+		writeError(w, &HTTPError{Code: 58, HTTPCode: http.StatusBadRequest,
+			Message: "nil body", Resource: resource})
+		return
+	}
+	defer r.Body.Close()
+	var conf struct{ Status string } // the namespace is optional
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err == nil {
+		err = xml.Unmarshal(b, &conf)
+	}
+	if err == nil {
+		err = s3intf.CheckVersioning(conf.Status)
+	}
+	if err != nil {
+		writeError(w, &HTTPError{Code: 58, HTTPCode: http.StatusBadRequest,
+			Message: "bad versioning configuration: " + err.Error(), Resource: resource})
+		return
+	}
+	if err = vr.SetVersioning(owner, bucket.Name, conf.Status); err != nil {
+		writeError(w, bucket.storageError(57, err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// listVersions lists the versions and the delete markers of the bucket.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketGETVersion.html
+func (bucket bucketHandler) listVersions(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	vr, ok := bucket.Service.Storage.(s3intf.Versioner)
+	if !ok {
+		writeError(w, &HTTPError{Code: 55, HTTPCode: http.StatusNotImplemented,
+			Message: "versioning is not supported", Resource: resource})
+		return
+	}
+	_, owner, he := bucket.authorize(r, 56, "", "s3:ListBucketVersions")
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	q := r.URL.Query()
+	maxKeys, err := intParam(r, "max-keys", 1000)
+	if err != nil || maxKeys < 0 {
+		writeError(w, &HTTPError{Code: 11, HTTPCode: http.StatusBadRequest,
+			Message: "bad max-keys value " + q.Get("max-keys"), Resource: resource})
+		return
+	}
+	if maxKeys > 1000 {
+		maxKeys = 1000
+	}
+	res := listVersionsResult{Name: bucket.Name, MaxKeys: maxKeys,
+		Prefix: q.Get("prefix"), Delimiter: q.Get("delimiter"),
+		KeyMarker: q.Get("key-marker"), VersionIdMarker: q.Get("version-id-marker")}
+	versions, commonprefixes, truncated, err := vr.ListVersions(owner, bucket.Name,
+		res.Prefix, res.Delimiter, res.KeyMarker, res.VersionIdMarker, maxKeys)
+	if err != nil {
+		writeError(w, bucket.storageError(59, err))
+		return
+	}
+	res.IsTruncated = truncated
+	var last s3intf.Version
+	for _, v := range versions {
+		o := xmlOwner{ID: v.Owner.ID(), DisplayName: v.Owner.Name()}
+		lastModified := v.LastModified.UTC().Format(S3Date)
+		if v.DeleteMarker {
+			res.Versions = append(res.Versions, xmlDeleteMarker{Key: v.Key, VersionId: v.VersionID,
+				IsLatest: v.IsLatest, LastModified: lastModified, Owner: o})
+		} else {
+			res.Versions = append(res.Versions, xmlVersion{Key: v.Key, VersionId: v.VersionID,
+				IsLatest: v.IsLatest, LastModified: lastModified, ETag: `"` + v.ETag + `"`,
+				Size: v.Size, Owner: o, StorageClass: "STANDARD"})
+		}
+		last = v
+	}
+	for _, cp := range commonprefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, xmlCommonPrefix{Prefix: cp})
+	}
+	if truncated {
+		if len(commonprefixes) > 0 && commonprefixes[len(commonprefixes)-1] > last.Key {
+			res.NextKeyMarker = commonprefixes[len(commonprefixes)-1]
+		} else {
+			res.NextKeyMarker, res.NextVersionIdMarker = last.Key, last.VersionID
+		}
+	}
+	writeXML(w, res)
+}
+
+// open returns the version of the object (the latest if versionID is empty),
+// and its content (the length bytes from offset) if body is true.
+// A Storage which is not a Versioner has the null version only.
+func (obj objectHandler) open(owner s3intf.Owner, versionID string, body bool,
+	offset, length int64) (v s3intf.Version, rc io.ReadCloser, err error) {
+
+	vr, ok := obj.Bucket.Service.Storage.(s3intf.Versioner)
+	if !ok {
+		if versionID != "" && versionID != s3intf.NullVersionID {
+			return v, nil, s3intf.NoSuchVersion
+		}
+		v.IsLatest = true
+		if !body {
+			v.Object, err = obj.Bucket.Service.Stat(owner, obj.Bucket.Name, obj.object)
+			return
+		}
+		v.Object, rc, err = obj.Bucket.Service.Get(owner, obj.Bucket.Name, obj.object, offset, length)
+		return
+	}
+	if v, err = vr.StatVersion(owner, obj.Bucket.Name, obj.object, versionID); err != nil ||
+		v.DeleteMarker || !body {
+		return
+	}
+	if versionID == "" {
+		versionID = v.VersionID
+	}
+	if versionID == "" { // not versioned
+		v.Object, rc, err = obj.Bucket.Service.Get(owner, obj.Bucket.Name, obj.object, offset, length)
+	} else {
+		v.Object, rc, err = vr.GetVersion(owner, obj.Bucket.Name, obj.object, versionID, offset, length)
+	}
+	return
+}
+
+// setVersionHeader sets the x-amz-version-id header to the version created
+// by the request, if any
+func setVersionHeader(w http.ResponseWriter, versionID string) {
+	if versionID != "" {
+		w.Header().Set("X-Amz-Version-Id", versionID)
+	}
+}
+
+// delVersion deletes the version of the object permanently.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTObjectDELETE.html
+func (obj objectHandler) delVersion(w http.ResponseWriter, owner s3intf.Owner, versionID string) {
+	deleteMarker, err := obj.Bucket.deleteVersion(owner, obj.object, versionID)
+	if err != nil {
+		writeError(w, obj.storageError(60, owner, err))
+		return
+	}
+	w.Header().Set("X-Amz-Version-Id", versionID)
+	if deleteMarker {
+		w.Header().Set("X-Amz-Delete-Marker", "true")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statVersion returns the version of the object (the latest, if versionID
+// is empty); a delete marker version is an InvalidRequest
+func (bucket bucketHandler) statVersion(owner s3intf.Owner, object, versionID string) (s3intf.Object, error) {
+	if versionID == "" {
+		return bucket.Service.Stat(owner, bucket.Name, object)
+	}
+	vr, ok := bucket.Service.Storage.(s3intf.Versioner)
+	if !ok {
+		if versionID != s3intf.NullVersionID {
+			return s3intf.Object{}, s3intf.NoSuchVersion
+		}
+		return bucket.Service.Stat(owner, bucket.Name, object)
+	}
+	v, err := vr.StatVersion(owner, bucket.Name, object, versionID)
+	if err == nil && v.DeleteMarker {
+		err = s3intf.NewError("InvalidRequest", "the version "+versionID+" is a delete marker")
+	}
+	return v.Object, err
+}
+
+// deleteVersion deletes the version of the object permanently,
+// and returns whether it was a delete marker
+func (bucket bucketHandler) deleteVersion(owner s3intf.Owner, object, versionID string) (bool, error) {
+	vr, ok := bucket.Service.Storage.(s3intf.Versioner)
+	if !ok {
+		if versionID != s3intf.NullVersionID {
+			return false, s3intf.NoSuchVersion
+		}
+		return false, bucket.Service.Del(owner, bucket.Name, object)
+	}
+	v, err := vr.StatVersion(owner, bucket.Name, object, versionID)
+	if err != nil {
+		return false, err
+	}
+	return v.DeleteMarker, vr.DelVersion(owner, bucket.Name, object, versionID)
+}
+
+// deleteMarker returns the version ID of the object's latest version,
+// if it is a delete marker (as after Del in a versioned bucket)
+func (bucket bucketHandler) deleteMarker(owner s3intf.Owner, object string) string {
+	vr, ok := bucket.Service.Storage.(s3intf.Versioner)
+	if !ok {
+		return ""
+	}
+	if v, err := vr.StatVersion(owner, bucket.Name, object, ""); err == nil && v.DeleteMarker {
+		return v.VersionID
+	}
+	return ""
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"encoding/xml"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/tgulacsi/s3weed/s3intf"
+)
+
+type websiteConfiguration struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ WebsiteConfiguration"`
+	xmlWebsite
+}
+
+// xmlWebsite is the content of the WebsiteConfiguration document, without the
+// namespace - which is optional in the requests
+type xmlWebsite struct {
+	RedirectAllRequestsTo *xmlRedirect      `xml:",omitempty"`
+	IndexDocument         *xmlIndexDocument `xml:",omitempty"`
+	ErrorDocument         *xmlErrorDocument `xml:",omitempty"`
+	RoutingRules          []xmlRoutingRule  `xml:"RoutingRules>RoutingRule,omitempty"`
+}
+
+type xmlIndexDocument struct {
+	Suffix string
+}
+
+type xmlErrorDocument struct {
+	Key string
+}
+
+type xmlRoutingRule struct {
+	Condition *xmlCondition `xml:",omitempty"`
+	Redirect  xmlRedirect
+}
+
+type xmlCondition struct {
+	KeyPrefixEquals             string `xml:",omitempty"`
+	HTTPErrorCodeReturnedEquals string `xml:"HttpErrorCodeReturnedEquals,omitempty"`
+}
+
+// xmlRedirect is the XML form of s3intf.WebsiteRedirect
+type xmlRedirect struct {
+	Protocol             string `xml:",omitempty"`
+	HostName             string `xml:",omitempty"`
+	ReplaceKeyPrefixWith string `xml:",omitempty"`
+	ReplaceKeyWith       string `xml:",omitempty"`
+	HTTPRedirectCode     string `xml:"HttpRedirectCode,omitempty"`
+}
+
+func newWebsiteConfiguration(c *s3intf.WebsiteConfig) websiteConfiguration {
+	var conf websiteConfiguration
+	if c.RedirectAllRequestsTo != nil {
+		rd := xmlRedirect(*c.RedirectAllRequestsTo)
+		conf.RedirectAllRequestsTo = &rd
+	}
+	if c.IndexSuffix != "" {
+		conf.IndexDocument = &xmlIndexDocument{Suffix: c.IndexSuffix}
+	}
+	if c.ErrorKey != "" {
+		conf.ErrorDocument = &xmlErrorDocument{Key: c.ErrorKey}
+	}
+	for _, rule := range c.RoutingRules {
+		xr := xmlRoutingRule{Redirect: xmlRedirect(rule.Redirect)}
+		if rule.KeyPrefixEquals != "" || rule.HTTPErrorCodeReturnedEquals != "" {
+			xr.Condition = &xmlCondition{KeyPrefixEquals: rule.KeyPrefixEquals,
+				HTTPErrorCodeReturnedEquals: rule.HTTPErrorCodeReturnedEquals}
+		}
+		conf.RoutingRules = append(conf.RoutingRules, xr)
+	}
+	return conf
+}
+
+// parseWebsiteConfiguration returns the checked configuration of the WebsiteConfiguration document
+func parseWebsiteConfiguration(b []byte) (*s3intf.WebsiteConfig, error) {
+	var conf xmlWebsite
+	if err := xml.Unmarshal(b, &conf); err != nil {
+		return nil, s3intf.NewError("MalformedXML", err.Error())
+	}
+	c := new(s3intf.WebsiteConfig)
+	if conf.RedirectAllRequestsTo != nil {
+		rd := s3intf.WebsiteRedirect(*conf.RedirectAllRequestsTo)
+		c.RedirectAllRequestsTo = &rd
+	}
+	if conf.IndexDocument != nil {
+		c.IndexSuffix = conf.IndexDocument.Suffix
+	}
+	if conf.ErrorDocument != nil {
+		c.ErrorKey = conf.ErrorDocument.Key
+	}
+	for _, xr := range conf.RoutingRules {
+		rule := s3intf.RoutingRule{Redirect: s3intf.WebsiteRedirect(xr.Redirect)}
+		if xr.Condition != nil {
+			rule.KeyPrefixEquals = xr.Condition.KeyPrefixEquals
+			rule.HTTPErrorCodeReturnedEquals = xr.Condition.HTTPErrorCodeReturnedEquals
+		}
+		c.RoutingRules = append(c.RoutingRules, rule)
+	}
+	return c, c.Check()
+}
+
+// serveWebsiteConfig gets (GET), sets (PUT) or deletes (DELETE) the website configuration of the bucket.
+// See http://docs.aws.amazon.com/AmazonS3/latest/API/RESTBucketPUTwebsite.html
+func (bucket bucketHandler) serveWebsiteConfig(w http.ResponseWriter, r *http.Request) {
+	resource := "/" + bucket.Name
+	websiter, ok := bucket.Service.Storage.(s3intf.Websiter)
+	if !ok {
+		writeError(w, &HTTPError{Code: 88, HTTPCode: http.StatusNotImplemented,
+			Message: "website configuration is not supported", Resource: resource})
+		return
+	}
+	action := map[string]string{"GET": "s3:GetBucketWebsite", "PUT": "s3:PutBucketWebsite",
+		"DELETE": "s3:DeleteBucketWebsite"}[r.Method]
+	_, owner, he := bucket.authorize(r, 89, "", action)
+	if he != nil {
+		writeError(w, he)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		conf, err := websiter.GetWebsite(owner, bucket.Name)
+		if err != nil {
+			writeError(w, bucket.storageError(90, err))
+			return
+		}
+		writeXML(w, newWebsiteConfiguration(conf))
+		return
+	case "PUT":
+		var b []byte
+		var err error
+		if r.Body != nil {
+			defer r.Body.Close()
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		}
+		var conf *s3intf.WebsiteConfig
+		if err == nil {
+			conf, err = parseWebsiteConfiguration(b)
+		}
+		if err != nil {
+			code := s3intf.ErrorCode(err)
+			if code == "" {
+				code = "MalformedXML"
+			}
+			writeError(w, &HTTPError{Code: 91, HTTPCode: http.StatusBadRequest,
+				AWSCode: code, Message: err.Error(), Resource: resource})
+			return
+		}
+		if err = websiter.SetWebsite(owner, bucket.Name, conf); err != nil {
+			writeError(w, bucket.storageError(92, err))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	case "DELETE":
+		if err := websiter.SetWebsite(owner, bucket.Name, nil); err != nil {
+			writeError(w, bucket.storageError(92, err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveWebsite serves the request of the website endpoint from the bucket,
+// as an anonymous GET: the directories (the keys ending with /) get their
+// index document, the missing keys the error document, the routing rules and
+// the objects' x-amz-website-redirect-location metadata redirect.
+// See http://docs.aws.amazon.com/AmazonS3/latest/dev/WebsiteEndpoints.html
+func (bucket bucketHandler) serveWebsite(w http.ResponseWriter, r *http.Request) {
+	if Debug {
+		log.Printf("website %s", bucket.Name)
+	}
+	resource := "/" + bucket.Name
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeWebsiteError(w, r, &HTTPError{Code: 93, HTTPCode: http.StatusMethodNotAllowed,
+			Message: "only GET and HEAD allowed at the website endpoint", Resource: resource})
+		return
+	}
+	var conf *s3intf.WebsiteConfig
+	owner, err := bucket.owner()
+	if err == nil {
+		if websiter, ok := bucket.Service.Storage.(s3intf.Websiter); ok {
+			conf, err = websiter.GetWebsite(owner, bucket.Name)
+		} else {
+			err = s3intf.NoSuchWebsiteConfiguration
+		}
+	} else if err == errNoACLer {
+		err = s3intf.NoSuchWebsiteConfiguration
+	}
+	if err != nil {
+		writeWebsiteError(w, r, bucket.storageError(94, err))
+		return
+	}
+	if rd := conf.RedirectAllRequestsTo; rd != nil {
+		websiteRedirect(w, r, *rd, r.URL.Path)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	dir := key == "" || strings.HasSuffix(key, "/")
+	if dir {
+		key += conf.IndexSuffix
+	}
+	if rule := conf.Route(key, 0); rule != nil {
+		websiteRedirect(w, r, rule.Redirect, "/"+rule.Key(key))
+		return
+	}
+	obj := objectHandler{Bucket: bucket, object: key}
+	o, he := obj.websiteStat(r, owner)
+	if he != nil {
+		_, status := he.codes()
+		if (status == http.StatusNotFound || status == http.StatusForbidden) && !dir {
+			// a directory without the trailing slash (a missing key is forbidden
+			// if the bucket is not readable)
+			index := objectHandler{Bucket: bucket, object: key + "/" + conf.IndexSuffix}
+			if _, ihe := index.websiteStat(r, owner); ihe == nil {
+				http.Redirect(w, r, "/"+key+"/", http.StatusFound)
+				return
+			}
+		}
+		if rule := conf.Route(key, status); rule != nil {
+			websiteRedirect(w, r, rule.Redirect, "/"+rule.Key(key))
+			return
+		}
+		if conf.ErrorKey != "" && status >= 400 && status < 500 {
+			errObj := objectHandler{Bucket: bucket, object: conf.ErrorKey}
+			if errObj.serveWebsiteError(w, r, owner, status) {
+				return
+			}
+		}
+		writeWebsiteError(w, r, he)
+		return
+	}
+	if loc := o.Metadata[s3intf.WebsiteMetadata]; loc != "" && s3intf.CheckRedirectLocation(loc) == nil {
+		http.Redirect(w, r, loc, http.StatusMovedPermanently)
+		return
+	}
+	// the website endpoint ignores the query and the authorization
+	u := *r.URL
+	u.RawQuery = ""
+	anon := *r
+	anon.URL, anon.Form = &u, nil
+	anon.Header = make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		if k != "Authorization" {
+			anon.Header[k] = v
+		}
+	}
+	obj.get(w, &anon)
+}
+
+// websiteStat returns the object, if it exists and the anonymous requesters may read it
+func (obj objectHandler) websiteStat(r *http.Request, owner s3intf.Owner) (s3intf.Object, *HTTPError) {
+	if _, he := obj.Bucket.permit(r, s3intf.Anonymous, 95, obj.object, "s3:GetObject"); he != nil {
+		return s3intf.Object{}, he
+	}
+	v, _, err := obj.open(owner, "", false, 0, -1)
+	if err == nil && v.DeleteMarker {
+		err = s3intf.NotFound
+	}
+	if err != nil {
+		return s3intf.Object{}, obj.storageError(95, owner, err)
+	}
+	return v.Object, nil
+}
+
+// serveWebsiteError serves the error document with the status - it returns
+// false if the document cannot be served
+func (obj objectHandler) serveWebsiteError(w http.ResponseWriter, r *http.Request,
+	owner s3intf.Owner, status int) bool {
+	if _, he := obj.websiteStat(r, owner); he != nil {
+		return false
+	}
+	v, body, err := obj.open(owner, "", r.Method != "HEAD", 0, -1)
+	if err != nil {
+		log.Printf("error getting the error document %s/%s: %s", obj.Bucket.Name, obj.object, err)
+		return false
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	w.Header().Set("Content-Type", v.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(v.Size, 10))
+	w.WriteHeader(status)
+	if body != nil {
+		io.Copy(w, body)
+	}
+	return true
+}
+
+// websiteRedirect redirects the request as the rule says, to the path on the
+// rule's host (the request's, if not given)
+func websiteRedirect(w http.ResponseWriter, r *http.Request, rd s3intf.WebsiteRedirect, path string) {
+	u := url.URL{Scheme: rd.Protocol, Host: rd.HostName, Path: path}
+	if u.Scheme == "" {
+		if u.Scheme = "http"; r.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	if u.Host == "" {
+		u.Host = r.Host
+	}
+	code := http.StatusMovedPermanently
+	if rd.HTTPRedirectCode != "" {
+		code, _ = strconv.Atoi(rd.HTTPRedirectCode)
+	}
+	w.Header().Set("Location", u.String())
+	w.WriteHeader(code)
+}
+
+var websiteErrorTemplate = template.Must(template.New("error").Parse(`<html>
+<head><title>{{.Status}}</title></head>
+<body>
+<h1>{{.Status}}</h1>
+<ul>
+<li>Code: {{.Code}}</li>
+<li>Message: {{.Message}}</li>
+{{if .Resource}}<li>Resource: {{.Resource}}</li>
+{{end}}<li>RequestId: {{.RequestID}}</li>
+<li>HostId: {{.HostID}}</li>
+</ul>
+</body>
+</html>
+`))
+
+// writeWebsiteError writes the error as a HTML page, as the website endpoint
+// serves browsers
+func writeWebsiteError(w http.ResponseWriter, r *http.Request, he *HTTPError) {
+	awsCode, status := he.codes()
+	log.Printf("website error %s (%d): %s", awsCode, he.Code, he.Message)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if r.Method == "HEAD" {
+		return
+	}
+	if err := websiteErrorTemplate.Execute(w, struct {
+		Status, Code, Message, Resource, RequestID, HostID string
+	}{strconv.Itoa(status) + " " + http.StatusText(status), awsCode, he.Message, he.Resource,
+		w.Header().Get("X-Amz-Request-Id"), w.Header().Get("X-Amz-Id-2")}); err != nil {
+		log.Printf("error writing the error page: %s", err)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2013 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3srv
+
+import (
+	"github.com/tgulacsi/s3weed/s3intf"
+
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testOwner struct{ id, name string }
+
+func (o testOwner) ID() string                                     { return o.id }
+func (o testOwner) Name() string                                   { return o.name }
+func (o testOwner) CalcHash(bytesToSign []byte) []byte             { return nil }
+func (o testOwner) SigningKey(date, region, service string) []byte { return nil }
+
+// xmlTokens returns the tokens of the XML document, without the whitespace
+// between the elements
+func xmlTokens(b []byte) ([]xml.Token, error) {
+	var tokens []xml.Token
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return tokens, nil
+		}
+		if err != nil {
+			return tokens, err
+		}
+		if cd, ok := tok.(xml.CharData); ok && len(bytes.TrimSpace(cd)) == 0 {
+			continue
+		}
+		tokens = append(tokens, xml.CopyToken(tok))
+	}
+}
+
+// TestGoldenXML compares the responses with the samples of the S3 documentation
+// in testdata
+func TestGoldenXML(t *testing.T) {
+	date := func(s string) time.Time {
+		d, err := time.Parse(S3Date, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	mtd := testOwner{id: "75aa57f09aa0c8caeab4f8c24e99d10f8e7faeebf76c078efc7c6caea54ba06a",
+		name: "mtd@amazon.com"}
+	mtdXML := xmlOwner{ID: mtd.ID(), DisplayName: mtd.Name()}
+
+	listObjects := listBucketResult{Name: "example-bucket", Prefix: "photos/2006/",
+		MaxKeys: 1000, Delimiter: "/",
+		Contents: []xmlObject{newXMLObject(s3intf.Object{Key: "photos/2006/sun & <sea>.jpg",
+			LastModified: date("2009-10-12T17:50:30.000Z"),
+			ETag:         "fba9dede5f27731c9771645a39863328", Size: 434234})},
+		CommonPrefixes: []xmlCommonPrefix{{"photos/2006/February/"}, {"photos/2006/January/"}}}
+	listObjects.Contents[0].Owner = &mtdXML
+
+	for _, tc := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"list_buckets", newListAllMyBucketsResult(testOwner{id: "bcaf1ffd86f461ca5fb16fd081034f", name: "webfile"},
+			[]s3intf.Bucket{{Name: "quotes", Created: date("2006-02-03T16:45:09.000Z")},
+				{Name: "samples", Created: date("2006-02-03T16:41:58.000Z")}})},
+		{"list_objects", listObjects},
+		{"list_objects_v2", listBucketResultV2{Name: "bucket", MaxKeys: 1000, KeyCount: 1,
+			Contents: []xmlObject{newXMLObject(s3intf.Object{Key: "ExampleObject.txt",
+				LastModified: date("2013-09-17T18:07:53.000Z"),
+				ETag:         "599bab3ed2c697f1d26842727561fd94", Size: 857})}}},
+		{"list_versions", listVersionsResult{Name: "bucket", Prefix: "my", MaxKeys: 5,
+			Versions: []interface{}{
+				xmlVersion{Key: "my-image.jpg", VersionId: "3/L4kqtJl40Nr8X8gdRQBpUMLUo",
+					IsLatest: true, LastModified: "2009-10-12T17:50:30.000Z",
+					ETag: `"fba9dede5f27731c9771645a39863328"`, Size: 434234,
+					Owner: mtdXML, StorageClass: "STANDARD"},
+				xmlDeleteMarker{Key: "my-second-image.jpg",
+					VersionId: "03jpff543dhffds434rfdsFDN943fdsFkdmqnh892",
+					IsLatest:  true, LastModified: "2009-11-12T17:50:30.000Z", Owner: mtdXML}}}},
+		{"copy_object", copyObjectResult{LastModified: "2009-10-28T22:32:00.000Z",
+			ETag: `"9b2cf535f27731c974343645a3985328"`}},
+		{"initiate_multipart", initiateMultipartUploadResult{Bucket: "example-bucket",
+			Key: "example-object", UploadID: "VXBsb2FkIElEIGZvciA2aWWpbmcncyBteS1tb3ZpZS5tMnRzIHVwbG9hZA"}},
+		{"complete_multipart", completeMultipartUploadResult{
+			Location: "http://Example-Bucket.s3.amazonaws.com/Example-Object",
+			Bucket:   "Example-Bucket", Key: "Example-Object",
+			ETag: `"3858f62230ac3c915f300c664312c11f-9"`}},
+		{"delete_result", deleteResult{Deleted: []deletedKey{{Key: "sample1.txt"}},
+			Errors: []deleteError{{Key: "sample2.txt", Code: "AccessDenied", Message: "Access Denied"}}}},
+		{"versioning", versioningConfiguration{Status: s3intf.VersioningEnabled}},
+		{"acl", newAccessControlPolicy(s3intf.ACL{Owner: mtd.ID(), Grants: []s3intf.Grant{
+			{Grantee: mtd.ID(), Permission: s3intf.PermFullControl},
+			{Grantee: s3intf.AllUsers, Permission: s3intf.PermRead}}}, mtd)},
+		{"cors", newCORSConfiguration([]s3intf.CORSRule{
+			{AllowedOrigins: []string{"http://www.example.com"},
+				AllowedMethods: []string{"PUT", "POST", "DELETE"}, AllowedHeaders: []string{"*"},
+				ExposeHeaders: []string{"x-amz-server-side-encryption"}, MaxAgeSeconds: 3000},
+			{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}})},
+		{"website", newWebsiteConfiguration(&s3intf.WebsiteConfig{IndexSuffix: "index.html",
+			ErrorKey: "Error.html", RoutingRules: []s3intf.RoutingRule{{KeyPrefixEquals: "docs/",
+				Redirect: s3intf.WebsiteRedirect{ReplaceKeyPrefixWith: "documents/"}}}})},
+		{"tagging", newTagging(s3intf.Tags{"Project": "Project One", "User": "jsmith"})},
+		{"lifecycle", newLifecycleConfiguration([]s3intf.LifecycleRule{
+			{ID: "tmp", Enabled: true, Prefix: "tmp/", ExpirationDays: 1},
+			{ID: "logs", Enabled: true, Prefix: "logs/", Tags: s3intf.Tags{"archive": "no"},
+				ExpirationDate: time.Date(2013, 12, 31, 0, 0, 0, 0, time.UTC), NoncurrentDays: 30},
+			{Tags: s3intf.Tags{"temp": "yes"}, NoncurrentDays: 1},
+			{ID: "uploads", Enabled: true, AbortIncompleteDays: 7}})},
+		{"error", &HTTPError{Code: 1, AWSCode: "NoSuchKey",
+			Message:  "The resource you requested does not exist",
+			Resource: "/mybucket/myfoto.jpg"}},
+	} {
+		w := httptest.NewRecorder()
+		if he, ok := tc.v.(*HTTPError); ok {
+			w.Header().Set("X-Amz-Request-Id", "4442587FB7D0A2F9")
+			w.Header().Set("X-Amz-Id-2", "eftixk72aD6Ap51TnqcoF8eFidJG9Z/2mkiDFu8yU9AS1ed4OpIszj7UDNEHGran")
+			writeError(w, he)
+		} else {
+			writeXML(w, tc.v)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("%s: Content-Type is %q", tc.name, ct)
+		}
+		if !bytes.HasPrefix(w.Body.Bytes(), []byte(xml.Header)) {
+			t.Errorf("%s: no XML header in %q", tc.name, w.Body.Bytes())
+		}
+		got, err := xmlTokens(w.Body.Bytes())
+		if err != nil {
+			t.Errorf("%s: cannot parse %q: %s", tc.name, w.Body.Bytes(), err)
+			continue
+		}
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", tc.name+".xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		awaited, err := xmlTokens(golden)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		for i := 0; i < len(got) || i < len(awaited); i++ {
+			var g, a xml.Token
+			if i < len(got) {
+				g = got[i]
+			}
+			if i < len(awaited) {
+				a = awaited[i]
+			}
+			if !reflect.DeepEqual(g, a) {
+				t.Errorf("%s: %d. token: got %#v, awaited %#v (body:%q)", tc.name, i, g, a,
+					strings.TrimPrefix(w.Body.String(), xml.Header))
+				break
+			}
+		}
+	}
+}